@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// AdaptiveRevalidation scales the interval after which sessions are
+// re-validated with the rate of authenticated requests: at fullRate
+// requests per minute or more it is max (cookie-refresh), and below that
+// proportionally shorter, but at least min. Low-traffic apps so re-validate
+// often, which costs few provider API requests, while busy apps don't
+// re-validate more often than max.
+//
+// The rate is the number of requests over the last window, or longer if no
+// request came for a while.
+type AdaptiveRevalidation struct {
+	min, max time.Duration
+	fullRate int // requests per minute
+	window   time.Duration
+
+	mu    sync.Mutex
+	start time.Time
+	count int
+	rate  float64 // requests per minute
+}
+
+func NewAdaptiveRevalidation(min, max time.Duration, fullRate int) *AdaptiveRevalidation {
+	return &AdaptiveRevalidation{
+		min:      min,
+		max:      max,
+		fullRate: fullRate,
+		window:   time.Minute,
+	}
+}
+
+// Observe counts a request at now
+func (a *AdaptiveRevalidation) Observe(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.start.IsZero() {
+		a.start = now
+	}
+	if elapsed := now.Sub(a.start); elapsed >= a.window {
+		a.rate = float64(a.count) / elapsed.Minutes()
+		a.start, a.count = now, 0
+	}
+	a.count++
+}
+
+// Interval returns the re-validation interval for the observed request rate
+func (a *AdaptiveRevalidation) Interval() time.Duration {
+	a.mu.Lock()
+	rate := a.rate
+	a.mu.Unlock()
+	if rate >= float64(a.fullRate) {
+		return a.max
+	}
+	interval := time.Duration(float64(a.max) * rate / float64(a.fullRate))
+	if interval < a.min {
+		return a.min
+	}
+	return interval
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+// observe counts n requests spread evenly over d from start, returning the
+// end of d
+func observe(a *AdaptiveRevalidation, start time.Time, n int, d time.Duration) time.Time {
+	for i := 0; i < n; i++ {
+		a.Observe(start.Add(d * time.Duration(i) / time.Duration(n)))
+	}
+	return start.Add(d)
+}
+
+func TestAdaptiveRevalidation(t *testing.T) {
+	a := NewAdaptiveRevalidation(time.Minute, time.Hour, 60)
+	// no requests observed yet
+	assert.Equal(t, time.Minute, a.Interval())
+
+	now := time.Unix(1500000000, 0)
+	now = observe(a, now, 30, time.Minute)
+	a.Observe(now)
+	assert.Equal(t, 30*time.Minute, a.Interval())
+
+	now = observe(a, now, 120, time.Minute)
+	a.Observe(now)
+	assert.Equal(t, time.Hour, a.Interval())
+
+	now = observe(a, now, 6, time.Minute)
+	a.Observe(now)
+	assert.Equal(t, 7*time.Minute, a.Interval())
+
+	// one request in 10 minutes
+	now = now.Add(10 * time.Minute)
+	a.Observe(now)
+	assert.Equal(t, time.Minute, a.Interval())
+
+	for rate := 1; rate <= 200; rate *= 3 {
+		now = observe(a, now, rate, time.Minute)
+		a.Observe(now)
+		interval := a.Interval()
+		assert.True(t, interval >= time.Minute && interval <= time.Hour, "rate %d: %s", rate, interval)
+	}
+}
+
+func TestAdaptiveRevalidationAuthenticate(t *testing.T) {
+	for _, tc := range []struct {
+		minInterval time.Duration
+		status      int
+	}{
+		// 5 minutes is within cookie-refresh
+		{0, http.StatusAccepted},
+		// but past the minimum interval of a proxy with few requests
+		{time.Minute, http.StatusForbidden},
+	} {
+		pc_test := NewProcessCookieTest(ProcessCookieTestOpts{provider_validate_cookie_response: false})
+		pc_test.proxy.CookieRefresh = time.Hour
+		if tc.minInterval > 0 {
+			pc_test.proxy.adaptiveRevalidation = NewAdaptiveRevalidation(tc.minInterval, time.Hour, 60)
+		}
+		startSession := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+		pc_test.SaveSession(startSession, time.Now().Add(-5*time.Minute))
+
+		assert.Equal(t, tc.status, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req), "min interval %s", tc.minInterval)
+	}
+}
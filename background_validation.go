@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
+)
+
+// BackgroundValidator re-validates sessions with the provider outside of the
+// request that triggered it. The result, with the groups validation found, is
+// kept until the next request with the same access token, which then saves
+// or clears the session cookie.
+type BackgroundValidator struct {
+	maxAge time.Duration // results not picked up within maxAge are dropped
+
+	mu      sync.Mutex
+	pending map[string]bool
+	results map[string]backgroundResult
+}
+
+type backgroundResult struct {
+	valid  bool
+	err    error
+	groups []string
+	at     time.Time
+}
+
+func NewBackgroundValidator(maxAge time.Duration) *BackgroundValidator {
+	return &BackgroundValidator{
+		maxAge:  maxAge,
+		pending: make(map[string]bool),
+		results: make(map[string]backgroundResult),
+	}
+}
+
+// Validate returns the result of a finished background validation of the
+// session's access token, with done true, and sets the session's Groups to
+// those of a valid result. Otherwise it starts one with validate, if not
+// already running, and returns done false.
+func (v *BackgroundValidator) Validate(s *providers.SessionState, validate func(*providers.SessionState) (bool, error)) (valid bool, err error, done bool) {
+	sum := sha256.Sum256([]byte(s.AccessToken))
+	key := hex.EncodeToString(sum[:])
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if r, ok := v.results[key]; ok {
+		delete(v.results, key)
+		if time.Since(r.at) <= v.maxAge {
+			if r.valid {
+				s.Groups = r.groups
+			}
+			return r.valid, r.err, true
+		}
+	}
+	if !v.pending[key] {
+		v.pending[key] = true
+		session := *s
+		go func() {
+			valid, err := validate(&session)
+			v.finish(key, backgroundResult{valid: valid, err: err, groups: session.Groups, at: time.Now()})
+		}()
+	}
+	return false, nil, false
+}
+
+func (v *BackgroundValidator) finish(key string, r backgroundResult) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.pending, key)
+	v.results[key] = r
+	for k, old := range v.results {
+		if r.at.Sub(old.at) > v.maxAge {
+			delete(v.results, k)
+		}
+	}
+}
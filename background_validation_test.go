@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackgroundValidator(t *testing.T) {
+	v := NewBackgroundValidator(time.Minute)
+	session := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	calls := make(chan bool, 10)
+	release := make(chan bool)
+	validate := func(s *providers.SessionState) (bool, error) {
+		calls <- true
+		<-release
+		return false, errors.New("provider unreachable")
+	}
+
+	_, _, done := v.Validate(session, validate)
+	assert.Equal(t, false, done)
+	<-calls
+	_, _, done = v.Validate(session, validate)
+	assert.Equal(t, false, done)
+	assert.Equal(t, 0, len(calls))
+
+	release <- true
+	waitBackgroundResult(t, v)
+	valid, err, done := v.Validate(session, validate)
+	assert.Equal(t, true, done)
+	assert.Equal(t, false, valid)
+	assert.Equal(t, errors.New("provider unreachable"), err)
+
+	// a result is only used once
+	_, _, done = v.Validate(session, validate)
+	assert.Equal(t, false, done)
+	<-calls
+	release <- true
+}
+
+func TestBackgroundValidatorGroups(t *testing.T) {
+	v := NewBackgroundValidator(time.Minute)
+	session := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		Groups: []string{"testorg/admins"}}
+	validate := func(s *providers.SessionState) (bool, error) {
+		s.Groups = []string{"testorg/devs"}
+		return true, nil
+	}
+
+	v.Validate(session, validate)
+	waitBackgroundResult(t, v)
+	assert.Equal(t, []string{"testorg/admins"}, session.Groups)
+	valid, _, done := v.Validate(session, validate)
+	assert.Equal(t, true, done)
+	assert.Equal(t, true, valid)
+	assert.Equal(t, []string{"testorg/devs"}, session.Groups)
+}
+
+func TestBackgroundValidatorDropsStaleResult(t *testing.T) {
+	v := NewBackgroundValidator(time.Minute)
+	session := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	validate := func(s *providers.SessionState) (bool, error) {
+		return true, nil
+	}
+
+	v.Validate(session, validate)
+	waitBackgroundResult(t, v)
+	for k, r := range v.results {
+		r.at = r.at.Add(-2 * time.Minute)
+		v.results[k] = r
+	}
+	_, _, done := v.Validate(session, validate)
+	assert.Equal(t, false, done)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/csv"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
+)
+
+// Blocklist holds emails, user names and "id:"-prefixed provider user IDs
+// which are denied access, whatever their provider or email domain
+// membership. It is loaded from a file with one entry per line, which is
+// reloaded when it changes.
+type Blocklist struct {
+	blocklistFile string
+	m             unsafe.Pointer
+}
+
+func NewBlocklist(blocklistFile string, done <-chan bool, onUpdate func()) *Blocklist {
+	b := &Blocklist{blocklistFile: blocklistFile}
+	m := make(map[string]bool)
+	atomic.StorePointer(&b.m, unsafe.Pointer(&m))
+	log.Printf("using blocklist file %s", blocklistFile)
+	WatchForUpdates(blocklistFile, done, func() {
+		if err := b.load(); err != nil {
+			log.Printf("error reloading blocklist-file=%q, keeping previous entries: %s", blocklistFile, err)
+		}
+		onUpdate()
+	})
+	if err := b.load(); err != nil {
+		log.Fatalf("failed loading blocklist-file=%q, %s", blocklistFile, err)
+	}
+	return b
+}
+
+// IsBlocked returns true if the session's email, user name or user ID is
+// blocked. User IDs, which unlike logins can't be renamed, are listed as
+// "id:12345". A nil Blocklist blocks nobody.
+func (b *Blocklist) IsBlocked(s *providers.SessionState) bool {
+	if b == nil {
+		return false
+	}
+	m := *(*map[string]bool)(atomic.LoadPointer(&b.m))
+	for _, id := range []string{s.User, s.Email} {
+		if id != "" && m[strings.ToLower(id)] {
+			return true
+		}
+	}
+	return s.UserID != "" && m["id:"+strings.ToLower(s.UserID)]
+}
+
+func (b *Blocklist) load() error {
+	r, err := os.Open(b.blocklistFile)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	csv_reader := csv.NewReader(r)
+	csv_reader.Comma = ','
+	csv_reader.Comment = '#'
+	csv_reader.TrimLeadingSpace = true
+	records, err := csv_reader.ReadAll()
+	if err != nil {
+		return err
+	}
+	updated := make(map[string]bool)
+	for _, r := range records {
+		id := strings.ToLower(strings.TrimSpace(r[0]))
+		if id != "" {
+			updated[id] = true
+		}
+	}
+	atomic.StorePointer(&b.m, unsafe.Pointer(&updated))
+	return nil
+}
@@ -0,0 +1,93 @@
+// +build !plan9,!solaris
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func newBlocklistTest(t *testing.T, contents string, done <-chan bool, updated chan<- bool) (*Blocklist, string) {
+	f, err := ioutil.TempFile("", "test_blocklist_")
+	if err != nil {
+		t.Fatal("failed to create temp file: " + err.Error())
+	}
+	f.WriteString(contents)
+	f.Close()
+	b := NewBlocklist(f.Name(), done, func() {
+		select {
+		case updated <- true:
+		default:
+		}
+	})
+	return b, f.Name()
+}
+
+func TestBlocklistIsBlocked(t *testing.T) {
+	done := make(chan bool)
+	defer close(done)
+	b, name := newBlocklistTest(t, "# compromised\nmbland\nXyzzy@Example.com\nid:12345\n", done, nil)
+	defer os.Remove(name)
+
+	assert.Equal(t, true, b.IsBlocked(&providers.SessionState{User: "mbland", Email: "michael.bland@gsa.gov"}))
+	assert.Equal(t, true, b.IsBlocked(&providers.SessionState{Email: "xyzzy@example.com"}))
+	assert.Equal(t, false, b.IsBlocked(&providers.SessionState{User: "plugh", Email: "plugh@example.com"}))
+
+	// a login renamed since it was blocked is still blocked by its user ID
+	assert.Equal(t, true, b.IsBlocked(&providers.SessionState{User: "renamed", Email: "renamed@example.com", UserID: "12345"}))
+	assert.Equal(t, false, b.IsBlocked(&providers.SessionState{User: "plugh", UserID: "54321"}))
+	// an ID is only matched as an ID, not as a user name
+	assert.Equal(t, false, b.IsBlocked(&providers.SessionState{User: "12345"}))
+
+	var none *Blocklist
+	assert.Equal(t, false, none.IsBlocked(&providers.SessionState{User: "mbland"}))
+}
+
+func TestBlocklistDeniesSession(t *testing.T) {
+	done := make(chan bool)
+	defer close(done)
+	updated := make(chan bool, 1)
+	b, name := newBlocklistTest(t, "plugh@example.com\n", done, updated)
+	defer os.Remove(name)
+
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.blocklist = b
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	pc_test.SaveSession(startSession, time.Now())
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+
+	if err := ioutil.WriteFile(name, []byte("plugh@example.com\nmichael.bland@gsa.gov\n"), 0600); err != nil {
+		t.Fatal("failed to update blocklist: " + err.Error())
+	}
+	select {
+	case <-updated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blocklist was not reloaded")
+	}
+
+	rw := httptest.NewRecorder()
+	assert.Equal(t, http.StatusForbidden, pc_test.proxy.Authenticate(rw, pc_test.req))
+	assert.NotEqual(t, 0, len(rw.HeaderMap["Set-Cookie"]))
+}
+
+func TestBlocklistDeniesSessionByUserID(t *testing.T) {
+	done := make(chan bool)
+	defer close(done)
+	b, name := newBlocklistTest(t, "id:12345\n", done, nil)
+	defer os.Remove(name)
+
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.blocklist = b
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", User: "mbland", UserID: "12345", AccessToken: "my_access_token"}
+	pc_test.SaveSession(startSession, time.Now())
+	assert.Equal(t, http.StatusForbidden, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+}
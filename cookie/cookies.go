@@ -6,6 +6,7 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -79,9 +80,36 @@ func checkHmac(input, expected string) bool {
 	return false
 }
 
+// Encrypted values start with a version prefix identifying the algorithm, so
+// values written by older versions can still be decrypted. Values from before
+// the prefix was introduced, base64 without a prefix, are version 1 (AES-CFB).
+// As ":" is not in the base64 alphabet, no version 1 value has the prefix.
+const cipherV2Prefix = "v2:" // AES-GCM
+
 // Cipher provides methods to encrypt and decrypt cookie values
 type Cipher struct {
 	cipher.Block
+	aead cipher.AEAD
+}
+
+// DeriveKey derives a 32 byte AES-256 key for NewCipher from a secret of any
+// length, with HKDF-SHA256 (RFC 5869)
+func DeriveKey(secret []byte) []byte {
+	return hkdfSHA256(secret, nil, []byte("oauth2_proxy cookie cipher"))
+}
+
+// hkdfSHA256 returns the first 32 bytes (a single block) of the HKDF-SHA256
+// output for the input key material ikm
+func hkdfSHA256(ikm, salt, info []byte) []byte {
+	if salt == nil {
+		salt = make([]byte, sha256.Size)
+	}
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
 }
 
 // NewCipher returns a new aes Cipher for encrypting cookie values
@@ -90,11 +118,26 @@ func NewCipher(secret []byte) (*Cipher, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Cipher{Block: c}, err
+	aead, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{Block: c, aead: aead}, err
 }
 
 // Encrypt a value for use in a cookie
 func (c *Cipher) Encrypt(value string) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to create nonce %s", err)
+	}
+
+	ciphertext := c.aead.Seal(nonce, nonce, []byte(value), nil)
+	return cipherV2Prefix + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// encryptV1 is how values were encrypted before the version prefix
+func (c *Cipher) encryptV1(value string) (string, error) {
 	ciphertext := make([]byte, aes.BlockSize+len(value))
 	iv := ciphertext[:aes.BlockSize]
 	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
@@ -108,11 +151,23 @@ func (c *Cipher) Encrypt(value string) (string, error) {
 
 // Decrypt a value from a cookie to it's original string
 func (c *Cipher) Decrypt(s string) (string, error) {
-	encrypted, err := base64.StdEncoding.DecodeString(s)
+	v2 := strings.HasPrefix(s, cipherV2Prefix)
+	encrypted, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, cipherV2Prefix))
 	if err != nil {
 		return "", fmt.Errorf("failed to decrypt cookie value %s", err)
 	}
 
+	if v2 {
+		value, err := c.decryptV2(encrypted)
+		if err != nil {
+			return "", fmt.Errorf("failed to decrypt cookie value %s", err)
+		}
+		return value, nil
+	}
+	return c.decryptV1(encrypted)
+}
+
+func (c *Cipher) decryptV1(encrypted []byte) (string, error) {
 	if len(encrypted) < aes.BlockSize {
 		return "", fmt.Errorf("encrypted cookie value should be "+
 			"at least %d bytes, but is only %d bytes",
@@ -126,3 +181,15 @@ func (c *Cipher) Decrypt(s string) (string, error) {
 
 	return string(encrypted), nil
 }
+
+func (c *Cipher) decryptV2(encrypted []byte) (string, error) {
+	nonceSize := c.aead.NonceSize()
+	if len(encrypted) < nonceSize {
+		return "", fmt.Errorf("encrypted cookie value too short")
+	}
+	value, err := c.aead.Open(nil, encrypted[:nonceSize], encrypted[nonceSize:], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
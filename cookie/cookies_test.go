@@ -1,7 +1,10 @@
 package cookie
 
 import (
+	"crypto/cipher"
 	"encoding/base64"
+	"encoding/hex"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -40,3 +43,82 @@ func TestEncodeAndDecodeAccessTokenB64(t *testing.T) {
 	assert.NotEqual(t, token, encoded)
 	assert.Equal(t, token, decoded)
 }
+
+func TestEncryptWritesVersion2(t *testing.T) {
+	c, err := NewCipher([]byte("0123456789abcdefghijklmnopqrstuv"))
+	assert.Equal(t, nil, err)
+
+	encoded, err := c.Encrypt("my access token")
+	assert.Equal(t, nil, err)
+	assert.True(t, strings.HasPrefix(encoded, "v2:"), encoded)
+	_, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(encoded, "v2:"))
+	assert.Equal(t, nil, err)
+}
+
+func TestDecryptVersion1(t *testing.T) {
+	const token = "my access token"
+	c, err := NewCipher([]byte("0123456789abcdefghijklmnopqrstuv"))
+	assert.Equal(t, nil, err)
+
+	// values written before the version prefix
+	for i := 0; i < 200; i++ {
+		encoded, err := c.encryptV1(token)
+		assert.Equal(t, nil, err)
+		decoded, err := c.Decrypt(encoded)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, token, decoded)
+	}
+
+	// including ones whose random IV happens to start with 0x02, which a
+	// leading version byte could not tell from version 2
+	raw := make([]byte, 16+len(token))
+	raw[0] = 0x02
+	stream := cipher.NewCFBEncrypter(c.Block, raw[:16])
+	stream.XORKeyStream(raw[16:], []byte(token))
+	decoded, err := c.Decrypt(base64.StdEncoding.EncodeToString(raw))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, token, decoded)
+}
+
+func TestDecryptVersion2Tampered(t *testing.T) {
+	c, err := NewCipher([]byte("0123456789abcdefghijklmnopqrstuv"))
+	assert.Equal(t, nil, err)
+
+	encoded, err := c.Encrypt("my access token")
+	assert.Equal(t, nil, err)
+	raw, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(encoded, "v2:"))
+	raw[len(raw)-1] ^= 0xff
+	decoded, err := c.Decrypt("v2:" + base64.StdEncoding.EncodeToString(raw))
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, "", decoded)
+}
+
+func TestHKDFSHA256(t *testing.T) {
+	// RFC 5869 test case 1, the first 32 bytes of OKM
+	ikm, _ := hex.DecodeString("0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b")
+	salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	assert.Equal(t, "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf",
+		hex.EncodeToString(hkdfSHA256(ikm, salt, info)))
+
+	// RFC 5869 test case 3, without salt and info
+	assert.Equal(t, "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d",
+		hex.EncodeToString(hkdfSHA256(ikm, nil, nil)))
+}
+
+func TestDeriveKey(t *testing.T) {
+	for _, secret := range []string{"short", "cookie of invalid length-", "a much longer secret than any AES key size, 64 bytes or more....."} {
+		key := DeriveKey([]byte(secret))
+		assert.Equal(t, 32, len(key))
+		assert.Equal(t, key, DeriveKey([]byte(secret)))
+
+		c, err := NewCipher(key)
+		assert.Equal(t, nil, err)
+		encoded, err := c.Encrypt("my access token")
+		assert.Equal(t, nil, err)
+		decoded, err := c.Decrypt(encoded)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "my access token", decoded)
+	}
+	assert.NotEqual(t, DeriveKey([]byte("secret1")), DeriveKey([]byte("secret2")))
+}
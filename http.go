@@ -2,6 +2,8 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -73,6 +75,18 @@ func (s *Server) ServeHTTPS() {
 	if err != nil {
 		log.Fatalf("FATAL: loading tls config (%s, %s) failed - %s", s.Opts.TLSCertFile, s.Opts.TLSKeyFile, err)
 	}
+	if s.Opts.TLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(s.Opts.TLSClientCAFile)
+		if err != nil {
+			log.Fatalf("FATAL: reading tls-client-ca %s failed - %s", s.Opts.TLSClientCAFile, err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			log.Fatalf("FATAL: no certificates found in tls-client-ca %s", s.Opts.TLSClientCAFile)
+		}
+		// client certificates are optional, OAuth authentication still applies
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
 
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -6,11 +6,16 @@ package main
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"text/template"
 	"time"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
 )
 
 const (
@@ -164,3 +169,47 @@ func (h loggingHandler) writeLogLine(username, upstream string, req *http.Reques
 
 	h.writer.Write([]byte("\n"))
 }
+
+// logger is where the proxy logs while handling requests, as the providers
+// do, so that setupLogging can discard both
+var logger = providers.StdLogger
+
+// setupLogging points the application log at opts.AppLog and returns the
+// writer for the request log, opts.RequestLog. With DisableLogging, the
+// request log and the logs of the proxy and providers are discarded; only
+// startup and fatal errors still go to the application log.
+func setupLogging(opts *Options, stdout, stderr io.Writer) (io.Writer, error) {
+	appLog, err := openLog(opts.AppLog, stdout, stderr)
+	if err != nil {
+		return nil, err
+	}
+	requestLog := ioutil.Discard
+	logger = providers.StdLogger
+	if opts.DisableLogging {
+		logger = log.New(ioutil.Discard, "", 0)
+	} else {
+		requestLog, err = openLog(opts.RequestLog, stdout, stderr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	providers.SetLogger(logger)
+	log.SetOutput(appLog)
+	return requestLog, nil
+}
+
+// openLog returns stdout or stderr for those names, or else opens the file
+// at path dest for appending
+func openLog(dest string, stdout, stderr io.Writer) (io.Writer, error) {
+	switch dest {
+	case "stdout":
+		return stdout, nil
+	case "stderr":
+		return stderr, nil
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening log file: %s", err)
+	}
+	return f, nil
+}
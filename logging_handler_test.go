@@ -3,10 +3,17 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"testing"
 	"time"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestLoggingHandler_ServeHTTP(t *testing.T) {
@@ -40,3 +47,128 @@ func TestLoggingHandler_ServeHTTP(t *testing.T) {
 		}
 	}
 }
+
+func TestDisableLogging(t *testing.T) {
+	logBuf := bytes.NewBuffer(nil)
+	log.SetOutput(logBuf)
+	defer log.SetOutput(os.Stderr)
+	defer func() {
+		logger = providers.StdLogger
+		providers.SetLogger(logger)
+	}()
+
+	provider_server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer provider_server.Close()
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.Upstreams = append(opts.Upstreams, provider_server.URL)
+	opts.DisableLogging = true
+	assert.Equal(t, nil, opts.Validate())
+
+	requestBuf := bytes.NewBuffer(nil)
+	requestLog, err := setupLogging(opts, requestBuf, logBuf)
+	assert.Equal(t, nil, err)
+
+	provider_url, _ := url.Parse(provider_server.URL)
+	opts.provider = NewTestProvider(provider_url, "michael.bland@gsa.gov")
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+	h := LoggingHandler(requestLog, proxy, opts.RequestLogging, opts.RequestLoggingFormat)
+
+	// sign in, then make a request with the new session, and sign out
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	h.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+
+	for _, path := range []string{"/", "/oauth2/sign_out"} {
+		req, _ = http.NewRequest("GET", path, nil)
+		for _, c := range (&http.Response{Header: rw.HeaderMap}).Cookies() {
+			if c.Name == proxy.CookieName {
+				req.AddCookie(c)
+			}
+		}
+		rw = httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+	}
+
+	assert.Equal(t, "", requestBuf.String())
+	assert.Equal(t, "", logBuf.String())
+
+	// startup and fatal errors are still logged
+	log.Printf("FATAL: unable to open htpasswd file")
+	assert.Contains(t, logBuf.String(), "FATAL: unable to open htpasswd file")
+}
+
+func TestSeparateRequestAndAppLogs(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+
+	provider_server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+		w.Write([]byte(`{"message": "provider unavailable"}`))
+	}))
+	defer provider_server.Close()
+
+	dir, err := ioutil.TempDir("", "test_logs_")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.Upstreams = append(opts.Upstreams, provider_server.URL)
+	opts.RequestLog = dir + "/access.log"
+	opts.AppLog = dir + "/app.log"
+	opts.RequestLoggingFormat = "{{.RequestMethod}} {{.RequestURI}} {{.StatusCode}}"
+	assert.Equal(t, nil, opts.Validate())
+
+	requestLog, err := setupLogging(opts, ioutil.Discard, ioutil.Discard)
+	assert.Equal(t, nil, err)
+
+	provider_url, _ := url.Parse(provider_server.URL)
+	opts.provider = NewTestProvider(provider_url, "michael.bland@gsa.gov")
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+	h := LoggingHandler(requestLog, proxy, opts.RequestLogging, opts.RequestLoggingFormat)
+
+	// redeeming the code fails with the provider error
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	h.ServeHTTP(rw, req)
+	assert.Equal(t, 500, rw.Code)
+
+	access, _ := ioutil.ReadFile(dir + "/access.log")
+	app, _ := ioutil.ReadFile(dir + "/app.log")
+	assert.Equal(t, "GET \"/oauth2/callback?code=callback_code&state=nonce:/\" 500\n", string(access))
+	assert.Contains(t, string(app), "error redeeming code")
+	assert.Contains(t, string(app), "provider unavailable")
+	assert.NotContains(t, string(app), "GET \"/oauth2/callback")
+}
+
+func TestSetupLoggingStdoutStderr(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+
+	stdout := bytes.NewBuffer(nil)
+	stderr := bytes.NewBuffer(nil)
+	opts := NewOptions()
+	opts.RequestLog = "stderr"
+	opts.AppLog = "stdout"
+	requestLog, err := setupLogging(opts, stdout, stderr)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, stderr, requestLog)
+	log.Printf("app message")
+	assert.Contains(t, stdout.String(), "app message")
+
+	opts.AppLog = "/nonexistent/app.log"
+	_, err = setupLogging(opts, stdout, stderr)
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
+)
+
+// LoginEvent is written to the login event log on each successful login,
+// for analytics. It is separate from the request log and the email is only
+// included as a keyed hash.
+type LoginEvent struct {
+	Login     string    `json:"login"`
+	EmailHash string    `json:"email_hash"`
+	Provider  string    `json:"provider"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// LoginEventLog writes a LoginEvent per line, as JSON
+type LoginEventLog struct {
+	mu  sync.Mutex
+	w   io.Writer
+	key []byte
+}
+
+// NewLoginEventLog returns a LoginEventLog writing to w, hashing emails with
+// HMAC-SHA256, so they can be correlated but not recovered. The key is
+// derived from seed, the cookie secret, rather than being the secret that
+// also signs the cookies.
+func NewLoginEventLog(w io.Writer, seed string) *LoginEventLog {
+	h := hmac.New(sha256.New, []byte(seed))
+	h.Write([]byte("email-hash"))
+	return &LoginEventLog{w: w, key: h.Sum(nil)}
+}
+
+func (l *LoginEventLog) hashEmail(email string) string {
+	if email == "" {
+		return ""
+	}
+	h := hmac.New(sha256.New, l.key)
+	h.Write([]byte(strings.ToLower(email)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Emit writes the login event for session s. A nil LoginEventLog is a no-op.
+func (l *LoginEventLog) Emit(s *providers.SessionState, provider string, now time.Time) {
+	if l == nil {
+		return
+	}
+	login := s.User
+	if login == "" {
+		// as the user is derived when the session cookie is decoded
+		login = strings.Split(s.Email, "@")[0]
+	}
+	b, err := json.Marshal(LoginEvent{
+		Login:     login,
+		EmailHash: l.hashEmail(s.Email),
+		Provider:  provider,
+		Timestamp: now.UTC(),
+	})
+	if err != nil {
+		logger.Printf("error encoding login event: %s", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(append(b, '\n')); err != nil {
+		logger.Printf("error writing login event: %s", err)
+	}
+}
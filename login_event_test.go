@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginEventEmittedOnCallback(t *testing.T) {
+	proxy, done := newCSRFCookieTest(t)
+	defer done()
+	var buf bytes.Buffer
+	proxy.loginEvents = NewLoginEventLog(&buf, proxy.CookieSeed)
+
+	before := time.Now().Add(-time.Second)
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+
+	var event LoginEvent
+	assert.Equal(t, nil, json.Unmarshal(buf.Bytes(), &event))
+	assert.Equal(t, "michael.bland", event.Login)
+	assert.Equal(t, proxy.loginEvents.hashEmail("Michael.Bland@gsa.gov"), event.EmailHash)
+	assert.Equal(t, 64, len(event.EmailHash))
+	assert.Equal(t, "Test Provider", event.Provider)
+	assert.Equal(t, true, event.Timestamp.After(before))
+	assert.NotContains(t, buf.String(), "michael.bland@gsa.gov")
+	assert.NotContains(t, buf.String(), "my_auth_token")
+}
+
+func TestLoginEventNotEmittedOnDenied(t *testing.T) {
+	proxy, done := newCSRFCookieTest(t)
+	defer done()
+	var buf bytes.Buffer
+	proxy.loginEvents = NewLoginEventLog(&buf, proxy.CookieSeed)
+	proxy.Validator = func(string) bool { return false }
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, "", buf.String())
+}
+
+func TestLoginEventEmailHashKey(t *testing.T) {
+	l := NewLoginEventLog(nil, "0123456789abcdefabcd")
+	// not keyed with the cookie secret itself
+	h := hmac.New(sha256.New, []byte("0123456789abcdefabcd"))
+	h.Write([]byte("michael.bland@gsa.gov"))
+	assert.NotEqual(t, hex.EncodeToString(h.Sum(nil)), l.hashEmail("michael.bland@gsa.gov"))
+	assert.Equal(t, l.hashEmail("michael.bland@gsa.gov"), l.hashEmail("Michael.Bland@gsa.gov"))
+	assert.NotEqual(t, l.hashEmail("michael.bland@gsa.gov"),
+		NewLoginEventLog(nil, "other secret").hashEmail("michael.bland@gsa.gov"))
+}
+
+func TestLoginEventLogNil(t *testing.T) {
+	var l *LoginEventLog
+	l.Emit(&providers.SessionState{User: "mbland"}, "GitHub", time.Now())
+}
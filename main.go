@@ -20,32 +20,82 @@ func mainFlagSet() *flag.FlagSet {
 	whitelistDomains := StringArray{}
 	upstreams := StringArray{}
 	skipAuthRegex := StringArray{}
+	skipAuthCIDRs := StringArray{}
+	upstreamTokenAudiences := StringArray{}
+	trustedProxies := StringArray{}
 	googleGroups := StringArray{}
 	gitlabGroups := StringArray{}
+	apiRequestHeaders := StringArray{}
+	stepUpRoutes := StringArray{}
+	routeGroups := StringArray{}
+	corsAllowedOrigins := StringArray{}
+	oidcRequiredClaims := StringArray{}
+	emailDomainAliases := StringArray{}
+	pageHeaders := StringArray{}
 
 	flagSet.String("http-address", "127.0.0.1:4180", "[http://]<addr>:<port> or unix://<path> to listen on for HTTP clients")
 	flagSet.String("https-address", ":443", "<addr>:<port> to listen on for HTTPS clients")
 	flagSet.String("tls-cert", "", "path to certificate file")
 	flagSet.String("tls-key", "", "path to private key file")
+	flagSet.String("tls-client-ca", "", "path to CA certificates file; HTTPS clients may then present a client certificate signed by one of them")
+	flagSet.String("client-cert-header", "", "pass the subject of the verified TLS client certificate to upstream in this header, e.g. X-Forwarded-Client-Cert")
 	flagSet.String("redirect-url", "", "the OAuth Redirect URL. ie: \"https://internalapp.yourcompany.com/oauth2/callback\"")
 	flagSet.Bool("set-xauthrequest", false, "set X-Auth-Request-User and X-Auth-Request-Email response headers (useful in Nginx auth_request mode)")
 	flagSet.Var(&upstreams, "upstream", "the http url(s) of the upstream endpoint or file:// paths for static files. Routing is based on the path")
 	flagSet.Bool("pass-basic-auth", true, "pass HTTP Basic Auth, X-Forwarded-User and X-Forwarded-Email information to upstream")
-	flagSet.Bool("pass-user-headers", true, "pass X-Forwarded-User and X-Forwarded-Email information to upstream")
+	flagSet.Bool("pass-user-headers", true, "pass X-Forwarded-User, X-Forwarded-Preferred-Username, X-Forwarded-Email and X-Forwarded-Groups information to upstream")
+	flagSet.String("session-expires-header", "", "pass the session expiry to upstream in X-Forwarded-Session-Expires, as \"epoch\" seconds or \"rfc3339\"")
+	flagSet.String("header-conflict", "override", "how identity headers sent by the client (X-Forwarded-User, -Preferred-Username, -Email, -Groups, -Access-Token, -Session-Expires) are handled: \"override\" removes them, \"append\" passes them after the values set, \"reject\" responds 400")
+	flagSet.String("user-from-email", "", "set the forwarded user to the email address, transformed by \"passthrough\", \"strip-domain\" and/or \"lowercase\" (comma separated)")
 	flagSet.String("basic-auth-password", "", "the password to set when passing the HTTP Basic Auth header")
 	flagSet.Bool("pass-access-token", false, "pass OAuth access_token to upstream via X-Forwarded-Access-Token header")
+	flagSet.String("pass-id-token-header", "", "pass the OIDC id_token to upstream in this header, e.g. X-Forwarded-Id-Token")
+	flagSet.Var(&upstreamTokenAudiences, "upstream-token-audience", "with pass-access-token, exchange the access token for one for an audience before passing it to an upstream, as \"upstream=audience\" (may be given multiple times)")
 	flagSet.Bool("pass-host-header", true, "pass the request Host Header to upstream")
+	flagSet.Bool("normalize-upstream-path", false, "redirect requests for paths with e.g. \"//\" to the clean path, rather than passing the path to upstream unchanged")
 	flagSet.Var(&skipAuthRegex, "skip-auth-regex", "bypass authentication for requests path's that match (may be given multiple times)")
+	flagSet.Var(&skipAuthCIDRs, "skip-auth-cidr", "bypass authentication for requests from clients in this network, e.g. 10.0.0.0/8 (may be given multiple times)")
+	flagSet.Var(&trustedProxies, "trusted-proxy", "trust X-Forwarded-For for the client address from reverse proxies in this network, e.g. 127.0.0.1/32 (may be given multiple times)")
+	flagSet.Var(&stepUpRoutes, "step-up-route", "require re-authentication for request paths matching regex if the login is older than max-age, as \"regex=max-age\" e.g. \"^/admin/=15m\" (may be given multiple times)")
+	flagSet.Var(&routeGroups, "route-group", "only allow sessions in one of groups to access request paths matching regex, as \"regex=group,group\" e.g. \"^/admin/=myorg/admins\", the first matching route group applies (may be given multiple times)")
 	flagSet.Bool("skip-provider-button", false, "will skip sign-in-page to directly reach the next step: oauth/start")
+	flagSet.Bool("api-challenge", false, "respond to unauthenticated API requests (Accept: application/json, or with an api-request-header) with 401 and WWW-Authenticate instead of the sign-in page")
+	flagSet.Var(&apiRequestHeaders, "api-request-header", "request header which identifies an API client for api-challenge, e.g. X-Requested-With (may be given multiple times)")
+	flagSet.Bool("denied-retry-link", false, "when an account is denied, offer to sign in with a different account and return to the original destination")
 	flagSet.Bool("skip-auth-preflight", false, "will skip authentication for OPTIONS requests")
+	flagSet.Var(&corsAllowedOrigins, "cors-allowed-origin", "respond to CORS preflight (OPTIONS) requests from this origin, e.g. https://app.example.com, or * for any, without credentials (may be given multiple times)")
 	flagSet.Bool("ssl-insecure-skip-verify", false, "skip validation of certificates presented when using HTTPS")
+	flagSet.Bool("cache-control-private", false, "add the \"private\" Cache-Control directive to authenticated upstream responses, so shared caches don't store them")
 	flagSet.Duration("flush-interval", 0, "period between response flushing when streaming responses (disabled by default)")
 
 	flagSet.Var(&emailDomains, "email-domain", "authenticate emails with the specified domain (may be given multiple times). Use * to authenticate any email")
+	flagSet.Var(&emailDomainAliases, "email-domain-alias", "rewrite the domain of emails from the provider, as \"alias=canonical\" e.g. \"corp-mail.example=example.com\" (may be given multiple times)")
 	flagSet.Var(&whitelistDomains, "whitelist-domain", "allowed domains for redirection after authentication. Prefix domain with a . to allow subdomains (eg .example.com)")
 	flagSet.String("azure-tenant", "common", "go to a tenant-specific or common (tenant-independent) endpoint.")
-	flagSet.String("github-org", "", "restrict logins to members of this organisation")
-	flagSet.String("github-team", "", "restrict logins to members of this team")
+	flagSet.String("github-base-url", "", "web URL of GitHub, e.g. https://github.example.com for GitHub Enterprise, from which the login, redeem and validate URLs are derived")
+	flagSet.String("github-host-mismatch", "warn", "if the login-url or redeem-url is not on the GitHub instance of the validate-url: \"warn\", \"error\" or \"ignore\"")
+	flagSet.String("github-org", "", "restrict logins to members of any of these organisations, separated by a comma")
+	flagSet.String("github-team", "", "restrict logins to members of any of these teams (slug or numeric ID, or \"org:team\" for a team in another org), separated by a comma")
+	flagSet.String("github-enterprise", "", "restrict logins to members of this GitHub Enterprise Cloud enterprise (slug)")
+	flagSet.String("github-repo", "", "restrict logins to collaborators of this repository (\"owner/repo\") with push access")
+	flagSet.Bool("github-saml-identity", false, "use the SAML identity (NameID) linked to the login in github-org as the email")
+	flagSet.Bool("github-coalesce-requests", false, "share one GitHub API request between identical requests for the same token made at the same time")
+	flagSet.String("github-app-identity", "", "accept GitHub App installation tokens of an installation on github-org as bearer tokens, and use this email as their identity rather than looking up the user")
+	flagSet.String("github-email-sources", "", "sources of the email tried in order until one has an email, separated by a comma: saml, primary, profile (default saml with github-saml-identity, otherwise primary)")
+	flagSet.Bool("github-email-as-username", false, "use the public email on the user's github profile, if set, as the username rather than the login")
+	flagSet.String("github-fine-grained-token", "error", "if a fine-grained personal access token lists no orgs or teams, which it may not have access to: fail the login with an \"error\", or \"deny\" it as not a member")
+	flagSet.String("github-missing-login", "deny", "if the GitHub user has an id but no login, as for some integration tokens: \"deny\" the login, or use \"id\" to take \"#<id>\" as the login")
+	flagSet.Bool("github-unverified-email", false, "if the user has no verified email, use their primary (else first) email rather than denying the login")
+	flagSet.Bool("github-verified-domain", false, "only accept an email in one of the verified domains of github-org")
+	flagSet.String("github-saml-token", "", "token of a github-org owner, used to look up SAML identities")
+	flagSet.Int("github-max-pages", 0, "most pages of the user's github orgs, teams or emails, or bitbucket workspaces or emails, to request; 0 for the default of 100")
+	flagSet.Int("github-max-teams", 0, "most of the user's github teams to fetch when looking for github-team before denying the login; 0 for no limit")
+	flagSet.Duration("github-rate-limit-max-wait", 0, "if a GitHub API request is rate limited, retry it once after waiting until the limit resets, but at most this long; 0 disables")
+	flagSet.Duration("github-abuse-backoff-max", 0, "if GitHub sends a secondary rate limit response with Retry-After, hold back all GitHub API requests until then, but at most this long; 0 disables")
+	flagSet.Duration("github-timeout", time.Duration(30)*time.Second, "timeout of each GitHub API request; 0 disables")
+	flagSet.Duration("github-membership-retry", 0, "if the user is not a member of github-org (and github-team), check again once after this delay, for members added moments ago; 0 disables")
+	flagSet.Duration("github-membership-cache-ttl", 0, "cache the github org/team membership check for each token for about this long (±10%); 0 disables")
+	flagSet.String("bitbucket-team", "", "restrict logins to members of this Bitbucket workspace (slug)")
 	flagSet.Var(&gitlabGroups, "gitlab-group", "restrict logins to members of this group (full path) (may be given multiple times)")
 	flagSet.Var(&googleGroups, "google-group", "restrict logins to members of this google group (may be given multiple times).")
 	flagSet.String("google-admin-email", "", "the google admin to impersonate for api calls")
@@ -53,34 +103,65 @@ func mainFlagSet() *flag.FlagSet {
 	flagSet.String("client-id", "", "the OAuth Client ID: ie: \"123456.apps.googleusercontent.com\"")
 	flagSet.String("client-secret", "", "the OAuth Client Secret")
 	flagSet.String("authenticated-emails-file", "", "authenticate against emails via file (one per line)")
+	flagSet.String("blocklist-file", "", "deny emails, user names or \"id:\"-prefixed user IDs listed in this file (one per line), whatever their domain or membership; reloaded on change")
 	flagSet.String("htpasswd-file", "", "additionally authenticate against a htpasswd file. Entries must be created with \"htpasswd -s\" for SHA encryption or \"htpasswd -B\" for bcrypt encryption")
 	flagSet.Bool("display-htpasswd-form", true, "display username / password login form if an htpasswd file is provided")
 	flagSet.String("custom-templates-dir", "", "path to custom html templates")
 	flagSet.String("footer", "", "custom footer string. Use \"-\" to disable default footer.")
+	flagSet.Var(&pageHeaders, "page-header", "response header to set on the sign-in and error pages, e.g. \"X-Frame-Options: DENY\" (may be given multiple times)")
 	flagSet.String("proxy-prefix", "/oauth2", "the url root path that this proxy should be nested under (e.g. /<oauth2>/sign_in)")
 
 	flagSet.String("cookie-name", "_oauth2_proxy", "the name of the cookie that the oauth_proxy creates")
 	flagSet.String("cookie-secret", "", "the seed string for secure cookies (optionally base64 encoded)")
+	flagSet.Bool("cookie-secret-derive", false, "derive the key for encrypting cookies from cookie-secret with HKDF, so it may be of any length rather than 16, 24 or 32 bytes")
 	flagSet.String("cookie-domain", "", "an optional cookie domain to force cookies to (ie: .yourcompany.com)*")
 	flagSet.Duration("cookie-expire", time.Duration(168)*time.Hour, "expire timeframe for cookie")
+	flagSet.String("session-fingerprint", "", "bind sessions to the client's User-Agent and network (/24 or /64): \"lax\" only rejects a session used with another User-Agent, \"strict\" also from another network")
 	flagSet.Duration("cookie-refresh", time.Duration(0), "refresh the cookie after this duration; 0 to disable")
 	flagSet.Bool("cookie-secure", true, "set secure (HTTPS) cookie flag")
+	flagSet.String("csrf-cookie-secret", "", "a separate seed string for signing the CSRF (OAuth state nonce) cookie (default: cookie-secret)")
+	flagSet.Bool("remember-me", false, "show a \"Remember me\" checkbox on the sign-in page; if unchecked the session cookie is cleared when the browser is closed")
+	flagSet.String("user-info-cookie", "", "name of an additional cookie, readable by javascript, holding the user's email, username, groups and avatar URL as a JWT signed with user-info-signing-key")
+	flagSet.String("user-info-signing-key", "", "the key, of at least 32 bytes and not the cookie-secret, user-info-cookie JWTs are signed with")
 	flagSet.Bool("cookie-httponly", true, "set HttpOnly cookie flag")
+	flagSet.Int("cookie-max-chunks", 10, "split a session cookie too big for one cookie in at most this many cookies, and reject sessions split in more")
 
 	flagSet.Bool("request-logging", true, "Log requests to stdout")
 	flagSet.String("request-logging-format", defaultRequestLoggingFormat, "Template for log lines")
+	flagSet.String("request-log", "stdout", "where to log requests: \"stdout\", \"stderr\" or a file path to append to")
+	flagSet.String("app-log", "stderr", "where to log everything else, e.g. provider errors: \"stdout\", \"stderr\" or a file path to append to")
+	flagSet.String("login-event-log", "", "where to write a JSON event for each successful login, for analytics: \"stdout\", \"stderr\" or a file path to append to")
+	flagSet.Bool("disable-logging", false, "disable the request log, login event log, and the logs of the proxy and provider; only startup and fatal errors are logged")
 
 	flagSet.String("provider", "google", "OAuth provider")
+	flagSet.String("callback-path", "", "the path of the OAuth callback for the provider (default \"<proxy-prefix>/callback\")")
 	flagSet.String("oidc-issuer-url", "", "OpenID Connect issuer URL (ie: https://accounts.google.com)")
+	flagSet.Duration("oidc-jwks-cache-ttl", time.Hour, "how long to cache the OpenID Connect issuer's signing keys (JWKS)")
+	flagSet.Duration("oidc-jwks-min-refetch", time.Minute, "fetch the issuer's signing keys again for an id_token signed with an unknown key, but at most this often")
+	flagSet.Var(&oidcRequiredClaims, "oidc-required-claim", "require an id_token claim to have this value, as \"claim=value\" (may be given multiple times; any value of the same claim, and all claims, are required)")
 	flagSet.String("login-url", "", "Authentication endpoint")
 	flagSet.String("redeem-url", "", "Token redemption endpoint")
 	flagSet.String("profile-url", "", "Profile access endpoint")
 	flagSet.String("resource", "", "The resource that is protected (Azure AD only)")
 	flagSet.String("validate-url", "", "Access token validation endpoint")
+	flagSet.String("logout-url", "", "provider end-session endpoint to redirect to after sign out (OIDC: discovered from the issuer if available)")
+	flagSet.String("post-logout-redirect-url", "", "absolute URL the provider should return to after its logout (default: \"/\" on the request host)")
 	flagSet.String("scope", "", "OAuth scope specification")
 	flagSet.String("approval-prompt", "force", "OAuth approval_prompt")
+	flagSet.String("provider-error-policy", "fail-closed", "when the provider can't be reached to re-validate a session: \"fail-closed\" removes the session, \"fail-open\" keeps it for provider-error-grace")
+	flagSet.Duration("provider-error-grace", time.Duration(1)*time.Hour, "with provider-error-policy=fail-open, how long after cookie-refresh a session is kept without re-validation")
+	flagSet.Bool("revalidate-async", false, "re-validate sessions due for cookie-refresh in the background, serving requests meanwhile with the existing session")
+	flagSet.Duration("revalidate-min-interval", 0, "re-validate sessions after as little as this when there are few requests, scaling up to cookie-refresh at revalidate-full-rate; 0 disables")
+	flagSet.Int("revalidate-full-rate", 60, "authenticated requests per minute at and above which sessions are re-validated after cookie-refresh, with revalidate-min-interval")
+	flagSet.Duration("revalidate-max-stale", time.Duration(5)*time.Minute, "with revalidate-async, how long after cookie-refresh a session may be served before re-validation is done synchronously")
+	flagSet.Int("provider-call-budget", 0, "maximum number of provider API calls made for a single login; 0 for no limit")
+	flagSet.String("provider-warm-up", "", "check the provider configuration and credentials at startup, and \"warn\" or \"fail\" to start on problems")
+	flagSet.Int64("provider-max-body-size", 4<<20, "maximum size in bytes of a provider API response (GitHub only); 0 for no limit")
+	flagSet.Bool("provider-verbose", false, "log the bodies of successful provider API responses, which contain personal data such as email addresses")
 
 	flagSet.String("signature-key", "", "GAP-Signature request signature key (algorithm:secretkey)")
+	flagSet.String("revoke-token", "", "enable the revoke endpoint, for requests with this bearer token")
+	flagSet.Bool("rate-limit-endpoint", false, "enable the rate_limit endpoint, reporting the provider API rate limit status as JSON")
 
 	return flagSet
 }
@@ -116,9 +197,32 @@ func main() {
 		log.Printf("%s", err)
 		os.Exit(1)
 	}
+	requestLog, err := setupLogging(opts, os.Stdout, os.Stderr)
+	if err != nil {
+		log.Fatalf("FATAL: %s", err)
+	}
 	validator := NewValidator(opts.EmailDomains, opts.AuthenticatedEmailsFile)
 	oauthproxy := NewOAuthProxy(opts, validator)
 
+	if opts.LoginEventLog != "" && !opts.DisableLogging {
+		w, err := openLog(opts.LoginEventLog, os.Stdout, os.Stderr)
+		if err != nil {
+			log.Fatalf("FATAL: %s", err)
+		}
+		oauthproxy.loginEvents = NewLoginEventLog(w, opts.CookieSecret)
+	}
+
+	if opts.ProviderWarmUp != "" {
+		if err := oauthproxy.WarmUp(); err != nil {
+			if opts.ProviderWarmUp == "fail" {
+				log.Fatalf("FATAL: provider warm-up failed: %s", err)
+			}
+			log.Printf("WARNING: provider warm-up failed: %s", err)
+		} else {
+			log.Printf("provider warm-up passed")
+		}
+	}
+
 	if len(opts.EmailDomains) != 0 && opts.AuthenticatedEmailsFile == "" {
 		if len(opts.EmailDomains) > 1 {
 			oauthproxy.SignInMessage = fmt.Sprintf("Authenticate using one of the following domains: %v", strings.Join(opts.EmailDomains, ", "))
@@ -137,7 +241,7 @@ func main() {
 	}
 
 	s := &Server{
-		Handler: LoggingHandler(os.Stdout, oauthproxy, opts.RequestLogging, opts.RequestLoggingFormat),
+		Handler: LoggingHandler(requestLog, oauthproxy, opts.RequestLogging, opts.RequestLoggingFormat),
 		Opts:    opts,
 	}
 	s.ListenAndServe()
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"crypto/x509/pkix"
 	b64 "encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
@@ -10,7 +14,9 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"path"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -34,10 +40,22 @@ var SignatureHeaders []string = []string{
 	"Gap-Auth",
 }
 
+// forwardedIdentityHeaders are the request headers in which the identity of
+// the user is passed to upstream, see header-conflict
+var forwardedIdentityHeaders = []string{
+	"X-Forwarded-User",
+	"X-Forwarded-Email",
+	"X-Forwarded-Access-Token",
+	"X-Forwarded-Session-Expires",
+	"X-Forwarded-Groups",
+	"X-Forwarded-Preferred-Username",
+}
+
 type OAuthProxy struct {
 	CookieSeed     string
 	CookieName     string
 	CSRFCookieName string
+	CSRFCookieSeed string
 	CookieDomain   string
 	CookieSecure   bool
 	CookieHttpOnly bool
@@ -45,6 +63,28 @@ type OAuthProxy struct {
 	CookieRefresh  time.Duration
 	Validator      func(string) bool
 
+	// CookieMaxChunks is the most cookies a session cookie too big for one
+	// cookie is split in, and reassembled from
+	CookieMaxChunks int
+
+	// name of the non-HttpOnly cookie with the user's identity as a JWT,
+	// signed with UserInfoSigningKey, for frontend javascript; empty to
+	// disable
+	UserInfoCookieName string
+	UserInfoSigningKey string
+	RememberMe         bool
+
+	ProviderErrorFailOpen bool
+	ProviderErrorGrace    time.Duration
+
+	// with a backgroundValidator, sessions due for re-validation are served
+	// for up to RevalidateMaxStale past CookieRefresh while it runs
+	backgroundValidator *BackgroundValidator
+	RevalidateMaxStale  time.Duration
+	// with adaptiveRevalidation, sessions are re-validated after an interval
+	// between revalidate-min-interval and CookieRefresh, by request rate
+	adaptiveRevalidation *AdaptiveRevalidation
+
 	RobotsPath        string
 	PingPath          string
 	SignInPath        string
@@ -52,6 +92,10 @@ type OAuthProxy struct {
 	OAuthStartPath    string
 	OAuthCallbackPath string
 	AuthOnlyPath      string
+	RevokePath        string
+	RateLimitPath     string
+
+	PostLogoutRedirectURL string
 
 	redirectURL         *url.URL // the url to receive requests at
 	whitelistDomains    []string
@@ -65,50 +109,205 @@ type OAuthProxy struct {
 	PassBasicAuth       bool
 	SkipProviderButton  bool
 	PassUserHeaders     bool
+	emailToUser         func(string) string
+	emailAliases        map[string]string
+	sessionExpires      string
+	headerConflict      string
 	BasicAuthPassword   string
 	PassAccessToken     bool
+	idTokenHeader       string
+	DeniedRetryLink     bool
+	APIChallenge        bool
+	apiRequestHeaders   []string
 	CookieCipher        *cookie.Cipher
 	skipAuthRegex       []string
 	skipAuthPreflight   bool
+	corsAllowedOrigins  []string
 	compiledRegex       []*regexp.Regexp
+	skipAuthNets        []*net.IPNet
+	trustedNets         []*net.IPNet
+	stepUpRoutes        []stepUpRoute
+	routeGroups         []routeGroup
 	templates           *template.Template
 	Footer              string
+	pageHeaders         http.Header
+	revokeToken         string
+	revocations         *RevocationList
+	blocklist           *Blocklist
+	loginEvents         *LoginEventLog
+	clientCertHeader    string
+	rateLimitEndpoint   bool
+	fingerprintMode     string
 }
 
 type UpstreamProxy struct {
-	upstream string
-	handler  http.Handler
-	auth     hmacauth.HmacAuth
+	upstream     string
+	handler      http.Handler
+	auth         hmacauth.HmacAuth
+	cachePrivate bool
+	exchange     *tokenExchanger
 }
 
 func (u *UpstreamProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("GAP-Upstream-Address", u.upstream)
+	// only the token of an authenticated session, not one sent by the client
+	// to a skip-auth-regex path, is exchanged
+	if token := r.Header.Get("X-Forwarded-Access-Token"); u.exchange != nil && token != "" && w.Header().Get("GAP-Auth") != "" {
+		exchanged, err := u.exchange.Token(token)
+		if err != nil {
+			logger.Printf("error exchanging the access token for upstream %s: %s", u.upstream, err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		r.Header.Set("X-Forwarded-Access-Token", exchanged)
+	}
 	if u.auth != nil {
 		r.Header.Set("GAP-Auth", w.Header().Get("GAP-Auth"))
 		u.auth.SignRequest(r)
 	}
+	// only authenticated responses (not skip-auth-regex) are marked private
+	if u.cachePrivate && w.Header().Get("GAP-Auth") != "" {
+		w = &privateCacheResponseWriter{ResponseWriter: w}
+	}
 	u.handler.ServeHTTP(w, r)
 }
 
+// privateCacheResponseWriter adds the "private" Cache-Control directive to
+// the upstream response headers, so shared caches don't store protected content,
+// while preserving the other upstream caching headers (max-age, ETag, etc)
+type privateCacheResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *privateCacheResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		setCacheControlPrivate(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *privateCacheResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *privateCacheResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func setCacheControlPrivate(h http.Header) {
+	var directives []string
+	for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+		d = strings.TrimSpace(d)
+		switch strings.ToLower(d) {
+		case "":
+		case "private", "no-store":
+			// already not stored by shared caches
+			return
+		case "public":
+		default:
+			directives = append(directives, d)
+		}
+	}
+	h.Set("Cache-Control", strings.Join(append([]string{"private"}, directives...), ", "))
+}
+
 func setProxyUpstreamHostHeader(proxy *httputil.ReverseProxy, target *url.URL) {
 	director := proxy.Director
 	proxy.Director = func(req *http.Request) {
 		director(req)
-		// use RequestURI so that we aren't unescaping encoded slashes in the request path
 		req.Host = target.Host
-		req.URL.Opaque = req.RequestURI
-		req.URL.RawQuery = ""
+		setRequestURI(req)
 	}
 }
 func setProxyDirector(proxy *httputil.ReverseProxy) {
 	director := proxy.Director
 	proxy.Director = func(req *http.Request) {
 		director(req)
-		// use RequestURI so that we aren't unescaping encoded slashes in the request path
-		req.URL.Opaque = req.RequestURI
-		req.URL.RawQuery = ""
+		setRequestURI(req)
+	}
+}
+
+// setRequestURI uses the RequestURI for the upstream request, so that we
+// aren't unescaping encoded slashes or cleaning the request path
+func setRequestURI(req *http.Request) {
+	if strings.HasPrefix(req.RequestURI, "//") {
+		// an Opaque "//a/b" would be sent as "http://a/b"
+		if u, err := url.ParseRequestURI(req.RequestURI); err == nil {
+			req.URL.Opaque = ""
+			req.URL.Path = u.Path
+			req.URL.RawPath = u.RawPath
+			req.URL.RawQuery = u.RawQuery
+			return
+		}
+	}
+	req.URL.Opaque = req.RequestURI
+	req.URL.RawQuery = ""
+}
+
+// upstreamMux returns mux, which redirects a request for a path with e.g.
+// "//" in it to the clean path, if normalize is set. Otherwise the request
+// is routed by its clean path but passed on unchanged. Paths with "." or
+// ".." segments are always redirected, see ServeHTTP.
+func upstreamMux(mux *http.ServeMux, normalize bool) http.Handler {
+	if normalize {
+		return mux
 	}
+	return preservePathMux{mux}
 }
+
+type preservePathMux struct {
+	*http.ServeMux
+}
+
+func (m preservePathMux) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	clean := cleanPath(req.URL.Path)
+	if clean == req.URL.Path || req.Method == "CONNECT" {
+		m.ServeMux.ServeHTTP(rw, req)
+		return
+	}
+	lookup := *req
+	lookupURL := *req.URL
+	lookupURL.Path = clean
+	lookup.URL = &lookupURL
+	h, _ := m.Handler(&lookup)
+	h.ServeHTTP(rw, req)
+}
+
+// hasDotSegment returns true if p has a "." or ".." segment, which the
+// upstream might resolve to a path other than the one matched against
+// skip-auth-regex, step-up-route and route-group
+func hasDotSegment(p string) bool {
+	for _, segment := range strings.Split(p, "/") {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanPath returns the canonical path for p, as http.ServeMux does,
+// keeping a trailing slash
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	if p[0] != '/' {
+		p = "/" + p
+	}
+	np := path.Clean(p)
+	if p[len(p)-1] == '/' && np != "/" {
+		np += "/"
+	}
+	return np
+}
+
 func NewFileServer(path string, filesystemPath string) (proxy http.Handler) {
 	return http.StripPrefix(path, http.FileServer(http.Dir(filesystemPath)))
 }
@@ -124,8 +323,13 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		path := u.Path
 		switch u.Scheme {
 		case "http", "https":
+			var exchange *tokenExchanger
+			if audience, ok := opts.audiences[u.String()]; ok {
+				logger.Printf("exchanging access tokens for upstream %q for audience %q", u, audience)
+				exchange = newTokenExchanger(opts.provider, audience)
+			}
 			u.Path = ""
-			log.Printf("mapping path %q => upstream %q", path, u)
+			logger.Printf("mapping path %q => upstream %q", path, u)
 			proxy := httputil.NewSingleHostReverseProxy(u)
 			proxy.FlushInterval = opts.FlushInterval
 			if !opts.PassHostHeader {
@@ -134,46 +338,70 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 				setProxyDirector(proxy)
 			}
 			serveMux.Handle(path,
-				&UpstreamProxy{u.Host, proxy, auth})
+				&UpstreamProxy{u.Host, proxy, auth, opts.CacheControlPrivate, exchange})
 		case "file":
 			if u.Fragment != "" {
 				path = u.Fragment
 			}
-			log.Printf("mapping path %q => file system %q", path, u.Path)
+			logger.Printf("mapping path %q => file system %q", path, u.Path)
 			proxy := NewFileServer(path, u.Path)
-			serveMux.Handle(path, &UpstreamProxy{path, proxy, nil})
+			serveMux.Handle(path, &UpstreamProxy{path, proxy, nil, opts.CacheControlPrivate, nil})
 		default:
 			panic(fmt.Sprintf("unknown upstream protocol %s", u.Scheme))
 		}
 	}
 	for _, u := range opts.CompiledRegex {
-		log.Printf("compiled skip-auth-regex => %q", u)
+		logger.Printf("compiled skip-auth-regex => %q", u)
 	}
 
+	callbackPath := opts.CallbackPath
+	if callbackPath == "" {
+		callbackPath = fmt.Sprintf("%s/callback", opts.ProxyPrefix)
+	}
 	redirectURL := opts.redirectURL
-	redirectURL.Path = fmt.Sprintf("%s/callback", opts.ProxyPrefix)
+	redirectURL.Path = callbackPath
 
-	log.Printf("OAuthProxy configured for %s Client ID: %s", opts.provider.Data().ProviderName, opts.ClientID)
+	logger.Printf("OAuthProxy configured for %s Client ID: %s", opts.provider.Data().ProviderName, opts.ClientID)
 	refresh := "disabled"
 	if opts.CookieRefresh != time.Duration(0) {
 		refresh = fmt.Sprintf("after %s", opts.CookieRefresh)
 	}
 
-	log.Printf("Cookie settings: name:%s secure(https):%v httponly:%v expiry:%s domain:%s refresh:%s", opts.CookieName, opts.CookieSecure, opts.CookieHttpOnly, opts.CookieExpire, opts.CookieDomain, refresh)
+	logger.Printf("Cookie settings: name:%s secure(https):%v httponly:%v expiry:%s domain:%s refresh:%s", opts.CookieName, opts.CookieSecure, opts.CookieHttpOnly, opts.CookieExpire, opts.CookieDomain, refresh)
 
 	var cipher *cookie.Cipher
-	if opts.PassAccessToken || (opts.CookieRefresh != time.Duration(0)) {
+	if opts.PassAccessToken || opts.PassIDTokenHeader != "" || (opts.CookieRefresh != time.Duration(0)) {
 		var err error
-		cipher, err = cookie.NewCipher(secretBytes(opts.CookieSecret))
+		cipher, err = cookie.NewCipher(cookieCipherKey(opts))
 		if err != nil {
 			log.Fatal("cookie-secret error: ", err)
 		}
 	}
 
+	csrfCookieSeed := opts.CSRFCookieSecret
+	if csrfCookieSeed == "" {
+		csrfCookieSeed = opts.CookieSecret
+	}
+
+	var blocklist *Blocklist
+	if opts.BlocklistFile != "" {
+		blocklist = NewBlocklist(opts.BlocklistFile, nil, func() {})
+	}
+
+	var backgroundValidator *BackgroundValidator
+	if opts.RevalidateAsync {
+		backgroundValidator = NewBackgroundValidator(opts.RevalidateMaxStale)
+	}
+	var adaptiveRevalidation *AdaptiveRevalidation
+	if opts.RevalidateMinInterval > 0 {
+		adaptiveRevalidation = NewAdaptiveRevalidation(opts.RevalidateMinInterval, opts.CookieRefresh, opts.RevalidateFullRate)
+	}
+
 	return &OAuthProxy{
 		CookieName:     opts.CookieName,
 		CSRFCookieName: fmt.Sprintf("%v_%v", opts.CookieName, "csrf"),
 		CookieSeed:     opts.CookieSecret,
+		CSRFCookieSeed: csrfCookieSeed,
 		CookieDomain:   opts.CookieDomain,
 		CookieSecure:   opts.CookieSecure,
 		CookieHttpOnly: opts.CookieHttpOnly,
@@ -181,31 +409,68 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		CookieRefresh:  opts.CookieRefresh,
 		Validator:      validator,
 
+		CookieMaxChunks: opts.CookieMaxChunks,
+
+		UserInfoCookieName: opts.UserInfoCookie,
+		UserInfoSigningKey: opts.UserInfoSigningKey,
+		RememberMe:         opts.RememberMe,
+
+		ProviderErrorFailOpen: opts.ProviderErrorPolicy == "fail-open",
+		ProviderErrorGrace:    opts.ProviderErrorGrace,
+
+		backgroundValidator:  backgroundValidator,
+		RevalidateMaxStale:   opts.RevalidateMaxStale,
+		adaptiveRevalidation: adaptiveRevalidation,
+
 		RobotsPath:        "/robots.txt",
 		PingPath:          "/ping",
 		SignInPath:        fmt.Sprintf("%s/sign_in", opts.ProxyPrefix),
 		SignOutPath:       fmt.Sprintf("%s/sign_out", opts.ProxyPrefix),
 		OAuthStartPath:    fmt.Sprintf("%s/start", opts.ProxyPrefix),
-		OAuthCallbackPath: fmt.Sprintf("%s/callback", opts.ProxyPrefix),
+		OAuthCallbackPath: callbackPath,
 		AuthOnlyPath:      fmt.Sprintf("%s/auth", opts.ProxyPrefix),
+		RevokePath:        fmt.Sprintf("%s/revoke", opts.ProxyPrefix),
+		RateLimitPath:     fmt.Sprintf("%s/rate_limit", opts.ProxyPrefix),
+
+		PostLogoutRedirectURL: opts.PostLogoutRedirectURL,
 
 		ProxyPrefix:        opts.ProxyPrefix,
 		provider:           opts.provider,
-		serveMux:           serveMux,
+		serveMux:           upstreamMux(serveMux, opts.NormalizeUpstreamPath),
 		redirectURL:        redirectURL,
 		whitelistDomains:   opts.WhitelistDomains,
 		skipAuthRegex:      opts.SkipAuthRegex,
 		skipAuthPreflight:  opts.SkipAuthPreflight,
+		corsAllowedOrigins: opts.CORSAllowedOrigins,
 		compiledRegex:      opts.CompiledRegex,
+		stepUpRoutes:       opts.stepUpRoutes,
+		routeGroups:        opts.routeGroups,
 		SetXAuthRequest:    opts.SetXAuthRequest,
 		PassBasicAuth:      opts.PassBasicAuth,
 		PassUserHeaders:    opts.PassUserHeaders,
+		emailToUser:        opts.emailToUser,
+		emailAliases:       opts.emailAliases,
+		clientCertHeader:   opts.ClientCertHeader,
+		skipAuthNets:       opts.skipAuthNets,
+		trustedNets:        opts.trustedNets,
+		sessionExpires:     opts.SessionExpiresHeader,
+		headerConflict:     opts.HeaderConflict,
 		BasicAuthPassword:  opts.BasicAuthPassword,
 		PassAccessToken:    opts.PassAccessToken,
+		idTokenHeader:      http.CanonicalHeaderKey(opts.PassIDTokenHeader),
 		SkipProviderButton: opts.SkipProviderButton,
+		DeniedRetryLink:    opts.DeniedRetryLink,
+		APIChallenge:       opts.APIChallenge,
+		apiRequestHeaders:  opts.APIRequestHeaders,
 		CookieCipher:       cipher,
 		templates:          loadTemplates(opts.CustomTemplatesDir),
 		Footer:             opts.Footer,
+		pageHeaders:        opts.pageHeaders,
+		revokeToken:        opts.RevokeToken,
+		revocations:        NewRevocationList(opts.CookieExpire),
+		blocklist:          blocklist,
+		rateLimitEndpoint:  opts.RateLimitEndpoint,
+		fingerprintMode:    opts.SessionFingerprint,
 	}
 }
 
@@ -227,11 +492,31 @@ func (p *OAuthProxy) GetRedirectURI(host string) string {
 	return u.String()
 }
 
+// WarmUp checks the provider configuration, e.g. at startup: that a login
+// URL can be constructed, and for providers which support it, that the
+// configured credentials are accepted by the provider's API
+func (p *OAuthProxy) WarmUp() error {
+	loginURL, err := url.Parse(p.provider.GetLoginURL(p.GetRedirectURI("localhost"), "/"))
+	if err != nil {
+		return fmt.Errorf("invalid login url: %s", err)
+	}
+	if !loginURL.IsAbs() || loginURL.Host == "" {
+		return fmt.Errorf("invalid login url %q, expected an absolute url", loginURL)
+	}
+	if loginURL.Query().Get("client_id") == "" {
+		return fmt.Errorf("login url %q has no client_id", loginURL)
+	}
+	if w, ok := p.provider.(providers.WarmUpper); ok {
+		return w.WarmUp()
+	}
+	return nil
+}
+
 func (p *OAuthProxy) displayCustomLoginForm() bool {
 	return p.HtpasswdFile != nil && p.DisplayHtpasswdForm
 }
 
-func (p *OAuthProxy) redeemCode(host, code string) (s *providers.SessionState, err error) {
+func (p *OAuthProxy) redeemCode(ctx context.Context, host, code string) (s *providers.SessionState, err error) {
 	if code == "" {
 		return nil, errors.New("missing code")
 	}
@@ -242,18 +527,40 @@ func (p *OAuthProxy) redeemCode(host, code string) (s *providers.SessionState, e
 	}
 
 	if s.Email == "" {
-		s.Email, err = p.provider.GetEmailAddress(s)
+		if s.Email, err = p.provider.GetEmailAddress(ctx, s); err != nil {
+			return
+		}
 	}
+	s.Email = p.canonicalEmail(s.Email)
 
 	if s.User == "" {
-		s.User, err = p.provider.GetUserName(s)
+		s.User, err = p.provider.GetUserName(ctx, s)
 		if err != nil && err.Error() == "not implemented" {
 			err = nil
 		}
+		if err != nil {
+			return
+		}
+	}
+
+	if s.PreferredUsername == "" {
+		s.PreferredUsername, err = p.provider.GetPreferredUsername(ctx, s)
 	}
 	return
 }
 
+// maxCookieSize is the largest cookie value written without a warning; the
+// session cookie is split in several cookies instead. nginx's default
+// response header limit is 4KiB, other software may have similar limits;
+// the threshold includes margin for the header name, cookie name and other
+// cookie options.
+const maxCookieSize = 3600
+
+// maxSessionCookieSize is the size of the session cookie above which an
+// error is logged, as the browser sends all its cookies in one request
+// header, which e.g. nginx limits to 8KiB by default
+const maxSessionCookieSize = 2 * maxCookieSize
+
 func (p *OAuthProxy) MakeSessionCookie(req *http.Request, value string, expiration time.Duration, now time.Time) *http.Cookie {
 	if value != "" {
 		value = cookie.SignedValue(p.CookieSeed, p.CookieName, value, now)
@@ -261,7 +568,84 @@ func (p *OAuthProxy) MakeSessionCookie(req *http.Request, value string, expirati
 	return p.makeCookie(req, p.CookieName, value, expiration, now)
 }
 
+// makeSessionCookies returns the session cookie for value, split in
+// cookies named CookieName_0, CookieName_1 etc. if it is too big for one
+func (p *OAuthProxy) makeSessionCookies(req *http.Request, value string, expiration time.Duration, now time.Time) []*http.Cookie {
+	signed := cookie.SignedValue(p.CookieSeed, p.CookieName, value, now)
+	if len(signed) <= maxCookieSize {
+		return []*http.Cookie{p.makeCookie(req, p.CookieName, signed, expiration, now)}
+	}
+	var cookies []*http.Cookie
+	for i := 0; signed != ""; i++ {
+		n := maxCookieSize
+		if len(signed) < n {
+			n = len(signed)
+		}
+		cookies = append(cookies, p.makeCookie(req, p.sessionCookieChunkName(i), signed[:n], expiration, now))
+		signed = signed[n:]
+	}
+	return cookies
+}
+
+func (p *OAuthProxy) sessionCookieChunkName(i int) string {
+	return fmt.Sprintf("%s_%d", p.CookieName, i)
+}
+
+// sessionCookie returns the session cookie of req, joining the cookies it
+// was split in. More than CookieMaxChunks of them are rejected, so that a
+// crafted request can't make it join any number of cookies.
+func (p *OAuthProxy) sessionCookie(req *http.Request) (*http.Cookie, error) {
+	if c, err := req.Cookie(p.CookieName); err == nil {
+		return c, nil
+	}
+	var value string
+	for i := 0; ; i++ {
+		c, err := req.Cookie(p.sessionCookieChunkName(i))
+		if err != nil {
+			break
+		}
+		if i >= p.CookieMaxChunks {
+			logger.Printf("WARNING - %s session cookie has more than %d chunks (cookie-max-chunks)", getRemoteAddr(req), p.CookieMaxChunks)
+			return nil, fmt.Errorf("session cookie has more than %d chunks", p.CookieMaxChunks)
+		}
+		value += c.Value
+	}
+	if value == "" {
+		return nil, http.ErrNoCookie
+	}
+	return &http.Cookie{Name: p.CookieName, Value: value}, nil
+}
+
+// isSessionCookie returns whether name is the session cookie's, or one of
+// the cookies the session cookie is split in
+func (p *OAuthProxy) isSessionCookie(name string) bool {
+	if name == p.CookieName {
+		return true
+	}
+	i := strings.TrimPrefix(name, p.CookieName+"_")
+	return i != name && i != "" && strings.Trim(i, "0123456789") == ""
+}
+
+// clearStaleSessionCookies expires the session cookies of req which are not
+// replaced by cookies, such as the chunks beyond the current count of a
+// session which was split in more cookies before
+func (p *OAuthProxy) clearStaleSessionCookies(rw http.ResponseWriter, req *http.Request, cookies []*http.Cookie) {
+	set := make(map[string]bool)
+	for _, c := range cookies {
+		set[c.Name] = true
+	}
+	for _, c := range req.Cookies() {
+		if p.isSessionCookie(c.Name) && !set[c.Name] {
+			set[c.Name] = true
+			http.SetCookie(rw, p.makeCookie(req, c.Name, "", time.Hour*-1, time.Now()))
+		}
+	}
+}
+
 func (p *OAuthProxy) MakeCSRFCookie(req *http.Request, value string, expiration time.Duration, now time.Time) *http.Cookie {
+	if value != "" {
+		value = cookie.SignedValue(p.CSRFCookieSeed, p.CSRFCookieName, value, now)
+	}
 	return p.makeCookie(req, p.CSRFCookieName, value, expiration, now)
 }
 
@@ -272,13 +656,11 @@ func (p *OAuthProxy) makeCookie(req *http.Request, name string, value string, ex
 			domain = h
 		}
 		if !strings.HasSuffix(domain, p.CookieDomain) {
-			log.Printf("Warning: request host is %q but using configured cookie domain of %q", domain, p.CookieDomain)
+			logger.Printf("Warning: request host is %q but using configured cookie domain of %q", domain, p.CookieDomain)
 		}
 	}
-	if len(value) > 3600 {
-		// nginx default response header limit is 4KiB, other software may have similar limits
-		// threshold includes margin for header name, cookie name, other cookie options
-		log.Printf("WARNING - %s cookie is very big: %d bytes", name, len(value))
+	if len(value) > maxCookieSize {
+		logger.Printf("WARNING - %s cookie is very big: %d bytes", name, len(value))
 	}
 
 	return &http.Cookie{
@@ -292,6 +674,38 @@ func (p *OAuthProxy) makeCookie(req *http.Request, name string, value string, ex
 	}
 }
 
+// userInfoClaims are the JWT claims of the user info cookie. They are
+// readable by the browser, so must never include tokens.
+type userInfoClaims struct {
+	Email     string   `json:"email,omitempty"`
+	User      string   `json:"user,omitempty"`
+	Groups    []string `json:"groups,omitempty"`
+	AvatarURL string   `json:"avatar_url,omitempty"`
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+func (p *OAuthProxy) MakeUserInfoCookie(req *http.Request, s *providers.SessionState, expiration time.Duration, now time.Time) (*http.Cookie, error) {
+	var value string
+	if s != nil {
+		var err error
+		value, err = cookie.SignedJWT(p.UserInfoSigningKey, userInfoClaims{
+			Email:     s.Email,
+			User:      s.User,
+			Groups:    s.Groups,
+			AvatarURL: s.AvatarURL,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(expiration).Unix(),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	c := p.makeCookie(req, p.UserInfoCookieName, value, expiration, now)
+	c.HttpOnly = false
+	return c, nil
+}
+
 func (p *OAuthProxy) ClearCSRFCookie(rw http.ResponseWriter, req *http.Request) {
 	http.SetCookie(rw, p.MakeCSRFCookie(req, "", time.Hour*-1, time.Now()))
 }
@@ -303,6 +717,16 @@ func (p *OAuthProxy) SetCSRFCookie(rw http.ResponseWriter, req *http.Request, va
 func (p *OAuthProxy) ClearSessionCookie(rw http.ResponseWriter, req *http.Request) {
 	clr := p.MakeSessionCookie(req, "", time.Hour*-1, time.Now())
 	http.SetCookie(rw, clr)
+	p.clearStaleSessionCookies(rw, req, []*http.Cookie{clr})
+
+	if p.UserInfoCookieName != "" {
+		if c, err := p.MakeUserInfoCookie(req, nil, time.Hour*-1, time.Now()); err == nil {
+			http.SetCookie(rw, c)
+		}
+	}
+	if p.RememberMe {
+		http.SetCookie(rw, p.makeCookie(req, p.sessionOnlyCookieName(), "", time.Hour*-1, time.Now()))
+	}
 
 	// ugly hack because default domain changed
 	if p.CookieDomain == "" {
@@ -312,16 +736,85 @@ func (p *OAuthProxy) ClearSessionCookie(rw http.ResponseWriter, req *http.Reques
 	}
 }
 
-func (p *OAuthProxy) SetSessionCookie(rw http.ResponseWriter, req *http.Request, val string) {
-	http.SetCookie(rw, p.MakeSessionCookie(req, val, p.CookieExpire, time.Now()))
+// SetSessionCookie sets the session cookie, split in several cookies if it
+// is too big for one, but in at most CookieMaxChunks
+func (p *OAuthProxy) SetSessionCookie(rw http.ResponseWriter, req *http.Request, val string) error {
+	cookies := p.makeSessionCookies(req, val, p.CookieExpire, time.Now())
+	if len(cookies) > p.CookieMaxChunks {
+		return fmt.Errorf("session cookie needs %d chunks, more than cookie-max-chunks (%d)", len(cookies), p.CookieMaxChunks)
+	}
+	sessionOnly := p.isSessionOnly(req)
+	for _, c := range cookies {
+		if sessionOnly {
+			// without Expires the browser discards the cookie when it is closed
+			c.Expires = time.Time{}
+		}
+		http.SetCookie(rw, c)
+	}
+	p.clearStaleSessionCookies(rw, req, cookies)
+	return nil
+}
+
+func (p *OAuthProxy) sessionOnlyCookieName() string {
+	return p.CookieName + "_session_only"
+}
+
+// rememberMeChoice returns whether the "remember me" checkbox of the sign-in
+// page was left unchecked, if the form was submitted from that page. A
+// hidden remember_me=0 comes before the checkbox's remember_me=1.
+func (p *OAuthProxy) rememberMeChoice(req *http.Request) (sessionOnly bool, ok bool) {
+	if !p.RememberMe || req.Form == nil {
+		return false, false
+	}
+	values, ok := req.Form["remember_me"]
+	if !ok {
+		return false, false
+	}
+	for _, v := range values {
+		if v == "1" {
+			return false, true
+		}
+	}
+	return true, true
+}
+
+// isSessionOnly returns whether the session cookie should be a session-only
+// cookie rather than a persistent one: as chosen on the sign-in page, which
+// is remembered in a session-only cookie for the callback and refreshes.
+func (p *OAuthProxy) isSessionOnly(req *http.Request) bool {
+	if sessionOnly, ok := p.rememberMeChoice(req); ok {
+		return sessionOnly
+	}
+	if !p.RememberMe {
+		return false
+	}
+	_, err := req.Cookie(p.sessionOnlyCookieName())
+	return err == nil
+}
+
+// setRememberMe remembers the sign-in page's "remember me" choice, if made
+func (p *OAuthProxy) setRememberMe(rw http.ResponseWriter, req *http.Request) {
+	sessionOnly, ok := p.rememberMeChoice(req)
+	if !ok {
+		return
+	}
+	c := p.makeCookie(req, p.sessionOnlyCookieName(), "1", 0, time.Now())
+	if sessionOnly {
+		c.Expires = time.Time{}
+	} else {
+		c.Value = ""
+		c.Expires = time.Now().Add(time.Hour * -1)
+	}
+	http.SetCookie(rw, c)
 }
 
 func (p *OAuthProxy) LoadCookiedSession(req *http.Request) (*providers.SessionState, time.Duration, error) {
 	var age time.Duration
-	c, err := req.Cookie(p.CookieName)
-	if err != nil {
-		// always http.ErrNoCookie
+	c, err := p.sessionCookie(req)
+	if err == http.ErrNoCookie {
 		return nil, age, fmt.Errorf("Cookie %q not present", p.CookieName)
+	} else if err != nil {
+		return nil, age, err
 	}
 	val, timestamp, ok := cookie.Validate(c, p.CookieSeed, p.CookieExpire)
 	if !ok {
@@ -338,11 +831,30 @@ func (p *OAuthProxy) LoadCookiedSession(req *http.Request) (*providers.SessionSt
 }
 
 func (p *OAuthProxy) SaveSession(rw http.ResponseWriter, req *http.Request, s *providers.SessionState) error {
+	if p.fingerprintMode != "" && s.Fingerprint == "" {
+		s.Fingerprint = p.fingerprint(req)
+	}
 	value, err := p.provider.CookieForSession(s, p.CookieCipher)
 	if err != nil {
 		return err
 	}
-	p.SetSessionCookie(rw, req, value)
+	if len(value) > maxSessionCookieSize {
+		logger.Printf("ERROR - session cookie for %s is %d bytes, of which the id_token is %d, and may be rejected by servers or proxies with a request header limit", s, len(value), len(s.IDToken))
+	}
+	if err := p.SetSessionCookie(rw, req, value); err != nil {
+		return err
+	}
+
+	if p.UserInfoCookieName != "" {
+		c, err := p.MakeUserInfoCookie(req, s, p.CookieExpire, time.Now())
+		if err != nil {
+			return err
+		}
+		if p.isSessionOnly(req) {
+			c.Expires = time.Time{}
+		}
+		http.SetCookie(rw, c)
+	}
 	return nil
 }
 
@@ -356,23 +868,56 @@ func (p *OAuthProxy) PingPage(rw http.ResponseWriter) {
 	fmt.Fprintf(rw, "OK")
 }
 
+// setPageHeaders adds the configured headers (e.g. Content-Security-Policy)
+// to pages served by oauth2_proxy itself
+func (p *OAuthProxy) setPageHeaders(rw http.ResponseWriter) {
+	for name, values := range p.pageHeaders {
+		for _, v := range values {
+			rw.Header().Add(name, v)
+		}
+	}
+}
+
 func (p *OAuthProxy) ErrorPage(rw http.ResponseWriter, code int, title string, message string) {
-	log.Printf("ErrorPage %d %s %s", code, title, message)
+	p.errorPage(rw, code, title, message, "")
+}
+
+// DeniedPage is the ErrorPage for an account that authenticated but is not
+// authorized, optionally offering to retry with a different account and
+// return to the original destination
+func (p *OAuthProxy) DeniedPage(rw http.ResponseWriter, redirect string) {
+	var retryURL string
+	if p.DeniedRetryLink {
+		params := url.Values{
+			"rd":     {redirect},
+			"prompt": {"login"},
+		}
+		retryURL = fmt.Sprintf("%s?%s", p.OAuthStartPath, params.Encode())
+	}
+	p.errorPage(rw, 403, "Permission Denied", "Invalid Account", retryURL)
+}
+
+func (p *OAuthProxy) errorPage(rw http.ResponseWriter, code int, title string, message string, retryURL string) {
+	logger.Printf("ErrorPage %d %s %s", code, title, message)
+	p.setPageHeaders(rw)
 	rw.WriteHeader(code)
 	t := struct {
 		Title       string
 		Message     string
 		ProxyPrefix string
+		RetryURL    string
 	}{
 		Title:       fmt.Sprintf("%d %s", code, title),
 		Message:     message,
 		ProxyPrefix: p.ProxyPrefix,
+		RetryURL:    retryURL,
 	}
 	p.templates.ExecuteTemplate(rw, "error.html", t)
 }
 
 func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code int) {
 	p.ClearSessionCookie(rw, req)
+	p.setPageHeaders(rw)
 	rw.WriteHeader(code)
 
 	redirect_url := req.URL.RequestURI()
@@ -387,6 +932,7 @@ func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code
 		ProviderName  string
 		SignInMessage string
 		CustomLogin   bool
+		RememberMe    bool
 		Redirect      string
 		Version       string
 		ProxyPrefix   string
@@ -395,6 +941,7 @@ func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code
 		ProviderName:  p.provider.Data().ProviderName,
 		SignInMessage: p.SignInMessage,
 		CustomLogin:   p.displayCustomLoginForm(),
+		RememberMe:    p.RememberMe,
 		Redirect:      redirect_url,
 		Version:       VERSION,
 		ProxyPrefix:   p.ProxyPrefix,
@@ -414,7 +961,7 @@ func (p *OAuthProxy) ManualSignIn(rw http.ResponseWriter, req *http.Request) (st
 	}
 	// check auth
 	if p.HtpasswdFile.Validate(user, passwd) {
-		log.Printf("authenticated %q via HtpasswdFile", user)
+		logger.Printf("authenticated %q via HtpasswdFile", user)
 		return user, true
 	}
 	return "", false
@@ -459,6 +1006,48 @@ func (p *OAuthProxy) IsWhitelistedRequest(req *http.Request) (ok bool) {
 	return isPreflightRequestAllowed || p.IsWhitelistedPath(req.URL.Path)
 }
 
+// IsAllowedCORSPreflight returns true for a CORS preflight request from one
+// of the corsAllowedOrigins. Browsers send these without credentials, so
+// they can't be authenticated.
+func (p *OAuthProxy) IsAllowedCORSPreflight(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if req.Method != "OPTIONS" || origin == "" || req.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	for _, allowed := range p.corsAllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// CORSPreflight allows the cross-origin request described by the preflight
+// request. Only origins listed by name may send credentials, not any origin
+// allowed by "*", which could otherwise read responses for the user.
+func (p *OAuthProxy) CORSPreflight(rw http.ResponseWriter, req *http.Request) {
+	origin := req.Header.Get("Origin")
+	listed := false
+	for _, allowed := range p.corsAllowedOrigins {
+		if allowed == origin {
+			listed = true
+			break
+		}
+	}
+	if listed {
+		rw.Header().Set("Access-Control-Allow-Origin", origin)
+		rw.Header().Set("Access-Control-Allow-Credentials", "true")
+	} else {
+		rw.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+	rw.Header().Set("Access-Control-Allow-Methods", req.Header.Get("Access-Control-Request-Method"))
+	if headers := req.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		rw.Header().Set("Access-Control-Allow-Headers", headers)
+	}
+	rw.Header().Add("Vary", "Origin")
+	rw.WriteHeader(http.StatusNoContent)
+}
+
 func (p *OAuthProxy) IsWhitelistedPath(path string) (ok bool) {
 	for _, u := range p.compiledRegex {
 		ok = u.MatchString(path)
@@ -469,6 +1058,64 @@ func (p *OAuthProxy) IsWhitelistedPath(path string) (ok bool) {
 	return
 }
 
+// IsAPIRequest guesses whether the request is from an API client rather than a
+// browser, by the presence of a configured header or an Accept header which
+// prefers JSON over HTML
+func (p *OAuthProxy) IsAPIRequest(req *http.Request) bool {
+	for _, h := range p.apiRequestHeaders {
+		if req.Header.Get(h) != "" {
+			return true
+		}
+	}
+	accept := req.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+func inNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client, from X-Forwarded-For if the
+// request is from one of the trustedNets, or nil. X-Real-IP is not used: a
+// trusted proxy which doesn't set it passes on whatever the client sent.
+func (p *OAuthProxy) ClientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !inNets(ip, p.trustedNets) {
+		return ip
+	}
+	// the last address which was not added by a trusted proxy
+	hops := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !inNets(ip, p.trustedNets) {
+			break
+		}
+	}
+	return ip
+}
+
+// IsTrustedClient returns true for a request from one of the skipAuthNets
+func (p *OAuthProxy) IsTrustedClient(req *http.Request) bool {
+	if len(p.skipAuthNets) == 0 {
+		return false
+	}
+	ip := p.ClientIP(req)
+	return ip != nil && inNets(ip, p.skipAuthNets)
+}
+
 func getRemoteAddr(req *http.Request) (s string) {
 	s = req.RemoteAddr
 	if req.Header.Get("X-Real-IP") != "" {
@@ -478,11 +1125,22 @@ func getRemoteAddr(req *http.Request) (s string) {
 }
 
 func (p *OAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if p.clientCertHeader != "" {
+		// only set from the verified client certificate, see authenticate
+		req.Header.Del(p.clientCertHeader)
+	}
+	if req.Method != "CONNECT" && hasDotSegment(req.URL.Path) {
+		u := url.URL{Path: cleanPath(req.URL.Path), RawQuery: req.URL.RawQuery}
+		http.Redirect(rw, req, u.String(), http.StatusMovedPermanently)
+		return
+	}
 	switch path := req.URL.Path; {
 	case path == p.RobotsPath:
 		p.RobotsTxt(rw)
 	case path == p.PingPath:
 		p.PingPage(rw)
+	case p.IsAllowedCORSPreflight(req):
+		p.CORSPreflight(rw, req)
 	case p.IsWhitelistedRequest(req):
 		p.serveMux.ServeHTTP(rw, req)
 	case path == p.SignInPath:
@@ -495,6 +1153,12 @@ func (p *OAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		p.OAuthCallback(rw, req)
 	case path == p.AuthOnlyPath:
 		p.AuthenticateOnly(rw, req)
+	case path == p.RevokePath && p.revokeToken != "":
+		p.RevokeSessions(rw, req)
+	case path == p.RateLimitPath && p.rateLimitEndpoint:
+		p.RateLimitStatus(rw, req)
+	case p.IsTrustedClient(req):
+		p.serveMux.ServeHTTP(rw, req)
 	default:
 		p.Proxy(rw, req)
 	}
@@ -509,8 +1173,10 @@ func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
 
 	user, ok := p.ManualSignIn(rw, req)
 	if ok {
-		session := &providers.SessionState{User: user}
+		session := &providers.SessionState{User: user, AuthTime: time.Now()}
+		p.setRememberMe(rw, req)
 		p.SaveSession(rw, req, session)
+		p.loginEvents.Emit(session, "htpasswd", session.AuthTime)
 		http.Redirect(rw, req, redirect, 302)
 	} else {
 		if p.SkipProviderButton {
@@ -522,10 +1188,30 @@ func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
 }
 
 func (p *OAuthProxy) SignOut(rw http.ResponseWriter, req *http.Request) {
+	var idToken string
+	if session, _, err := p.LoadCookiedSession(req); err == nil {
+		idToken = session.IDToken
+	}
 	p.ClearSessionCookie(rw, req)
+	if logoutURL := p.provider.GetLogoutURL(p.GetPostLogoutRedirectURI(req.Host), idToken); logoutURL != "" {
+		http.Redirect(rw, req, logoutURL, 302)
+		return
+	}
 	http.Redirect(rw, req, "/", 302)
 }
 
+// GetPostLogoutRedirectURI is where the provider should send the user after
+// its logout, by default "/" on the same host as the redirect URL
+func (p *OAuthProxy) GetPostLogoutRedirectURI(host string) string {
+	if p.PostLogoutRedirectURL != "" {
+		return p.PostLogoutRedirectURL
+	}
+	u, _ := url.Parse(p.GetRedirectURI(host))
+	u.Path = "/"
+	u.RawQuery = ""
+	return u.String()
+}
+
 func (p *OAuthProxy) OAuthStart(rw http.ResponseWriter, req *http.Request) {
 	nonce, err := cookie.Nonce()
 	if err != nil {
@@ -538,8 +1224,96 @@ func (p *OAuthProxy) OAuthStart(rw http.ResponseWriter, req *http.Request) {
 		p.ErrorPage(rw, 500, "Internal Error", err.Error())
 		return
 	}
+	p.setRememberMe(rw, req)
 	redirectURI := p.GetRedirectURI(req.Host)
-	http.Redirect(rw, req, p.provider.GetLoginURL(redirectURI, fmt.Sprintf("%v:%v", nonce, redirect)), 302)
+	loginURL := p.provider.GetLoginURL(redirectURI, fmt.Sprintf("%v:%v", nonce, redirect))
+	if req.Form.Get("prompt") == "login" {
+		loginURL = forceLoginPrompt(loginURL, req.Form.Get("max_age"))
+	}
+	http.Redirect(rw, req, loginURL, 302)
+}
+
+// forceLoginPrompt asks the provider to re-authenticate the user rather than
+// silently re-using their current provider session, so a different account
+// can be chosen. A max_age in seconds is passed on if given.
+func forceLoginPrompt(loginURL, maxAge string) string {
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return loginURL
+	}
+	params := u.Query()
+	params.Set("prompt", "login")
+	if n, err := strconv.Atoi(maxAge); err == nil && n >= 0 {
+		params.Set("max_age", maxAge)
+	}
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+// stepUpMaxAge returns the max-age of the first step-up route matching the
+// request path, if any
+func (p *OAuthProxy) stepUpMaxAge(req *http.Request) (time.Duration, bool) {
+	path := p.routePath(req)
+	for _, r := range p.stepUpRoutes {
+		if path != "" && r.regex.MatchString(path) {
+			return r.maxAge, true
+		}
+	}
+	return 0, false
+}
+
+// routePath returns the clean path of the request, which step-up-route and
+// route-group are matched against. For the auth endpoint, used by nginx
+// auth_request, it is the path of the X-Original-URI header, or "" if that
+// isn't set.
+func (p *OAuthProxy) routePath(req *http.Request) string {
+	if req.URL.Path != p.AuthOnlyPath {
+		return cleanPath(req.URL.Path)
+	}
+	u, err := url.ParseRequestURI(req.Header.Get("X-Original-URI"))
+	if err != nil {
+		return ""
+	}
+	return cleanPath(u.Path)
+}
+
+// routeAuthorized returns true unless the first route group matching the
+// request path lists none of the session's groups. Without a path, as for
+// the auth endpoint without X-Original-URI, no route group is satisfied.
+func (p *OAuthProxy) routeAuthorized(req *http.Request, s *providers.SessionState) bool {
+	if len(p.routeGroups) == 0 {
+		return true
+	}
+	path := p.routePath(req)
+	if path == "" {
+		return false
+	}
+	for _, r := range p.routeGroups {
+		if !r.regex.MatchString(path) {
+			continue
+		}
+		for _, group := range s.Groups {
+			for _, allowed := range r.groups {
+				if strings.EqualFold(group, allowed) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// StepUp redirects to re-authenticate with the provider, for a step-up route
+// whose max-age the session's login is older than
+func (p *OAuthProxy) StepUp(rw http.ResponseWriter, req *http.Request) {
+	maxAge, _ := p.stepUpMaxAge(req)
+	params := url.Values{
+		"prompt":  {"login"},
+		"max_age": {strconv.Itoa(int(maxAge.Seconds()))},
+		"rd":      {req.URL.RequestURI()},
+	}
+	http.Redirect(rw, req, p.OAuthStartPath+"?"+params.Encode(), 302)
 }
 
 func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
@@ -557,9 +1331,21 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	session, err := p.redeemCode(req.Host, req.Form.Get("code"))
+	session, err := p.redeemCode(req.Context(), req.Host, req.Form.Get("code"))
+	if redeemErr, ok := err.(*providers.RedeemError); ok {
+		// the provider's code and description, escaped by the template,
+		// tell the user why, e.g. an expired code
+		logger.Printf("%s error redeeming code %s", remoteAddr, err)
+		p.ErrorPage(rw, 403, "Permission Denied", redeemErr.Error())
+		return
+	}
+	if err == providers.ErrNoPrimaryEmail {
+		logger.Printf("%s error redeeming code %s", remoteAddr, err)
+		p.ErrorPage(rw, 403, "Permission Denied", "Your account has no verified email address")
+		return
+	}
 	if err != nil {
-		log.Printf("%s error redeeming code %s", remoteAddr, err)
+		logger.Printf("%s error redeeming code %s", remoteAddr, err)
 		p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
 		return
 	}
@@ -577,8 +1363,14 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 	p.ClearCSRFCookie(rw, req)
-	if c.Value != nonce {
-		log.Printf("%s csrf token mismatch, potential attack", remoteAddr)
+	csrfNonce, _, ok := cookie.Validate(c, p.CSRFCookieSeed, p.CookieExpire)
+	if !ok {
+		logger.Printf("%s invalid csrf cookie, potential attack", remoteAddr)
+		p.ErrorPage(rw, 403, "Permission Denied", "csrf failed")
+		return
+	}
+	if csrfNonce != nonce {
+		logger.Printf("%s csrf token mismatch, potential attack", remoteAddr)
 		p.ErrorPage(rw, 403, "Permission Denied", "csrf failed")
 		return
 	}
@@ -588,37 +1380,174 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	// set cookie, or deny
-	if p.Validator(session.Email) && p.provider.ValidateGroup(session.Email) {
-		log.Printf("%s authentication complete %s", remoteAddr, session)
+	if p.Validator(session.Email) && p.provider.ValidateGroup(session.Email) && !p.blocklist.IsBlocked(session) {
+		logger.Printf("%s authentication complete %s", remoteAddr, session)
+		session.AuthTime = time.Now()
 		err := p.SaveSession(rw, req, session)
 		if err != nil {
-			log.Printf("%s %s", remoteAddr, err)
+			logger.Printf("%s %s", remoteAddr, err)
 			p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
 			return
 		}
+		p.loginEvents.Emit(session, p.provider.Data().ProviderName, session.AuthTime)
 		http.Redirect(rw, req, redirect, 302)
 	} else {
-		log.Printf("%s Permission Denied: %q is unauthorized", remoteAddr, session.Email)
-		p.ErrorPage(rw, 403, "Permission Denied", "Invalid Account")
+		logger.Printf("%s Permission Denied: %q is unauthorized", remoteAddr, session.Email)
+		p.DeniedPage(rw, redirect)
+	}
+}
+
+// RateLimitStatus reports the provider's API rate limit status from its most
+// recent response, or null if it hasn't been seen yet, as JSON, to clients
+// with a valid session
+func (p *OAuthProxy) RateLimitStatus(rw http.ResponseWriter, req *http.Request) {
+	if status, _ := p.authenticate(rw, req); status != http.StatusAccepted {
+		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+		return
+	}
+	reporter, ok := p.provider.(providers.RateLimitReporter)
+	if !ok {
+		http.Error(rw, "rate limit status not available for this provider", http.StatusNotFound)
+		return
+	}
+	status := struct {
+		Provider  string               `json:"provider"`
+		RateLimit *providers.RateLimit `json:"rate_limit"`
+	}{p.provider.Data().ProviderName, reporter.RateLimit()}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(status)
+}
+
+// RevokeSessions is an admin endpoint to revoke all current sessions for a
+// user, given by the "user" or "email" form value
+func (p *OAuthProxy) RevokeSessions(rw http.ResponseWriter, req *http.Request) {
+	remoteAddr := getRemoteAddr(req)
+	if req.Method != "POST" {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	auth := req.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+p.revokeToken)) != 1 {
+		logger.Printf("%s invalid revoke token", remoteAddr)
+		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := req.Form.Get("user")
+	if id == "" {
+		id = req.Form.Get("email")
+	}
+	if id == "" {
+		http.Error(rw, "missing user or email", http.StatusBadRequest)
+		return
 	}
+	p.revocations.Revoke(id, time.Now())
+	logger.Printf("%s revoked all sessions for %q", remoteAddr, id)
+	rw.WriteHeader(http.StatusOK)
+	fmt.Fprintf(rw, "OK")
 }
 
 func (p *OAuthProxy) AuthenticateOnly(rw http.ResponseWriter, req *http.Request) {
-	status := p.Authenticate(rw, req)
-	if status == http.StatusAccepted {
-		rw.WriteHeader(http.StatusAccepted)
-	} else {
+	status, session := p.authenticate(rw, req)
+	if status == http.StatusForbidden && session != nil {
+		http.Error(rw, "forbidden request", http.StatusForbidden)
+		return
+	}
+	if status != http.StatusAccepted {
 		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+		return
+	}
+	if !acceptsJSON(req) {
+		rw.WriteHeader(http.StatusAccepted)
+		return
+	}
+	info := struct {
+		User  string `json:"user"`
+		Email string `json:"email,omitempty"`
+	}{p.forwardedUser(session), session.Email}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(rw).Encode(info)
+}
+
+// acceptsJSON returns true if the request's Accept header lists
+// application/json
+func acceptsJSON(req *http.Request) bool {
+	for _, accept := range req.Header["Accept"] {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType := strings.TrimSpace(strings.SplitN(mediaRange, ";", 2)[0])
+			if strings.EqualFold(mediaType, "application/json") {
+				return true
+			}
+		}
 	}
+	return false
+}
+
+// canonicalEmail rewrites the domain of email if it is an alias, see
+// email-domain-alias
+func (p *OAuthProxy) canonicalEmail(email string) string {
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return email
+	}
+	if canonical, ok := p.emailAliases[strings.ToLower(email[i+1:])]; ok {
+		return email[:i+1] + canonical
+	}
+	return email
+}
+
+// certSubject formats a certificate subject as an RFC 2253 distinguished
+// name, most specific attribute first
+func certSubject(name pkix.Name) string {
+	var rdns []string
+	add := func(attr string, values []string) {
+		for _, v := range values {
+			rdns = append(rdns, attr+"="+dnEscaper.Replace(v))
+		}
+	}
+	if name.CommonName != "" {
+		add("CN", []string{name.CommonName})
+	}
+	add("OU", name.OrganizationalUnit)
+	add("O", name.Organization)
+	add("L", name.Locality)
+	add("ST", name.Province)
+	add("C", name.Country)
+	return strings.Join(rdns, ",")
+}
+
+var dnEscaper = strings.NewReplacer(`,`, `\,`, `+`, `\+`, `"`, `\"`, `\`, `\\`, `<`, `\<`, `>`, `\>`, `;`, `\;`)
+
+// forwardedUser returns the user name passed upstream for the session
+func (p *OAuthProxy) forwardedUser(s *providers.SessionState) string {
+	if p.emailToUser != nil && s.Email != "" {
+		return p.emailToUser(s.Email)
+	}
+	return s.User
 }
 
 func (p *OAuthProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
-	status := p.Authenticate(rw, req)
+	status, session := p.authenticate(rw, req)
 	if status == http.StatusInternalServerError {
 		p.ErrorPage(rw, http.StatusInternalServerError,
 			"Internal Error", "Internal Error")
+	} else if status == http.StatusBadRequest {
+		p.ErrorPage(rw, http.StatusBadRequest,
+			"Bad Request", "The request must not set identity headers")
+	} else if status == http.StatusUnauthorized {
+		p.StepUp(rw, req)
+	} else if status == http.StatusForbidden && session != nil {
+		p.ErrorPage(rw, 403, "Permission Denied", "You are not a member of a group allowed to access this page")
 	} else if status == http.StatusForbidden {
-		if p.SkipProviderButton {
+		if p.APIChallenge && p.IsAPIRequest(req) {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+		} else if p.SkipProviderButton {
 			p.OAuthStart(rw, req)
 		} else {
 			p.SignInPage(rw, req, http.StatusForbidden)
@@ -629,20 +1558,49 @@ func (p *OAuthProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
 }
 
 func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int {
+	status, _ := p.authenticate(rw, req)
+	return status
+}
+
+// authenticate returns the status as Authenticate does, and with
+// http.StatusAccepted, the authenticated session. With http.StatusForbidden
+// it returns the session too if it is authenticated, but not in the groups
+// of the route group matching the request.
+func (p *OAuthProxy) authenticate(rw http.ResponseWriter, req *http.Request) (int, *providers.SessionState) {
 	var saveSession, clearSession, revalidated bool
 	remoteAddr := getRemoteAddr(req)
 
 	session, sessionAge, err := p.LoadCookiedSession(req)
 	if err != nil {
-		log.Printf("%s %s", remoteAddr, err)
+		logger.Printf("%s %s", remoteAddr, err)
+	}
+	if session != nil && p.revocations.IsRevoked(session, time.Now().Truncate(time.Second).Add(-sessionAge)) {
+		logger.Printf("%s removing session. revoked %s", remoteAddr, session)
+		session = nil
+		clearSession = true
+	}
+	if session != nil && p.blocklist.IsBlocked(session) {
+		logger.Printf("%s removing session. blocked %s", remoteAddr, session)
+		session = nil
+		clearSession = true
 	}
-	if session != nil && p.CookieRefresh != time.Duration(0) && sessionAge > p.CookieRefresh && session.AccessToken != "" {
-		log.Printf("%s refreshing %s old session cookie for %s (refresh after %s)", remoteAddr, sessionAge, session, p.CookieRefresh)
+	if session != nil && !p.fingerprintMatches(req, session) {
+		logger.Printf("%s removing session. fingerprint changed %s", remoteAddr, session)
+		session = nil
+		clearSession = true
+	}
+	refresh := p.CookieRefresh
+	if p.adaptiveRevalidation != nil && session != nil {
+		p.adaptiveRevalidation.Observe(time.Now())
+		refresh = p.adaptiveRevalidation.Interval()
+	}
+	if session != nil && refresh != time.Duration(0) && sessionAge > refresh && session.AccessToken != "" {
+		logger.Printf("%s refreshing %s old session cookie for %s (refresh after %s)", remoteAddr, sessionAge, session, refresh)
 		saveSession = true
 	}
 
 	if ok, err := p.provider.RefreshSessionIfNeeded(session); err != nil {
-		log.Printf("%s removing session. error refreshing access token %s %s", remoteAddr, err, session)
+		logger.Printf("%s removing session. error refreshing access token %s %s", remoteAddr, err, session)
 		clearSession = true
 		session = nil
 	} else if ok {
@@ -651,7 +1609,7 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 	}
 
 	if session != nil && session.IsExpired() {
-		log.Printf("%s removing session. token expired %s", remoteAddr, session)
+		logger.Printf("%s removing session. token expired %s", remoteAddr, session)
 		session = nil
 		saveSession = false
 		clearSession = true
@@ -659,8 +1617,22 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 
 	if saveSession && !revalidated && session != nil {
 		if session.AccessToken != "" {
-			if !p.provider.ValidateSessionState(session) {
-				log.Printf("%s removing session. error validating %s", remoteAddr, session)
+			var valid bool
+			var err error
+			done := true
+			if p.backgroundValidator != nil && sessionAge < refresh+p.RevalidateMaxStale {
+				valid, err, done = p.backgroundValidator.Validate(session, p.provider.ValidateSessionState)
+			} else {
+				valid, err = p.provider.ValidateSessionState(session)
+			}
+			if !done {
+				logger.Printf("%s re-validating session %s in the background", remoteAddr, session)
+				saveSession = false
+			} else if err != nil && p.ProviderErrorFailOpen && sessionAge < refresh+p.ProviderErrorGrace {
+				logger.Printf("%s keeping session %s without re-validation, provider error: %s", remoteAddr, session, err)
+				saveSession = false
+			} else if !valid {
+				logger.Printf("%s removing session. error validating %s", remoteAddr, session)
 				saveSession = false
 				session = nil
 				clearSession = true
@@ -671,7 +1643,7 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 	}
 
 	if session != nil && session.Email != "" && !p.Validator(session.Email) {
-		log.Printf("%s Permission Denied: removing session %s", remoteAddr, session)
+		logger.Printf("%s Permission Denied: removing session %s", remoteAddr, session)
 		session = nil
 		saveSession = false
 		clearSession = true
@@ -680,8 +1652,8 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 	if saveSession && session != nil {
 		err := p.SaveSession(rw, req, session)
 		if err != nil {
-			log.Printf("%s %s", remoteAddr, err)
-			return http.StatusInternalServerError
+			logger.Printf("%s %s", remoteAddr, err)
+			return http.StatusInternalServerError, nil
 		}
 	}
 
@@ -689,33 +1661,81 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 		p.ClearSessionCookie(rw, req)
 	}
 
+	if session != nil {
+		if maxAge, ok := p.stepUpMaxAge(req); ok {
+			// the login time of sessions without an auth time is unknown,
+			// as refreshing the cookie resets its age, so they are stale
+			if session.AuthTime.IsZero() {
+				logger.Printf("%s step-up authentication required, unknown login time for %s (max-age %s)", remoteAddr, session, maxAge)
+				return http.StatusUnauthorized, nil
+			}
+			if authAge := time.Since(session.AuthTime); authAge > maxAge {
+				logger.Printf("%s step-up authentication required, %s old login for %s (max-age %s)", remoteAddr, authAge, session, maxAge)
+				return http.StatusUnauthorized, nil
+			}
+		}
+	}
+
 	if session == nil {
-		session, err = p.CheckBasicAuth(req)
+		session, err = p.CheckBearerToken(req)
+		if err == nil && session == nil {
+			session, err = p.CheckBasicAuth(req)
+		}
 		if err != nil {
-			log.Printf("%s %s", remoteAddr, err)
+			logger.Printf("%s %s", remoteAddr, err)
+		}
+		if session != nil && p.blocklist.IsBlocked(session) {
+			logger.Printf("%s blocked %s", remoteAddr, session)
+			session = nil
 		}
 	}
 
 	if session == nil {
-		return http.StatusForbidden
+		return http.StatusForbidden, nil
+	}
+	if !p.routeAuthorized(req, session) {
+		logger.Printf("%s %s is not in a group allowed for %q", remoteAddr, session, p.routePath(req))
+		return http.StatusForbidden, session
 	}
 
 	// At this point, the user is authenticated. proxy normally
+	switch p.headerConflict {
+	case "append":
+	case "reject":
+		for _, h := range p.identityHeaders() {
+			if _, ok := req.Header[h]; ok {
+				logger.Printf("%s rejecting request for %s with a %s header", remoteAddr, session, h)
+				return http.StatusBadRequest, nil
+			}
+		}
+	default:
+		// only set by oauth2_proxy, not by the client
+		for _, h := range p.identityHeaders() {
+			req.Header.Del(h)
+		}
+	}
+	user := p.forwardedUser(session)
 	if p.PassBasicAuth {
-		req.SetBasicAuth(session.User, p.BasicAuthPassword)
-		req.Header["X-Forwarded-User"] = []string{session.User}
+		req.SetBasicAuth(user, p.BasicAuthPassword)
+		p.setForwardedHeader(req, "X-Forwarded-User", user)
 		if session.Email != "" {
-			req.Header["X-Forwarded-Email"] = []string{session.Email}
+			p.setForwardedHeader(req, "X-Forwarded-Email", session.Email)
 		}
 	}
 	if p.PassUserHeaders {
-		req.Header["X-Forwarded-User"] = []string{session.User}
+		p.setForwardedHeader(req, "X-Forwarded-User", user)
 		if session.Email != "" {
-			req.Header["X-Forwarded-Email"] = []string{session.Email}
+			p.setForwardedHeader(req, "X-Forwarded-Email", session.Email)
+		}
+		if len(session.Groups) > 0 {
+			p.setForwardedHeader(req, "X-Forwarded-Groups", strings.Join(session.Groups, ","))
+		}
+		if session.PreferredUsername != "" {
+			p.setForwardedHeader(req, "X-Forwarded-Preferred-Username", session.PreferredUsername)
 		}
 	}
 	if p.SetXAuthRequest {
-		rw.Header().Set("X-Auth-Request-User", session.User)
+		rw.Header().Set("X-Auth-Request-User", user)
 		if session.Email != "" {
 			rw.Header().Set("X-Auth-Request-Email", session.Email)
 		}
@@ -724,14 +1744,71 @@ func (p *OAuthProxy) Authenticate(rw http.ResponseWriter, req *http.Request) int
 		}
 	}
 	if p.PassAccessToken && session.AccessToken != "" {
-		req.Header["X-Forwarded-Access-Token"] = []string{session.AccessToken}
+		p.setForwardedHeader(req, "X-Forwarded-Access-Token", session.AccessToken)
+	}
+	if p.idTokenHeader != "" && session.IDToken != "" {
+		p.setForwardedHeader(req, p.idTokenHeader, session.IDToken)
+	}
+	if p.clientCertHeader != "" && req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		req.Header.Set(p.clientCertHeader, fmt.Sprintf("Subject=%q", certSubject(req.TLS.VerifiedChains[0][0].Subject)))
+	}
+	if p.sessionExpires != "" && !session.ExpiresOn.IsZero() {
+		if p.sessionExpires == "rfc3339" {
+			p.setForwardedHeader(req, "X-Forwarded-Session-Expires", session.ExpiresOn.UTC().Format(time.RFC3339))
+		} else {
+			p.setForwardedHeader(req, "X-Forwarded-Session-Expires", strconv.FormatInt(session.ExpiresOn.Unix(), 10))
+		}
 	}
 	if session.Email == "" {
 		rw.Header().Set("GAP-Auth", session.User)
 	} else {
 		rw.Header().Set("GAP-Auth", session.Email)
 	}
-	return http.StatusAccepted
+	return http.StatusAccepted, session
+}
+
+// identityHeaders are the forwardedIdentityHeaders, and the id_token header
+// if set
+func (p *OAuthProxy) identityHeaders() []string {
+	if p.idTokenHeader == "" {
+		return forwardedIdentityHeaders
+	}
+	return append([]string{p.idTokenHeader}, forwardedIdentityHeaders...)
+}
+
+// setForwardedHeader sets an identity header passed to upstream. With
+// header-conflict=append, a value the client sent is kept after it, so that
+// the first value, which Header.Get returns, is always the one set here; a
+// value already set is not added again.
+func (p *OAuthProxy) setForwardedHeader(req *http.Request, name, value string) {
+	if p.headerConflict == "append" {
+		if v := req.Header[name]; len(v) == 0 || v[0] != value {
+			req.Header[name] = append([]string{value}, v...)
+		}
+		return
+	}
+	req.Header[name] = []string{value}
+}
+
+// CheckBearerToken returns the session of a provider token in a "Bearer"
+// Authorization header, if the provider takes such tokens (see
+// providers.TokenSessionProvider), or nil if it does not. No session cookie
+// is saved for it, the token is checked with each request.
+func (p *OAuthProxy) CheckBearerToken(req *http.Request) (*providers.SessionState, error) {
+	tp, ok := p.provider.(providers.TokenSessionProvider)
+	auth := req.Header.Get("Authorization")
+	if !ok || !strings.HasPrefix(auth, "Bearer ") {
+		return nil, nil
+	}
+	session, err := tp.SessionFromToken(req.Context(), strings.TrimPrefix(auth, "Bearer "))
+	if err != nil || session == nil {
+		return nil, err
+	}
+	if !p.Validator(session.Email) {
+		return nil, fmt.Errorf("Permission Denied: %s via bearer token", session)
+	}
+	logger.Printf("authenticated %s via bearer token", session)
+	return session, nil
 }
 
 func (p *OAuthProxy) CheckBasicAuth(req *http.Request) (*providers.SessionState, error) {
@@ -755,7 +1832,7 @@ func (p *OAuthProxy) CheckBasicAuth(req *http.Request) (*providers.SessionState,
 		return nil, fmt.Errorf("invalid format %s", b)
 	}
 	if p.HtpasswdFile.Validate(pair[0], pair[1]) {
-		log.Printf("authenticated %q via basic auth", pair[0])
+		logger.Printf("authenticated %q via basic auth", pair[0])
 		return &providers.SessionState{User: pair[0]}, nil
 	}
 	return nil, fmt.Errorf("%s not in HtpasswdFile", pair[0])
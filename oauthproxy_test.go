@@ -1,8 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html"
 	"io"
 	"io/ioutil"
 	"log"
@@ -11,12 +21,14 @@ import (
 	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"regexp"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/mbland/hmacauth"
+	"github.com/ploxiln/oauth2_proxy/cookie"
 	"github.com/ploxiln/oauth2_proxy/providers"
 	"github.com/stretchr/testify/assert"
 )
@@ -52,6 +64,129 @@ func TestNewReverseProxy(t *testing.T) {
 	}
 }
 
+func testPassHostHeader(t *testing.T, passHostHeader bool) (string, string) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(r.Host))
+	}))
+	defer backend.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, backend.URL)
+	opts.SkipAuthRegex = append(opts.SkipAuthRegex, "^/")
+	opts.PassHostHeader = passHostHeader
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://app.example.com/some/path", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	backendURL, _ := url.Parse(backend.URL)
+	return rw.Body.String(), backendURL.Host
+}
+
+func TestPassHostHeader(t *testing.T) {
+	seen, _ := testPassHostHeader(t, true)
+	assert.Equal(t, "app.example.com", seen)
+}
+
+func TestPassHostHeaderDisabled(t *testing.T) {
+	seen, backendHost := testPassHostHeader(t, false)
+	assert.Equal(t, backendHost, seen)
+}
+
+func testUpstreamPath(t *testing.T, normalize bool, requestURI string) *httptest.ResponseRecorder {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(r.RequestURI))
+	}))
+	defer backend.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, backend.URL+"/a/")
+	opts.SkipAuthRegex = append(opts.SkipAuthRegex, "^/")
+	opts.NormalizeUpstreamPath = normalize
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://app.example.com"+requestURI, nil)
+	req.RequestURI = requestURI
+	proxy.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestUpstreamPathPreserved(t *testing.T) {
+	for _, uri := range []string{"/a//b/", "/a/b/", "/a/b", "//a/b?x=1", "//a/b%2Fc//?x=%2F"} {
+		rw := testUpstreamPath(t, false, uri)
+		assert.Equal(t, 200, rw.Code, uri)
+		assert.Equal(t, uri, rw.Body.String())
+	}
+}
+
+func TestUpstreamPathDotSegments(t *testing.T) {
+	for _, normalize := range []bool{false, true} {
+		rw := testUpstreamPath(t, normalize, "/a/./b/../c?x=1")
+		assert.Equal(t, 301, rw.Code)
+		assert.Equal(t, "/a/c?x=1", rw.HeaderMap.Get("Location"))
+
+		rw = testUpstreamPath(t, normalize, "/a/%2e%2e/b/")
+		assert.Equal(t, 301, rw.Code)
+		assert.Equal(t, "/b/", rw.HeaderMap.Get("Location"))
+	}
+}
+
+func TestSkipAuthRegexDotSegments(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(r.RequestURI))
+	}))
+	defer backend.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, backend.URL)
+	opts.SkipAuthRegex = append(opts.SkipAuthRegex, "^/public/")
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "http://app.example.com/public/../admin/", nil)
+	req.RequestURI = "/public/../admin/"
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 301, rw.Code)
+	assert.Equal(t, "/admin/", rw.HeaderMap.Get("Location"))
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "http://app.example.com/admin/", nil)
+	req.RequestURI = "/admin/"
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+}
+
+func TestUpstreamPathNormalized(t *testing.T) {
+	rw := testUpstreamPath(t, true, "/a//b/")
+	// 307 since Go 1.22
+	assert.Contains(t, []int{301, 307}, rw.Code)
+	assert.Equal(t, "/a/b/", rw.HeaderMap.Get("Location"))
+
+	rw = testUpstreamPath(t, true, "/a/b/")
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "/a/b/", rw.Body.String())
+}
+
 func TestEncodedSlashes(t *testing.T) {
 	var seen string
 	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -78,6 +213,81 @@ func TestEncodedSlashes(t *testing.T) {
 	}
 }
 
+func newCacheControlTestUpstream(cachePrivate bool) (*httptest.Server, *UpstreamProxy) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Header().Set("ETag", `"abc123"`)
+		w.WriteHeader(200)
+		w.Write([]byte("static asset"))
+	}))
+	backendURL, _ := url.Parse(backend.URL)
+	proxyHandler := httputil.NewSingleHostReverseProxy(backendURL)
+	setProxyDirector(proxyHandler)
+	return backend, &UpstreamProxy{backendURL.Host, proxyHandler, nil, cachePrivate, nil}
+}
+
+func TestUpstreamProxyPreservesCacheHeaders(t *testing.T) {
+	backend, upstream := newCacheControlTestUpstream(false)
+	defer backend.Close()
+
+	rw := httptest.NewRecorder()
+	rw.Header().Set("GAP-Auth", "michael.bland@gsa.gov")
+	req, _ := http.NewRequest("GET", "/asset.js", nil)
+	req.RequestURI = "/asset.js"
+	upstream.ServeHTTP(rw, req)
+
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "public, max-age=3600", rw.Header().Get("Cache-Control"))
+	assert.Equal(t, `"abc123"`, rw.Header().Get("ETag"))
+	assert.Equal(t, "static asset", rw.Body.String())
+}
+
+func TestUpstreamProxyCacheControlPrivate(t *testing.T) {
+	backend, upstream := newCacheControlTestUpstream(true)
+	defer backend.Close()
+
+	rw := httptest.NewRecorder()
+	rw.Header().Set("GAP-Auth", "michael.bland@gsa.gov")
+	req, _ := http.NewRequest("GET", "/asset.js", nil)
+	req.RequestURI = "/asset.js"
+	upstream.ServeHTTP(rw, req)
+
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "private, max-age=3600", rw.Header().Get("Cache-Control"))
+	assert.Equal(t, `"abc123"`, rw.Header().Get("ETag"))
+	assert.Equal(t, "static asset", rw.Body.String())
+}
+
+func TestUpstreamProxyCacheControlPrivateSkippedWhenUnauthenticated(t *testing.T) {
+	backend, upstream := newCacheControlTestUpstream(true)
+	defer backend.Close()
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/asset.js", nil)
+	req.RequestURI = "/asset.js"
+	upstream.ServeHTTP(rw, req)
+
+	assert.Equal(t, "public, max-age=3600", rw.Header().Get("Cache-Control"))
+}
+
+func TestSetCacheControlPrivate(t *testing.T) {
+	cases := map[string]string{
+		"":                         "private",
+		"max-age=60":               "private, max-age=60",
+		"public, max-age=60":       "private, max-age=60",
+		"no-store":                 "no-store",
+		"private, must-revalidate": "private, must-revalidate",
+	}
+	for in, expected := range cases {
+		h := http.Header{}
+		if in != "" {
+			h.Set("Cache-Control", in)
+		}
+		setCacheControlPrivate(h)
+		assert.Equal(t, expected, h.Get("Cache-Control"), "Cache-Control: %q", in)
+	}
+}
+
 func TestRobotsTxt(t *testing.T) {
 	opts := NewOptions()
 	opts.ClientID = "bazquux"
@@ -146,8 +356,10 @@ func TestIsValidRedirect(t *testing.T) {
 
 type TestProvider struct {
 	*providers.ProviderData
-	EmailAddress string
-	ValidToken   bool
+	EmailAddress  string
+	EmailError    error
+	ValidToken    bool
+	ValidateError error
 }
 
 func NewTestProvider(provider_url *url.URL, email_address string) *TestProvider {
@@ -175,12 +387,12 @@ func NewTestProvider(provider_url *url.URL, email_address string) *TestProvider
 	}
 }
 
-func (tp *TestProvider) GetEmailAddress(session *providers.SessionState) (string, error) {
-	return tp.EmailAddress, nil
+func (tp *TestProvider) GetEmailAddress(ctx context.Context, session *providers.SessionState) (string, error) {
+	return tp.EmailAddress, tp.EmailError
 }
 
-func (tp *TestProvider) ValidateSessionState(session *providers.SessionState) bool {
-	return tp.ValidToken
+func (tp *TestProvider) ValidateSessionState(session *providers.SessionState) (bool, error) {
+	return tp.ValidToken, tp.ValidateError
 }
 
 func TestBasicAuthPassword(t *testing.T) {
@@ -263,6 +475,138 @@ func TestBasicAuthPassword(t *testing.T) {
 	provider_server.Close()
 }
 
+func newCSRFCookieTest(t *testing.T) (*OAuthProxy, func()) {
+	provider_server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.CSRFCookieSecret = "csrfcsrfcsrfcsrf"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	assert.Equal(t, nil, opts.Validate())
+
+	provider_url, _ := url.Parse(provider_server.URL)
+	opts.provider = NewTestProvider(provider_url, "michael.bland@gsa.gov")
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+	return proxy, provider_server.Close
+}
+
+func TestCSRFCookieDedicatedSecret(t *testing.T) {
+	proxy, done := newCSRFCookieTest(t)
+	defer done()
+	assert.Equal(t, "csrfcsrfcsrfcsrf", proxy.CSRFCookieSeed)
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	c := proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now())
+	_, _, ok := cookie.Validate(c, "csrfcsrfcsrfcsrf", proxy.CookieExpire)
+	assert.Equal(t, true, ok)
+	req.AddCookie(c)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+}
+
+func TestOAuthCallbackNoPrimaryEmail(t *testing.T) {
+	proxy, done := newCSRFCookieTest(t)
+	defer done()
+	proxy.provider.(*TestProvider).EmailAddress = ""
+	proxy.provider.(*TestProvider).EmailError = providers.ErrNoPrimaryEmail
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+	assert.Contains(t, rw.Body.String(), "no verified email address")
+	assert.Equal(t, 0, len(rw.HeaderMap["Set-Cookie"]))
+}
+
+func TestCSRFCookieWrongSecret(t *testing.T) {
+	proxy, done := newCSRFCookieTest(t)
+	defer done()
+
+	for _, secret := range []string{proxy.CookieSeed, "wrongwrongwrong"} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+		req.AddCookie(&http.Cookie{
+			Name:  proxy.CSRFCookieName,
+			Value: cookie.SignedValue(secret, proxy.CSRFCookieName, "nonce", time.Now()),
+		})
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 403, rw.Code)
+		assert.Contains(t, rw.Body.String(), "csrf failed")
+	}
+
+	// nor is an unsigned nonce accepted
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.AddCookie(&http.Cookie{Name: proxy.CSRFCookieName, Value: "nonce"})
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+}
+
+func TestDeniedPageRetryLink(t *testing.T) {
+	provider_server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer provider_server.Close()
+
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.DeniedRetryLink = true
+	opts.Validate()
+
+	provider_url, _ := url.Parse(provider_server.URL)
+	opts.provider = NewTestProvider(provider_url, "denied@example.com")
+	proxy := NewOAuthProxy(opts, func(email string) bool { return false })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/some/destination?a=b", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 403, rw.Code)
+
+	match := regexp.MustCompile(`<a href="([^"]+)">Sign in with a different account</a>`).FindStringSubmatch(rw.Body.String())
+	if match == nil {
+		t.Fatal("Did not find retry link in body: " + rw.Body.String())
+	}
+	retryURL, err := url.Parse(html.UnescapeString(match[1]))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, proxy.OAuthStartPath, retryURL.Path)
+	assert.Equal(t, "/some/destination?a=b", retryURL.Query().Get("rd"))
+	assert.Equal(t, "login", retryURL.Query().Get("prompt"))
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", retryURL.String(), nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	loginURL, _ := url.Parse(rw.HeaderMap.Get("Location"))
+	assert.Equal(t, "login", loginURL.Query().Get("prompt"))
+	assert.Equal(t, true, strings.HasSuffix(loginURL.Query().Get("state"), ":/some/destination?a=b"))
+}
+
+func TestDeniedPageWithoutRetryLink(t *testing.T) {
+	opts := NewOptions()
+	opts.CookieSecret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.Validate()
+	proxy := NewOAuthProxy(opts, func(email string) bool { return false })
+
+	rw := httptest.NewRecorder()
+	proxy.DeniedPage(rw, "/some/destination")
+	assert.Equal(t, 403, rw.Code)
+	assert.NotContains(t, rw.Body.String(), "different account")
+	assert.Contains(t, rw.Body.String(), "/oauth2/sign_in")
+}
+
 type PassAccessTokenTest struct {
 	provider_server *httptest.Server
 	proxy           *OAuthProxy
@@ -480,6 +824,34 @@ func TestSignInPageDirectAccessRedirectsToRoot(t *testing.T) {
 	}
 }
 
+func TestSignInPageHeaders(t *testing.T) {
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	opts.PageHeaders = []string{
+		"Content-Security-Policy: default-src 'self'",
+		"X-Frame-Options: DENY",
+		"Strict-Transport-Security: max-age=31536000",
+	}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+
+	for _, endpoint := range []string{"/oauth2/sign_in", "/some/random/endpoint"} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", endpoint, nil)
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, "default-src 'self'", rw.Header().Get("Content-Security-Policy"))
+		assert.Equal(t, "DENY", rw.Header().Get("X-Frame-Options"))
+		assert.Equal(t, "max-age=31536000", rw.Header().Get("Strict-Transport-Security"))
+	}
+
+	rw := httptest.NewRecorder()
+	proxy.ErrorPage(rw, 500, "Internal Error", "Internal Error")
+	assert.Equal(t, "DENY", rw.Header().Get("X-Frame-Options"))
+}
+
 func TestSignInPageSkipProvider(t *testing.T) {
 	sip_test := NewSignInPageTest(true)
 	const endpoint = "/some/random/endpoint"
@@ -508,6 +880,57 @@ func TestSignInPageSkipProviderDirect(t *testing.T) {
 	}
 }
 
+func newAPIChallengeTestProxy() *OAuthProxy {
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.APIChallenge = true
+	opts.APIRequestHeaders = []string{"X-Requested-With"}
+	opts.Validate()
+
+	return NewOAuthProxy(opts, func(email string) bool { return true })
+}
+
+func TestAPIChallengeBrowserRequest(t *testing.T) {
+	proxy := newAPIChallengeTestProxy()
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/some/page", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/json;q=0.9,*/*;q=0.8")
+	proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, 403, rw.Code)
+	assert.Equal(t, "", rw.Header().Get("WWW-Authenticate"))
+	assert.Contains(t, rw.Body.String(), `action="/oauth2/start"`)
+
+	proxy.SkipProviderButton = true
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+}
+
+func TestAPIChallengeJSONRequest(t *testing.T) {
+	proxy := newAPIChallengeTestProxy()
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/thing", nil)
+	req.Header.Set("Accept", "application/json")
+	proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, 401, rw.Code)
+	assert.Equal(t, "Bearer", rw.Header().Get("WWW-Authenticate"))
+}
+
+func TestAPIChallengeConfiguredHeader(t *testing.T) {
+	proxy := newAPIChallengeTestProxy()
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/thing", nil)
+	req.Header.Set("X-Requested-With", "XMLHttpRequest")
+	proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, 401, rw.Code)
+	assert.Equal(t, "Bearer", rw.Header().Get("WWW-Authenticate"))
+}
+
 type ProcessCookieTest struct {
 	opts          *Options
 	proxy         *OAuthProxy
@@ -612,6 +1035,30 @@ func TestProcessCookieRefreshNotSet(t *testing.T) {
 	assert.Equal(t, startSession.Email, session.Email)
 }
 
+func TestProcessCookieNotReissuedWithinRefresh(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.CookieRefresh = time.Hour
+	reference := time.Now().Add(-30 * time.Minute)
+
+	startSession := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	pc_test.SaveSession(startSession, reference)
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	assert.Equal(t, 0, len(pc_test.rw.HeaderMap["Set-Cookie"]))
+}
+
+func TestProcessCookieReissuedAfterRefresh(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.CookieRefresh = time.Hour
+	reference := time.Now().Add(-90 * time.Minute)
+
+	startSession := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	pc_test.SaveSession(startSession, reference)
+
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+	assert.Equal(t, 1, len(pc_test.rw.HeaderMap["Set-Cookie"]))
+}
+
 func TestProcessCookieFailIfCookieExpired(t *testing.T) {
 	pc_test := NewProcessCookieTestWithDefaults()
 	pc_test.proxy.CookieExpire = time.Duration(24) * time.Hour
@@ -660,6 +1107,36 @@ func TestAuthOnlyEndpointAccepted(t *testing.T) {
 	assert.Equal(t, "", string(bodyBytes))
 }
 
+func TestAuthOnlyEndpointAcceptJSON(t *testing.T) {
+	test := NewAuthOnlyEndpointTest()
+	test.req.Header.Set("Accept", "text/html;q=0.9, application/json")
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", User: "mbland", AccessToken: "my_access_token"}
+	test.SaveSession(startSession, time.Now())
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusAccepted, test.rw.Code)
+	assert.Equal(t, "application/json", test.rw.HeaderMap.Get("Content-Type"))
+	assert.Equal(t, "michael.bland@gsa.gov", test.rw.HeaderMap.Get("GAP-Auth"))
+	var info map[string]string
+	assert.Equal(t, nil, json.NewDecoder(test.rw.Body).Decode(&info))
+	assert.Equal(t, map[string]string{"user": "mbland", "email": "michael.bland@gsa.gov"}, info)
+}
+
+func TestAuthOnlyEndpointAcceptOther(t *testing.T) {
+	test := NewAuthOnlyEndpointTest()
+	test.req.Header.Set("Accept", "text/plain")
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", User: "mbland", AccessToken: "my_access_token"}
+	test.SaveSession(startSession, time.Now())
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusAccepted, test.rw.Code)
+	assert.Equal(t, "michael.bland@gsa.gov", test.rw.HeaderMap.Get("GAP-Auth"))
+	bodyBytes, _ := ioutil.ReadAll(test.rw.Body)
+	assert.Equal(t, "", string(bodyBytes))
+}
+
 func TestAuthOnlyEndpointUnauthorizedOnNoCookieSetError(t *testing.T) {
 	test := NewAuthOnlyEndpointTest()
 
@@ -696,29 +1173,1062 @@ func TestAuthOnlyEndpointUnauthorizedOnEmailValidationFailure(t *testing.T) {
 	assert.Equal(t, "unauthorized request\n", string(bodyBytes))
 }
 
-func TestAuthOnlyEndpointSetXAuthRequestHeaders(t *testing.T) {
-	var pc_test ProcessCookieTest
+func TestRevokeSessionsTakesEffectOnNextRequest(t *testing.T) {
+	test := NewAuthOnlyEndpointTest()
+	test.proxy.revokeToken = "admin-secret"
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	test.SaveSession(startSession, time.Now().Add(-time.Minute))
 
-	pc_test.opts = NewOptions()
-	pc_test.opts.SetXAuthRequest = true
-	pc_test.opts.Validate()
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusAccepted, test.rw.Code)
 
-	pc_test.proxy = NewOAuthProxy(pc_test.opts, func(email string) bool {
-		return pc_test.validate_user
-	})
-	pc_test.proxy.provider = &TestProvider{
-		ValidToken: true,
-	}
+	// wrong token
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/oauth2/revoke",
+		strings.NewReader("email=michael.bland@gsa.gov"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer wrong")
+	test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+
+	test.rw = httptest.NewRecorder()
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusAccepted, test.rw.Code)
 
-	pc_test.validate_user = true
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/oauth2/revoke",
+		strings.NewReader("email=michael.bland@gsa.gov"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	test.rw = httptest.NewRecorder()
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusUnauthorized, test.rw.Code)
 
-	pc_test.rw = httptest.NewRecorder()
-	pc_test.req, _ = http.NewRequest("GET",
-		pc_test.opts.ProxyPrefix+"/auth", nil)
+	// a new login after revocation is accepted
+	test.req, _ = http.NewRequest("GET", "/oauth2/auth", nil)
+	test.SaveSession(startSession, time.Now().Add(2*time.Second))
+	test.rw = httptest.NewRecorder()
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusAccepted, test.rw.Code)
+}
 
-	startSession := &providers.SessionState{
-		User: "oauth_user", Email: "oauth_user@example.com", AccessToken: "oauth_token"}
-	pc_test.SaveSession(startSession, time.Now())
+func newRateLimitTest(enabled bool, provider string) *OAuthProxy {
+	opts := NewOptions()
+	opts.Provider = provider
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.CookieSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	opts.RateLimitEndpoint = enabled
+	opts.Validate()
+	return NewOAuthProxy(opts, func(email string) bool { return true })
+}
+
+// rateLimitRequest is a request for the rate_limit endpoint with a session
+func rateLimitRequest(proxy *OAuthProxy) *http.Request {
+	req, _ := http.NewRequest("GET", "/oauth2/rate_limit", nil)
+	rw := httptest.NewRecorder()
+	proxy.SaveSession(rw, req, &providers.SessionState{Email: "michael.bland@gsa.gov"})
+	for _, c := range (&http.Response{Header: rw.HeaderMap}).Cookies() {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func TestRateLimitEndpoint(t *testing.T) {
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", "42")
+		w.Header().Set("X-RateLimit-Reset", "1900000000")
+		w.WriteHeader(200)
+		w.Write([]byte(`[ {"email": "michael.bland@gsa.gov", "primary": true, "verified": true} ]`))
+	}))
+	defer b.Close()
+
+	proxy := newRateLimitTest(true, "github")
+	rw := httptest.NewRecorder()
+	req := rateLimitRequest(proxy)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "application/json", rw.HeaderMap.Get("Content-Type"))
+	assert.Equal(t, `{"provider":"GitHub","rate_limit":null}`+"\n", rw.Body.String())
+
+	proxy.provider.Data().ValidateURL, _ = url.Parse(b.URL)
+	proxy.provider.GetEmailAddress(context.Background(), &providers.SessionState{AccessToken: "my_access_token"})
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	var status struct {
+		Provider  string
+		RateLimit struct {
+			Limit     int       `json:"limit"`
+			Remaining int       `json:"remaining"`
+			Reset     time.Time `json:"reset"`
+		} `json:"rate_limit"`
+	}
+	assert.Equal(t, nil, json.Unmarshal(rw.Body.Bytes(), &status))
+	assert.Equal(t, "GitHub", status.Provider)
+	assert.Equal(t, 5000, status.RateLimit.Limit)
+	assert.Equal(t, 42, status.RateLimit.Remaining)
+	assert.Equal(t, int64(1900000000), status.RateLimit.Reset.Unix())
+}
+
+func TestRateLimitEndpointUnsupportedProvider(t *testing.T) {
+	proxy := newRateLimitTest(true, "google")
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, rateLimitRequest(proxy))
+	assert.Equal(t, 404, rw.Code)
+}
+
+func TestRateLimitEndpointUnauthenticated(t *testing.T) {
+	proxy := newRateLimitTest(true, "github")
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/rate_limit", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.NotContains(t, rw.Body.String(), "rate_limit")
+}
+
+func TestRateLimitEndpointDisabledByDefault(t *testing.T) {
+	proxy := newRateLimitTest(false, "github")
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/rate_limit", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.NotEqual(t, 200, rw.Code)
+}
+
+func TestRevokeEndpointDisabledByDefault(t *testing.T) {
+	sip_test := NewSignInPageTest(false)
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/oauth2/revoke",
+		strings.NewReader("email=michael.bland@gsa.gov"))
+	sip_test.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
+
+func TestCallbackPathDefault(t *testing.T) {
+	sip_test := NewSignInPageTest(false)
+	assert.Equal(t, "/oauth2/callback", sip_test.proxy.OAuthCallbackPath)
+	assert.Equal(t, "https://localhost/oauth2/callback",
+		sip_test.proxy.GetRedirectURI("localhost"))
+}
+
+func TestCallbackPathCustom(t *testing.T) {
+	opts := NewOptions()
+	opts.CookieSecret = "foobar"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	opts.CallbackPath = "/auth/github/callback"
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool {
+		return true
+	})
+	assert.Equal(t, "/auth/github/callback", proxy.OAuthCallbackPath)
+	assert.Equal(t, "https://localhost/auth/github/callback",
+		proxy.GetRedirectURI("localhost"))
+
+	// the redirect_uri sent to the provider matches the callback route
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start?rd=%2F", nil)
+	req.Host = "localhost"
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	loc, _ := url.Parse(rw.HeaderMap.Get("Location"))
+	assert.Equal(t, "https://localhost/auth/github/callback",
+		loc.Query().Get("redirect_uri"))
+
+	// the callback is routed by the configured path
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/auth/github/callback?error=access_denied", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Contains(t, rw.Body.String(), "access_denied")
+
+	// and no longer answered at the default path
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/callback?error=access_denied", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.NotContains(t, rw.Body.String(), "Permission Denied")
+}
+
+func newProviderErrorTest(failOpen bool, sessionAge time.Duration) *ProcessCookieTest {
+	test := NewAuthOnlyEndpointTest()
+	test.proxy.CookieRefresh = time.Hour
+	test.proxy.ProviderErrorFailOpen = failOpen
+	test.proxy.ProviderErrorGrace = time.Hour
+	test.proxy.provider = &TestProvider{
+		ValidToken:    false,
+		ValidateError: errors.New("provider unreachable"),
+	}
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	test.SaveSession(startSession, time.Now().Add(-sessionAge))
+	return test
+}
+
+func TestProviderErrorFailOpenRetainsSession(t *testing.T) {
+	test := newProviderErrorTest(true, 90*time.Minute)
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusAccepted, test.rw.Code)
+	assert.Equal(t, 0, len(test.rw.HeaderMap["Set-Cookie"]))
+}
+
+func TestProviderErrorFailOpenGraceExpired(t *testing.T) {
+	test := newProviderErrorTest(true, 150*time.Minute)
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusUnauthorized, test.rw.Code)
+}
+
+func TestProviderErrorFailClosedTerminatesSession(t *testing.T) {
+	test := newProviderErrorTest(false, 90*time.Minute)
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusUnauthorized, test.rw.Code)
+}
+
+func testUpstreamAuthError(t *testing.T, code int) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="sub-resource"`)
+		w.Header().Set("X-Upstream", "yes")
+		w.WriteHeader(code)
+		w.Write([]byte("upstream says no"))
+	}))
+	defer backend.Close()
+
+	var pc_test ProcessCookieTest
+	pc_test.opts = NewOptions()
+	pc_test.opts.Upstreams = append(pc_test.opts.Upstreams, backend.URL)
+	pc_test.opts.ClientID = "bazquux"
+	pc_test.opts.ClientSecret = "xyzzyplugh"
+	pc_test.opts.CookieSecret = "0123456789abcdefabcd"
+	pc_test.opts.EmailDomains = []string{"*"}
+	pc_test.opts.CacheControlPrivate = true
+	assert.Equal(t, nil, pc_test.opts.Validate())
+	pc_test.proxy = NewOAuthProxy(pc_test.opts, func(email string) bool { return true })
+	pc_test.proxy.provider = &TestProvider{ValidToken: true}
+
+	pc_test.rw = httptest.NewRecorder()
+	pc_test.req, _ = http.NewRequest("GET", "/protected/resource", nil)
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	pc_test.SaveSession(startSession, time.Now())
+
+	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+	assert.Equal(t, code, pc_test.rw.Code)
+	assert.Equal(t, "upstream says no", pc_test.rw.Body.String())
+	assert.Equal(t, `Basic realm="sub-resource"`, pc_test.rw.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, "yes", pc_test.rw.Header().Get("X-Upstream"))
+	// the session is left alone
+	assert.Equal(t, 0, len(pc_test.rw.HeaderMap["Set-Cookie"]))
+}
+
+func TestUpstreamForbiddenPassesThrough(t *testing.T) {
+	testUpstreamAuthError(t, http.StatusForbidden)
+}
+
+func TestUpstreamUnauthorizedPassesThrough(t *testing.T) {
+	testUpstreamAuthError(t, http.StatusUnauthorized)
+}
+
+func TestOAuthCallbackRedeemErrorDetail(t *testing.T) {
+	description := "The code passed is incorrect or expired."
+	redeem := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(url.Values{"error": {"bad_verification_code"}, "error_description": {description}}.Encode()))
+	}))
+	defer redeem.Close()
+
+	opts := NewOptions()
+	opts.Provider = "github"
+	opts.RedeemURL = redeem.URL + "/login/oauth/access_token"
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "xyzzyplugh"
+	opts.CookieSecret = "foobar"
+	opts.EmailDomains = []string{"*"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=expired_code&state=%2F", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Contains(t, rw.Body.String(), "bad_verification_code: The code passed is incorrect or expired.")
+
+	// the description is escaped
+	description = "<b>expired</b>"
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Contains(t, rw.Body.String(), "bad_verification_code: &lt;b&gt;expired&lt;/b&gt;")
+	assert.NotContains(t, rw.Body.String(), "<b>expired</b>")
+}
+
+type tokenSessionProvider struct {
+	*TestProvider
+}
+
+func (tp *tokenSessionProvider) SessionFromToken(ctx context.Context, token string) (*providers.SessionState, error) {
+	if token != "installation_token" {
+		return nil, errors.New("invalid token")
+	}
+	return &providers.SessionState{Email: "deploy-bot@example.com", User: "deploy-bot", AccessToken: token}, nil
+}
+
+func TestAuthOnlyEndpointBearerToken(t *testing.T) {
+	for _, tc := range []struct {
+		authorization string
+		validateUser  bool
+		code          int
+	}{
+		{"Bearer installation_token", true, http.StatusAccepted},
+		{"Bearer other_token", true, http.StatusUnauthorized},
+		{"Bearer installation_token", false, http.StatusUnauthorized},
+		{"token installation_token", true, http.StatusUnauthorized},
+		{"", true, http.StatusUnauthorized},
+	} {
+		test := NewAuthOnlyEndpointTest()
+		test.proxy.provider = &tokenSessionProvider{&TestProvider{ValidToken: true}}
+		test.validate_user = tc.validateUser
+		if tc.authorization != "" {
+			test.req.Header.Set("Authorization", tc.authorization)
+		}
+
+		test.proxy.ServeHTTP(test.rw, test.req)
+		assert.Equal(t, tc.code, test.rw.Code, "%q", tc.authorization)
+		if tc.code == http.StatusAccepted {
+			assert.Equal(t, "deploy-bot@example.com", test.rw.HeaderMap.Get("GAP-Auth"))
+			// the token is checked with each request, without a cookie
+			assert.Equal(t, "", test.rw.HeaderMap.Get("Set-Cookie"))
+		}
+	}
+
+	// without a provider taking bearer tokens, they are not accepted
+	test := NewAuthOnlyEndpointTest()
+	test.req.Header.Set("Authorization", "Bearer installation_token")
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusUnauthorized, test.rw.Code)
+}
+
+type slowValidateProvider struct {
+	*TestProvider
+	started chan bool
+	release chan bool
+}
+
+func (sp *slowValidateProvider) ValidateSessionState(session *providers.SessionState) (bool, error) {
+	sp.started <- true
+	<-sp.release
+	return sp.TestProvider.ValidateSessionState(session)
+}
+
+func newRevalidateAsyncTest(valid bool, sessionAge time.Duration) (*ProcessCookieTest, *slowValidateProvider) {
+	test := NewAuthOnlyEndpointTest()
+	test.proxy.CookieRefresh = time.Hour
+	test.proxy.RevalidateMaxStale = 5 * time.Minute
+	test.proxy.backgroundValidator = NewBackgroundValidator(test.proxy.RevalidateMaxStale)
+	provider := &slowValidateProvider{
+		TestProvider: &TestProvider{ValidToken: valid},
+		started:      make(chan bool, 1),
+		release:      make(chan bool),
+	}
+	test.proxy.provider = provider
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	test.SaveSession(startSession, time.Now().Add(-sessionAge))
+	return test, provider
+}
+
+func waitBackgroundResult(t *testing.T, v *BackgroundValidator) {
+	for i := 0; i < 100; i++ {
+		v.mu.Lock()
+		n := len(v.results)
+		v.mu.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("background validation did not finish")
+}
+
+func TestRevalidateAsyncServesWhileValidating(t *testing.T) {
+	test, provider := newRevalidateAsyncTest(true, 61*time.Minute)
+
+	// served immediately with the existing session
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusAccepted, test.rw.Code)
+	assert.Equal(t, 0, len(test.rw.HeaderMap["Set-Cookie"]))
+	<-provider.started
+
+	// still served while the background validation is running, without starting another
+	rw := httptest.NewRecorder()
+	test.proxy.ServeHTTP(rw, test.req)
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+	assert.Equal(t, 0, len(rw.HeaderMap["Set-Cookie"]))
+	assert.Equal(t, 0, len(provider.started))
+
+	provider.release <- true
+	waitBackgroundResult(t, test.proxy.backgroundValidator)
+
+	// the next request picks up the result and refreshes the cookie
+	rw = httptest.NewRecorder()
+	test.proxy.ServeHTTP(rw, test.req)
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+	assert.Equal(t, 1, len(rw.HeaderMap["Set-Cookie"]))
+	assert.NotEqual(t, "", rw.HeaderMap["Set-Cookie"][0])
+}
+
+func TestRevalidateAsyncInvalidRemovesSession(t *testing.T) {
+	test, provider := newRevalidateAsyncTest(false, 61*time.Minute)
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusAccepted, test.rw.Code)
+	<-provider.started
+	provider.release <- true
+	waitBackgroundResult(t, test.proxy.backgroundValidator)
+
+	rw := httptest.NewRecorder()
+	test.proxy.ServeHTTP(rw, test.req)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.NotEqual(t, 0, len(rw.HeaderMap["Set-Cookie"]))
+}
+
+func TestRevalidateAsyncTooStaleValidatesSynchronously(t *testing.T) {
+	test, provider := newRevalidateAsyncTest(false, 66*time.Minute)
+
+	go func() {
+		<-provider.started
+		provider.release <- true
+	}()
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusUnauthorized, test.rw.Code)
+}
+
+func testSessionExpiresHeader(t *testing.T, format string, expires time.Time) string {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(r.Header.Get("X-Forwarded-Session-Expires")))
+	}))
+	defer backend.Close()
+
+	var pc_test ProcessCookieTest
+	pc_test.opts = NewOptions()
+	pc_test.opts.Upstreams = append(pc_test.opts.Upstreams, backend.URL)
+	pc_test.opts.ClientID = "bazquux"
+	pc_test.opts.ClientSecret = "xyzzyplugh"
+	pc_test.opts.CookieSecret = "0123456789abcdefabcd"
+	pc_test.opts.EmailDomains = []string{"*"}
+	pc_test.opts.SessionExpiresHeader = format
+	// so that the session is stored encrypted, with its expiry
+	pc_test.opts.CookieRefresh = time.Hour
+	assert.Equal(t, nil, pc_test.opts.Validate())
+	pc_test.proxy = NewOAuthProxy(pc_test.opts, func(email string) bool { return true })
+	pc_test.proxy.provider = &TestProvider{ValidToken: true}
+
+	pc_test.rw = httptest.NewRecorder()
+	pc_test.req, _ = http.NewRequest("GET", "/", nil)
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token", ExpiresOn: expires}
+	pc_test.SaveSession(startSession, time.Now())
+
+	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+	assert.Equal(t, 200, pc_test.rw.Code)
+	return pc_test.rw.Body.String()
+}
+
+func TestSessionExpiresHeader(t *testing.T) {
+	expires := time.Unix(1900000000, 0)
+	assert.Equal(t, "1900000000", testSessionExpiresHeader(t, "epoch", expires))
+	assert.Equal(t, "2030-03-17T17:46:40Z", testSessionExpiresHeader(t, "rfc3339", expires))
+	assert.Equal(t, "", testSessionExpiresHeader(t, "", expires))
+}
+
+func testHeaderConflict(t *testing.T, mode string, spoofed http.Header) (int, string) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		for _, h := range []string{"X-Forwarded-User", "X-Forwarded-Email", "X-Forwarded-Access-Token"} {
+			w.Write([]byte(h + ": " + strings.Join(r.Header[h], ",") + "\n"))
+		}
+	}))
+	defer backend.Close()
+
+	var pc_test ProcessCookieTest
+	pc_test.opts = NewOptions()
+	pc_test.opts.Upstreams = append(pc_test.opts.Upstreams, backend.URL)
+	pc_test.opts.ClientID = "bazquux"
+	pc_test.opts.ClientSecret = "xyzzyplugh"
+	pc_test.opts.CookieSecret = "0123456789abcdefabcd"
+	pc_test.opts.EmailDomains = []string{"*"}
+	pc_test.opts.HeaderConflict = mode
+	assert.Equal(t, nil, pc_test.opts.Validate())
+	pc_test.proxy = NewOAuthProxy(pc_test.opts, func(email string) bool { return true })
+	pc_test.proxy.provider = &TestProvider{ValidToken: true}
+
+	pc_test.rw = httptest.NewRecorder()
+	pc_test.req, _ = http.NewRequest("GET", "/", nil)
+	for k, v := range spoofed {
+		pc_test.req.Header[k] = v
+	}
+	startSession := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	pc_test.SaveSession(startSession, time.Now())
+
+	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+	return pc_test.rw.Code, pc_test.rw.Body.String()
+}
+
+func TestHeaderConflictOverride(t *testing.T) {
+	spoofed := http.Header{
+		"X-Forwarded-User":         {"admin"},
+		"X-Forwarded-Email":        {"admin@example.com"},
+		"X-Forwarded-Access-Token": {"spoofed_token"},
+	}
+	for _, mode := range []string{"override", ""} {
+		code, body := testHeaderConflict(t, mode, spoofed)
+		assert.Equal(t, 200, code)
+		assert.Equal(t, "X-Forwarded-User: michael.bland\n"+
+			"X-Forwarded-Email: michael.bland@gsa.gov\n"+
+			"X-Forwarded-Access-Token: \n", body)
+	}
+}
+
+func TestHeaderConflictAppend(t *testing.T) {
+	code, body := testHeaderConflict(t, "append", http.Header{"X-Forwarded-User": {"admin"}})
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "X-Forwarded-User: michael.bland,admin\n"+
+		"X-Forwarded-Email: michael.bland@gsa.gov\n"+
+		"X-Forwarded-Access-Token: \n", body)
+}
+
+func TestHeaderConflictReject(t *testing.T) {
+	code, body := testHeaderConflict(t, "reject", http.Header{"X-Forwarded-Email": {"admin@example.com"}})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.NotContains(t, body, "X-Forwarded-Email:")
+
+	code, body = testHeaderConflict(t, "reject", nil)
+	assert.Equal(t, 200, code)
+	assert.Contains(t, body, "X-Forwarded-Email: michael.bland@gsa.gov\n")
+}
+
+func TestGroupsAndPreferredUsernameHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(strings.Join(r.Header["X-Forwarded-Groups"], "|") + " " +
+			strings.Join(r.Header["X-Forwarded-Preferred-Username"], "|")))
+	}))
+	defer backend.Close()
+
+	var pc_test ProcessCookieTest
+	pc_test.opts = NewOptions()
+	pc_test.opts.Upstreams = append(pc_test.opts.Upstreams, backend.URL)
+	pc_test.opts.ClientID = "bazquux"
+	pc_test.opts.ClientSecret = "xyzzyplugh"
+	pc_test.opts.CookieSecret = "0123456789abcdefabcd"
+	pc_test.opts.EmailDomains = []string{"*"}
+	assert.Equal(t, nil, pc_test.opts.Validate())
+	pc_test.proxy = NewOAuthProxy(pc_test.opts, func(email string) bool { return true })
+	pc_test.proxy.provider = &TestProvider{ValidToken: true}
+
+	pc_test.rw = httptest.NewRecorder()
+	pc_test.req, _ = http.NewRequest("GET", "/", nil)
+	pc_test.req.Header.Set("X-Forwarded-Groups", "spoofed/admins")
+	pc_test.req.Header.Set("X-Forwarded-Preferred-Username", "admin")
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token",
+		Groups: []string{"testorg/ops", "testorg/devs"}, PreferredUsername: "mbland"}
+	pc_test.SaveSession(startSession, time.Now())
+
+	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+	assert.Equal(t, 200, pc_test.rw.Code)
+	assert.Equal(t, "testorg/ops,testorg/devs mbland", pc_test.rw.Body.String())
+}
+
+func testIDTokenHeader(t *testing.T, header string, spoofed string) string {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(strings.Join(r.Header["X-Forwarded-Id-Token"], "|")))
+	}))
+	defer backend.Close()
+
+	var pc_test ProcessCookieTest
+	pc_test.opts = NewOptions()
+	pc_test.opts.Upstreams = append(pc_test.opts.Upstreams, backend.URL)
+	pc_test.opts.ClientID = "bazquux"
+	pc_test.opts.ClientSecret = "xyzzyplugh"
+	pc_test.opts.CookieSecret = "16 bytes AES-128"
+	pc_test.opts.EmailDomains = []string{"*"}
+	pc_test.opts.PassIDTokenHeader = header
+	assert.Equal(t, nil, pc_test.opts.Validate())
+	pc_test.proxy = NewOAuthProxy(pc_test.opts, func(email string) bool { return true })
+	pc_test.proxy.provider = &TestProvider{ValidToken: true}
+	// keep the id_token in the session cookie even without the header
+	pc_test.proxy.CookieCipher, _ = cookie.NewCipher([]byte(pc_test.opts.CookieSecret))
+
+	pc_test.rw = httptest.NewRecorder()
+	pc_test.req, _ = http.NewRequest("GET", "/", nil)
+	if spoofed != "" {
+		pc_test.req.Header.Set("X-Forwarded-Id-Token", spoofed)
+	}
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token", IDToken: "my.id.token"}
+	pc_test.SaveSession(startSession, time.Now())
+
+	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+	assert.Equal(t, 200, pc_test.rw.Code)
+	return pc_test.rw.Body.String()
+}
+
+func TestIDTokenHeader(t *testing.T) {
+	assert.Equal(t, "my.id.token", testIDTokenHeader(t, "x-forwarded-id-token", ""))
+	assert.Equal(t, "my.id.token", testIDTokenHeader(t, "X-Forwarded-Id-Token", "spoofed.id.token"))
+	assert.Equal(t, "", testIDTokenHeader(t, "", ""))
+}
+
+func TestSaveSessionTooBig(t *testing.T) {
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	pc_test := NewProcessCookieTestWithDefaults()
+	session := &providers.SessionState{Email: "michael.bland@gsa.gov",
+		AccessToken: "my_access_token", IDToken: strings.Repeat("x", 6000)}
+	assert.Equal(t, nil, pc_test.proxy.SaveSession(pc_test.rw, pc_test.req, session))
+	assert.Contains(t, logBuf.String(), "of which the id_token is 6000")
+
+	logBuf.Reset()
+	session.IDToken = "my.id.token"
+	assert.Equal(t, nil, pc_test.proxy.SaveSession(httptest.NewRecorder(), pc_test.req, session))
+	assert.Equal(t, "", logBuf.String())
+}
+
+// sessionCookieTestRequest is a request with the cookies set by rw
+func sessionCookieTestRequest(rw *httptest.ResponseRecorder) (*http.Request, []*http.Cookie) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	cookies := (&http.Response{Header: rw.HeaderMap}).Cookies()
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	return req, cookies
+}
+
+func TestSessionCookieChunked(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	proxy := pc_test.proxy
+	idToken := strings.Repeat("x", 3000)
+	session := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token", IDToken: idToken}
+	assert.Equal(t, nil, proxy.SaveSession(pc_test.rw, pc_test.req, session))
+
+	req, cookies := sessionCookieTestRequest(pc_test.rw)
+	var names []string
+	for _, c := range cookies {
+		names = append(names, c.Name)
+		assert.True(t, len(c.Value) <= maxCookieSize, c.Name)
+	}
+	assert.Equal(t, []string{proxy.CookieName + "_0", proxy.CookieName + "_1"}, names)
+
+	loaded, _, err := proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, idToken, loaded.IDToken)
+}
+
+func TestSessionCookieChunksShrink(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	proxy := pc_test.proxy
+	session := &providers.SessionState{Email: "michael.bland@gsa.gov",
+		AccessToken: "my_access_token", IDToken: strings.Repeat("x", 5000)}
+	assert.Equal(t, nil, proxy.SaveSession(pc_test.rw, pc_test.req, session))
+	req, cookies := sessionCookieTestRequest(pc_test.rw)
+	assert.Equal(t, 3, len(cookies))
+
+	// a session in 1 chunk expires the 3 chunks of the previous one
+	rw := httptest.NewRecorder()
+	session.IDToken = "my.id.token"
+	assert.Equal(t, nil, proxy.SaveSession(rw, req, session))
+	expired := make(map[string]bool)
+	for _, c := range (&http.Response{Header: rw.HeaderMap}).Cookies() {
+		expired[c.Name] = c.Expires.Before(time.Now())
+	}
+	assert.Equal(t, map[string]bool{proxy.CookieName: false, proxy.CookieName + "_0": true,
+		proxy.CookieName + "_1": true, proxy.CookieName + "_2": true}, expired)
+
+	// and signing out expires them as well
+	rw = httptest.NewRecorder()
+	proxy.ClearSessionCookie(rw, req)
+	expired = make(map[string]bool)
+	for _, c := range (&http.Response{Header: rw.HeaderMap}).Cookies() {
+		expired[c.Name] = c.Expires.Before(time.Now())
+	}
+	assert.Equal(t, true, expired[proxy.CookieName+"_1"])
+	assert.Equal(t, true, expired[proxy.CookieName+"_2"])
+}
+
+func TestSessionCookieMaxChunks(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	proxy := pc_test.proxy
+	proxy.CookieMaxChunks = 2
+	session := &providers.SessionState{Email: "michael.bland@gsa.gov",
+		AccessToken: "my_access_token", IDToken: strings.Repeat("x", 3000)}
+	assert.Equal(t, nil, proxy.SaveSession(pc_test.rw, pc_test.req, session))
+	req, _ := sessionCookieTestRequest(pc_test.rw)
+	_, _, err := proxy.LoadCookiedSession(req)
+	assert.Equal(t, nil, err)
+
+	// reassembly stops at the maximum, rather than joining any number of chunks
+	for i := 2; i < 100; i++ {
+		req.AddCookie(&http.Cookie{Name: proxy.sessionCookieChunkName(i), Value: "x"})
+	}
+	loaded, _, err := proxy.LoadCookiedSession(req)
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "session cookie has more than 2 chunks")
+	assert.Equal(t, (*providers.SessionState)(nil), loaded)
+
+	// and a session needing more chunks is not saved
+	proxy.CookieMaxChunks = 1
+	err = proxy.SaveSession(httptest.NewRecorder(), pc_test.req, session)
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "more than cookie-max-chunks (1)")
+}
+
+func testClientCertHeader(t *testing.T, state *tls.ConnectionState, spoofed string) string {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(r.Header.Get("X-Forwarded-Client-Cert")))
+	}))
+	defer backend.Close()
+
+	var pc_test ProcessCookieTest
+	pc_test.opts = NewOptions()
+	pc_test.opts.Upstreams = append(pc_test.opts.Upstreams, backend.URL)
+	pc_test.opts.ClientID = "bazquux"
+	pc_test.opts.ClientSecret = "xyzzyplugh"
+	pc_test.opts.CookieSecret = "0123456789abcdefabcd"
+	pc_test.opts.EmailDomains = []string{"*"}
+	pc_test.opts.ClientCertHeader = "X-Forwarded-Client-Cert"
+	assert.Equal(t, nil, pc_test.opts.Validate())
+	pc_test.proxy = NewOAuthProxy(pc_test.opts, func(email string) bool { return true })
+	pc_test.proxy.provider = &TestProvider{ValidToken: true}
+
+	pc_test.rw = httptest.NewRecorder()
+	pc_test.req, _ = http.NewRequest("GET", "/", nil)
+	pc_test.req.TLS = state
+	if spoofed != "" {
+		pc_test.req.Header.Set("X-Forwarded-Client-Cert", spoofed)
+	}
+	startSession := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	pc_test.SaveSession(startSession, time.Now())
+
+	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+	assert.Equal(t, 200, pc_test.rw.Code)
+	return pc_test.rw.Body.String()
+}
+
+func TestClientCertHeader(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{
+		CommonName:         "client.example.com",
+		Organization:       []string{"Example, Inc."},
+		OrganizationalUnit: []string{"Ops"},
+		Country:            []string{"US"},
+	}}
+	verified := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	assert.Equal(t, `Subject="CN=client.example.com,OU=Ops,O=Example\\, Inc.,C=US"`,
+		testClientCertHeader(t, verified, ""))
+	assert.Equal(t, `Subject="CN=client.example.com,OU=Ops,O=Example\\, Inc.,C=US"`,
+		testClientCertHeader(t, verified, `Subject="CN=admin"`))
+}
+
+func TestClientCertHeaderNoCertificate(t *testing.T) {
+	assert.Equal(t, "", testClientCertHeader(t, nil, ""))
+	assert.Equal(t, "", testClientCertHeader(t, nil, `Subject="CN=admin"`))
+	// presented but not verified against the client CAs
+	unverified := &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+		{Subject: pkix.Name{CommonName: "admin"}}}}
+	assert.Equal(t, "", testClientCertHeader(t, unverified, ""))
+}
+
+func newStepUpTest(path string, authTime time.Time) *ProcessCookieTest {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.stepUpRoutes = []stepUpRoute{
+		{regex: regexp.MustCompile("^/admin/"), maxAge: 15 * time.Minute}}
+	pc_test.req, _ = http.NewRequest("GET", path, nil)
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token", AuthTime: authTime}
+	pc_test.SaveSession(startSession, time.Now())
+	return pc_test
+}
+
+func TestStepUpRouteRecentLogin(t *testing.T) {
+	pc_test := newStepUpTest("/admin/users", time.Now().Add(-5*time.Minute))
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+}
+
+func TestStepUpRouteStaleLogin(t *testing.T) {
+	pc_test := newStepUpTest("/admin/users?page=2", time.Now().Add(-20*time.Minute))
+	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+
+	assert.Equal(t, 302, pc_test.rw.Code)
+	loc, _ := url.Parse(pc_test.rw.HeaderMap.Get("Location"))
+	assert.Equal(t, "/oauth2/start", loc.Path)
+	assert.Equal(t, "login", loc.Query().Get("prompt"))
+	assert.Equal(t, "900", loc.Query().Get("max_age"))
+	assert.Equal(t, "/admin/users?page=2", loc.Query().Get("rd"))
+}
+
+func TestStepUpRouteUnknownAuthTime(t *testing.T) {
+	// a fresh cookie, but no auth time to tell when the user logged in
+	pc_test := newStepUpTest("/admin/users", time.Time{})
+	assert.Equal(t, http.StatusUnauthorized, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+
+	pc_test = newStepUpTest("/reports", time.Time{})
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+}
+
+func TestStepUpRouteOtherPath(t *testing.T) {
+	pc_test := newStepUpTest("/reports", time.Now().Add(-20*time.Minute))
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+}
+
+func newRouteGroupTest(path string, groups []string) *ProcessCookieTest {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.routeGroups = []routeGroup{
+		{regex: regexp.MustCompile("^/admin/"), groups: []string{"testorg/admins"}},
+		{regex: regexp.MustCompile("^/"), groups: []string{"testorg/admins", "testorg/devs"}}}
+	pc_test.req, _ = http.NewRequest("GET", path, nil)
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token", Groups: groups}
+	pc_test.SaveSession(startSession, time.Now())
+	return pc_test
+}
+
+func TestRouteGroupAdminAllowed(t *testing.T) {
+	pc_test := newRouteGroupTest("/admin/users", []string{"testorg/devs", "TestOrg/Admins"})
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+}
+
+func TestRouteGroupAdminDenied(t *testing.T) {
+	pc_test := newRouteGroupTest("/admin/users", []string{"testorg/devs"})
+	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+	assert.Equal(t, 403, pc_test.rw.Code)
+	assert.Contains(t, pc_test.rw.Body.String(), "Permission Denied")
+	// the session is kept, for the routes it is allowed
+	assert.Equal(t, 0, len(pc_test.rw.HeaderMap["Set-Cookie"]))
+}
+
+func TestRouteGroupCleanPath(t *testing.T) {
+	pc_test := newRouteGroupTest("/admin/users", []string{"testorg/devs"})
+	pc_test.req.URL.Path = "//admin/users"
+	assert.Equal(t, http.StatusForbidden, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+}
+
+func TestRouteGroupAuthOnly(t *testing.T) {
+	for _, tc := range []struct {
+		originalURI string
+		groups      []string
+		code        int
+	}{
+		{"/admin/users?page=2", []string{"testorg/admins"}, http.StatusAccepted},
+		{"/admin/users?page=2", []string{"testorg/devs"}, http.StatusForbidden},
+		{"/x/../admin/", []string{"testorg/devs"}, http.StatusForbidden},
+		{"/reports", []string{"testorg/devs"}, http.StatusAccepted},
+		// route groups can't be checked without the original URI
+		{"", []string{"testorg/admins"}, http.StatusForbidden},
+	} {
+		pc_test := newRouteGroupTest("/oauth2/auth", tc.groups)
+		if tc.originalURI != "" {
+			pc_test.req.Header.Set("X-Original-URI", tc.originalURI)
+		}
+		pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+		assert.Equal(t, tc.code, pc_test.rw.Code, "%+v", tc)
+	}
+}
+
+func TestRouteGroupOtherPath(t *testing.T) {
+	pc_test := newRouteGroupTest("/reports", []string{"testorg/devs"})
+	assert.Equal(t, http.StatusAccepted, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+
+	pc_test = newRouteGroupTest("/reports", nil)
+	assert.Equal(t, http.StatusForbidden, pc_test.proxy.Authenticate(pc_test.rw, pc_test.req))
+}
+
+func TestOAuthStartMaxAge(t *testing.T) {
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.Upstreams = append(opts.Upstreams, "http://localhost/")
+	opts.EmailDomains = []string{"*"}
+	opts.Validate()
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start?prompt=login&max_age=900&rd=/admin/", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	loginURL, _ := url.Parse(rw.HeaderMap.Get("Location"))
+	assert.Equal(t, "login", loginURL.Query().Get("prompt"))
+	assert.Equal(t, "900", loginURL.Query().Get("max_age"))
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/start?prompt=login&max_age=soon", nil)
+	proxy.ServeHTTP(rw, req)
+	loginURL, _ = url.Parse(rw.HeaderMap.Get("Location"))
+	assert.Equal(t, "", loginURL.Query().Get("max_age"))
+}
+
+func TestUserInfoCookie(t *testing.T) {
+	pc_test := NewProcessCookieTestWithDefaults()
+	pc_test.proxy.UserInfoCookieName = "_user_info"
+	pc_test.proxy.UserInfoSigningKey = "0123456789abcdef0123456789abcdef"
+	pc_test.proxy.CookieHttpOnly = true
+
+	rw := httptest.NewRecorder()
+	session := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", User: "mbland",
+		Groups:      []string{"testorg/devs", "testorg/ops"},
+		AvatarURL:   "https://avatars.githubusercontent.com/u/123?v=4",
+		AccessToken: "my_access_token", RefreshToken: "my_refresh_token", IDToken: "my.id.token"}
+	assert.Equal(t, nil, pc_test.proxy.SaveSession(rw, pc_test.req, session))
+
+	var c *http.Cookie
+	for _, rc := range (&http.Response{Header: rw.HeaderMap}).Cookies() {
+		if rc.Name == "_user_info" {
+			c = rc
+		}
+	}
+	if c == nil {
+		t.Fatal("user info cookie not set")
+	}
+	assert.Equal(t, false, c.HttpOnly)
+
+	parts := strings.Split(c.Value, ".")
+	assert.Equal(t, 3, len(parts))
+	mac := hmac.New(sha256.New, []byte("0123456789abcdef0123456789abcdef"))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), parts[2])
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	assert.Equal(t, nil, err)
+	var claims map[string]interface{}
+	assert.Equal(t, nil, json.Unmarshal(payload, &claims))
+	assert.Equal(t, "michael.bland@gsa.gov", claims["email"])
+	assert.Equal(t, "mbland", claims["user"])
+	assert.Equal(t, []interface{}{"testorg/devs", "testorg/ops"}, claims["groups"])
+	assert.Equal(t, "https://avatars.githubusercontent.com/u/123?v=4", claims["avatar_url"])
+	assert.NotEqual(t, nil, claims["exp"])
+	assert.NotContains(t, string(payload), "my_access_token")
+	assert.NotContains(t, string(payload), "my_refresh_token")
+	assert.NotContains(t, string(payload), "my.id.token")
+
+	rw = httptest.NewRecorder()
+	pc_test.proxy.ClearSessionCookie(rw, pc_test.req)
+	cleared := false
+	for _, rc := range (&http.Response{Header: rw.HeaderMap}).Cookies() {
+		if rc.Name == "_user_info" && rc.Value == "" {
+			cleared = true
+		}
+	}
+	assert.Equal(t, true, cleared)
+}
+
+func TestWarmUp(t *testing.T) {
+	opts := NewOptions()
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.Upstreams = append(opts.Upstreams, "http://localhost/")
+	opts.EmailDomains = []string{"*"}
+	assert.Equal(t, nil, opts.Validate())
+	proxy := NewOAuthProxy(opts, func(email string) bool { return true })
+	assert.Equal(t, nil, proxy.WarmUp())
+
+	proxy.provider.Data().ClientID = ""
+	err := proxy.WarmUp()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "has no client_id")
+
+	proxy.provider.Data().ClientID = "bazquux"
+	proxy.provider.Data().LoginURL = &url.URL{Path: "/authorize"}
+	err = proxy.WarmUp()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "expected an absolute url")
+}
+
+func newSignOutTest(logoutURL string) *ProcessCookieTest {
+	pc_test := NewProcessCookieTestWithDefaults()
+	provider := NewTestProvider(&url.URL{Host: "localhost"}, "michael.bland@gsa.gov")
+	provider.ClientID = "bazquux"
+	provider.LogoutURL, _ = url.Parse(logoutURL)
+	pc_test.proxy.provider = provider
+	pc_test.req, _ = http.NewRequest("GET", "/oauth2/sign_out", nil)
+	pc_test.req.Host = "app.example.com"
+	startSession := &providers.SessionState{
+		Email: "michael.bland@gsa.gov", AccessToken: "my_access_token", IDToken: "my.id.token"}
+	pc_test.SaveSession(startSession, time.Now())
+	return pc_test
+}
+
+func TestSignOutRedirectsToProviderLogout(t *testing.T) {
+	pc_test := newSignOutTest("https://provider.example.com/logout")
+	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+
+	assert.Equal(t, 302, pc_test.rw.Code)
+	assert.NotEqual(t, 0, len(pc_test.rw.HeaderMap["Set-Cookie"]))
+	loc, _ := url.Parse(pc_test.rw.HeaderMap.Get("Location"))
+	assert.Equal(t, "provider.example.com", loc.Host)
+	assert.Equal(t, "/logout", loc.Path)
+	assert.Equal(t, "my.id.token", loc.Query().Get("id_token_hint"))
+	assert.Equal(t, "bazquux", loc.Query().Get("client_id"))
+	assert.Equal(t, "https://app.example.com/", loc.Query().Get("post_logout_redirect_uri"))
+}
+
+func TestSignOutPostLogoutRedirectURL(t *testing.T) {
+	pc_test := newSignOutTest("https://provider.example.com/logout")
+	pc_test.proxy.PostLogoutRedirectURL = "https://www.example.com/goodbye"
+	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+
+	assert.Equal(t, 302, pc_test.rw.Code)
+	loc, _ := url.Parse(pc_test.rw.HeaderMap.Get("Location"))
+	assert.Equal(t, "https://www.example.com/goodbye", loc.Query().Get("post_logout_redirect_uri"))
+}
+
+func TestSignOutWithoutProviderLogout(t *testing.T) {
+	pc_test := newSignOutTest("")
+	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+
+	assert.Equal(t, 302, pc_test.rw.Code)
+	assert.Equal(t, "/", pc_test.rw.HeaderMap.Get("Location"))
+}
+
+func TestAuthOnlyEndpointSetXAuthRequestHeaders(t *testing.T) {
+	var pc_test ProcessCookieTest
+
+	pc_test.opts = NewOptions()
+	pc_test.opts.SetXAuthRequest = true
+	pc_test.opts.Validate()
+
+	pc_test.proxy = NewOAuthProxy(pc_test.opts, func(email string) bool {
+		return pc_test.validate_user
+	})
+	pc_test.proxy.provider = &TestProvider{
+		ValidToken: true,
+	}
+
+	pc_test.validate_user = true
+
+	pc_test.rw = httptest.NewRecorder()
+	pc_test.req, _ = http.NewRequest("GET",
+		pc_test.opts.ProxyPrefix+"/auth", nil)
+
+	startSession := &providers.SessionState{
+		User: "oauth_user", Email: "oauth_user@example.com", AccessToken: "oauth_token"}
+	pc_test.SaveSession(startSession, time.Now())
 
 	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
 	assert.Equal(t, http.StatusAccepted, pc_test.rw.Code)
@@ -726,6 +2236,38 @@ func TestAuthOnlyEndpointSetXAuthRequestHeaders(t *testing.T) {
 	assert.Equal(t, "oauth_user@example.com", pc_test.rw.HeaderMap["X-Auth-Request-Email"][0])
 }
 
+func TestAuthOnlyEndpointSetXAuthRequestUserFromEmail(t *testing.T) {
+	var pc_test ProcessCookieTest
+
+	pc_test.opts = NewOptions()
+	pc_test.opts.SetXAuthRequest = true
+	pc_test.opts.UserFromEmail = "strip-domain"
+	pc_test.opts.Validate()
+
+	pc_test.proxy = NewOAuthProxy(pc_test.opts, func(email string) bool {
+		return pc_test.validate_user
+	})
+	pc_test.proxy.provider = &TestProvider{
+		ValidToken: true,
+	}
+
+	pc_test.validate_user = true
+
+	pc_test.rw = httptest.NewRecorder()
+	pc_test.req, _ = http.NewRequest("GET",
+		pc_test.opts.ProxyPrefix+"/auth", nil)
+
+	startSession := &providers.SessionState{
+		User: "oauth_user", Email: "email_user@example.com", AccessToken: "oauth_token"}
+	pc_test.SaveSession(startSession, time.Now())
+
+	pc_test.proxy.ServeHTTP(pc_test.rw, pc_test.req)
+	assert.Equal(t, http.StatusAccepted, pc_test.rw.Code)
+	assert.Equal(t, "email_user", pc_test.rw.HeaderMap["X-Auth-Request-User"][0])
+	assert.Equal(t, "email_user@example.com", pc_test.rw.HeaderMap["X-Auth-Request-Email"][0])
+	assert.Equal(t, []string{"email_user"}, pc_test.req.Header["X-Forwarded-User"])
+}
+
 func TestAuthSkippedForPreflightRequests(t *testing.T) {
 	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(200)
@@ -753,6 +2295,196 @@ func TestAuthSkippedForPreflightRequests(t *testing.T) {
 	assert.Equal(t, "response", rw.Body.String())
 }
 
+func newTrustedClientTest(t *testing.T) (*OAuthProxy, func()) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte("response"))
+	}))
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, upstream.URL)
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	opts.SkipAuthCIDRs = []string{"10.1.2.0/24", "fd00::1"}
+	opts.TrustedProxies = []string{"127.0.0.1"}
+	assert.Equal(t, nil, opts.Validate())
+
+	upstream_url, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(upstream_url, "")
+	return NewOAuthProxy(opts, func(string) bool { return true }), upstream.Close
+}
+
+func TestTrustedClientBypassesAuth(t *testing.T) {
+	proxy, done := newTrustedClientTest(t)
+	defer done()
+
+	for _, tc := range []struct {
+		remoteAddr, realIP, forwardedFor string
+	}{
+		{"10.1.2.3:4567", "", ""},
+		{"[fd00::1]:4567", "", ""},
+		{"127.0.0.1:4567", "", "192.168.0.1, 10.1.2.3"},
+		{"127.0.0.1:4567", "", "10.1.2.3, 127.0.0.1"},
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/metrics", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.realIP != "" {
+			req.Header.Set("X-Real-IP", tc.realIP)
+		}
+		if tc.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 200, rw.Code, "%+v", tc)
+		assert.Equal(t, "response", rw.Body.String())
+	}
+}
+
+func TestUntrustedClientRequiresAuth(t *testing.T) {
+	proxy, done := newTrustedClientTest(t)
+	defer done()
+
+	for _, tc := range []struct {
+		remoteAddr, realIP, forwardedFor string
+	}{
+		{"10.1.3.1:4567", "", ""},
+		{"[fd00::2]:4567", "", ""},
+		// only trusted from a trusted-proxy
+		{"192.168.0.1:4567", "10.1.2.3", ""},
+		{"192.168.0.1:4567", "", "10.1.2.3"},
+		{"127.0.0.1:4567", "", "10.1.2.3, 192.168.0.1"},
+		{"127.0.0.1:4567", "", ""},
+		// X-Real-IP is never trusted, the client may have set it
+		{"127.0.0.1:4567", "10.1.2.3", ""},
+		{"127.0.0.1:4567", "10.1.2.3", "192.168.0.1"},
+	} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/metrics", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.realIP != "" {
+			req.Header.Set("X-Real-IP", tc.realIP)
+		}
+		if tc.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, 403, rw.Code, "%+v", tc)
+		assert.NotEqual(t, "response", rw.Body.String())
+	}
+}
+
+func TestTrustedClientOAuthEndpoints(t *testing.T) {
+	proxy, done := newTrustedClientTest(t)
+	defer done()
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/auth", nil)
+	req.RemoteAddr = "10.1.2.3:4567"
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+}
+
+func newCORSPreflightTest(origins ...string) *OAuthProxy {
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, "http://localhost/")
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	opts.CORSAllowedOrigins = append([]string{"https://app.example.com"}, origins...)
+	opts.Validate()
+	opts.provider = NewTestProvider(&url.URL{Host: "localhost"}, "")
+	return NewOAuthProxy(opts, func(string) bool { return true })
+}
+
+func TestCORSPreflightAllowedOrigin(t *testing.T) {
+	proxy := newCORSPreflightTest()
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("OPTIONS", "/api/items", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	req.Header.Set("Access-Control-Request-Headers", "Content-Type")
+	proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusNoContent, rw.Code)
+	assert.Equal(t, "https://app.example.com", rw.HeaderMap.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rw.HeaderMap.Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "PUT", rw.HeaderMap.Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Content-Type", rw.HeaderMap.Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "Origin", rw.HeaderMap.Get("Vary"))
+}
+
+func TestCORSPreflightOtherOrigin(t *testing.T) {
+	proxy := newCORSPreflightTest()
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("OPTIONS", "/api/items", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Equal(t, "", rw.HeaderMap.Get("Access-Control-Allow-Origin"))
+}
+
+func TestCORSPreflightAnyOrigin(t *testing.T) {
+	proxy := newCORSPreflightTest("*")
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("OPTIONS", "/api/items", nil)
+	req.Header.Set("Origin", "https://other.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	proxy.ServeHTTP(rw, req)
+
+	assert.Equal(t, http.StatusNoContent, rw.Code)
+	assert.Equal(t, "*", rw.HeaderMap.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "", rw.HeaderMap.Get("Access-Control-Allow-Credentials"))
+
+	// a listed origin still may send credentials
+	rw = httptest.NewRecorder()
+	req.Header.Set("Origin", "https://app.example.com")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, "https://app.example.com", rw.HeaderMap.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rw.HeaderMap.Get("Access-Control-Allow-Credentials"))
+}
+
+func TestHeadRequestAuthenticatedLikeGet(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream-Method", r.Method)
+		w.WriteHeader(200)
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.Upstreams = append(opts.Upstreams, upstream.URL)
+	opts.ClientID = "bazquux"
+	opts.ClientSecret = "foobar"
+	opts.CookieSecret = "xyzzyplugh"
+	opts.EmailDomains = []string{"*"}
+	opts.Validate()
+	upstream_url, _ := url.Parse(upstream.URL)
+	opts.provider = NewTestProvider(upstream_url, "")
+	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+
+	session := &providers.SessionState{Email: "michael.bland@gsa.gov"}
+	value, err := proxy.provider.CookieForSession(session, proxy.CookieCipher)
+	assert.Equal(t, nil, err)
+
+	for _, method := range []string{"GET", "HEAD"} {
+		rw := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/", nil)
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusForbidden, rw.Code, method)
+
+		rw = httptest.NewRecorder()
+		req.AddCookie(proxy.MakeSessionCookie(req, value, proxy.CookieExpire, time.Now()))
+		proxy.ServeHTTP(rw, req)
+		assert.Equal(t, http.StatusOK, rw.Code, method)
+		assert.Equal(t, method, rw.HeaderMap.Get("X-Upstream-Method"))
+	}
+}
+
 type SignatureAuthenticator struct {
 	auth hmacauth.HmacAuth
 }
@@ -888,3 +2620,143 @@ func TestRequestSignaturePostRequest(t *testing.T) {
 	assert.Equal(t, 200, st.rw.Code)
 	assert.Equal(t, st.rw.Body.String(), "signatures match")
 }
+
+func TestEmailDomainAliasRewritten(t *testing.T) {
+	proxy, done := newCSRFCookieTest(t)
+	defer done()
+	proxy.emailAliases = map[string]string{"gsa.gov": "example.gov"}
+	var validated string
+	proxy.Validator = func(email string) bool {
+		validated = email
+		return true
+	}
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "michael.bland@example.gov", validated)
+}
+
+func TestEmailDomainAliasPassthrough(t *testing.T) {
+	proxy, done := newCSRFCookieTest(t)
+	defer done()
+	proxy.emailAliases = map[string]string{"corp-mail.example": "example.com"}
+	var validated string
+	proxy.Validator = func(email string) bool {
+		validated = email
+		return true
+	}
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	assert.Equal(t, "michael.bland@gsa.gov", validated)
+}
+
+func TestCanonicalEmail(t *testing.T) {
+	p := &OAuthProxy{emailAliases: map[string]string{"corp-mail.example": "example.com"}}
+	assert.Equal(t, "jdoe@example.com", p.canonicalEmail("jdoe@Corp-Mail.example"))
+	assert.Equal(t, "jdoe@example.org", p.canonicalEmail("jdoe@example.org"))
+	assert.Equal(t, "jdoe@mail.corp-mail.example", p.canonicalEmail("jdoe@mail.corp-mail.example"))
+	assert.Equal(t, "", p.canonicalEmail(""))
+	assert.Equal(t, "jdoe@corp-mail.example", (&OAuthProxy{}).canonicalEmail("jdoe@corp-mail.example"))
+}
+
+func rememberMeSignIn(t *testing.T, proxy *OAuthProxy, form url.Values) map[string]*http.Cookie {
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/oauth2/sign_in", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	cookies := make(map[string]*http.Cookie)
+	for _, c := range (&http.Response{Header: rw.HeaderMap}).Cookies() {
+		cookies[c.Name] = c
+	}
+	return cookies
+}
+
+func TestRememberMeSignIn(t *testing.T) {
+	proxy, done := newCSRFCookieTest(t)
+	defer done()
+	proxy.RememberMe = true
+	proxy.HtpasswdFile, _ = NewHtpasswd(strings.NewReader("testuser:{SHA}PaVBVZkYqAjCQCu6UBL2xgsnZhw=\n"))
+
+	// checked: a persistent cookie
+	cookies := rememberMeSignIn(t, proxy, url.Values{
+		"username": {"testuser"}, "password": {"asdf"}, "remember_me": {"0", "1"}})
+	assert.NotEqual(t, "", cookies[proxy.CookieName].Value)
+	assert.Equal(t, false, cookies[proxy.CookieName].Expires.IsZero())
+	assert.Equal(t, true, cookies[proxy.CookieName].Expires.After(time.Now()))
+
+	// unchecked: a session cookie
+	cookies = rememberMeSignIn(t, proxy, url.Values{
+		"username": {"testuser"}, "password": {"asdf"}, "remember_me": {"0"}})
+	assert.NotEqual(t, "", cookies[proxy.CookieName].Value)
+	assert.Equal(t, true, cookies[proxy.CookieName].Expires.IsZero())
+	assert.Equal(t, "1", cookies[proxy.sessionOnlyCookieName()].Value)
+	assert.Equal(t, true, cookies[proxy.sessionOnlyCookieName()].Expires.IsZero())
+}
+
+func TestRememberMeOAuth(t *testing.T) {
+	proxy, done := newCSRFCookieTest(t)
+	defer done()
+	proxy.RememberMe = true
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/start?rd=%2F&remember_me=0", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	var sessionOnly *http.Cookie
+	for _, c := range (&http.Response{Header: rw.HeaderMap}).Cookies() {
+		if c.Name == proxy.sessionOnlyCookieName() {
+			sessionOnly = c
+		}
+	}
+	if sessionOnly == nil {
+		t.Fatal("session-only choice not remembered")
+	}
+
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	req.AddCookie(sessionOnly)
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	for _, c := range (&http.Response{Header: rw.HeaderMap}).Cookies() {
+		if c.Name == proxy.CookieName {
+			assert.NotEqual(t, "", c.Value)
+			assert.Equal(t, true, c.Expires.IsZero())
+		}
+	}
+
+	// without the session-only cookie the session cookie is persistent
+	rw = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, 302, rw.Code)
+	for _, c := range (&http.Response{Header: rw.HeaderMap}).Cookies() {
+		if c.Name == proxy.CookieName {
+			assert.Equal(t, false, c.Expires.IsZero())
+		}
+	}
+}
+
+func TestRememberMeCheckbox(t *testing.T) {
+	proxy, done := newCSRFCookieTest(t)
+	defer done()
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/sign_in", nil)
+	proxy.ServeHTTP(rw, req)
+	assert.NotContains(t, rw.Body.String(), "remember_me")
+
+	proxy.RememberMe = true
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Contains(t, rw.Body.String(), `<input type="checkbox" name="remember_me" value="1" checked>`)
+}
@@ -5,6 +5,8 @@ import (
 	"crypto/tls"
 	"encoding/base64"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -13,6 +15,7 @@ import (
 	"time"
 
 	"github.com/mbland/hmacauth"
+	"github.com/ploxiln/oauth2_proxy/cookie"
 	"github.com/ploxiln/oauth2_proxy/providers"
 )
 
@@ -27,13 +30,32 @@ type Options struct {
 	TLSCertFile  string `flag:"tls-cert" cfg:"tls_cert_file"`
 	TLSKeyFile   string `flag:"tls-key" cfg:"tls_key_file"`
 
+	TLSClientCAFile  string `flag:"tls-client-ca" cfg:"tls_client_ca_file"`
+	ClientCertHeader string `flag:"client-cert-header" cfg:"client_cert_header"`
+
 	AuthenticatedEmailsFile  string   `flag:"authenticated-emails-file" cfg:"authenticated_emails_file"`
+	BlocklistFile            string   `flag:"blocklist-file" cfg:"blocklist_file"`
 	AzureTenant              string   `flag:"azure-tenant" cfg:"azure_tenant"`
 	EmailDomains             []string `flag:"email-domain" cfg:"email_domains"`
+	EmailDomainAliases       []string `flag:"email-domain-alias" cfg:"email_domain_aliases"`
 	WhitelistDomains         []string `flag:"whitelist-domain" cfg:"whitelist_domains" env:"OAUTH2_PROXY_WHITELIST_DOMAINS"`
+	GitHubBaseURL            string   `flag:"github-base-url" cfg:"github_base_url"`
+	GitHubHostMismatch       string   `flag:"github-host-mismatch" cfg:"github_host_mismatch"`
 	GitHubOrg                string   `flag:"github-org" cfg:"github_org"`
 	GitHubTeam               string   `flag:"github-team" cfg:"github_team"`
+	GitHubEnterprise         string   `flag:"github-enterprise" cfg:"github_enterprise"`
+	GitHubRepo               string   `flag:"github-repo" cfg:"github_repo"`
+	GitHubSAMLIdentity       bool     `flag:"github-saml-identity" cfg:"github_saml_identity"`
+	GitHubSAMLToken          string   `flag:"github-saml-token" cfg:"github_saml_token" env:"OAUTH2_PROXY_GITHUB_SAML_TOKEN"`
+	GitHubEmailSources       string   `flag:"github-email-sources" cfg:"github_email_sources"`
+	GitHubVerifiedDomain     bool     `flag:"github-verified-domain" cfg:"github_verified_domain"`
+	GitHubUnverifiedEmail    bool     `flag:"github-unverified-email" cfg:"github_unverified_email"`
+	GitHubEmailAsUsername    bool     `flag:"github-email-as-username" cfg:"github_email_as_username"`
+	GitHubMissingLogin       string   `flag:"github-missing-login" cfg:"github_missing_login"`
+	GitHubFineGrainedToken   string   `flag:"github-fine-grained-token" cfg:"github_fine_grained_token"`
+	GitHubAppIdentity        string   `flag:"github-app-identity" cfg:"github_app_identity"`
 	GitLabGroups             []string `flag:"gitlab-group" cfg:"gitlab_groups"`
+	BitbucketTeam            string   `flag:"bitbucket-team" cfg:"bitbucket_team"`
 	GoogleGroups             []string `flag:"google-group" cfg:"google_group"`
 	GoogleAdminEmail         string   `flag:"google-admin-email" cfg:"google_admin_email"`
 	GoogleServiceAccountJSON string   `flag:"google-service-account-json" cfg:"google_service_account_json"`
@@ -41,6 +63,7 @@ type Options struct {
 	DisplayHtpasswdForm      bool     `flag:"display-htpasswd-form" cfg:"display_htpasswd_form"`
 	CustomTemplatesDir       string   `flag:"custom-templates-dir" cfg:"custom_templates_dir"`
 	Footer                   string   `flag:"footer" cfg:"footer"`
+	PageHeaders              []string `flag:"page-header" cfg:"page_headers"`
 
 	CookieName     string        `flag:"cookie-name" cfg:"cookie_name" env:"OAUTH2_PROXY_COOKIE_NAME"`
 	CookieSecret   string        `flag:"cookie-secret" cfg:"cookie_secret" env:"OAUTH2_PROXY_COOKIE_SECRET"`
@@ -50,20 +73,45 @@ type Options struct {
 	CookieSecure   bool          `flag:"cookie-secure" cfg:"cookie_secure"`
 	CookieHttpOnly bool          `flag:"cookie-httponly" cfg:"cookie_httponly"`
 
+	CookieSecretDerive bool `flag:"cookie-secret-derive" cfg:"cookie_secret_derive"`
+	CookieMaxChunks    int  `flag:"cookie-max-chunks" cfg:"cookie_max_chunks"`
+
+	SessionFingerprint string `flag:"session-fingerprint" cfg:"session_fingerprint"`
+
+	CSRFCookieSecret string `flag:"csrf-cookie-secret" cfg:"csrf_cookie_secret" env:"OAUTH2_PROXY_CSRF_COOKIE_SECRET"`
+
+	UserInfoCookie     string `flag:"user-info-cookie" cfg:"user_info_cookie"`
+	UserInfoSigningKey string `flag:"user-info-signing-key" cfg:"user_info_signing_key" env:"OAUTH2_PROXY_USER_INFO_SIGNING_KEY"`
+	RememberMe         bool   `flag:"remember-me" cfg:"remember_me"`
+
 	Upstreams             []string `flag:"upstream" cfg:"upstreams"`
 	SkipAuthRegex         []string `flag:"skip-auth-regex" cfg:"skip_auth_regex"`
+	SkipAuthCIDRs         []string `flag:"skip-auth-cidr" cfg:"skip_auth_cidrs"`
+	TrustedProxies        []string `flag:"trusted-proxy" cfg:"trusted_proxies"`
 	PassBasicAuth         bool     `flag:"pass-basic-auth" cfg:"pass_basic_auth"`
 	BasicAuthPassword     string   `flag:"basic-auth-password" cfg:"basic_auth_password"`
 	PassAccessToken       bool     `flag:"pass-access-token" cfg:"pass_access_token"`
+	PassIDTokenHeader     string   `flag:"pass-id-token-header" cfg:"pass_id_token_header"`
 	PassHostHeader        bool     `flag:"pass-host-header" cfg:"pass_host_header"`
+	NormalizeUpstreamPath bool     `flag:"normalize-upstream-path" cfg:"normalize_upstream_path"`
 	SkipProviderButton    bool     `flag:"skip-provider-button" cfg:"skip_provider_button"`
+	DeniedRetryLink       bool     `flag:"denied-retry-link" cfg:"denied_retry_link"`
+	APIChallenge          bool     `flag:"api-challenge" cfg:"api_challenge"`
+	APIRequestHeaders     []string `flag:"api-request-header" cfg:"api_request_headers"`
 	PassUserHeaders       bool     `flag:"pass-user-headers" cfg:"pass_user_headers"`
+	UserFromEmail         string   `flag:"user-from-email" cfg:"user_from_email"`
+	SessionExpiresHeader  string   `flag:"session-expires-header" cfg:"session_expires_header"`
+	HeaderConflict        string   `flag:"header-conflict" cfg:"header_conflict"`
 	SSLInsecureSkipVerify bool     `flag:"ssl-insecure-skip-verify" cfg:"ssl_insecure_skip_verify"`
 	SetXAuthRequest       bool     `flag:"set-xauthrequest" cfg:"set_xauthrequest"`
 	SkipAuthPreflight     bool     `flag:"skip-auth-preflight" cfg:"skip_auth_preflight"`
+	CORSAllowedOrigins    []string `flag:"cors-allowed-origin" cfg:"cors_allowed_origins"`
+	CacheControlPrivate   bool     `flag:"cache-control-private" cfg:"cache_control_private"`
 
 	FlushInterval time.Duration `flag:"flush-interval" cfg:"flush_interval"`
 
+	UpstreamTokenAudiences []string `flag:"upstream-token-audience" cfg:"upstream_token_audiences"`
+
 	// These options allow for other providers besides Google, with
 	// potential overrides.
 	Provider          string `flag:"provider" cfg:"provider"`
@@ -73,13 +121,49 @@ type Options struct {
 	ProfileURL        string `flag:"profile-url" cfg:"profile_url"`
 	ProtectedResource string `flag:"resource" cfg:"resource"`
 	ValidateURL       string `flag:"validate-url" cfg:"validate_url"`
+	LogoutURL         string `flag:"logout-url" cfg:"logout_url"`
 	Scope             string `flag:"scope" cfg:"scope"`
 	ApprovalPrompt    string `flag:"approval-prompt" cfg:"approval_prompt"`
 
+	OIDCRequiredClaims []string      `flag:"oidc-required-claim" cfg:"oidc_required_claims"`
+	OIDCJWKSCacheTTL   time.Duration `flag:"oidc-jwks-cache-ttl" cfg:"oidc_jwks_cache_ttl"`
+	OIDCJWKSMinRefetch time.Duration `flag:"oidc-jwks-min-refetch" cfg:"oidc_jwks_min_refetch"`
+
+	CallbackPath             string        `flag:"callback-path" cfg:"callback_path"`
+	PostLogoutRedirectURL    string        `flag:"post-logout-redirect-url" cfg:"post_logout_redirect_url"`
+	ProviderCallBudget       int           `flag:"provider-call-budget" cfg:"provider_call_budget"`
+	ProviderMaxBodySize      int64         `flag:"provider-max-body-size" cfg:"provider_max_body_size"`
+	ProviderVerbose          bool          `flag:"provider-verbose" cfg:"provider_verbose"`
+	GitHubMembershipCacheTTL time.Duration `flag:"github-membership-cache-ttl" cfg:"github_membership_cache_ttl"`
+	GitHubMembershipRetry    time.Duration `flag:"github-membership-retry" cfg:"github_membership_retry"`
+	GitHubTimeout            time.Duration `flag:"github-timeout" cfg:"github_timeout"`
+	GitHubMaxPages           int           `flag:"github-max-pages" cfg:"github_max_pages"`
+	GitHubMaxTeams           int           `flag:"github-max-teams" cfg:"github_max_teams"`
+	GitHubRateLimitMaxWait   time.Duration `flag:"github-rate-limit-max-wait" cfg:"github_rate_limit_max_wait"`
+	GitHubAbuseBackoffMax    time.Duration `flag:"github-abuse-backoff-max" cfg:"github_abuse_backoff_max"`
+	GitHubCoalesceRequests   bool          `flag:"github-coalesce-requests" cfg:"github_coalesce_requests"`
+	ProviderErrorPolicy      string        `flag:"provider-error-policy" cfg:"provider_error_policy"`
+	ProviderErrorGrace       time.Duration `flag:"provider-error-grace" cfg:"provider_error_grace"`
+	ProviderWarmUp           string        `flag:"provider-warm-up" cfg:"provider_warm_up"`
+	RevalidateAsync          bool          `flag:"revalidate-async" cfg:"revalidate_async"`
+	RevalidateMaxStale       time.Duration `flag:"revalidate-max-stale" cfg:"revalidate_max_stale"`
+	RevalidateMinInterval    time.Duration `flag:"revalidate-min-interval" cfg:"revalidate_min_interval"`
+	RevalidateFullRate       int           `flag:"revalidate-full-rate" cfg:"revalidate_full_rate"`
+
 	RequestLogging       bool   `flag:"request-logging" cfg:"request_logging"`
 	RequestLoggingFormat string `flag:"request-logging-format" cfg:"request_logging_format"`
+	DisableLogging       bool   `flag:"disable-logging" cfg:"disable_logging"`
+	RequestLog           string `flag:"request-log" cfg:"request_log"`
+	AppLog               string `flag:"app-log" cfg:"app_log"`
+	LoginEventLog        string `flag:"login-event-log" cfg:"login_event_log"`
 
 	SignatureKey string `flag:"signature-key" cfg:"signature_key" env:"OAUTH2_PROXY_SIGNATURE_KEY"`
+	RevokeToken  string `flag:"revoke-token" cfg:"revoke_token" env:"OAUTH2_PROXY_REVOKE_TOKEN"`
+
+	RateLimitEndpoint bool `flag:"rate-limit-endpoint" cfg:"rate_limit_endpoint"`
+
+	StepUpRoutes []string `flag:"step-up-route" cfg:"step_up_routes"`
+	RouteGroups  []string `flag:"route-group" cfg:"route_groups"`
 
 	// internal values that are set after config validation
 	redirectURL   *url.URL
@@ -87,6 +171,28 @@ type Options struct {
 	CompiledRegex []*regexp.Regexp
 	provider      providers.Provider
 	signatureData *SignatureData
+	emailToUser   func(string) string
+	emailAliases  map[string]string
+	audiences     map[string]string
+	skipAuthNets  []*net.IPNet
+	trustedNets   []*net.IPNet
+	pageHeaders   http.Header
+	stepUpRoutes  []stepUpRoute
+	routeGroups   []routeGroup
+}
+
+// stepUpRoute requires that requests for paths matching regex were
+// authenticated within maxAge
+type stepUpRoute struct {
+	regex  *regexp.Regexp
+	maxAge time.Duration
+}
+
+// routeGroup requires that the session of requests for paths matching regex
+// is in one of groups
+type routeGroup struct {
+	regex  *regexp.Regexp
+	groups []string
 }
 
 type SignatureData struct {
@@ -96,24 +202,39 @@ type SignatureData struct {
 
 func NewOptions() *Options {
 	return &Options{
-		ProxyPrefix:          "/oauth2",
-		HttpAddress:          "127.0.0.1:4180",
-		HttpsAddress:         ":443",
-		DisplayHtpasswdForm:  true,
-		CookieName:           "_oauth2_proxy",
-		CookieSecure:         true,
-		CookieHttpOnly:       true,
-		CookieExpire:         time.Duration(168) * time.Hour,
-		CookieRefresh:        time.Duration(0),
-		SetXAuthRequest:      false,
-		SkipAuthPreflight:    false,
-		PassBasicAuth:        true,
-		PassUserHeaders:      true,
-		PassAccessToken:      false,
-		PassHostHeader:       true,
-		ApprovalPrompt:       "force",
-		RequestLogging:       true,
-		RequestLoggingFormat: defaultRequestLoggingFormat,
+		ProxyPrefix:            "/oauth2",
+		HttpAddress:            "127.0.0.1:4180",
+		HttpsAddress:           ":443",
+		DisplayHtpasswdForm:    true,
+		CookieName:             "_oauth2_proxy",
+		CookieSecure:           true,
+		CookieHttpOnly:         true,
+		CookieExpire:           time.Duration(168) * time.Hour,
+		CookieRefresh:          time.Duration(0),
+		CookieMaxChunks:        10,
+		SetXAuthRequest:        false,
+		SkipAuthPreflight:      false,
+		PassBasicAuth:          true,
+		PassUserHeaders:        true,
+		HeaderConflict:         "override",
+		PassAccessToken:        false,
+		PassHostHeader:         true,
+		ApprovalPrompt:         "force",
+		ProviderErrorPolicy:    "fail-closed",
+		GitHubHostMismatch:     "warn",
+		GitHubMissingLogin:     "deny",
+		GitHubFineGrainedToken: "error",
+		ProviderErrorGrace:     time.Duration(1) * time.Hour,
+		ProviderMaxBodySize:    4 << 20,
+		GitHubTimeout:          time.Duration(30) * time.Second,
+		OIDCJWKSCacheTTL:       providers.DefaultJWKSCacheTTL,
+		OIDCJWKSMinRefetch:     providers.DefaultJWKSMinRefetch,
+		RevalidateMaxStale:     time.Duration(5) * time.Minute,
+		RevalidateFullRate:     60,
+		RequestLogging:         true,
+		RequestLoggingFormat:   defaultRequestLoggingFormat,
+		RequestLog:             "stdout",
+		AppLog:                 "stderr",
 	}
 }
 
@@ -156,16 +277,14 @@ func (o *Options) Validate() error {
 	o.redirectURL, msgs = parseURL(o.RedirectURL, "redirect", msgs)
 
 	for _, u := range o.Upstreams {
-		upstreamURL, err := url.Parse(u)
+		upstreamURL, err := parseUpstreamURL(u)
 		if err != nil {
 			msgs = append(msgs, fmt.Sprintf("error parsing upstream: %s", err))
 		} else {
-			if upstreamURL.Path == "" {
-				upstreamURL.Path = "/"
-			}
 			o.proxyURLs = append(o.proxyURLs, upstreamURL)
 		}
 	}
+	msgs = parseUpstreamTokenAudiences(o, msgs)
 
 	for _, u := range o.SkipAuthRegex {
 		CompiledRegex, err := regexp.Compile(u)
@@ -176,9 +295,103 @@ func (o *Options) Validate() error {
 		o.CompiledRegex = append(o.CompiledRegex, CompiledRegex)
 	}
 
+	switch o.SessionExpiresHeader {
+	case "", "epoch", "rfc3339":
+	default:
+		msgs = append(msgs, fmt.Sprintf("session_expires_header (%q) must be \"epoch\" or \"rfc3339\"", o.SessionExpiresHeader))
+	}
+	switch o.HeaderConflict {
+	case "", "override", "append", "reject":
+	default:
+		msgs = append(msgs, fmt.Sprintf("header_conflict (%q) must be \"override\", \"append\" or \"reject\"", o.HeaderConflict))
+	}
+	if o.UserInfoCookie != "" {
+		// the JWT is readable by the browser, so its key can be guessed
+		// offline and must not be the cookie-secret
+		if o.UserInfoSigningKey == "" {
+			msgs = append(msgs, "missing setting: user-info-signing-key is required with user-info-cookie")
+		} else if len(o.UserInfoSigningKey) < 32 {
+			msgs = append(msgs, fmt.Sprintf("user_info_signing_key must be at least 32 bytes, but is %d bytes", len(o.UserInfoSigningKey)))
+		} else if o.UserInfoSigningKey == o.CookieSecret {
+			msgs = append(msgs, "user_info_signing_key must not be the cookie_secret")
+		}
+	}
+	if o.PostLogoutRedirectURL != "" {
+		if u, err := url.Parse(o.PostLogoutRedirectURL); err != nil || !u.IsAbs() {
+			msgs = append(msgs, fmt.Sprintf("post_logout_redirect_url (%q) must be an absolute URL", o.PostLogoutRedirectURL))
+		}
+	}
+	if o.CallbackPath != "" && !strings.HasPrefix(o.CallbackPath, "/") {
+		msgs = append(msgs, fmt.Sprintf("callback_path (%q) must start with \"/\"", o.CallbackPath))
+	}
+	switch o.SessionFingerprint {
+	case "", "lax", "strict":
+	default:
+		msgs = append(msgs, fmt.Sprintf("session_fingerprint (%q) must be \"lax\" or \"strict\"", o.SessionFingerprint))
+	}
+	switch o.ProviderErrorPolicy {
+	case "fail-closed", "fail-open":
+	default:
+		msgs = append(msgs, fmt.Sprintf("provider_error_policy (%q) must be \"fail-closed\" or \"fail-open\"", o.ProviderErrorPolicy))
+	}
+	if o.RevalidateAsync && o.RevalidateMaxStale <= 0 {
+		msgs = append(msgs, "revalidate_max_stale must be positive with revalidate_async")
+	}
+	if o.RevalidateMinInterval < 0 {
+		msgs = append(msgs, fmt.Sprintf("revalidate_min_interval (%s) must not be negative", o.RevalidateMinInterval))
+	} else if o.RevalidateMinInterval > 0 {
+		if o.CookieRefresh <= 0 || o.RevalidateMinInterval > o.CookieRefresh {
+			msgs = append(msgs, fmt.Sprintf("revalidate_min_interval (%s) must not be more than cookie_refresh (%s), which must be set", o.RevalidateMinInterval, o.CookieRefresh))
+		}
+		if o.RevalidateFullRate <= 0 {
+			msgs = append(msgs, fmt.Sprintf("revalidate_full_rate (%d) must be positive with revalidate_min_interval", o.RevalidateFullRate))
+		}
+	}
+	if o.GitHubMembershipCacheTTL < 0 {
+		msgs = append(msgs, fmt.Sprintf("github_membership_cache_ttl (%s) must not be negative", o.GitHubMembershipCacheTTL))
+	}
+	if o.GitHubMembershipRetry < 0 {
+		msgs = append(msgs, fmt.Sprintf("github_membership_retry (%s) must not be negative", o.GitHubMembershipRetry))
+	}
+	if o.GitHubMaxPages < 0 {
+		msgs = append(msgs, fmt.Sprintf("github_max_pages (%d) must not be negative", o.GitHubMaxPages))
+	}
+	if o.GitHubMaxTeams < 0 {
+		msgs = append(msgs, fmt.Sprintf("github_max_teams (%d) must not be negative", o.GitHubMaxTeams))
+	}
+	if o.OIDCJWKSCacheTTL < 0 {
+		msgs = append(msgs, fmt.Sprintf("oidc_jwks_cache_ttl (%s) must not be negative", o.OIDCJWKSCacheTTL))
+	}
+	if o.OIDCJWKSMinRefetch < 0 {
+		msgs = append(msgs, fmt.Sprintf("oidc_jwks_min_refetch (%s) must not be negative", o.OIDCJWKSMinRefetch))
+	}
+	if o.GitHubAbuseBackoffMax < 0 {
+		msgs = append(msgs, fmt.Sprintf("github_abuse_backoff_max (%s) must not be negative", o.GitHubAbuseBackoffMax))
+	}
+	if o.GitHubRateLimitMaxWait < 0 {
+		msgs = append(msgs, fmt.Sprintf("github_rate_limit_max_wait (%s) must not be negative", o.GitHubRateLimitMaxWait))
+	}
+	if o.GitHubTimeout < 0 {
+		msgs = append(msgs, fmt.Sprintf("github_timeout (%s) must not be negative", o.GitHubTimeout))
+	}
+	if o.ProviderCallBudget < 0 {
+		msgs = append(msgs, fmt.Sprintf("provider_call_budget (%d) must not be negative", o.ProviderCallBudget))
+	}
+	if o.RequestLog == "" {
+		msgs = append(msgs, "missing setting: request-log")
+	}
+	if o.AppLog == "" {
+		msgs = append(msgs, "missing setting: app-log")
+	}
+	if o.ProviderWarmUp != "" && o.ProviderWarmUp != "warn" && o.ProviderWarmUp != "fail" {
+		msgs = append(msgs, fmt.Sprintf("provider_warm_up (%q) must be \"warn\" or \"fail\"", o.ProviderWarmUp))
+	}
+	if o.ProviderMaxBodySize < 0 {
+		msgs = append(msgs, fmt.Sprintf("provider_max_body_size (%d) must not be negative", o.ProviderMaxBodySize))
+	}
 	msgs = parseProviderInfo(o, msgs)
 
-	if o.PassAccessToken || (o.CookieRefresh != time.Duration(0)) {
+	if (o.PassAccessToken || o.PassIDTokenHeader != "" || (o.CookieRefresh != time.Duration(0))) && !o.CookieSecretDerive {
 		valid_cookie_secret_size := false
 		for _, i := range []int{16, 24, 32} {
 			if len(secretBytes(o.CookieSecret)) == i {
@@ -197,12 +410,17 @@ func (o *Options) Validate() error {
 			msgs = append(msgs, fmt.Sprintf(
 				"cookie_secret must be 16, 24, or 32 bytes "+
 					"to create an AES cipher when "+
-					"pass_access_token == true or "+
+					"pass_access_token == true, "+
+					"pass_id_token_header is set or "+
 					"cookie_refresh != 0, but is %d bytes.%s",
 				len(secretBytes(o.CookieSecret)), suffix))
 		}
 	}
 
+	if o.CookieMaxChunks < 1 {
+		msgs = append(msgs, fmt.Sprintf("cookie_max_chunks (%d) must be at least 1", o.CookieMaxChunks))
+	}
+
 	if o.CookieRefresh >= o.CookieExpire {
 		msgs = append(msgs, fmt.Sprintf(
 			"cookie_refresh (%s) must be less than "+
@@ -212,6 +430,13 @@ func (o *Options) Validate() error {
 	}
 
 	msgs = parseSignatureKey(o, msgs)
+	msgs = parseUserFromEmail(o, msgs)
+	msgs = parseEmailDomainAliases(o, msgs)
+	o.skipAuthNets, msgs = parseCIDRs(o.SkipAuthCIDRs, "skip-auth-cidr", msgs)
+	o.trustedNets, msgs = parseCIDRs(o.TrustedProxies, "trusted-proxy", msgs)
+	msgs = parsePageHeaders(o, msgs)
+	msgs = parseStepUpRoutes(o, msgs)
+	msgs = parseRouteGroups(o, msgs)
 	msgs = validateCookieName(o, msgs)
 
 	if len(msgs) != 0 {
@@ -227,21 +452,116 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 		ClientID:       o.ClientID,
 		ClientSecret:   o.ClientSecret,
 		ApprovalPrompt: o.ApprovalPrompt,
+		CallBudget:     o.ProviderCallBudget,
+		MaxBodySize:    o.ProviderMaxBodySize,
+		Verbose:        o.ProviderVerbose,
+	}
+	// the provider only checks email-domain if it is the only rule, as
+	// emails in the authenticated-emails-file or of an email-domain-alias
+	// may be in other domains; the validator modifies o.EmailDomains
+	if o.AuthenticatedEmailsFile == "" && len(o.EmailDomainAliases) == 0 {
+		p.EmailDomains = append([]string(nil), o.EmailDomains...)
 	}
 	p.LoginURL, msgs = parseURL(o.LoginURL, "login", msgs)
 	p.RedeemURL, msgs = parseURL(o.RedeemURL, "redeem", msgs)
 	p.ProfileURL, msgs = parseURL(o.ProfileURL, "profile", msgs)
 	p.ValidateURL, msgs = parseURL(o.ValidateURL, "validate", msgs)
 	p.ProtectedResource, msgs = parseURL(o.ProtectedResource, "resource", msgs)
+	p.LogoutURL, msgs = parseURL(o.LogoutURL, "logout", msgs)
+	if o.GitHubBaseURL != "" {
+		msgs = parseGitHubBaseURL(o, p, msgs)
+	}
 
 	o.provider = providers.New(o.Provider, p)
 	switch p := o.provider.(type) {
 	case *providers.AzureProvider:
 		p.Configure(o.AzureTenant)
 	case *providers.GitHubProvider:
+		msgs = checkGitHubHosts(o, p.ProviderData, msgs)
 		p.SetOrgTeam(o.GitHubOrg, o.GitHubTeam)
+		if o.GitHubTeam != "" && o.GitHubOrg == "" {
+			for _, team := range strings.Split(o.GitHubTeam, ",") {
+				if !strings.Contains(team, ":") {
+					msgs = append(msgs, fmt.Sprintf("missing setting: github-org is required for github-team %q, or give it as \"org:team\"", strings.TrimSpace(team)))
+				}
+			}
+		}
+		p.SetEnterprise(o.GitHubEnterprise)
+		p.SetAllGroups(len(o.RouteGroups) > 0)
+		if o.GitHubRepo != "" {
+			if parts := strings.Split(o.GitHubRepo, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				msgs = append(msgs, fmt.Sprintf("invalid github-repo %q: must be \"owner/repo\"", o.GitHubRepo))
+			}
+		}
+		p.SetRepo(o.GitHubRepo)
+		if o.GitHubSAMLIdentity && o.GitHubOrg == "" {
+			msgs = append(msgs, "missing setting: github-org is required for github-saml-identity")
+		}
+		p.SetSAMLIdentity(o.GitHubSAMLIdentity, o.GitHubSAMLToken)
+		if o.GitHubEmailSources != "" {
+			sources := strings.Split(o.GitHubEmailSources, ",")
+			for i, source := range sources {
+				sources[i] = strings.TrimSpace(source)
+				switch sources[i] {
+				case "saml":
+					if o.GitHubOrg == "" {
+						msgs = append(msgs, "missing setting: github-org is required for github-email-sources=saml")
+					}
+				case "primary", "profile":
+				default:
+					msgs = append(msgs, fmt.Sprintf("invalid github-email-sources: unknown source %q", sources[i]))
+				}
+			}
+			p.SetEmailSources(sources)
+		}
+		if o.GitHubVerifiedDomain && o.GitHubOrg == "" {
+			msgs = append(msgs, "missing setting: github-org is required for github-verified-domain")
+		}
+		if o.GitHubVerifiedDomain && o.GitHubSAMLToken == "" {
+			msgs = append(msgs, "missing setting: github-saml-token is required for github-verified-domain")
+		}
+		p.SetVerifiedDomainEmail(o.GitHubVerifiedDomain)
+		p.SetUnverifiedEmail(o.GitHubUnverifiedEmail)
+		p.SetEmailAsUsername(o.GitHubEmailAsUsername)
+		switch o.GitHubMissingLogin {
+		case "deny":
+		case "id":
+			p.SetLoginFromID(true)
+		default:
+			msgs = append(msgs, fmt.Sprintf("github_missing_login (%q) must be \"deny\" or \"id\"", o.GitHubMissingLogin))
+		}
+		if o.GitHubAppIdentity != "" {
+			if o.GitHubOrg == "" || strings.Contains(o.GitHubOrg, ",") {
+				msgs = append(msgs, "github-app-identity requires a single github-org, which the app must be installed on")
+			}
+			if o.GitHubTeam != "" || o.GitHubRepo != "" || o.GitHubEnterprise != "" || o.GitHubSAMLIdentity || o.GitHubVerifiedDomain || o.GitHubEmailSources != "" {
+				msgs = append(msgs, "github-app-identity can't be combined with github-team, github-repo, github-enterprise, github-saml-identity, github-verified-domain or github-email-sources, which installation tokens can't check")
+			}
+			p.SetInstallationIdentity(o.GitHubAppIdentity)
+		}
+		switch o.GitHubFineGrainedToken {
+		case "error":
+			p.SetFineGrainedTokenError(true)
+		case "deny":
+		default:
+			msgs = append(msgs, fmt.Sprintf("github_fine_grained_token (%q) must be \"error\" or \"deny\"", o.GitHubFineGrainedToken))
+		}
+		if len(p.Orgs) > 1 && (o.GitHubSAMLIdentity || o.GitHubVerifiedDomain || strings.Contains(o.GitHubEmailSources, "saml")) {
+			msgs = append(msgs, "github-saml-identity, github-email-sources=saml and github-verified-domain require a single github-org")
+		}
+		p.SetMembershipCacheTTL(o.GitHubMembershipCacheTTL)
+		p.SetMembershipRetry(o.GitHubMembershipRetry)
+		p.SetTimeout(o.GitHubTimeout)
+		p.SetMaxPages(o.GitHubMaxPages)
+		p.SetMaxTeams(o.GitHubMaxTeams)
+		p.SetRateLimitMaxWait(o.GitHubRateLimitMaxWait)
+		p.SetAbuseBackoffMax(o.GitHubAbuseBackoffMax)
+		p.SetCoalesceRequests(o.GitHubCoalesceRequests)
 	case *providers.GitLabProvider:
 		p.SetGroups(o.GitLabGroups)
+	case *providers.BitbucketProvider:
+		p.SetTeam(o.BitbucketTeam)
+		p.SetMaxPages(o.GitHubMaxPages)
 	case *providers.GoogleProvider:
 		if len(o.GoogleGroups) > 0 || o.GoogleAdminEmail != "" || o.GoogleServiceAccountJSON != "" {
 			if len(o.GoogleGroups) < 1 {
@@ -266,11 +586,23 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 		if o.OIDCIssuerURL == "" {
 			msgs = append(msgs, "missing-setting: oidc-issuer-url")
 		} else {
+			p.SetJWKSCache(o.OIDCJWKSCacheTTL, o.OIDCJWKSMinRefetch)
 			err := p.SetIssuerURL(o.OIDCIssuerURL)
 			if err != nil {
 				msgs = append(msgs, err.Error())
 			}
 		}
+		if len(o.OIDCRequiredClaims) > 0 {
+			p.RequiredClaims = make(map[string][]string)
+		}
+		for _, c := range o.OIDCRequiredClaims {
+			parts := strings.SplitN(c, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				msgs = append(msgs, fmt.Sprintf("invalid oidc-required-claim %q, expected \"claim=value\"", c))
+				continue
+			}
+			p.RequiredClaims[parts[0]] = append(p.RequiredClaims[parts[0]], parts[1])
+		}
 	}
 	return msgs
 }
@@ -296,6 +628,245 @@ func parseSignatureKey(o *Options, msgs []string) []string {
 	return msgs
 }
 
+func parseUserFromEmail(o *Options, msgs []string) []string {
+	if o.UserFromEmail == "" {
+		return msgs
+	}
+
+	var transforms []func(string) string
+	for _, name := range strings.Split(o.UserFromEmail, ",") {
+		switch strings.TrimSpace(name) {
+		case "passthrough":
+		case "strip-domain":
+			transforms = append(transforms, func(email string) string {
+				return strings.Split(email, "@")[0]
+			})
+		case "lowercase":
+			transforms = append(transforms, strings.ToLower)
+		default:
+			return append(msgs, fmt.Sprintf("invalid user-from-email transform: %q", name))
+		}
+	}
+	o.emailToUser = func(email string) string {
+		for _, t := range transforms {
+			email = t(email)
+		}
+		return email
+	}
+	return msgs
+}
+
+// parseGitHubBaseURL derives the login, redeem and validate URLs from
+// github-base-url. A login-url, redeem-url or validate-url which is also set
+// takes precedence, with a warning if it conflicts.
+func parseGitHubBaseURL(o *Options, p *providers.ProviderData, msgs []string) []string {
+	if o.Provider != "github" {
+		return append(msgs, "github-base-url requires provider=github")
+	}
+	base, err := url.Parse(o.GitHubBaseURL)
+	if err != nil || base.Scheme == "" || base.Host == "" {
+		return append(msgs, fmt.Sprintf("invalid github-base-url=%q, expected e.g. \"https://github.example.com\"", o.GitHubBaseURL))
+	}
+	loginURL, redeemURL, validateURL := providers.GitHubEndpoints(base)
+	p.LoginURL = githubBaseOverride(p.LoginURL, loginURL, "login-url")
+	p.RedeemURL = githubBaseOverride(p.RedeemURL, redeemURL, "redeem-url")
+	p.ValidateURL = githubBaseOverride(p.ValidateURL, validateURL, "validate-url")
+	return msgs
+}
+
+func githubBaseOverride(override, derived *url.URL, name string) *url.URL {
+	if override == nil || override.String() == "" {
+		return derived
+	}
+	if strings.TrimSuffix(override.String(), "/") != strings.TrimSuffix(derived.String(), "/") {
+		log.Printf("WARNING: %s=%q conflicts with %q derived from github-base-url, using %s",
+			name, override, derived, name)
+	}
+	return override
+}
+
+// checkGitHubHosts warns, or with github-host-mismatch=error fails, if the
+// login or redeem URL is not on the GitHub instance of the validate (API)
+// URL, e.g. github.com login and redeem URLs with a GitHub Enterprise API
+func checkGitHubHosts(o *Options, p *providers.ProviderData, msgs []string) []string {
+	switch o.GitHubHostMismatch {
+	case "warn", "error":
+	case "ignore":
+		return msgs
+	default:
+		return append(msgs, fmt.Sprintf("github_host_mismatch (%q) must be \"warn\", \"error\" or \"ignore\"", o.GitHubHostMismatch))
+	}
+	web := providers.GitHubWebURL(p.ValidateURL)
+	for _, u := range []struct {
+		name string
+		url  *url.URL
+	}{
+		{"login-url", p.LoginURL},
+		{"redeem-url", p.RedeemURL},
+	} {
+		if strings.EqualFold(u.url.Host, web.Host) {
+			continue
+		}
+		msg := fmt.Sprintf("%s=%q is not on %s, the GitHub instance of validate-url=%q", u.name, u.url, web.Host, p.ValidateURL)
+		if o.GitHubHostMismatch == "error" {
+			msgs = append(msgs, msg)
+		} else {
+			log.Printf("WARNING: %s", msg)
+		}
+	}
+	return msgs
+}
+
+func parseUpstreamURL(u string) (*url.URL, error) {
+	upstreamURL, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	if upstreamURL.Path == "" {
+		upstreamURL.Path = "/"
+	}
+	return upstreamURL, nil
+}
+
+// parseUpstreamTokenAudiences maps each upstream URL, as in proxyURLs, to
+// the audience of the access token forwarded to it
+func parseUpstreamTokenAudiences(o *Options, msgs []string) []string {
+	o.audiences = nil
+	if len(o.UpstreamTokenAudiences) > 0 && !o.PassAccessToken {
+		msgs = append(msgs, "upstream-token-audience requires pass-access-token")
+	}
+	for _, a := range o.UpstreamTokenAudiences {
+		i := strings.LastIndex(a, "=")
+		if i <= 0 || strings.TrimSpace(a[i+1:]) == "" {
+			msgs = append(msgs, fmt.Sprintf("invalid upstream-token-audience %q, expected \"upstream=audience\"", a))
+			continue
+		}
+		upstreamURL, err := parseUpstreamURL(strings.TrimSpace(a[:i]))
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid upstream-token-audience %q: %s", a, err))
+			continue
+		}
+		found := false
+		for _, u := range o.proxyURLs {
+			found = found || u.String() == upstreamURL.String()
+		}
+		if !found || (upstreamURL.Scheme != "http" && upstreamURL.Scheme != "https") {
+			msgs = append(msgs, fmt.Sprintf("invalid upstream-token-audience %q: not an http(s) upstream", a))
+			continue
+		}
+		if o.audiences == nil {
+			o.audiences = make(map[string]string)
+		}
+		o.audiences[upstreamURL.String()] = strings.TrimSpace(a[i+1:])
+	}
+	return msgs
+}
+
+func parseEmailDomainAliases(o *Options, msgs []string) []string {
+	o.emailAliases = nil
+	for _, a := range o.EmailDomainAliases {
+		parts := strings.SplitN(a, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			msgs = append(msgs, fmt.Sprintf("invalid email-domain-alias %q, expected \"alias=canonical\"", a))
+			continue
+		}
+		if o.emailAliases == nil {
+			o.emailAliases = make(map[string]string)
+		}
+		o.emailAliases[strings.ToLower(strings.TrimSpace(parts[0]))] = strings.TrimSpace(parts[1])
+	}
+	return msgs
+}
+
+// parseCIDRs parses networks in CIDR notation, or single IP addresses
+func parseCIDRs(values []string, name string, msgs []string) ([]*net.IPNet, []string) {
+	var nets []*net.IPNet
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil {
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 8*net.IPv4len
+				}
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("invalid %s %q: %s", name, v, err))
+			continue
+		}
+		nets = append(nets, n)
+	}
+	return nets, msgs
+}
+
+func parseStepUpRoutes(o *Options, msgs []string) []string {
+	o.stepUpRoutes = nil
+	for _, r := range o.StepUpRoutes {
+		i := strings.LastIndex(r, "=")
+		if i < 0 {
+			msgs = append(msgs, fmt.Sprintf("invalid step-up-route %q, expected \"regex=max-age\"", r))
+			continue
+		}
+		regex, err := regexp.Compile(r[:i])
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error compiling step-up-route regex %q: %s", r[:i], err))
+			continue
+		}
+		maxAge, err := time.ParseDuration(r[i+1:])
+		if err != nil || maxAge <= 0 {
+			msgs = append(msgs, fmt.Sprintf("invalid step-up-route max-age %q, expected a positive duration", r[i+1:]))
+			continue
+		}
+		o.stepUpRoutes = append(o.stepUpRoutes, stepUpRoute{regex: regex, maxAge: maxAge})
+	}
+	return msgs
+}
+
+func parseRouteGroups(o *Options, msgs []string) []string {
+	o.routeGroups = nil
+	for _, r := range o.RouteGroups {
+		i := strings.LastIndex(r, "=")
+		if i < 0 {
+			msgs = append(msgs, fmt.Sprintf("invalid route-group %q, expected \"regex=group,group\"", r))
+			continue
+		}
+		regex, err := regexp.Compile(r[:i])
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error compiling route-group regex %q: %s", r[:i], err))
+			continue
+		}
+		var groups []string
+		for _, g := range strings.Split(r[i+1:], ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				groups = append(groups, g)
+			}
+		}
+		if len(groups) == 0 {
+			msgs = append(msgs, fmt.Sprintf("invalid route-group %q, no groups given", r))
+			continue
+		}
+		o.routeGroups = append(o.routeGroups, routeGroup{regex: regex, groups: groups})
+	}
+	return msgs
+}
+
+func parsePageHeaders(o *Options, msgs []string) []string {
+	o.pageHeaders = make(http.Header)
+	for _, h := range o.PageHeaders {
+		components := strings.SplitN(h, ":", 2)
+		if len(components) != 2 || strings.TrimSpace(components[0]) == "" {
+			msgs = append(msgs, fmt.Sprintf("invalid page-header %q, expected \"Name: value\"", h))
+			continue
+		}
+		o.pageHeaders.Add(strings.TrimSpace(components[0]), strings.TrimSpace(components[1]))
+	}
+	return msgs
+}
+
 func validateCookieName(o *Options, msgs []string) []string {
 	cookie := &http.Cookie{Name: o.CookieName}
 	if cookie.String() == "" {
@@ -318,6 +889,15 @@ func addPadding(secret string) string {
 	}
 }
 
+// cookieCipherKey returns the AES key for encrypting session cookies, the
+// cookie secret itself or with CookieSecretDerive a key derived from it
+func cookieCipherKey(o *Options) []byte {
+	if o.CookieSecretDerive {
+		return cookie.DeriveKey(secretBytes(o.CookieSecret))
+	}
+	return secretBytes(o.CookieSecret)
+}
+
 // secretBytes attempts to base64 decode the secret, if that fails it treats the secret as binary
 func secretBytes(secret string) []byte {
 	b, err := base64.URLEncoding.DecodeString(addPadding(secret))
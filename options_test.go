@@ -1,14 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"crypto"
 	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/mreiferson/go-options"
+	"github.com/ploxiln/oauth2_proxy/cookie"
+	"github.com/ploxiln/oauth2_proxy/providers"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -195,6 +202,24 @@ func TestPassAccessTokenRequiresSpecificCookieSecretLengths(t *testing.T) {
 	assert.Equal(t, nil, o.Validate())
 }
 
+func TestCookieSecretDerive(t *testing.T) {
+	o := testOptions()
+	o.PassAccessToken = true
+	o.CookieSecret = "cookie of invalid length-"
+	o.CookieSecretDerive = true
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, cookie.DeriveKey([]byte("cookie of invalid length-")), cookieCipherKey(o))
+	assert.Equal(t, 32, len(cookieCipherKey(o)))
+
+	// a valid length secret is derived from too, not used as is
+	o.CookieSecret = "16 bytes AES-128"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, cookie.DeriveKey([]byte("16 bytes AES-128")), cookieCipherKey(o))
+
+	o.CookieSecretDerive = false
+	assert.Equal(t, []byte("16 bytes AES-128"), cookieCipherKey(o))
+}
+
 func TestCookieRefreshMustBeLessThanCookieExpire(t *testing.T) {
 	o := testOptions()
 	assert.Equal(t, nil, o.Validate())
@@ -269,3 +294,690 @@ func TestValidateCookieBadName(t *testing.T) {
 	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
 		fmt.Sprintf("  invalid cookie name: %q", o.CookieName))
 }
+
+func TestUserFromEmailStripDomain(t *testing.T) {
+	o := testOptions()
+	o.UserFromEmail = "strip-domain,lowercase"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "michael.bland", o.emailToUser("Michael.Bland@gsa.gov"))
+}
+
+func TestUserFromEmailPassthrough(t *testing.T) {
+	o := testOptions()
+	o.UserFromEmail = "passthrough"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "Michael.Bland@gsa.gov", o.emailToUser("Michael.Bland@gsa.gov"))
+}
+
+func TestUserFromEmailInvalid(t *testing.T) {
+	o := testOptions()
+	o.UserFromEmail = "strip-domain,uppercase"
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  invalid user-from-email transform: \"uppercase\"")
+}
+
+func TestEmailDomainAliases(t *testing.T) {
+	o := testOptions()
+	o.EmailDomainAliases = []string{"Corp-Mail.example=example.com", " other.example = example.com"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, map[string]string{
+		"corp-mail.example": "example.com",
+		"other.example":     "example.com",
+	}, o.emailAliases)
+}
+
+func TestEmailDomainAliasesInvalid(t *testing.T) {
+	o := testOptions()
+	o.EmailDomainAliases = []string{"corp-mail.example", "=example.com"}
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  invalid email-domain-alias \"corp-mail.example\", expected \"alias=canonical\"\n"+
+		"  invalid email-domain-alias \"=example.com\", expected \"alias=canonical\"")
+}
+
+func TestSkipAuthCIDRs(t *testing.T) {
+	o := testOptions()
+	o.SkipAuthCIDRs = []string{"10.0.0.0/8", "192.168.1.10", "fd00::/8"}
+	o.TrustedProxies = []string{"127.0.0.1/32"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 3, len(o.skipAuthNets))
+	assert.Equal(t, "192.168.1.10/32", o.skipAuthNets[1].String())
+	assert.Equal(t, "127.0.0.1/32", o.trustedNets[0].String())
+
+	o = testOptions()
+	o.SkipAuthCIDRs = []string{"10.0.0.0/33"}
+	o.TrustedProxies = []string{"localhost"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), `invalid skip-auth-cidr "10.0.0.0/33"`)
+	assert.Contains(t, err.Error(), `invalid trusted-proxy "localhost"`)
+}
+
+func TestUpstreamTokenAudiences(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{"http://127.0.0.1:8080", "http://127.0.0.1:8081/api/"}
+	o.PassAccessToken = true
+	o.CookieSecret = "0123456789abcdefabcd"
+	o.UpstreamTokenAudiences = []string{"http://127.0.0.1:8080/=https://api.example.com", "http://127.0.0.1:8081/api/ = api://backend"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, map[string]string{
+		"http://127.0.0.1:8080/":     "https://api.example.com",
+		"http://127.0.0.1:8081/api/": "api://backend",
+	}, o.audiences)
+}
+
+func TestUpstreamTokenAudiencesInvalid(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{"http://127.0.0.1:8080/"}
+	o.UpstreamTokenAudiences = []string{"http://127.0.0.1:8080/", "http://127.0.0.1:9090/=api://backend"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "upstream-token-audience requires pass-access-token")
+	assert.Contains(t, err.Error(), `invalid upstream-token-audience "http://127.0.0.1:8080/", expected "upstream=audience"`)
+	assert.Contains(t, err.Error(), `invalid upstream-token-audience "http://127.0.0.1:9090/=api://backend": not an http(s) upstream`)
+}
+
+func TestPageHeadersInvalid(t *testing.T) {
+	o := testOptions()
+	o.PageHeaders = []string{"X-Frame-Options DENY"}
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  invalid page-header \"X-Frame-Options DENY\", expected \"Name: value\"")
+}
+
+func TestPostLogoutRedirectURLNotAbsolute(t *testing.T) {
+	o := testOptions()
+	o.PostLogoutRedirectURL = "/goodbye"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "post_logout_redirect_url")
+}
+
+func TestSessionExpiresHeaderInvalid(t *testing.T) {
+	o := testOptions()
+	o.SessionExpiresHeader = "iso"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "session_expires_header")
+}
+
+func TestStepUpRoutes(t *testing.T) {
+	o := testOptions()
+	o.StepUpRoutes = []string{"^/admin/=15m", "^/a=b/=1h"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 2, len(o.stepUpRoutes))
+	assert.Equal(t, "^/admin/", o.stepUpRoutes[0].regex.String())
+	assert.Equal(t, 15*time.Minute, o.stepUpRoutes[0].maxAge)
+	assert.Equal(t, "^/a=b/", o.stepUpRoutes[1].regex.String())
+	assert.Equal(t, time.Hour, o.stepUpRoutes[1].maxAge)
+}
+
+func TestRouteGroups(t *testing.T) {
+	o := testOptions()
+	o.RouteGroups = []string{"^/admin/=myorg/admins", "^/=myorg/admins, myorg/devs"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 2, len(o.routeGroups))
+	assert.Equal(t, "^/admin/", o.routeGroups[0].regex.String())
+	assert.Equal(t, []string{"myorg/admins"}, o.routeGroups[0].groups)
+	assert.Equal(t, "^/", o.routeGroups[1].regex.String())
+	assert.Equal(t, []string{"myorg/admins", "myorg/devs"}, o.routeGroups[1].groups)
+}
+
+func TestRouteGroupsInvalid(t *testing.T) {
+	o := testOptions()
+	o.RouteGroups = []string{"^/admin/", "(=myorg", "^/x/= ,"}
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  invalid route-group \"^/admin/\", expected \"regex=group,group\"\n"+
+		"  error compiling route-group regex \"(\": error parsing regexp: missing closing ): `(`\n"+
+		"  invalid route-group \"^/x/= ,\", no groups given")
+}
+
+func TestRouteGroupsGitHubAllGroups(t *testing.T) {
+	o := testOptions()
+	o.Provider = "github"
+	o.GitHubOrg = "myorg"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, false, o.provider.(*providers.GitHubProvider).AllGroups)
+
+	o = testOptions()
+	o.Provider = "github"
+	o.GitHubOrg = "myorg"
+	o.RouteGroups = []string{"^/admin/=myorg/admins"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, true, o.provider.(*providers.GitHubProvider).AllGroups)
+}
+
+func TestStepUpRoutesInvalid(t *testing.T) {
+	o := testOptions()
+	o.StepUpRoutes = []string{"^/admin/", "(=1m", "^/x/=0s", "^/y/=soon"}
+	err := o.Validate()
+	assert.Equal(t, err.Error(), "Invalid configuration:\n"+
+		"  invalid step-up-route \"^/admin/\", expected \"regex=max-age\"\n"+
+		"  error compiling step-up-route regex \"(\": error parsing regexp: missing closing ): `(`\n"+
+		"  invalid step-up-route max-age \"0s\", expected a positive duration\n"+
+		"  invalid step-up-route max-age \"soon\", expected a positive duration")
+}
+
+func TestOIDCRequiredClaims(t *testing.T) {
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"issuer": "http://%[1]s", "authorization_endpoint": "http://%[1]s/auth",
+			"token_endpoint": "http://%[1]s/token", "jwks_uri": "http://%[1]s/keys"}`, r.Host)
+	}))
+	defer issuer.Close()
+
+	o := testOptions()
+	o.Provider = "oidc"
+	o.OIDCIssuerURL = issuer.URL
+	o.OIDCRequiredClaims = []string{"department=engineering", "department=sre", "groups=a=b"}
+	assert.Equal(t, nil, o.Validate())
+	p := o.provider.(*providers.OIDCProvider)
+	assert.Equal(t, map[string][]string{
+		"department": {"engineering", "sre"},
+		"groups":     {"a=b"},
+	}, p.RequiredClaims)
+
+	o = testOptions()
+	o.Provider = "oidc"
+	o.OIDCIssuerURL = issuer.URL
+	o.OIDCRequiredClaims = []string{"department"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid oidc-required-claim \"department\"")
+}
+
+func TestProviderWarmUpInvalid(t *testing.T) {
+	o := testOptions()
+	o.ProviderWarmUp = "yes"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "provider_warm_up")
+}
+
+func TestCallbackPathInvalid(t *testing.T) {
+	o := testOptions()
+	o.CallbackPath = "auth/callback"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "callback_path")
+}
+
+func TestGitHubSAMLIdentityRequiresOrg(t *testing.T) {
+	o := testOptions()
+	o.Provider = "github"
+	o.GitHubSAMLIdentity = true
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "github-org is required for github-saml-identity")
+
+	o = testOptions()
+	o.Provider = "github"
+	o.GitHubOrg = "testorg"
+	o.GitHubSAMLIdentity = true
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestGitHubVerifiedDomainRequiresSAMLToken(t *testing.T) {
+	o := testOptions()
+	o.Provider = "github"
+	o.GitHubOrg = "testorg"
+	o.GitHubVerifiedDomain = true
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "github-saml-token is required for github-verified-domain")
+
+	o = testOptions()
+	o.Provider = "github"
+	o.GitHubOrg = "testorg"
+	o.GitHubVerifiedDomain = true
+	o.GitHubSAMLToken = "owner-token"
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestCookieMaxChunks(t *testing.T) {
+	o := testOptions()
+	assert.Equal(t, 10, o.CookieMaxChunks)
+	assert.Equal(t, nil, o.Validate())
+
+	o.CookieMaxChunks = 0
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "cookie_max_chunks (0) must be at least 1")
+}
+
+func TestGitHubBaseURL(t *testing.T) {
+	o := testOptions()
+	o.Provider = "github"
+	o.GitHubBaseURL = "https://github.com"
+	assert.Equal(t, nil, o.Validate())
+	p := o.provider.Data()
+	assert.Equal(t, "https://github.com/login/oauth/authorize", p.LoginURL.String())
+	assert.Equal(t, "https://github.com/login/oauth/access_token", p.RedeemURL.String())
+	assert.Equal(t, "https://api.github.com/", p.ValidateURL.String())
+
+	o = testOptions()
+	o.Provider = "github"
+	o.GitHubBaseURL = "https://github.example.com"
+	assert.Equal(t, nil, o.Validate())
+	p = o.provider.Data()
+	assert.Equal(t, "https://github.example.com/login/oauth/authorize", p.LoginURL.String())
+	assert.Equal(t, "https://github.example.com/login/oauth/access_token", p.RedeemURL.String())
+	assert.Equal(t, "https://github.example.com/api/v3", p.ValidateURL.String())
+}
+
+func TestGitHubBaseURLConflict(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	o := testOptions()
+	o.Provider = "github"
+	o.GitHubBaseURL = "https://github.example.com"
+	o.RedeemURL = "https://github.example.com/login/oauth/access_token"
+	o.ValidateURL = "https://api.github.com/"
+	assert.Equal(t, nil, o.Validate())
+	p := o.provider.Data()
+	assert.Equal(t, "https://github.example.com/login/oauth/authorize", p.LoginURL.String())
+	assert.Equal(t, "https://api.github.com/", p.ValidateURL.String())
+	assert.Contains(t, buf.String(), `WARNING: validate-url="https://api.github.com/" conflicts with "https://github.example.com/api/v3"`)
+	assert.NotContains(t, buf.String(), "redeem-url=\"https://github.example.com/login/oauth/access_token\" conflicts")
+	// the API is no longer on the same instance as login and redeem
+	assert.Contains(t, buf.String(), `WARNING: login-url="https://github.example.com/login/oauth/authorize" is not on github.com`)
+}
+
+func TestGitHubHostMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	o := testOptions()
+	o.Provider = "github"
+	o.ValidateURL = "https://github.example.com/api/v3"
+	o.LoginURL = "https://github.com/login/oauth/authorize"
+	assert.Equal(t, nil, o.Validate())
+	assert.Contains(t, buf.String(), `WARNING: login-url="https://github.com/login/oauth/authorize" is not on github.example.com, the GitHub instance of validate-url="https://github.example.com/api/v3"`)
+	assert.NotContains(t, buf.String(), "redeem-url")
+
+	o.GitHubHostMismatch = "error"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), `login-url="https://github.com/login/oauth/authorize" is not on github.example.com`)
+
+	buf.Reset()
+	o.GitHubHostMismatch = "ignore"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "", buf.String())
+
+	o.GitHubHostMismatch = "fail"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), `github_host_mismatch ("fail") must be "warn", "error" or "ignore"`)
+
+	// the defaults, and all URLs on the same instance, match
+	for _, validateURL := range []string{"", "https://api.github.com/", "https://github.example.com/api/v3"} {
+		buf.Reset()
+		o = testOptions()
+		o.Provider = "github"
+		o.GitHubHostMismatch = "error"
+		o.ValidateURL = validateURL
+		assert.Equal(t, nil, o.Validate(), validateURL)
+		assert.Equal(t, "", buf.String(), validateURL)
+	}
+}
+
+func TestGitHubEnterpriseValidateURL(t *testing.T) {
+	o := testOptions()
+	o.Provider = "github"
+	o.ValidateURL = "https://github.example.com/api/v3"
+	assert.Equal(t, nil, o.Validate())
+	p := o.provider.Data()
+	assert.Equal(t, "https://github.example.com/login/oauth/authorize", p.LoginURL.String())
+	assert.Equal(t, "https://github.example.com/login/oauth/access_token", p.RedeemURL.String())
+	assert.Equal(t, "https://github.example.com/api/v3", p.ValidateURL.String())
+
+	o = testOptions()
+	o.Provider = "github"
+	o.LoginURL = "https://login.example.com/authorize"
+	o.RedeemURL = "https://login.example.com/token"
+	o.ValidateURL = "https://github.example.com/api/v3"
+	assert.Equal(t, nil, o.Validate())
+	p = o.provider.Data()
+	assert.Equal(t, "https://login.example.com/authorize", p.LoginURL.String())
+	assert.Equal(t, "https://login.example.com/token", p.RedeemURL.String())
+	assert.Equal(t, "https://github.example.com/api/v3", p.ValidateURL.String())
+}
+
+func TestGitHubBaseURLInvalid(t *testing.T) {
+	o := testOptions()
+	o.Provider = "github"
+	o.GitHubBaseURL = "github.example.com"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), `invalid github-base-url="github.example.com"`)
+
+	o = testOptions()
+	o.GitHubBaseURL = "https://github.example.com"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "github-base-url requires provider=github")
+}
+
+func TestGitHubTimeout(t *testing.T) {
+	o := testOptions()
+	o.Provider = "github"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 30*time.Second, o.GitHubTimeout)
+
+	o.GitHubTimeout = -time.Second
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "github_timeout (-1s) must not be negative")
+}
+
+func TestGitHubRateLimitMaxWait(t *testing.T) {
+	o := testOptions()
+	o.Provider = "github"
+	o.GitHubRateLimitMaxWait = 10 * time.Second
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 10*time.Second, o.provider.(*providers.GitHubProvider).RateLimitMaxWait)
+
+	o.GitHubRateLimitMaxWait = -time.Second
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "github_rate_limit_max_wait (-1s) must not be negative")
+}
+
+func TestGitHubRepo(t *testing.T) {
+	o := testOptions()
+	o.Provider = "github"
+	o.GitHubRepo = "testorg/testrepo"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "testorg/testrepo", o.provider.(*providers.GitHubProvider).Repo)
+
+	for _, repo := range []string{"testrepo", "testorg/", "/testrepo", "testorg/testrepo/x"} {
+		o = testOptions()
+		o.Provider = "github"
+		o.GitHubRepo = repo
+		err := o.Validate()
+		assert.NotEqual(t, nil, err, repo)
+		assert.Contains(t, err.Error(), fmt.Sprintf("invalid github-repo %q", repo))
+	}
+}
+
+func TestGitHubMaxTeams(t *testing.T) {
+	o := testOptions()
+	o.Provider = "github"
+	o.GitHubMaxTeams = 500
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, 500, o.provider.(*providers.GitHubProvider).MaxTeams)
+
+	o.GitHubMaxTeams = -1
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "github_max_teams (-1) must not be negative")
+}
+
+func TestGitHubMultipleOrgsSingleOrgSettings(t *testing.T) {
+	o := testOptions()
+	o.Provider = "github"
+	o.GitHubOrg = "testorg1,testorg2"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, []string{"testorg1", "testorg2"}, o.provider.(*providers.GitHubProvider).Orgs)
+
+	o = testOptions()
+	o.Provider = "github"
+	o.GitHubOrg = "testorg1,testorg2"
+	o.GitHubSAMLIdentity = true
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "require a single github-org")
+}
+
+func TestGitHubTeamAcrossOrgs(t *testing.T) {
+	o := testOptions()
+	o.Provider = "github"
+	o.GitHubTeam = "orgA:infra,orgB:platform"
+	assert.Equal(t, nil, o.Validate())
+
+	o = testOptions()
+	o.Provider = "github"
+	o.GitHubTeam = "orgA:infra,platform"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), `github-org is required for github-team "platform"`)
+
+	o = testOptions()
+	o.Provider = "github"
+	o.GitHubOrg = "orgB"
+	o.GitHubTeam = "orgA:infra,platform"
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestGitHubEmailSources(t *testing.T) {
+	o := testOptions()
+	o.Provider = "github"
+	o.GitHubEmailSources = "profile, primary"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, []string{"profile", "primary"}, o.provider.(*providers.GitHubProvider).EmailSources)
+
+	o = testOptions()
+	o.Provider = "github"
+	o.GitHubEmailSources = "primary,avatar"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), `unknown source "avatar"`)
+
+	o = testOptions()
+	o.Provider = "github"
+	o.GitHubEmailSources = "saml,primary"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "github-org is required for github-email-sources=saml")
+}
+
+func TestSessionFingerprint(t *testing.T) {
+	o := testOptions()
+	o.SessionFingerprint = "strict"
+	assert.Equal(t, nil, o.Validate())
+
+	o.SessionFingerprint = "always"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), `session_fingerprint ("always") must be "lax" or "strict"`)
+}
+
+func TestGitHubAbuseBackoffMax(t *testing.T) {
+	o := testOptions()
+	o.Provider = "github"
+	o.GitHubAbuseBackoffMax = time.Minute
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, time.Minute, o.provider.(*providers.GitHubProvider).AbuseBackoffMax)
+
+	o.GitHubAbuseBackoffMax = -time.Second
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "github_abuse_backoff_max (-1s) must not be negative")
+}
+
+func TestHeaderConflict(t *testing.T) {
+	o := testOptions()
+	assert.Equal(t, "override", o.HeaderConflict)
+	o.HeaderConflict = "reject"
+	assert.Equal(t, nil, o.Validate())
+
+	o.HeaderConflict = "merge"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), `header_conflict ("merge") must be "override", "append" or "reject"`)
+}
+
+func TestOIDCJWKSCache(t *testing.T) {
+	o := testOptions()
+	assert.Equal(t, providers.DefaultJWKSCacheTTL, o.OIDCJWKSCacheTTL)
+	assert.Equal(t, providers.DefaultJWKSMinRefetch, o.OIDCJWKSMinRefetch)
+
+	o.OIDCJWKSCacheTTL = -time.Second
+	o.OIDCJWKSMinRefetch = -time.Second
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "oidc_jwks_cache_ttl (-1s) must not be negative")
+	assert.Contains(t, err.Error(), "oidc_jwks_min_refetch (-1s) must not be negative")
+}
+
+func TestProviderEmailDomains(t *testing.T) {
+	o := testOptions()
+	o.EmailDomains = []string{"example.com"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, []string{"example.com"}, o.provider.Data().EmailDomains)
+
+	// other rules may admit emails in other domains
+	o = testOptions()
+	o.EmailDomains = []string{"example.com"}
+	o.EmailDomainAliases = []string{"corp-mail.example=example.com"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, []string(nil), o.provider.Data().EmailDomains)
+}
+
+func TestBitbucketTeam(t *testing.T) {
+	o := testOptions()
+	o.Provider = "bitbucket"
+	o.BitbucketTeam = "testteam"
+	assert.Equal(t, nil, o.Validate())
+	p, ok := o.provider.(*providers.BitbucketProvider)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "testteam", p.Team)
+	assert.Equal(t, "https://api.bitbucket.org/2.0/user", p.Data().ValidateURL.String())
+}
+
+func TestGitHubMissingLogin(t *testing.T) {
+	o := testOptions()
+	o.Provider = "github"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, false, o.provider.(*providers.GitHubProvider).LoginFromID)
+
+	o = testOptions()
+	o.Provider = "github"
+	o.GitHubMissingLogin = "id"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, true, o.provider.(*providers.GitHubProvider).LoginFromID)
+
+	o = testOptions()
+	o.Provider = "github"
+	o.GitHubMissingLogin = "login"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "github_missing_login (\"login\") must be \"deny\" or \"id\"")
+}
+
+func TestRevalidateMinInterval(t *testing.T) {
+	o := testOptions()
+	o.CookieSecret = "16 bytes AES-128"
+	o.CookieRefresh = time.Hour
+	o.RevalidateMinInterval = time.Minute
+	assert.Equal(t, nil, o.Validate())
+
+	o = testOptions()
+	o.RevalidateMinInterval = time.Minute
+	assert.NotEqual(t, nil, o.Validate())
+
+	o = testOptions()
+	o.CookieSecret = "16 bytes AES-128"
+	o.CookieRefresh = time.Hour
+	o.RevalidateMinInterval = 2 * time.Hour
+	assert.NotEqual(t, nil, o.Validate())
+
+	o = testOptions()
+	o.CookieSecret = "16 bytes AES-128"
+	o.CookieRefresh = time.Hour
+	o.RevalidateMinInterval = time.Minute
+	o.RevalidateFullRate = 0
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "revalidate_full_rate (0) must be positive")
+
+	o = testOptions()
+	o.RevalidateMinInterval = -time.Minute
+	assert.NotEqual(t, nil, o.Validate())
+}
+
+func TestPassIDTokenHeader(t *testing.T) {
+	o := testOptions()
+	o.PassIDTokenHeader = "X-Forwarded-Id-Token"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "pass_id_token_header is set")
+
+	o.CookieSecret = "16 bytes AES-128"
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestUserInfoSigningKey(t *testing.T) {
+	o := testOptions()
+	o.UserInfoCookie = "_user_info"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "user-info-signing-key is required")
+
+	o.UserInfoSigningKey = "too short"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "at least 32 bytes")
+
+	o.CookieSecret = "0123456789abcdef0123456789abcdef"
+	o.UserInfoSigningKey = o.CookieSecret
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "must not be the cookie_secret")
+
+	o.UserInfoSigningKey = "fedcba9876543210fedcba9876543210"
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestGitHubFineGrainedToken(t *testing.T) {
+	o := testOptions()
+	o.Provider = "github"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, true, o.provider.(*providers.GitHubProvider).FineGrainedTokenError)
+
+	o = testOptions()
+	o.Provider = "github"
+	o.GitHubFineGrainedToken = "deny"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, false, o.provider.(*providers.GitHubProvider).FineGrainedTokenError)
+
+	o = testOptions()
+	o.Provider = "github"
+	o.GitHubFineGrainedToken = "allow"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "github_fine_grained_token (\"allow\") must be \"error\" or \"deny\"")
+}
+
+func TestGitHubAppIdentity(t *testing.T) {
+	o := testOptions()
+	o.Provider = "github"
+	o.GitHubAppIdentity = "deploy-bot@example.com"
+	o.GitHubOrg = "testorg"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "deploy-bot@example.com", o.provider.(*providers.GitHubProvider).InstallationIdentity)
+
+	for _, org := range []string{"", "testorg,otherorg"} {
+		o = testOptions()
+		o.Provider = "github"
+		o.GitHubAppIdentity = "deploy-bot@example.com"
+		o.GitHubOrg = org
+		err := o.Validate()
+		assert.NotEqual(t, nil, err, "org %q", org)
+		assert.Contains(t, err.Error(), "github-app-identity requires a single github-org", "org %q", org)
+	}
+
+	o = testOptions()
+	o.Provider = "github"
+	o.GitHubAppIdentity = "deploy-bot@example.com"
+	o.GitHubOrg = "testorg"
+	o.GitHubTeam = "devs"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "github-app-identity can't be combined with github-team")
+}
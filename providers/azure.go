@@ -1,9 +1,9 @@
 package providers
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
 
@@ -84,7 +84,7 @@ func getEmailFromJSON(json *simplejson.Json) (string, error) {
 	return email, err
 }
 
-func (p *AzureProvider) GetEmailAddress(s *SessionState) (string, error) {
+func (p *AzureProvider) GetEmailAddress(ctx context.Context, s *SessionState) (string, error) {
 	var email string
 	var err error
 
@@ -95,6 +95,7 @@ func (p *AzureProvider) GetEmailAddress(s *SessionState) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	req = req.WithContext(ctx)
 	req.Header = getAzureHeader(s.AccessToken)
 
 	json, err := api.Request(req)
@@ -106,20 +107,20 @@ func (p *AzureProvider) GetEmailAddress(s *SessionState) (string, error) {
 	email, err = getEmailFromJSON(json)
 
 	if err == nil && email != "" {
-		return email, err
+		return p.allowedEmail(email, err)
 	}
 
 	email, err = json.Get("userPrincipalName").String()
 
 	if err != nil {
-		log.Printf("failed making request %s", err)
+		logger.Printf("failed making request %s", err)
 		return "", err
 	}
 
 	if email == "" {
-		log.Printf("failed to get email address")
+		logger.Printf("failed to get email address")
 		return "", err
 	}
 
-	return email, err
+	return p.allowedEmail(email, err)
 }
@@ -0,0 +1,189 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/ploxiln/oauth2_proxy/api"
+)
+
+type BitbucketProvider struct {
+	*ProviderData
+	// Team is the slug of the workspace users must be a member of, if set
+	Team string
+	// MaxPages bounds how many pages of a list are requested, see
+	// DefaultGitHubMaxPages
+	MaxPages int
+}
+
+func NewBitbucketProvider(p *ProviderData) *BitbucketProvider {
+	p.ProviderName = "Bitbucket"
+	if p.LoginURL == nil || p.LoginURL.String() == "" {
+		p.LoginURL = &url.URL{
+			Scheme: "https",
+			Host:   "bitbucket.org",
+			Path:   "/site/oauth2/authorize",
+		}
+	}
+	if p.RedeemURL == nil || p.RedeemURL.String() == "" {
+		p.RedeemURL = &url.URL{
+			Scheme: "https",
+			Host:   "bitbucket.org",
+			Path:   "/site/oauth2/access_token",
+		}
+	}
+	if p.ValidateURL == nil || p.ValidateURL.String() == "" {
+		p.ValidateURL = &url.URL{
+			Scheme: "https",
+			Host:   "api.bitbucket.org",
+			Path:   "/2.0/user",
+		}
+	}
+	if p.Scope == "" {
+		p.Scope = "account email"
+	}
+	return &BitbucketProvider{ProviderData: p}
+}
+
+// SetTeam restricts logins to members of the workspace with slug team
+func (p *BitbucketProvider) SetTeam(team string) {
+	p.Team = team
+}
+
+// SetMaxPages bounds how many pages of the workspaces or emails of a user
+// are requested. 0 uses DefaultGitHubMaxPages, as GitHub does.
+func (p *BitbucketProvider) SetMaxPages(n int) {
+	p.MaxPages = n
+}
+
+func (p *BitbucketProvider) maxPages() int {
+	if p.MaxPages <= 0 {
+		return DefaultGitHubMaxPages
+	}
+	return p.MaxPages
+}
+
+func getBitbucketHeader(accessToken string) http.Header {
+	header := make(http.Header)
+	header.Set("Accept", "application/json")
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	return header
+}
+
+// bitbucketURL returns the API endpoint rel, relative to the ValidateURL
+// /2.0/user, listing 100 items per page
+func (p *BitbucketProvider) bitbucketURL(rel string) string {
+	endpoint := &url.URL{
+		Scheme:   p.ValidateURL.Scheme,
+		Host:     p.ValidateURL.Host,
+		Path:     path.Join(p.ValidateURL.Path, rel),
+		RawQuery: url.Values{"pagelen": {"100"}}.Encode(),
+	}
+	return endpoint.String()
+}
+
+func (p *BitbucketProvider) getJSON(ctx context.Context, endpoint, accessToken string, v interface{}) error {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header = getBitbucketHeader(accessToken)
+	return api.RequestJson(req, v)
+}
+
+func (p *BitbucketProvider) hasTeam(ctx context.Context, s *SessionState) (bool, error) {
+	type workspacesPage struct {
+		Values []struct {
+			Workspace struct {
+				Slug string `json:"slug"`
+			} `json:"workspace"`
+		} `json:"values"`
+		Next string `json:"next"`
+	}
+
+	endpoint := p.bitbucketURL("permissions/workspaces")
+	for pn := 1; endpoint != ""; pn++ {
+		if pn > p.maxPages() {
+			logger.Printf("WARNING: stopped after %d pages of Bitbucket workspaces, not requesting %q", p.maxPages(), endpoint)
+			break
+		}
+		var workspaces workspacesPage
+		if err := p.getJSON(ctx, endpoint, s.AccessToken, &workspaces); err != nil {
+			return false, err
+		}
+		for _, w := range workspaces.Values {
+			if w.Workspace.Slug == p.Team {
+				logger.Printf("Found Bitbucket Workspace: %q", p.Team)
+				s.Groups = []string{p.Team}
+				return true, nil
+			}
+		}
+		var err error
+		if endpoint, err = nextPageURL(workspaces.Next, p.ValidateURL); err != nil {
+			return false, err
+		}
+	}
+
+	logger.Printf("Missing Bitbucket Workspace: %q", p.Team)
+	return false, nil
+}
+
+func (p *BitbucketProvider) GetEmailAddress(ctx context.Context, s *SessionState) (string, error) {
+	// if we require a Team, check that first
+	if p.Team != "" {
+		if ok, err := p.hasTeam(ctx, s); err != nil || !ok {
+			return "", err
+		}
+	}
+
+	type emailsPage struct {
+		Values []struct {
+			Email     string `json:"email"`
+			Primary   bool   `json:"is_primary"`
+			Confirmed bool   `json:"is_confirmed"`
+		} `json:"values"`
+		Next string `json:"next"`
+	}
+
+	endpoint := p.bitbucketURL("emails")
+	for pn := 1; endpoint != ""; pn++ {
+		if pn > p.maxPages() {
+			logger.Printf("WARNING: stopped after %d pages of Bitbucket emails, not requesting %q", p.maxPages(), endpoint)
+			break
+		}
+		var emails emailsPage
+		if err := p.getJSON(ctx, endpoint, s.AccessToken, &emails); err != nil {
+			return "", err
+		}
+		for _, e := range emails.Values {
+			if e.Primary && e.Confirmed {
+				return p.allowedEmail(e.Email, nil)
+			}
+		}
+		var err error
+		if endpoint, err = nextPageURL(emails.Next, p.ValidateURL); err != nil {
+			return "", err
+		}
+	}
+
+	return "", errors.New("no primary confirmed email")
+}
+
+func (p *BitbucketProvider) GetUserName(ctx context.Context, s *SessionState) (string, error) {
+	var user struct {
+		Username string `json:"username"`
+	}
+	if err := p.getJSON(ctx, p.ValidateURL.String(), s.AccessToken, &user); err != nil {
+		return "", err
+	}
+	return user.Username, nil
+}
+
+func (p *BitbucketProvider) ValidateSessionState(s *SessionState) (bool, error) {
+	return validateToken(p, s.AccessToken, getBitbucketHeader(s.AccessToken))
+}
@@ -0,0 +1,265 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testBitbucketProvider(hostname string) *BitbucketProvider {
+	p := NewBitbucketProvider(
+		&ProviderData{
+			ProviderName: "",
+			LoginURL:     &url.URL{},
+			RedeemURL:    &url.URL{},
+			ProfileURL:   &url.URL{},
+			ValidateURL:  &url.URL{},
+			Scope:        ""})
+	if hostname != "" {
+		updateURL(p.Data().LoginURL, hostname)
+		updateURL(p.Data().RedeemURL, hostname)
+		updateURL(p.Data().ProfileURL, hostname)
+		updateURL(p.Data().ValidateURL, hostname)
+	}
+	return p
+}
+
+// testBitbucketBackend serves payloads by path and query, with NEXT in a
+// payload replaced by the URL of the backend, for the "next" page links
+func testBitbucketBackend(payloads map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			payload, ok := payloads[r.URL.RequestURI()]
+			if r.Header.Get("Authorization") != "Bearer imaginary_access_token" {
+				w.WriteHeader(401)
+			} else if !ok {
+				w.WriteHeader(404)
+			} else {
+				w.WriteHeader(200)
+				w.Write([]byte(strings.Replace(payload, "NEXT", "http://"+r.Host, -1)))
+			}
+		}))
+}
+
+func TestBitbucketProviderDefaults(t *testing.T) {
+	p := testBitbucketProvider("")
+	assert.NotEqual(t, nil, p)
+	assert.Equal(t, "Bitbucket", p.Data().ProviderName)
+	assert.Equal(t, "https://bitbucket.org/site/oauth2/authorize",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://bitbucket.org/site/oauth2/access_token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://api.bitbucket.org/2.0/user",
+		p.Data().ValidateURL.String())
+	assert.Equal(t, "account email", p.Data().Scope)
+}
+
+func TestBitbucketProviderOverrides(t *testing.T) {
+	p := NewBitbucketProvider(
+		&ProviderData{
+			LoginURL: &url.URL{
+				Scheme: "https",
+				Host:   "example.com",
+				Path:   "/oauth/auth"},
+			RedeemURL: &url.URL{
+				Scheme: "https",
+				Host:   "example.com",
+				Path:   "/oauth/token"},
+			ValidateURL: &url.URL{
+				Scheme: "https",
+				Host:   "api.example.com",
+				Path:   "/2.0/user"},
+			Scope: "account"})
+	assert.NotEqual(t, nil, p)
+	assert.Equal(t, "Bitbucket", p.Data().ProviderName)
+	assert.Equal(t, "https://example.com/oauth/auth",
+		p.Data().LoginURL.String())
+	assert.Equal(t, "https://example.com/oauth/token",
+		p.Data().RedeemURL.String())
+	assert.Equal(t, "https://api.example.com/2.0/user",
+		p.Data().ValidateURL.String())
+	assert.Equal(t, "account", p.Data().Scope)
+}
+
+func TestBitbucketProviderGetEmailAddress(t *testing.T) {
+	b := testBitbucketBackend(map[string]string{
+		"/2.0/user/emails?pagelen=100": `{"values": [
+			{"email": "old@example.com", "is_primary": false, "is_confirmed": true},
+			{"email": "michael.bland@gsa.gov", "is_primary": true, "is_confirmed": true}]}`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testBitbucketProvider(bURL.Host)
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+}
+
+func TestBitbucketProviderGetEmailAddressUnconfirmed(t *testing.T) {
+	b := testBitbucketBackend(map[string]string{
+		"/2.0/user/emails?pagelen=100": `{"values": [
+			{"email": "michael.bland@gsa.gov", "is_primary": true, "is_confirmed": false}]}`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testBitbucketProvider(bURL.Host)
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(context.Background(), session)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, "", email)
+}
+
+func TestBitbucketProviderGetEmailAddressFailedRequest(t *testing.T) {
+	b := testBitbucketBackend(map[string]string{})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testBitbucketProvider(bURL.Host)
+
+	session := &SessionState{AccessToken: "unexpected_access_token"}
+	email, err := p.GetEmailAddress(context.Background(), session)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, "", email)
+}
+
+func TestBitbucketProviderGetEmailAddressWithTeam(t *testing.T) {
+	b := testBitbucketBackend(map[string]string{
+		"/2.0/user/emails?pagelen=100": `{"values": [
+			{"email": "michael.bland@gsa.gov", "is_primary": true, "is_confirmed": true}]}`,
+		"/2.0/user/permissions/workspaces?pagelen=100": `{"values": [
+			{"permission": "member", "workspace": {"slug": "otherteam"}}],
+			"next": "NEXT/2.0/user/permissions/workspaces?pagelen=100&page=2"}`,
+		"/2.0/user/permissions/workspaces?pagelen=100&page=2": `{"values": [
+			{"permission": "member", "workspace": {"slug": "testteam"}}]}`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testBitbucketProvider(bURL.Host)
+	p.SetTeam("testteam")
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+	assert.Equal(t, []string{"testteam"}, session.Groups)
+
+	p.SetTeam("missingteam")
+	session = &SessionState{AccessToken: "imaginary_access_token"}
+	email, err = p.GetEmailAddress(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+	assert.Equal(t, []string(nil), session.Groups)
+}
+
+func TestBitbucketProviderMaxPages(t *testing.T) {
+	b := testBitbucketBackend(map[string]string{
+		"/2.0/user/emails?pagelen=100": `{"values": [
+			{"email": "michael.bland@gsa.gov", "is_primary": true, "is_confirmed": true}]}`,
+		"/2.0/user/permissions/workspaces?pagelen=100": `{"values": [
+			{"permission": "member", "workspace": {"slug": "otherteam"}}],
+			"next": "NEXT/2.0/user/permissions/workspaces?pagelen=100&page=2"}`,
+		"/2.0/user/permissions/workspaces?pagelen=100&page=2": `{"values": [
+			{"permission": "member", "workspace": {"slug": "testteam"}}]}`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testBitbucketProvider(bURL.Host)
+	p.SetTeam("testteam")
+	p.SetMaxPages(1)
+
+	// the second page, with the team, is not requested
+	email, err := p.GetEmailAddress(context.Background(), &SessionState{AccessToken: "imaginary_access_token"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", email)
+
+	p.SetMaxPages(2)
+	email, err = p.GetEmailAddress(context.Background(), &SessionState{AccessToken: "imaginary_access_token"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+}
+
+func TestBitbucketProviderNextOtherOrigin(t *testing.T) {
+	var otherRequests int
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherRequests++
+		w.Write([]byte(`{"values": []}`))
+	}))
+	defer other.Close()
+	b := testBitbucketBackend(map[string]string{
+		"/2.0/user/emails?pagelen=100": `{"values": [],
+			"next": "` + other.URL + `/2.0/user/emails?pagelen=100&page=2"}`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testBitbucketProvider(bURL.Host)
+
+	// the access token is not sent to another origin
+	email, err := p.GetEmailAddress(context.Background(), &SessionState{AccessToken: "imaginary_access_token"})
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "not following next page link")
+	assert.Equal(t, "", email)
+	assert.Equal(t, 0, otherRequests)
+}
+
+func TestBitbucketProviderGetEmailAddressDomain(t *testing.T) {
+	b := testBitbucketBackend(map[string]string{
+		"/2.0/user/emails?pagelen=100": `{"values": [
+			{"email": "michael.bland@gsa.gov", "is_primary": true, "is_confirmed": true}]}`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testBitbucketProvider(bURL.Host)
+	p.EmailDomains = []string{"example.com"}
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	email, err := p.GetEmailAddress(context.Background(), session)
+	assert.Equal(t, "", email)
+	if assert.IsType(t, &RedeemError{}, err) {
+		assert.Equal(t, "access_denied", err.(*RedeemError).Code)
+	}
+}
+
+func TestBitbucketProviderGetUserName(t *testing.T) {
+	b := testBitbucketBackend(map[string]string{
+		"/2.0/user": `{"username": "mbland", "display_name": "Michael Bland"}`,
+	})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testBitbucketProvider(bURL.Host)
+
+	session := &SessionState{AccessToken: "imaginary_access_token"}
+	user, err := p.GetUserName(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "mbland", user)
+}
+
+func TestBitbucketProviderValidateSessionState(t *testing.T) {
+	b := testBitbucketBackend(map[string]string{"/2.0/user": `{"username": "mbland"}`})
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testBitbucketProvider(bURL.Host)
+
+	ok, err := p.ValidateSessionState(&SessionState{AccessToken: "imaginary_access_token"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, ok)
+
+	ok, err = p.ValidateSessionState(&SessionState{AccessToken: "expired_access_token"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, ok)
+}
@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -62,7 +63,7 @@ func getDiscordHeader(access_token string) http.Header {
 	return header
 }
 
-func getUserInfo(p *DiscordProvider, s *SessionState) (DiscordUserInfo, error) {
+func getUserInfo(ctx context.Context, p *DiscordProvider, s *SessionState) (DiscordUserInfo, error) {
 	var r DiscordUserInfo
 	if s.AccessToken == "" {
 		return r, errors.New("missing access token")
@@ -71,6 +72,7 @@ func getUserInfo(p *DiscordProvider, s *SessionState) (DiscordUserInfo, error) {
 	if err != nil {
 		return r, err
 	}
+	req = req.WithContext(ctx)
 	req.Header = getDiscordHeader(s.AccessToken)
 
 	err = api.RequestJson(req, &r)
@@ -84,8 +86,8 @@ func getUserInfo(p *DiscordProvider, s *SessionState) (DiscordUserInfo, error) {
 // authenticated user, as this is NOT STABLE and can be changed at any
 // time! Instead, the user id which is guratanteed to be stable by
 // Discord is provided.
-func (p *DiscordProvider) GetUserName(s *SessionState) (string, error) {
-	r, err := getUserInfo(p, s)
+func (p *DiscordProvider) GetUserName(ctx context.Context, s *SessionState) (string, error) {
+	r, err := getUserInfo(ctx, p, s)
 	if err != nil {
 		return "", err
 	}
@@ -95,17 +97,17 @@ func (p *DiscordProvider) GetUserName(s *SessionState) (string, error) {
 	return r.Id, nil
 }
 
-func (p *DiscordProvider) GetEmailAddress(s *SessionState) (string, error) {
-	r, err := getUserInfo(p, s)
+func (p *DiscordProvider) GetEmailAddress(ctx context.Context, s *SessionState) (string, error) {
+	r, err := getUserInfo(ctx, p, s)
 	if err != nil {
 		return "", err
 	}
 	if r.Email == "" {
 		return "", errors.New("no email")
 	}
-	return r.Email, nil
+	return p.allowedEmail(r.Email, nil)
 }
 
-func (p *DiscordProvider) ValidateSessionState(s *SessionState) bool {
+func (p *DiscordProvider) ValidateSessionState(s *SessionState) (bool, error) {
 	return validateToken(p, s.AccessToken, getDiscordHeader(s.AccessToken))
 }
@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -51,7 +52,7 @@ func getFacebookHeader(access_token string) http.Header {
 	return header
 }
 
-func (p *FacebookProvider) GetEmailAddress(s *SessionState) (string, error) {
+func (p *FacebookProvider) GetEmailAddress(ctx context.Context, s *SessionState) (string, error) {
 	if s.AccessToken == "" {
 		return "", errors.New("missing access token")
 	}
@@ -59,6 +60,7 @@ func (p *FacebookProvider) GetEmailAddress(s *SessionState) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	req = req.WithContext(ctx)
 	req.Header = getFacebookHeader(s.AccessToken)
 
 	type result struct {
@@ -72,9 +74,9 @@ func (p *FacebookProvider) GetEmailAddress(s *SessionState) (string, error) {
 	if r.Email == "" {
 		return "", errors.New("no email")
 	}
-	return r.Email, nil
+	return p.allowedEmail(r.Email, nil)
 }
 
-func (p *FacebookProvider) ValidateSessionState(s *SessionState) bool {
+func (p *FacebookProvider) ValidateSessionState(s *SessionState) (bool, error) {
 	return validateToken(p, s.AccessToken, getFacebookHeader(s.AccessToken))
 }
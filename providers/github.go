@@ -1,136 +1,777 @@
 package providers
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// ErrNoPrimaryEmail is returned by GetEmailAddress if the user has emails,
+// but none of them can be used: none is verified (see SetUnverifiedEmail)
+var ErrNoPrimaryEmail = errors.New("no verified email address for user")
+
+// ErrTokenCannotVerifyMembership is returned by GetEmailAddress, with
+// SetFineGrainedTokenError, if the user has no orgs or teams at all and the
+// access token is a fine-grained personal access token, which may not be
+// granted access to org membership
+var ErrTokenCannotVerifyMembership = errors.New("token cannot verify org membership: fine-grained personal access token without org access")
+
+// ErrInvalidInstallationToken is returned by SessionFromToken for a token
+// which is not a valid installation token of an installation on the org
+var ErrInvalidInstallationToken = errors.New("not a valid installation token for an installation on the org")
+
 type GitHubProvider struct {
 	*ProviderData
-	Org  string
-	Team string
+	Orgs       []string
+	Team       string
+	Enterprise string
+
+	// Repo ("owner/repo") restricts logins to its collaborators with at
+	// least push access
+	Repo string
+
+	// SAMLIdentity uses the login's SAML identity (NameID) in the (first)
+	// org as the session email, looked up with SAMLToken (of an org owner)
+	// if set
+	SAMLIdentity bool
+	SAMLToken    string
+
+	// EmailSources are tried in order until one has an email for the
+	// session, see GitHubEmailSources. By default "saml" with SAMLIdentity,
+	// otherwise "primary".
+	EmailSources []string
+
+	// EmailAsUsername uses the public profile email of the user as the
+	// session user, if set, rather than the login
+	EmailAsUsername bool
+
+	// FineGrainedTokenError fails the membership check with
+	// ErrTokenCannotVerifyMembership, rather than denying the login, if a
+	// fine-grained personal access token lists no orgs or teams
+	FineGrainedTokenError bool
+
+	// InstallationIdentity, if set, takes access tokens to be GitHub App
+	// installation tokens, which are sent with the Bearer scheme and act for
+	// no user: the user is not looked up, the session email is
+	// InstallationIdentity instead. Only installations on the (first) org
+	// are accepted.
+	InstallationIdentity string
+
+	// LoginFromID uses "#<id>" as the login of a user without one, as the
+	// /user of some integration (bot) tokens has, rather than failing
+	LoginFromID bool
+
+	// UnverifiedEmail falls back to the primary, else the first, of the
+	// user's emails if none is verified
+	UnverifiedEmail bool
+
+	// VerifiedDomainEmail only accepts an email in one of the (first) org's
+	// verified domains, also looked up with SAMLToken if set
+	VerifiedDomainEmail bool
+
+	// MembershipRetry is the delay before the org/team membership check
+	// is retried once, if the user was not a member. 0 disables the retry.
+	MembershipRetry time.Duration
+
+	// RateLimitMaxWait is the longest an API request which was rate
+	// limited waits before it is retried once. 0 disables the retry.
+	RateLimitMaxWait time.Duration
+
+	// AbuseBackoffMax is the longest all API requests are held back after
+	// a secondary rate limit response with a Retry-After header. 0
+	// disables the backoff.
+	AbuseBackoffMax time.Duration
+
+	// MaxPages bounds how many pages of a list are requested, see
+	// DefaultGitHubMaxPages
+	MaxPages int
+
+	// MaxTeams bounds how many of the user's teams are fetched when
+	// looking for a team. 0 is unlimited, up to MaxPages pages.
+	MaxTeams int
+
+	// AllGroups keeps looking after the first matching org or team, so
+	// that Groups lists each configured one the user is a member of
+	AllGroups bool
+
+	client     *http.Client
+	membership *membershipCache
+	rateLimit  rateLimitTracker
+	backoff    backoffGate
+	requests   *requestGroup
 }
 
+// NewGitHubProvider initializes all default endpoints up front. API endpoints
+// are derived from ValidateURL for each request without modifying the
+// provider, so once configured it is safe for concurrent use.
 func NewGitHubProvider(p *ProviderData) *GitHubProvider {
 	p.ProviderName = "GitHub"
+	base := &url.URL{Scheme: "https", Host: "github.com"}
+	if p.ValidateURL != nil && p.ValidateURL.Host != "" {
+		// a GitHub Enterprise API base alone is enough to find its login
+		// and redeem URLs
+		base = GitHubWebURL(p.ValidateURL)
+	}
+	loginURL, redeemURL, validateURL := GitHubEndpoints(base)
 	if p.LoginURL == nil || p.LoginURL.String() == "" {
-		p.LoginURL = &url.URL{
-			Scheme: "https",
-			Host:   "github.com",
-			Path:   "/login/oauth/authorize",
-		}
+		p.LoginURL = loginURL
 	}
 	if p.RedeemURL == nil || p.RedeemURL.String() == "" {
-		p.RedeemURL = &url.URL{
-			Scheme: "https",
-			Host:   "github.com",
-			Path:   "/login/oauth/access_token",
-		}
+		p.RedeemURL = redeemURL
 	}
 	// ValidationURL is the API Base URL
 	if p.ValidateURL == nil || p.ValidateURL.String() == "" {
-		p.ValidateURL = &url.URL{
-			Scheme: "https",
-			Host:   "api.github.com",
-			Path:   "/",
-		}
+		p.ValidateURL = validateURL
 	}
 	if p.Scope == "" {
 		p.Scope = "user:email"
 	}
-	return &GitHubProvider{ProviderData: p}
+	return &GitHubProvider{ProviderData: p, client: newGitHubClient(DefaultGitHubTimeout)}
 }
+
+// GitHubEndpoints derives the login, redeem and validate (API base) URLs
+// from the web URL of a GitHub instance: the API of github.com is at
+// api.github.com, that of GitHub Enterprise Server at /api/v3 on its host
+func GitHubEndpoints(base *url.URL) (loginURL, redeemURL, validateURL *url.URL) {
+	web := func(p string) *url.URL {
+		return &url.URL{Scheme: base.Scheme, Host: base.Host, Path: path.Join("/", base.Path, p)}
+	}
+	loginURL = web("/login/oauth/authorize")
+	redeemURL = web("/login/oauth/access_token")
+	if strings.EqualFold(base.Host, "github.com") {
+		validateURL = &url.URL{Scheme: base.Scheme, Host: "api.github.com", Path: "/"}
+	} else {
+		validateURL = web("/api/v3")
+	}
+	return
+}
+
+// GitHubWebURL is the inverse of GitHubEndpoints for the API base: the web
+// URL of the GitHub instance whose API is at validateURL
+func GitHubWebURL(validateURL *url.URL) *url.URL {
+	if strings.EqualFold(validateURL.Host, "api.github.com") {
+		return &url.URL{Scheme: validateURL.Scheme, Host: "github.com"}
+	}
+	p := strings.TrimSuffix(strings.TrimSuffix(validateURL.Path, "/"), "/api/v3")
+	return &url.URL{Scheme: validateURL.Scheme, Host: validateURL.Host, Path: p}
+}
+
+// SetOrgTeam restricts logins to members of any of the orgs, separated by
+// a comma, and if team is set to members of any of those teams (slugs) in
+// them. A team given as "org:team" is in that org, rather than the orgs.
 func (p *GitHubProvider) SetOrgTeam(org, team string) {
-	p.Org = org
+	p.Orgs = nil
+	for _, o := range strings.Split(org, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			p.Orgs = append(p.Orgs, o)
+		}
+	}
 	p.Team = team
-	if org != "" || team != "" {
+	if len(p.Orgs) > 0 || team != "" {
 		p.Scope += " read:org"
 	}
 }
 
-func (p *GitHubProvider) hasOrg(accessToken string) (bool, error) {
-	// https://developer.github.com/v3/orgs/#list-your-organizations
-	var orgs []struct {
-		Login string `json:"login"`
+// org is the organization whose SAML identities and verified domains are
+// used, the first of Orgs
+func (p *GitHubProvider) org() string {
+	if len(p.Orgs) == 0 {
+		return ""
+	}
+	return p.Orgs[0]
+}
+
+// isOrg returns the configured org matching login, case-insensitively as
+// GitHub does, or "" if there is none
+func (p *GitHubProvider) isOrg(login string) string {
+	for _, o := range p.Orgs {
+		if strings.EqualFold(o, login) {
+			return o
+		}
+	}
+	return ""
+}
+
+// SetEnterprise restricts logins to members of a GitHub Enterprise Cloud
+// enterprise, identified by its slug
+func (p *GitHubProvider) SetEnterprise(enterprise string) {
+	p.Enterprise = enterprise
+	if enterprise != "" {
+		p.Scope += " read:enterprise"
+	}
+}
+
+// SetRepo restricts logins to collaborators of repo ("owner/repo") with
+// push, maintain or admin permission
+func (p *GitHubProvider) SetRepo(repo string) {
+	p.Repo = repo
+}
+
+// SetSAMLIdentity uses the SAML identity linked to each login by the Org's
+// SAML single sign-on as the session email instead of the GitHub primary
+// email. Reading external identities requires an Org owner's token.
+func (p *GitHubProvider) SetSAMLIdentity(enabled bool, token string) {
+	p.SAMLIdentity = enabled
+	p.SAMLToken = token
+}
+
+// SetVerifiedDomainEmail only accepts session emails in one of the Org's
+// verified domains. Reading an Org's domains requires an Org owner's token,
+// see SetSAMLIdentity.
+func (p *GitHubProvider) SetVerifiedDomainEmail(enabled bool) {
+	p.VerifiedDomainEmail = enabled
+}
+
+// SetEmailAsUsername uses the public profile email of the user, if set, as
+// the username rather than the login
+func (p *GitHubProvider) SetEmailAsUsername(enabled bool) {
+	p.EmailAsUsername = enabled
+}
+
+// SetFineGrainedTokenError fails the org/team membership check with
+// ErrTokenCannotVerifyMembership, rather than denying the login, if the
+// access token looks like a fine-grained personal access token and no orgs
+// or teams are listed with it
+func (p *GitHubProvider) SetFineGrainedTokenError(enabled bool) {
+	p.FineGrainedTokenError = enabled
+}
+
+// isFineGrainedToken returns true if the access token is a fine-grained
+// personal access token: it has their prefix, and GitHub reported no OAuth
+// scopes for it, as fine-grained tokens have permissions instead
+func isFineGrainedToken(accessToken string, header http.Header) bool {
+	return strings.HasPrefix(accessToken, "github_pat_") && header.Get("X-OAuth-Scopes") == ""
+}
+
+// SetInstallationIdentity takes access tokens to be GitHub App installation
+// tokens, rather than user OAuth tokens, using identity as the email of
+// their sessions; "" for user tokens. The installation must be on the org
+// set with SetOrgTeam.
+func (p *GitHubProvider) SetInstallationIdentity(identity string) {
+	p.InstallationIdentity = identity
+}
+
+// SessionFromToken returns the session of an installation token presented
+// as a bearer token, or ErrInvalidInstallationToken if it is not valid for
+// an installation on the org. Without InstallationIdentity it returns nil,
+// as sessions of user tokens come from redeeming a login.
+func (p *GitHubProvider) SessionFromToken(ctx context.Context, token string) (*SessionState, error) {
+	if p.InstallationIdentity == "" {
+		return nil, nil
+	}
+	s := &SessionState{AccessToken: token}
+	email, err := p.GetEmailAddress(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if email == "" {
+		return nil, ErrInvalidInstallationToken
+	}
+	s.Email = email
+	s.User, _ = p.GetUserName(ctx, s)
+	return s, nil
+}
+
+// authorization returns the Authorization header value for token: with the
+// Bearer scheme for installation tokens, otherwise the token scheme
+func (p *GitHubProvider) authorization(token string) string {
+	if p.InstallationIdentity != "" {
+		return "Bearer " + token
+	}
+	return "token " + token
+}
+
+// SetLoginFromID uses "#<id>" as the login of a user whose /user has an id
+// but no login, rather than failing the login
+func (p *GitHubProvider) SetLoginFromID(enabled bool) {
+	p.LoginFromID = enabled
+}
+
+// SetUnverifiedEmail uses the primary, else the first, email of a user
+// without a verified email, rather than denying the login
+func (p *GitHubProvider) SetUnverifiedEmail(enabled bool) {
+	p.UnverifiedEmail = enabled
+}
+
+// GitHubEmailSources are the sources of the session email:
+// "saml", the SAML identity (NameID) linked to the login in the org;
+// "primary", the primary email of the account;
+// "profile", the public email on the login's profile
+var GitHubEmailSources = []string{"saml", "primary", "profile"}
+
+// SetEmailSources sets the order in which GitHubEmailSources are tried
+func (p *GitHubProvider) SetEmailSources(sources []string) {
+	p.EmailSources = sources
+}
+
+func (p *GitHubProvider) emailSources() []string {
+	if len(p.EmailSources) > 0 {
+		return p.EmailSources
 	}
-	type orgsPage []struct {
-		Login string `json:"login"`
+	if p.SAMLIdentity {
+		return []string{"saml"}
 	}
+	return []string{"primary"}
+}
+
+// SetMembershipCacheTTL caches the result of the org/team membership check
+// for each access token for about ttl (±10%, so that entries cached at the
+// same time expire staggered). A ttl of 0 disables the cache.
+func (p *GitHubProvider) SetMembershipCacheTTL(ttl time.Duration) {
+	if ttl > 0 {
+		p.membership = newMembershipCache(ttl)
+	} else {
+		p.membership = nil
+	}
+}
+
+// SetMembershipRetry retries a failed org/team membership check once after
+// delay, as a newly added member may not be listed by the API straight away
+func (p *GitHubProvider) SetMembershipRetry(delay time.Duration) {
+	p.MembershipRetry = delay
+}
 
-	for pn := 1; pn <= 10; pn++ {
-		params := url.Values{
-			"limit": {"100"},
-			"page":  {strconv.Itoa(pn)},
+// SetMaxPages bounds how many pages of the orgs, teams or emails of a user
+// are requested. 0 uses DefaultGitHubMaxPages.
+func (p *GitHubProvider) SetMaxPages(n int) {
+	p.MaxPages = n
+}
+
+// SetMaxTeams bounds how many of the user's teams are fetched when looking
+// for a matching team, before the user is denied. 0 is unlimited.
+func (p *GitHubProvider) SetMaxTeams(n int) {
+	p.MaxTeams = n
+}
+
+// SetAllGroups records every configured org, or team, the user is a member
+// of in the session Groups, rather than only the first found, at the cost
+// of fetching all of the user's orgs or teams
+func (p *GitHubProvider) SetAllGroups(enabled bool) {
+	p.AllGroups = enabled
+}
+
+// SetCoalesceRequests shares one API request, and its response, between
+// identical GET requests for the same token made concurrently, e.g. by
+// several requests of a user arriving at once
+func (p *GitHubProvider) SetCoalesceRequests(enabled bool) {
+	if enabled {
+		p.requests = newRequestGroup()
+	} else {
+		p.requests = nil
+	}
+}
+
+// SetRateLimitMaxWait retries a rate limited API request once, after
+// waiting until the rate limit resets but at most maxWait
+func (p *GitHubProvider) SetRateLimitMaxWait(maxWait time.Duration) {
+	p.RateLimitMaxWait = maxWait
+}
+
+// SetAbuseBackoffMax holds back all API requests, for the Retry-After of a
+// secondary rate limit response but at most maxWait
+func (p *GitHubProvider) SetAbuseBackoffMax(maxWait time.Duration) {
+	p.AbuseBackoffMax = maxWait
+}
+
+// SetTimeout bounds each GitHub API request, including reading the response
+// body, to timeout. A timeout of 0 disables the bound.
+func (p *GitHubProvider) SetTimeout(timeout time.Duration) {
+	p.client = newGitHubClient(timeout)
+}
+
+// RateLimit returns the GitHub API rate limit status from the latest response
+func (p *GitHubProvider) RateLimit() *RateLimit {
+	return p.rateLimit.get()
+}
+
+// githubScopes lists the scopes which include each scope required for the
+// org, team and enterprise checks, and the SAML identity lookup
+// https://docs.github.com/en/apps/oauth-apps/building-oauth-apps/scopes-for-oauth-apps
+var githubScopes = map[string][]string{
+	"read:org":        {"read:org", "write:org", "admin:org"},
+	"read:enterprise": {"read:enterprise", "admin:enterprise"},
+	"admin:org":       {"admin:org"},
+}
+
+func (p *GitHubProvider) requiredScopes() []string {
+	var required []string
+	if len(p.Orgs) > 0 || p.Team != "" {
+		required = append(required, "read:org")
+	}
+	if p.Enterprise != "" {
+		required = append(required, "read:enterprise")
+	}
+	return required
+}
+
+// checkScopes returns an error if the X-OAuth-Scopes granted to the token,
+// reported in every GitHub API response, lack a scope required for the
+// configured checks, which would otherwise fail or be incomplete
+func (p *GitHubProvider) checkScopes(resp *http.Response) error {
+	return checkGrantedScopes(resp, p.requiredScopes())
+}
+
+func checkGrantedScopes(resp *http.Response, requiredScopes []string) error {
+	header, ok := resp.Header["X-Oauth-Scopes"]
+	if !ok {
+		return nil
+	}
+	granted := make(map[string]bool)
+	for _, h := range header {
+		for _, scope := range strings.Split(h, ",") {
+			granted[strings.TrimSpace(scope)] = true
 		}
-		endpoint := &url.URL{
-			Scheme:   p.ValidateURL.Scheme,
-			Host:     p.ValidateURL.Host,
-			Path:     path.Join(p.ValidateURL.Path, "/user/orgs"),
-			RawQuery: params.Encode(),
+	}
+	for _, required := range requiredScopes {
+		found := false
+		for _, scope := range githubScopes[required] {
+			found = found || granted[scope]
+		}
+		if !found {
+			return fmt.Errorf("insufficient scope: token has scopes %q, %s is required",
+				strings.Join(header, ","), required)
+		}
+	}
+	return nil
+}
+
+// DefaultGitHubTimeout bounds each GitHub API request, including reading
+// the response body, unless changed with SetTimeout
+const DefaultGitHubTimeout = 30 * time.Second
+
+// newGitHubClient returns a client which only follows redirects of API
+// requests within the same origin, keeping the Authorization header. A
+// redirect to another origin, e.g. by an enterprise reverse proxy, would
+// drop the header and lead to a confusing 401, so it is an error instead.
+func newGitHubClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			orig := via[0]
+			if req.URL.Scheme != orig.URL.Scheme || !strings.EqualFold(req.URL.Host, orig.URL.Host) {
+				return fmt.Errorf("not following redirect to another origin %s://%s, which would drop the Authorization header; check the validate-url",
+					req.URL.Scheme, req.URL.Host)
+			}
+			if auth := orig.Header.Get("Authorization"); auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			return nil
+		},
+	}
+}
+
+// apiRequest performs a GitHub API request on behalf of the login for
+// session s, enforcing the per-login CallBudget if one is configured. The
+// scopes granted to the session's token are checked on the first response.
+// The request is canceled with ctx.
+func (p *GitHubProvider) apiRequest(ctx context.Context, s *SessionState, req *http.Request) (*http.Response, error) {
+	if p.CallBudget > 0 {
+		if s.providerCalls >= p.CallBudget {
+			return nil, fmt.Errorf("provider call budget exceeded: %d calls made for this login, not requesting %q",
+				s.providerCalls, req.URL.String())
+		}
+		s.providerCalls++
+	}
+	client := p.client
+	if client == nil {
+		client = newGitHubClient(DefaultGitHubTimeout)
+	}
+	req = req.WithContext(ctx)
+	do := func(req *http.Request) (*http.Response, error) {
+		if err := p.backoff.wait(req.Context()); err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err == nil && p.AbuseBackoffMax > 0 {
+			p.observeAbuse(req, resp)
+		}
+		if err == nil && p.RateLimitMaxWait > 0 {
+			resp, err = p.retryRateLimited(client, req, resp)
 		}
-		req, _ := http.NewRequest("GET", endpoint.String(), nil)
-		req.Header.Set("Accept", "application/vnd.github.v3+json")
-		req.Header.Set("Authorization", fmt.Sprintf("token %s", accessToken))
-		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			p.rateLimit.observe(resp.Header)
+			if p.MaxBodySize > 0 {
+				resp.Body = limitBody(resp.Body, p.MaxBodySize)
+			}
+		}
+		return resp, err
+	}
+	var resp *http.Response
+	var err error
+	if p.requests != nil {
+		resp, err = p.requests.Do(req, do)
+	} else {
+		resp, err = do(req)
+	}
+	if err != nil && ctx.Err() != nil {
+		// rather than the *url.Error it is wrapped in
+		err = ctx.Err()
+	}
+	if err != nil || s.scopesChecked || req.Header.Get("Authorization") != p.authorization(s.AccessToken) {
+		return resp, err
+	}
+	s.scopesChecked = true
+	if err := p.checkScopes(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// rateLimitWait returns how long to wait before retrying a request which was
+// rate limited, from the Retry-After or X-RateLimit-Reset header, and false
+// if resp is not a rate limit response
+func rateLimitWait(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	// https://docs.github.com/en/rest/using-the-rest-api/rate-limits-for-the-rest-api#exceeding-the-rate-limit
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") != "0" {
+		// e.g. a 403 for a missing scope or SSO authorization
+		return 0, false
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return 0, true
+	}
+	if wait := time.Unix(reset, 0).Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
+
+// observeAbuse pauses all API requests if resp is a secondary rate limit
+// response, which GitHub sends with a Retry-After header
+func (p *GitHubProvider) observeAbuse(req *http.Request, resp *http.Response) {
+	if resp.Header.Get("Retry-After") == "" {
+		return
+	}
+	wait, limited := rateLimitWait(resp, time.Now())
+	if !limited {
+		return
+	}
+	if wait > p.AbuseBackoffMax {
+		wait = p.AbuseBackoffMax
+	}
+	logger.Printf("secondary rate limit by %s, holding back API requests for %s", req.URL.Host, wait)
+	p.backoff.pause(wait)
+}
+
+// retryRateLimited retries req once if resp is a rate limit response, after
+// waiting until the limit resets, but at most RateLimitMaxWait
+func (p *GitHubProvider) retryRateLimited(client *http.Client, req *http.Request, resp *http.Response) (*http.Response, error) {
+	wait, limited := rateLimitWait(resp, time.Now())
+	if !limited || (req.Body != nil && req.GetBody == nil) {
+		return resp, nil
+	}
+	if wait > p.RateLimitMaxWait {
+		wait = p.RateLimitMaxWait
+	}
+	p.rateLimit.observe(resp.Header)
+	resp.Body.Close()
+	logger.Printf("rate limited by %s, retrying in %s", req.URL.Host, wait)
+	select {
+	case <-time.After(wait):
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
 		if err != nil {
-			return false, err
+			return nil, err
+		}
+		req.Body = body
+	}
+	return client.Do(req)
+}
+
+// DefaultGitHubMaxPages bounds how many pages paginate will request, unless
+// changed with SetMaxPages. With 100 items per page it allows for members
+// of thousands of orgs or teams. The Bitbucket provider shares it.
+const DefaultGitHubMaxPages = 100
+
+var githubNextLinkPattern = regexp.MustCompile(`<([^>]+)>; rel="next"`)
+
+// paginate requests apiURL and each following page, calling perItem with
+// each element of the JSON array returned, until perItem returns stop, or
+// there are no more pages. Following pages are found from the Link header's
+// rel="next" URL. Without a Link header, if apiURL has a page parameter it
+// is incremented until a page is empty, as not all endpoints report the
+// total; otherwise there are no more pages.
+func (p *GitHubProvider) paginate(ctx context.Context, s *SessionState, apiURL, accept string, perItem func(item json.RawMessage) (stop bool, err error)) error {
+	_, err := p.paginateHeader(ctx, s, apiURL, accept, perItem)
+	return err
+}
+
+// paginateHeader paginates as paginate does, also returning the header of
+// the first page
+func (p *GitHubProvider) paginateHeader(ctx context.Context, s *SessionState, apiURL, accept string, perItem func(item json.RawMessage) (stop bool, err error)) (http.Header, error) {
+	var header http.Header
+	maxPages := p.MaxPages
+	if maxPages <= 0 {
+		maxPages = DefaultGitHubMaxPages
+	}
+	pageURL := apiURL
+	for i := 0; i < maxPages; i++ {
+		req, _ := http.NewRequest("GET", pageURL, nil)
+		req.Header.Set("Accept", accept)
+		req.Header.Set("Authorization", p.authorization(s.AccessToken))
+		resp, err := p.apiRequest(ctx, s, req)
+		if err != nil {
+			return header, err
+		}
+		if header == nil {
+			header = resp.Header
 		}
 
 		body, err := ioutil.ReadAll(resp.Body)
 		resp.Body.Close()
 		if err != nil {
-			return false, err
+			return header, err
 		}
 		if resp.StatusCode != 200 {
-			return false, fmt.Errorf(
-				"got %d from %q %s", resp.StatusCode, endpoint.String(), body)
+			return header, fmt.Errorf(
+				"got %d from %q %s", resp.StatusCode, pageURL, body)
 		}
 
-		var op orgsPage
-		if err := json.Unmarshal(body, &op); err != nil {
-			return false, err
+		var items []json.RawMessage
+		if err := json.Unmarshal(body, &items); err != nil {
+			return header, fmt.Errorf("%s unmarshaling %s", err, body)
 		}
-		if len(op) == 0 {
-			break
+		for _, item := range items {
+			stop, err := perItem(item)
+			if err != nil || stop {
+				return header, err
+			}
 		}
 
-		orgs = append(orgs, op...)
+		if matches := githubNextLinkPattern.FindStringSubmatch(resp.Header.Get("Link")); matches != nil {
+			if pageURL, err = nextPageURL(matches[1], p.ValidateURL); err != nil {
+				return header, err
+			}
+			continue
+		}
+		u, err := url.Parse(pageURL)
+		if err != nil {
+			return header, err
+		}
+		params := u.Query()
+		pn, err := strconv.Atoi(params.Get("page"))
+		if err != nil || len(items) == 0 {
+			return header, nil
+		}
+		params.Set("page", strconv.Itoa(pn+1))
+		u.RawQuery = params.Encode()
+		pageURL = u.String()
 	}
+	logger.Printf("WARNING: stopped after %d pages of %s, not requesting %q", maxPages, apiURL, pageURL)
+	return header, nil
+}
 
+func (p *GitHubProvider) hasOrg(ctx context.Context, s *SessionState) (bool, error) {
+	// https://developer.github.com/v3/orgs/#list-your-organizations
+	params := url.Values{
+		"per_page": {"100"},
+		"page":     {"1"},
+	}
+	endpoint := &url.URL{
+		Scheme:   p.ValidateURL.Scheme,
+		Host:     p.ValidateURL.Host,
+		Path:     path.Join(p.ValidateURL.Path, "/user/orgs"),
+		RawQuery: params.Encode(),
+	}
+
+	var found bool
 	var presentOrgs []string
-	for _, org := range orgs {
-		if p.Org == org.Login {
-			log.Printf("Found Github Organization: %q", org.Login)
-			return true, nil
+	header, err := p.paginateHeader(ctx, s, endpoint.String(), "application/vnd.github.v3+json", func(item json.RawMessage) (bool, error) {
+		var org struct {
+			Login string `json:"login"`
+		}
+		if err := json.Unmarshal(item, &org); err != nil {
+			return false, err
+		}
+		// org logins and team slugs are case-insensitive
+		if matched := p.isOrg(org.Login); matched != "" {
+			logger.Printf("Found Github Organization: %q", matched)
+			if !found {
+				s.Groups = nil
+			}
+			s.Groups = append(s.Groups, org.Login)
+			found = true
+			return !p.AllGroups, nil
 		}
 		presentOrgs = append(presentOrgs, org.Login)
+		return false, nil
+	})
+	if found {
+		if err != nil {
+			logger.Printf("WARNING: listing the remaining orgs failed, Groups are incomplete: %s", err)
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, err
 	}
 
-	log.Printf("Missing Organization:%q in %v", p.Org, presentOrgs)
+	if len(presentOrgs) == 0 {
+		if p.FineGrainedTokenError && isFineGrainedToken(s.AccessToken, header) {
+			return false, ErrTokenCannotVerifyMembership
+		}
+		logger.Printf("Missing Organization:%q, not a member of any organization", p.Orgs)
+		return false, nil
+	}
+	logger.Printf("Missing Organization:%q in %v", p.Orgs, presentOrgs)
 	return false, nil
 }
 
-func (p *GitHubProvider) hasOrgAndTeam(accessToken string) (bool, error) {
-	// https://developer.github.com/v3/orgs/teams/#list-user-teams
+// githubTeam is an entry of the Team list, with Org empty unless it was
+// given as "org:team". A team given as all digits is matched by its slug or
+// its ID, which unlike the slug does not change when the team is renamed.
+type githubTeam struct {
+	Org  string
+	Slug string
+	ID   int64
+}
 
-	var teams []struct {
-		Name string `json:"name"`
-		Slug string `json:"slug"`
-		Org  struct {
-			Login string `json:"login"`
-		} `json:"organization"`
+func splitTeam(entry string) githubTeam {
+	var t githubTeam
+	entry = strings.TrimSpace(entry)
+	if i := strings.Index(entry, ":"); i >= 0 {
+		t.Org, entry = entry[:i], entry[i+1:]
+	}
+	t.Slug = entry
+	if strings.Trim(entry, "0123456789") == "" {
+		t.ID, _ = strconv.ParseInt(entry, 10, 64)
 	}
+	return t
+}
+
+// matches returns true if the team with slug and id is this entry
+func (t githubTeam) matches(slug string, id int64) bool {
+	return strings.EqualFold(t.Slug, slug) || (t.ID != 0 && t.ID == id)
+}
 
+func (p *GitHubProvider) hasOrgAndTeam(ctx context.Context, s *SessionState) (bool, error) {
+	// https://developer.github.com/v3/orgs/teams/#list-user-teams
 	params := url.Values{
-		"limit": {"100"},
+		"per_page": {"100"},
+		"page":     {"1"},
 	}
 	endpoint := &url.URL{
 		Scheme:   p.ValidateURL.Scheme,
@@ -138,132 +779,721 @@ func (p *GitHubProvider) hasOrgAndTeam(accessToken string) (bool, error) {
 		Path:     path.Join(p.ValidateURL.Path, "/user/teams"),
 		RawQuery: params.Encode(),
 	}
-	team_url := endpoint.String()
 
-	pattern := regexp.MustCompile(`<([^>]+)>; rel="next"`)
+	var found bool
 	var hasOrg bool
+	var fetched int
+	// stop once MaxTeams teams were fetched, without requesting another page
+	maxTeams := func() bool {
+		if p.MaxTeams > 0 && fetched >= p.MaxTeams {
+			logger.Printf("WARNING: stopped looking for Team:%q after %d teams (github-max-teams)", p.Team, fetched)
+			return true
+		}
+		return false
+	}
 	presentOrgs := make(map[string]bool)
 	var presentTeams []string
+	var ts []githubTeam
+	for _, t := range strings.Split(p.Team, ",") {
+		ts = append(ts, splitTeam(t))
+	}
 
-	for i := 0; i < 10; i++ {
-		req, _ := http.NewRequest("GET", team_url, nil)
-		req.Header.Set("Accept", "application/vnd.github.hellcat-preview+json")
-		req.Header.Set("Authorization", fmt.Sprintf("token %s", accessToken))
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return false, err
+	header, err := p.paginateHeader(ctx, s, endpoint.String(), "application/vnd.github.hellcat-preview+json", func(item json.RawMessage) (bool, error) {
+		var team struct {
+			ID    int64  `json:"id"`
+			Name  string `json:"name"`
+			Slug  string `json:"slug"`
+			State string `json:"state"`
+			Org   struct {
+				Login string `json:"login"`
+			} `json:"organization"`
 		}
-
-		body, err := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
+		if err := json.Unmarshal(item, &team); err != nil {
 			return false, err
 		}
-		if resp.StatusCode != 200 {
-			return false, fmt.Errorf(
-				"got %d from %q %s", resp.StatusCode, endpoint.String(), body)
-		}
-
-		if err := json.Unmarshal(body, &teams); err != nil {
-			return false, fmt.Errorf("%s unmarshaling %s", err, body)
+		fetched++
+		if team.State != "" && team.State != "active" {
+			// e.g. a pending invitation, or a membership just removed
+			logger.Printf("Ignoring Github Organization:%q Team:%q in state %q",
+				team.Org.Login, team.Slug, team.State)
+			return maxTeams(), nil
 		}
-
-		for _, team := range teams {
-			presentOrgs[team.Org.Login] = true
-			if p.Org == team.Org.Login {
-				hasOrg = true
-				ts := strings.Split(p.Team, ",")
-				for _, t := range ts {
-					if t == team.Slug {
-						log.Printf("Found Github Organization:%q Team:%q (Name:%q)",
-							team.Org.Login, team.Slug, team.Name)
-						return true, nil
-					}
+		presentOrgs[team.Org.Login] = true
+		inOrg := false
+		for _, t := range ts {
+			if t.Org != "" {
+				if !strings.EqualFold(t.Org, team.Org.Login) {
+					continue
+				}
+			} else if p.isOrg(team.Org.Login) == "" {
+				continue
+			}
+			inOrg = true
+			if t.matches(team.Slug, team.ID) {
+				logger.Printf("Found Github Organization:%q Team:%q (ID:%d Name:%q)",
+					team.Org.Login, team.Slug, team.ID, team.Name)
+				if !found {
+					s.Groups = nil
+				}
+				s.Groups = append(s.Groups, team.Org.Login+"/"+team.Slug)
+				found = true
+				if !p.AllGroups {
+					return true, nil
 				}
-				presentTeams = append(presentTeams, team.Slug)
+				return maxTeams(), nil
 			}
 		}
-
-		matches := pattern.FindStringSubmatch(resp.Header["Link"][0])
-		if len(matches) == 0 {
-			break
+		if inOrg {
+			hasOrg = true
+			presentTeams = append(presentTeams, team.Org.Login+":"+team.Slug)
+		}
+		return maxTeams(), nil
+	})
+	if found {
+		if err != nil {
+			logger.Printf("WARNING: listing the remaining teams failed, Groups are incomplete: %s", err)
 		}
-		team_url = matches[1]
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if fetched == 0 && p.FineGrainedTokenError && isFineGrainedToken(s.AccessToken, header) {
+		return false, ErrTokenCannotVerifyMembership
 	}
 
 	if hasOrg {
-		log.Printf("Missing Team:%q from Org:%q in teams: %v", p.Team, p.Org, presentTeams)
+		logger.Printf("Missing Team:%q from Org:%q in teams: %v", p.Team, p.Orgs, presentTeams)
 	} else {
 		var allOrgs []string
 		for org, _ := range presentOrgs {
 			allOrgs = append(allOrgs, org)
 		}
-		log.Printf("Missing Organization:%q in %#v", p.Org, allOrgs)
+		logger.Printf("Missing Organization:%q in %#v", p.Orgs, allOrgs)
 	}
 	return false, nil
 }
 
-func (p *GitHubProvider) GetEmailAddress(s *SessionState) (string, error) {
+// WarmUp checks that the SAMLToken, if configured, is accepted by the GitHub
+// API and has the scope needed to look up SAML identities
+func (p *GitHubProvider) WarmUp() error {
+	if p.SAMLToken == "" {
+		return nil
+	}
+	endpoint := &url.URL{
+		Scheme: p.ValidateURL.Scheme,
+		Host:   p.ValidateURL.Host,
+		Path:   path.Join(p.ValidateURL.Path, "/user"),
+	}
+	req, _ := http.NewRequest("GET", endpoint.String(), nil)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("Authorization", fmt.Sprintf("token %s", p.SAMLToken))
+	resp, err := p.apiRequest(context.Background(), &SessionState{}, req)
+	if err != nil {
+		return fmt.Errorf("github-saml-token: %s", err)
+	}
 
-	var emails []struct {
-		Email   string `json:"email"`
-		Primary bool   `json:"primary"`
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("github-saml-token: %s", err)
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf(
+			"github-saml-token: got %d from %q %s", resp.StatusCode, endpoint.String(), body)
+	}
+	if err := checkGrantedScopes(resp, []string{"admin:org"}); err != nil {
+		return fmt.Errorf("github-saml-token: %s", err)
 	}
+	return nil
+}
 
-	// if we require an Org or Team, check that first
-	if p.Org != "" {
-		if p.Team != "" {
-			if ok, err := p.hasOrgAndTeam(s.AccessToken); err != nil || !ok {
-				return "", err
-			}
-		} else {
-			if ok, err := p.hasOrg(s.AccessToken); err != nil || !ok {
-				return "", err
-			}
-		}
+// graphqlURL is derived from the API base: https://api.github.com/graphql
+// for github.com, http(s)://<enterprise github host>/api/graphql for GitHub Enterprise
+func (p *GitHubProvider) graphqlURL() *url.URL {
+	basePath := p.ValidateURL.Path
+	if strings.HasSuffix(strings.TrimSuffix(basePath, "/"), "/v3") {
+		basePath = path.Dir(strings.TrimSuffix(basePath, "/"))
+	}
+	return &url.URL{
+		Scheme: p.ValidateURL.Scheme,
+		Host:   p.ValidateURL.Host,
+		Path:   path.Join(basePath, "/graphql"),
+	}
+}
+
+func (p *GitHubProvider) hasEnterprise(ctx context.Context, s *SessionState) (bool, error) {
+	// an enterprise is only visible to its members
+	// https://docs.github.com/en/graphql/reference/queries#enterprise
+	query, _ := json.Marshal(map[string]interface{}{
+		"query":     `query($slug: String!) { enterprise(slug: $slug) { slug } }`,
+		"variables": map[string]string{"slug": p.Enterprise},
+	})
+
+	endpoint := p.graphqlURL()
+	req, _ := http.NewRequest("POST", endpoint.String(), bytes.NewReader(query))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", p.authorization(s.AccessToken))
+	resp, err := p.apiRequest(ctx, s, req)
+	if err != nil {
+		return false, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == 404 {
+		// e.g. older GitHub Enterprise Server without the GraphQL API
+		logger.Printf("Enterprise API not available at %q, can not verify membership of Enterprise:%q",
+			endpoint.String(), p.Enterprise)
+		return false, nil
+	}
+	if resp.StatusCode != 200 {
+		return false, fmt.Errorf(
+			"got %d from %q %s", resp.StatusCode, endpoint.String(), body)
+	}
+
+	var result struct {
+		Data struct {
+			Enterprise *struct {
+				Slug string `json:"slug"`
+			} `json:"enterprise"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return false, fmt.Errorf("%s unmarshaling %s", err, body)
+	}
+
+	// slugs are case-insensitive, and GitHub returns the enterprise's own
+	// spelling rather than the configured one
+	if result.Data.Enterprise == nil || !strings.EqualFold(result.Data.Enterprise.Slug, p.Enterprise) {
+		logger.Printf("Missing Enterprise:%q", p.Enterprise)
+		return false, nil
+	}
+	logger.Printf("Found Github Enterprise: %q", p.Enterprise)
+	return true, nil
+}
+
+func (p *GitHubProvider) hasRepoAccess(ctx context.Context, s *SessionState) (bool, error) {
+	login, _, err := p.getUser(ctx, s)
+	if err != nil {
+		return false, err
 	}
 
+	// https://docs.github.com/en/rest/collaborators/collaborators#get-repository-permissions-for-a-user
 	endpoint := &url.URL{
 		Scheme: p.ValidateURL.Scheme,
 		Host:   p.ValidateURL.Host,
-		Path:   path.Join(p.ValidateURL.Path, "/user/emails"),
+		Path:   path.Join(p.ValidateURL.Path, "/repos", p.Repo, "/collaborators", login, "/permission"),
 	}
 	req, _ := http.NewRequest("GET", endpoint.String(), nil)
-	req.Header.Set("Authorization", fmt.Sprintf("token %s", s.AccessToken))
-	resp, err := http.DefaultClient.Do(req)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("Authorization", p.authorization(s.AccessToken))
+	resp, err := p.apiRequest(ctx, s, req)
+	if err != nil {
+		return false, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == 404 {
+		// not a collaborator, or the repo is not visible to the user
+		logger.Printf("Missing Repo:%q for %q", p.Repo, login)
+		return false, nil
+	}
+	if resp.StatusCode != 200 {
+		return false, fmt.Errorf(
+			"got %d from %q %s", resp.StatusCode, endpoint.String(), body)
+	}
+
+	var perm struct {
+		Permission string `json:"permission"`
+		User       struct {
+			Permissions struct {
+				Admin    bool `json:"admin"`
+				Maintain bool `json:"maintain"`
+				Push     bool `json:"push"`
+			} `json:"permissions"`
+		} `json:"user"`
+	}
+	if err := json.Unmarshal(body, &perm); err != nil {
+		return false, fmt.Errorf("%s unmarshaling %s", err, body)
+	}
+
+	// "permission" is the legacy admin, write or read, which maps maintain
+	// to write, so push access is either of them
+	ps := perm.User.Permissions
+	if ps.Admin || ps.Maintain || ps.Push || perm.Permission == "admin" || perm.Permission == "write" {
+		logger.Printf("Found Github Repo:%q for %q (Permission:%q)", p.Repo, login, perm.Permission)
+		return true, nil
+	}
+	logger.Printf("Missing push access to Repo:%q for %q (Permission:%q)", p.Repo, login, perm.Permission)
+	return false, nil
+}
+
+func (p *GitHubProvider) getSAMLIdentity(ctx context.Context, s *SessionState, login string) (string, error) {
+	// https://docs.github.com/en/graphql/reference/objects#externalidentity
+	query, _ := json.Marshal(map[string]interface{}{
+		"query": `query($org: String!, $login: String!) {
+  organization(login: $org) {
+    samlIdentityProvider {
+      externalIdentities(first: 1, login: $login) {
+        nodes { samlIdentity { nameId } user { login } }
+      }
+    }
+  }
+}`,
+		"variables": map[string]string{"org": p.org(), "login": login},
+	})
+
+	authorization := p.authorization(s.AccessToken)
+	if p.SAMLToken != "" {
+		authorization = "token " + p.SAMLToken
+	}
+	endpoint := p.graphqlURL()
+	req, _ := http.NewRequest("POST", endpoint.String(), bytes.NewReader(query))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", authorization)
+	resp, err := p.apiRequest(ctx, s, req)
 	if err != nil {
 		return "", err
 	}
+
 	body, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
 	if err != nil {
 		return "", err
 	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf(
+			"got %d from %q %s", resp.StatusCode, endpoint.String(), body)
+	}
+
+	var result struct {
+		Data struct {
+			Organization *struct {
+				SAMLIdentityProvider *struct {
+					ExternalIdentities struct {
+						Nodes []struct {
+							SAMLIdentity *struct {
+								NameID string `json:"nameId"`
+							} `json:"samlIdentity"`
+							User *struct {
+								Login string `json:"login"`
+							} `json:"user"`
+						} `json:"nodes"`
+					} `json:"externalIdentities"`
+				} `json:"samlIdentityProvider"`
+			} `json:"organization"`
+		} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("%s unmarshaling %s", err, body)
+	}
+	if len(result.Errors) > 0 {
+		return "", fmt.Errorf("error looking up SAML identity for %q in Organization:%q %s",
+			login, p.org(), result.Errors[0].Message)
+	}
+	org := result.Data.Organization
+	if org == nil || org.SAMLIdentityProvider == nil {
+		return "", fmt.Errorf("Organization:%q has no SAML identity provider", p.org())
+	}
+	for _, node := range org.SAMLIdentityProvider.ExternalIdentities.Nodes {
+		if node.User != nil && strings.EqualFold(node.User.Login, login) &&
+			node.SAMLIdentity != nil && node.SAMLIdentity.NameID != "" {
+			logger.Printf("Found SAML identity %q for %q", node.SAMLIdentity.NameID, login)
+			return node.SAMLIdentity.NameID, nil
+		}
+	}
+	logger.Printf("Missing SAML identity for %q in Organization:%q", login, p.org())
+	return "", nil
+}
+
+func (p *GitHubProvider) getVerifiedDomains(ctx context.Context, s *SessionState) ([]string, error) {
+	// https://docs.github.com/en/graphql/reference/objects#verifiabledomain
+	query, _ := json.Marshal(map[string]interface{}{
+		"query": `query($org: String!) {
+  organization(login: $org) {
+    domains(first: 100, isVerified: true) { nodes { domain } }
+  }
+}`,
+		"variables": map[string]string{"org": p.org()},
+	})
+
+	authorization := p.authorization(s.AccessToken)
+	if p.SAMLToken != "" {
+		authorization = "token " + p.SAMLToken
+	}
+	endpoint := p.graphqlURL()
+	req, _ := http.NewRequest("POST", endpoint.String(), bytes.NewReader(query))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", authorization)
+	resp, err := p.apiRequest(ctx, s, req)
+	if err != nil {
+		return nil, err
+	}
 
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("got %d from %q %s",
-			resp.StatusCode, endpoint.String(), body)
+		return nil, fmt.Errorf(
+			"got %d from %q %s", resp.StatusCode, endpoint.String(), body)
 	}
 
-	log.Printf("got %d from %q %s", resp.StatusCode, endpoint.String(), body)
+	var result struct {
+		Data struct {
+			Organization *struct {
+				Domains struct {
+					Nodes []struct {
+						Domain string `json:"domain"`
+					} `json:"nodes"`
+				} `json:"domains"`
+			} `json:"organization"`
+		} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("%s unmarshaling %s", err, body)
+	}
+	if len(result.Errors) > 0 {
+		return nil, fmt.Errorf("error looking up verified domains of Organization:%q %s",
+			p.org(), result.Errors[0].Message)
+	}
+	if result.Data.Organization == nil {
+		return nil, fmt.Errorf("Organization:%q not found", p.org())
+	}
+	var domains []string
+	for _, node := range result.Data.Organization.Domains.Nodes {
+		domains = append(domains, node.Domain)
+	}
+	return domains, nil
+}
 
-	if err := json.Unmarshal(body, &emails); err != nil {
-		return "", fmt.Errorf("%s unmarshaling %s", err, body)
+func (p *GitHubProvider) hasMembership(ctx context.Context, s *SessionState) (bool, error) {
+	if p.Team != "" {
+		return p.hasOrgAndTeam(ctx, s)
+	}
+	return p.hasOrg(ctx, s)
+}
+
+// checkMembership checks the configured Orgs (and Team), consulting the
+// membership cache first if one is configured
+func (p *GitHubProvider) checkMembership(ctx context.Context, s *SessionState) (bool, error) {
+	if p.membership != nil {
+		if ok, groups, found := p.membership.Get(s.AccessToken); found {
+			s.Groups = groups
+			return ok, nil
+		}
+	}
+	ok, err := p.hasMembership(ctx, s)
+	if err == nil && !ok && p.MembershipRetry > 0 {
+		logger.Printf("retrying membership check in %s", p.MembershipRetry)
+		select {
+		case <-time.After(p.MembershipRetry):
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+		ok, err = p.hasMembership(ctx, s)
+	}
+	if err == nil && p.membership != nil {
+		p.membership.Set(s.AccessToken, ok, s.Groups)
+	}
+	return ok, err
+}
+
+// checkInstallation checks that an installation token is valid for an
+// installation on the org, with the result cached like checkMembership's
+func (p *GitHubProvider) checkInstallation(ctx context.Context, s *SessionState) (bool, error) {
+	if p.membership != nil {
+		if ok, _, found := p.membership.Get(s.AccessToken); found {
+			return ok, nil
+		}
+	}
+	ok, err := p.validateSessionState(ctx, s)
+	if err == nil && p.membership != nil {
+		p.membership.Set(s.AccessToken, ok, nil)
+	}
+	return ok, err
+}
+
+func (p *GitHubProvider) GetEmailAddress(ctx context.Context, s *SessionState) (string, error) {
+	if p.InstallationIdentity != "" {
+		if ok, err := p.checkInstallation(ctx, s); err != nil || !ok {
+			return "", err
+		}
+		return p.allowedEmail(p.InstallationIdentity, nil)
+	}
+
+	if p.Enterprise != "" {
+		if ok, err := p.hasEnterprise(ctx, s); err != nil || !ok {
+			return "", err
+		}
+	}
+
+	// if we require an Org or Team, check that first
+	if len(p.Orgs) > 0 || p.Team != "" {
+		if ok, err := p.checkMembership(ctx, s); err != nil || !ok {
+			return "", err
+		}
+	}
+
+	if p.Repo != "" {
+		if ok, err := p.hasRepoAccess(ctx, s); err != nil || !ok {
+			return "", err
+		}
 	}
 
-	for _, email := range emails {
+	var verifiedDomains []string
+	if p.VerifiedDomainEmail {
+		var err error
+		if verifiedDomains, err = p.getVerifiedDomains(ctx, s); err != nil {
+			return "", err
+		}
+	}
+
+	// ErrNoPrimaryEmail if the primary source had emails but none was
+	// usable, and no other source had one either
+	var noEmail error
+	for _, source := range p.emailSources() {
+		var email string
+		var err error
+		switch source {
+		case "saml":
+			email, err = p.getSAMLEmail(ctx, s)
+		case "primary":
+			email, err = p.getPrimaryEmail(ctx, s)
+			if err == ErrNoPrimaryEmail {
+				noEmail, err = err, nil
+			}
+		case "profile":
+			// the login comes with the email, so GetUserName need not
+			// fetch /user again
+			var login string
+			if login, email, err = p.getUser(ctx, s); err == nil {
+				s.User = p.userName(login, email)
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+		if email != "" && p.VerifiedDomainEmail && !inDomains(email, verifiedDomains) {
+			logger.Printf("email %q from source %q is not in a verified domain of Organization:%q %v",
+				email, source, p.org(), verifiedDomains)
+			continue
+		}
+		if email != "" {
+			return p.allowedEmail(email, nil)
+		}
+		logger.Printf("no email from source %q for %s", source, s)
+	}
+	return "", noEmail
+}
+
+func inDomains(email string, domains []string) bool {
+	i := strings.LastIndex(email, "@")
+	for _, d := range domains {
+		if i >= 0 && strings.EqualFold(email[i+1:], d) {
+			return true
+		}
+	}
+	return false
+}
+
+// getSAMLEmail returns the SAML identity linked to the login, which it also
+// sets as the session user
+func (p *GitHubProvider) getSAMLEmail(ctx context.Context, s *SessionState) (string, error) {
+	login, _, err := p.getUser(ctx, s)
+	if err != nil {
+		return "", err
+	}
+	s.User = login
+	return p.getSAMLIdentity(ctx, s, login)
+}
+
+func (p *GitHubProvider) getPrimaryEmail(ctx context.Context, s *SessionState) (string, error) {
+	// https://developer.github.com/v3/users/emails/#list-email-addresses-for-a-user
+	endpoint := &url.URL{
+		Scheme: p.ValidateURL.Scheme,
+		Host:   p.ValidateURL.Host,
+		Path:   path.Join(p.ValidateURL.Path, "/user/emails"),
+	}
+
+	// the primary email if verified, else the first verified email, else
+	// with UnverifiedEmail the primary or first email
+	var verified, unverified string
+	var unverifiedPrimary bool
+	var hasEmails bool
+	err := p.paginate(ctx, s, endpoint.String(), "application/vnd.github.v3+json", func(item json.RawMessage) (bool, error) {
+		var email struct {
+			Email    string `json:"email"`
+			Primary  bool   `json:"primary"`
+			Verified bool   `json:"verified"`
+		}
+		if err := json.Unmarshal(item, &email); err != nil {
+			return false, err
+		}
+		hasEmails = hasEmails || email.Email != ""
+		if !email.Verified {
+			if email.Email != "" && (unverified == "" || email.Primary && !unverifiedPrimary) {
+				unverified = email.Email
+				unverifiedPrimary = email.Primary
+			}
+			return false, nil
+		}
 		if email.Primary {
-			return email.Email, nil
+			verified = email.Email
+			return true, nil
+		}
+		if verified == "" {
+			verified = email.Email
+		}
+		return false, nil
+	})
+	if err == nil && verified == "" {
+		if p.UnverifiedEmail && unverified != "" {
+			logger.Printf("no verified email address for user, using unverified %q", unverified)
+			return unverified, nil
 		}
+		if hasEmails {
+			return "", ErrNoPrimaryEmail
+		}
+		logger.Printf("no email address for user")
 	}
+	return verified, err
+}
 
-	return "", nil
+// ValidateSessionState checks with GET /user that the session's access token
+// has not been revoked. The default implementation can't be used, as GitHub
+// no longer accepts the token as a query parameter. With AllGroups, the
+// org/team membership is checked again, updating the session's Groups. An
+// error indicates GitHub could not be reached, had a server error or rate
+// limited the request, so validity is unknown.
+func (p *GitHubProvider) ValidateSessionState(s *SessionState) (bool, error) {
+	return p.validateSessionState(context.Background(), s)
+}
+
+func (p *GitHubProvider) validateSessionState(ctx context.Context, s *SessionState) (bool, error) {
+	if s.AccessToken == "" || p.ValidateURL == nil {
+		return false, nil
+	}
+	// installation tokens can't read /user, but list the repositories the
+	// app is installed on
+	// https://docs.github.com/en/rest/apps/installations#list-repositories-accessible-to-the-app-installation
+	endpoint := &url.URL{
+		Scheme: p.ValidateURL.Scheme,
+		Host:   p.ValidateURL.Host,
+		Path:   path.Join(p.ValidateURL.Path, "/user"),
+	}
+	if p.InstallationIdentity != "" {
+		endpoint.Path = path.Join(p.ValidateURL.Path, "/installation/repositories")
+		endpoint.RawQuery = "per_page=1"
+	}
+	req, err := http.NewRequest("GET", endpoint.String(), nil)
+	if err != nil {
+		return false, fmt.Errorf("could not create new GET request: %v", err)
+	}
+	req.Header.Set("Authorization", p.authorization(s.AccessToken))
+	resp, err := p.apiRequest(ctx, s, req)
+	if err != nil {
+		return false, fmt.Errorf("token validation request failed: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode == 200 {
+		if p.InstallationIdentity != "" {
+			return p.isOrgInstallation(body)
+		}
+		if p.AllGroups && (len(p.Orgs) > 0 || p.Team != "") {
+			// the groups route-group is checked against may have changed
+			return p.checkMembership(context.Background(), s)
+		}
+		return true, nil
+	}
+	logger.Printf("token validation request failed: status %d - %s", resp.StatusCode, body)
+	if _, limited := rateLimitWait(resp, time.Now()); limited || resp.StatusCode == 429 || resp.StatusCode >= 500 {
+		return false, fmt.Errorf("token validation request failed: status %d", resp.StatusCode)
+	}
+	return false, nil
+}
+
+// isOrgInstallation checks that the repositories listed for an
+// installation token are in the org, so that tokens of installations of the
+// app on other accounts are not accepted
+func (p *GitHubProvider) isOrgInstallation(body []byte) (bool, error) {
+	var installation struct {
+		Repositories []struct {
+			Owner struct {
+				Login string `json:"login"`
+			} `json:"owner"`
+		} `json:"repositories"`
+	}
+	if err := json.Unmarshal(body, &installation); err != nil {
+		return false, fmt.Errorf("%s unmarshaling %s", err, body)
+	}
+	if len(installation.Repositories) == 0 {
+		logger.Printf("Missing Organization:%q, installation has no repositories", p.org())
+		return false, nil
+	}
+	if owner := installation.Repositories[0].Owner.Login; p.isOrg(owner) == "" {
+		logger.Printf("Missing Organization:%q, installation is on %q", p.org(), owner)
+		return false, nil
+	}
+	return true, nil
 }
 
-func (p *GitHubProvider) GetUserName(s *SessionState) (string, error) {
+// GetPreferredUsername returns the login of the user, even with
+// EmailAsUsername. Installation tokens have none.
+func (p *GitHubProvider) GetPreferredUsername(ctx context.Context, s *SessionState) (string, error) {
+	if s.PreferredUsername != "" || p.InstallationIdentity != "" {
+		return s.PreferredUsername, nil
+	}
+	login, _, err := p.getUser(ctx, s)
+	return login, err
+}
+
+// GetUserName returns the login of the user, or with EmailAsUsername their
+// public profile email if set. For installation tokens it is the
+// InstallationIdentity, up to an "@".
+func (p *GitHubProvider) GetUserName(ctx context.Context, s *SessionState) (string, error) {
+	if p.InstallationIdentity != "" {
+		return strings.Split(p.InstallationIdentity, "@")[0], nil
+	}
+	login, email, err := p.getUser(ctx, s)
+	if err != nil {
+		return "", err
+	}
+	return p.userName(login, email), nil
+}
+
+func (p *GitHubProvider) userName(login, email string) string {
+	if p.EmailAsUsername && email != "" {
+		return email
+	}
+	return login
+}
+
+// getUser returns the login and public profile email of the user; a user
+// without a login is an error, unless LoginFromID
+func (p *GitHubProvider) getUser(ctx context.Context, s *SessionState) (string, string, error) {
 	var user struct {
-		Login string `json:"login"`
-		Email string `json:"email"`
+		ID        int64  `json:"id"`
+		Login     string `json:"login"`
+		Email     string `json:"email"`
+		AvatarURL string `json:"avatar_url"`
 	}
 
 	endpoint := &url.URL{
@@ -274,31 +1504,47 @@ func (p *GitHubProvider) GetUserName(s *SessionState) (string, error) {
 
 	req, err := http.NewRequest("GET", endpoint.String(), nil)
 	if err != nil {
-		return "", fmt.Errorf("could not create new GET request: %v", err)
+		return "", "", fmt.Errorf("could not create new GET request: %v", err)
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("token %s", s.AccessToken))
-	resp, err := http.DefaultClient.Do(req)
+	req.Header.Set("Authorization", p.authorization(s.AccessToken))
+	resp, err := p.apiRequest(ctx, s, req)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	defer resp.Body.Close()
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("got %d from %q %s",
+		return "", "", fmt.Errorf("got %d from %q %s",
 			resp.StatusCode, endpoint.String(), body)
 	}
 
-	log.Printf("got %d from %q %s", resp.StatusCode, endpoint.String(), body)
+	if p.Verbose {
+		logger.Printf("got %d from %q %s", resp.StatusCode, endpoint.String(), body)
+	}
 
 	if err := json.Unmarshal(body, &user); err != nil {
-		return "", fmt.Errorf("%s unmarshaling %s", err, body)
+		return "", "", fmt.Errorf("%s unmarshaling %s", err, body)
+	}
+
+	if user.Login == "" {
+		if !p.LoginFromID || user.ID == 0 {
+			return "", "", fmt.Errorf("no login for GitHub user %d from %q", user.ID, endpoint.String())
+		}
+		user.Login = fmt.Sprintf("#%d", user.ID)
+		logger.Printf("no login for GitHub user %d, using %q", user.ID, user.Login)
+	}
+	// so GetPreferredUsername need not fetch /user again
+	s.PreferredUsername = user.Login
+	s.AvatarURL = user.AvatarURL
+	if user.ID != 0 {
+		s.UserID = strconv.FormatInt(user.ID, 10)
 	}
 
-	return user.Login, nil
+	return user.Login, user.Email, nil
 }
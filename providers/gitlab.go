@@ -1,7 +1,7 @@
 package providers
 
 import (
-	"log"
+	"context"
 	"net/http"
 	"net/url"
 	"path"
@@ -51,7 +51,7 @@ func (p *GitLabProvider) SetGroups(groups []string) {
 	}
 }
 
-func (p *GitLabProvider) hasGroup(accessToken string) (bool, error) {
+func (p *GitLabProvider) hasGroup(ctx context.Context, accessToken string) (bool, error) {
 
 	type groupsPage []struct {
 		FullPath string `json:"full_path"`
@@ -74,6 +74,7 @@ func (p *GitLabProvider) hasGroup(accessToken string) (bool, error) {
 		if err != nil {
 			return false, err
 		}
+		req = req.WithContext(ctx)
 
 		var groups groupsPage
 		err = api.RequestJson(req, &groups)
@@ -87,7 +88,7 @@ func (p *GitLabProvider) hasGroup(accessToken string) (bool, error) {
 		for _, group := range groups {
 			for _, g := range p.Groups {
 				if g == group.FullPath {
-					log.Printf("Found GitLab Group:%q", g)
+					logger.Printf("Found GitLab Group:%q", g)
 					return true, nil
 				}
 			}
@@ -97,10 +98,10 @@ func (p *GitLabProvider) hasGroup(accessToken string) (bool, error) {
 	return false, nil
 }
 
-func (p *GitLabProvider) GetEmailAddress(s *SessionState) (string, error) {
+func (p *GitLabProvider) GetEmailAddress(ctx context.Context, s *SessionState) (string, error) {
 	// if we require a Group, check that first
 	if len(p.Groups) > 0 {
-		if ok, err := p.hasGroup(s.AccessToken); err != nil || !ok {
+		if ok, err := p.hasGroup(ctx, s.AccessToken); err != nil || !ok {
 			return "", err
 		}
 	}
@@ -108,13 +109,14 @@ func (p *GitLabProvider) GetEmailAddress(s *SessionState) (string, error) {
 	req, err := http.NewRequest("GET",
 		p.ValidateURL.String()+"?access_token="+s.AccessToken, nil)
 	if err != nil {
-		log.Printf("failed building request %s", err)
+		logger.Printf("failed building request %s", err)
 		return "", err
 	}
+	req = req.WithContext(ctx)
 	json, err := api.Request(req)
 	if err != nil {
-		log.Printf("failed making request %s", err)
+		logger.Printf("failed making request %s", err)
 		return "", err
 	}
-	return json.Get("email").String()
+	return p.allowedEmail(json.Get("email").String())
 }
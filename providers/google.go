@@ -135,7 +135,7 @@ func (p *GoogleProvider) Redeem(redirectURL, code string) (s *SessionState, err
 		return
 	}
 	var email string
-	email, err = emailFromIdToken(jsonResponse.IdToken)
+	email, err = p.allowedEmail(emailFromIdToken(jsonResponse.IdToken))
 	if err != nil {
 		return
 	}
@@ -188,24 +188,24 @@ func userInGroup(service *admin.Service, groups []string, email string) bool {
 		}
 		resp, err := req.Do()
 		if err != nil {
-			log.Printf("Error calling service.Groups.List().userKey(%s)", email)
+			logger.Printf("Error calling service.Groups.List().userKey(%s)", email)
 			return false
 		}
 		for _, group := range resp.Groups {
 			for _, allowedgroup := range groups {
 				if group.Email == allowedgroup {
-					log.Printf("%s is a member of %s, authorized", email, allowedgroup)
+					logger.Printf("%s is a member of %s, authorized", email, allowedgroup)
 					return true
 				}
 			}
 		}
 		if resp.NextPageToken == "" {
-			log.Printf("%s not found in any allowed groups", email)
+			logger.Printf("%s not found in any allowed groups", email)
 			return false
 		}
 		pageToken = resp.NextPageToken
 	}
-	log.Printf("WARNING: %s has more than 10 pages of groups", email)
+	logger.Printf("WARNING: %s has more than 10 pages of groups", email)
 	return false
 }
 
@@ -233,7 +233,7 @@ func (p *GoogleProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
 	origExpiration := s.ExpiresOn
 	s.AccessToken = newToken
 	s.ExpiresOn = time.Now().Add(duration).Truncate(time.Second)
-	log.Printf("refreshed access token %s (expired on %s)", s, origExpiration)
+	logger.Printf("refreshed access token %s (expired on %s)", s, origExpiration)
 	return true, nil
 }
 
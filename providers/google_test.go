@@ -7,6 +7,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -122,6 +123,82 @@ func TestGoogleProviderWithoutValidateGroup(t *testing.T) {
 	assert.Equal(t, true, p.ValidateGroup("michael.bland@gsa.gov"))
 }
 
+func newRefreshServer(calls *int) (*url.URL, *httptest.Server) {
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		*calls++
+		if r.Method != "POST" || r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "refresh12345" {
+			rw.WriteHeader(400)
+			rw.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		rw.Write([]byte(`{"access_token": "a5678", "expires_in": 3600}`))
+	}))
+	u, _ := url.Parse(s.URL)
+	return u, s
+}
+
+func TestGoogleProviderRefreshSessionIfNeededNotExpired(t *testing.T) {
+	var calls int
+	p := newGoogleProvider()
+	var server *httptest.Server
+	p.RedeemURL, server = newRefreshServer(&calls)
+	defer server.Close()
+
+	expires := time.Now().Add(time.Hour)
+	session := &SessionState{Email: "michael.bland@gsa.gov", AccessToken: "a1234",
+		RefreshToken: "refresh12345", ExpiresOn: expires}
+	refreshed, err := p.RefreshSessionIfNeeded(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, refreshed)
+	assert.Equal(t, "a1234", session.AccessToken)
+	assert.Equal(t, expires, session.ExpiresOn)
+	assert.Equal(t, 0, calls)
+}
+
+func TestGoogleProviderRefreshSessionIfNeededExpired(t *testing.T) {
+	var calls int
+	p := newGoogleProvider()
+	var server *httptest.Server
+	p.RedeemURL, server = newRefreshServer(&calls)
+	defer server.Close()
+
+	session := &SessionState{Email: "michael.bland@gsa.gov", AccessToken: "a1234",
+		RefreshToken: "refresh12345", ExpiresOn: time.Now().Add(-time.Minute)}
+	refreshed, err := p.RefreshSessionIfNeeded(session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, "a5678", session.AccessToken)
+	assert.Equal(t, "refresh12345", session.RefreshToken)
+	assert.True(t, session.ExpiresOn.After(time.Now().Add(59*time.Minute)))
+	assert.Equal(t, 1, calls)
+}
+
+func TestGoogleProviderRefreshSessionIfNeededFails(t *testing.T) {
+	var calls int
+	p := newGoogleProvider()
+	var server *httptest.Server
+	p.RedeemURL, server = newRefreshServer(&calls)
+	defer server.Close()
+
+	expires := time.Now().Add(-time.Minute)
+	session := &SessionState{Email: "michael.bland@gsa.gov", AccessToken: "a1234",
+		RefreshToken: "revoked", ExpiresOn: expires}
+	refreshed, err := p.RefreshSessionIfNeeded(session)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, false, refreshed)
+	assert.Equal(t, "a1234", session.AccessToken)
+	assert.Equal(t, expires, session.ExpiresOn)
+	assert.Equal(t, 1, calls)
+
+	// refreshed, but no longer in the group(s)
+	p.GroupValidator = func(email string) bool { return false }
+	session.RefreshToken = "refresh12345"
+	refreshed, err = p.RefreshSessionIfNeeded(session)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, false, refreshed)
+	assert.Equal(t, "a1234", session.AccessToken)
+}
+
 //
 func TestGoogleProviderGetEmailAddressInvalidEncoding(t *testing.T) {
 	p := newGoogleProvider()
@@ -1,10 +1,12 @@
 package providers
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/ploxiln/oauth2_proxy/api"
 )
@@ -24,14 +26,14 @@ func stripToken(endpoint string) string {
 func stripParam(param, endpoint string) string {
 	u, err := url.Parse(endpoint)
 	if err != nil {
-		log.Printf("error attempting to strip %s: %s", param, err)
+		logger.Printf("error attempting to strip %s: %s", param, err)
 		return endpoint
 	}
 
 	if u.RawQuery != "" {
 		values, err := url.ParseQuery(u.RawQuery)
 		if err != nil {
-			log.Printf("error attempting to strip %s: %s", param, err)
+			logger.Printf("error attempting to strip %s: %s", param, err)
 			return u.String()
 		}
 
@@ -45,10 +47,11 @@ func stripParam(param, endpoint string) string {
 	return endpoint
 }
 
-// validateToken returns true if token is valid
-func validateToken(p Provider, access_token string, header http.Header) bool {
+// validateToken returns true if token is valid, or an error if the provider
+// could not be reached or had a server error, so the validity is unknown
+func validateToken(p Provider, access_token string, header http.Header) (bool, error) {
 	if access_token == "" || p.Data().ValidateURL == nil {
-		return false
+		return false, nil
 	}
 	endpoint := p.Data().ValidateURL.String()
 	if len(header) == 0 {
@@ -57,23 +60,74 @@ func validateToken(p Provider, access_token string, header http.Header) bool {
 	}
 	resp, err := api.RequestUnparsedResponse(endpoint, header)
 	if err != nil {
-		log.Printf("GET %s", stripToken(endpoint))
-		log.Printf("token validation request failed: %s", err)
-		return false
+		logger.Printf("GET %s", stripToken(endpoint))
+		logger.Printf("token validation request failed: %s", err)
+		return false, fmt.Errorf("token validation request failed: %s", err)
 	}
 
 	body, _ := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
-	log.Printf("%d GET %s %s", resp.StatusCode, stripToken(endpoint), body)
-
 	if resp.StatusCode == 200 {
-		return true
+		if p.Data().Verbose {
+			logger.Printf("%d GET %s %s", resp.StatusCode, stripToken(endpoint), body)
+		}
+		return true, nil
+	}
+	logger.Printf("%d GET %s", resp.StatusCode, stripToken(endpoint))
+	logger.Printf("token validation request failed: status %d - %s", resp.StatusCode, body)
+	if resp.StatusCode >= 500 || resp.StatusCode == 429 {
+		return false, fmt.Errorf("token validation request failed: status %d", resp.StatusCode)
+	}
+	return false, nil
+}
+
+// nextPageURL parses the URL of the next page of a list, from a Link header
+// or response body, which must have the origin of the API at apiURL: the
+// access token is only sent there, so a link elsewhere is an error. No next
+// link, "", is no next page.
+func nextPageURL(next string, apiURL *url.URL) (string, error) {
+	if next == "" {
+		return "", nil
+	}
+	u, err := url.Parse(next)
+	if err != nil {
+		return "", fmt.Errorf("invalid next page link %q: %s", next, err)
+	}
+	if u.Scheme != apiURL.Scheme || !strings.EqualFold(u.Host, apiURL.Host) {
+		return "", fmt.Errorf("not following next page link %q to another origin than %s://%s",
+			next, apiURL.Scheme, apiURL.Host)
 	}
-	log.Printf("token validation request failed: status %d - %s", resp.StatusCode, body)
-	return false
+	return u.String(), nil
 }
 
 func updateURL(url *url.URL, hostname string) {
 	url.Scheme = "http"
 	url.Host = hostname
 }
+
+// limitedBody is a response body which returns an error once more than
+// limit bytes have been read, rather than reading an unbounded response
+type limitedBody struct {
+	io.ReadCloser
+	limit int64
+	read  int64
+}
+
+func limitBody(body io.ReadCloser, limit int64) io.ReadCloser {
+	return &limitedBody{ReadCloser: body, limit: limit}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.read > b.limit {
+		return 0, fmt.Errorf("response body exceeds %d bytes", b.limit)
+	}
+	if remaining := b.limit + 1 - b.read; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.read > b.limit {
+		return n - 1, fmt.Errorf("response body exceeds %d bytes", b.limit)
+	}
+	return n, err
+}
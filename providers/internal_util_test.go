@@ -1,10 +1,16 @@
 package providers
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -14,14 +20,14 @@ type ValidateSessionStateTestProvider struct {
 	*ProviderData
 }
 
-func (tp *ValidateSessionStateTestProvider) GetEmailAddress(s *SessionState) (string, error) {
+func (tp *ValidateSessionStateTestProvider) GetEmailAddress(ctx context.Context, s *SessionState) (string, error) {
 	return "", errors.New("not implemented")
 }
 
 // Note that we're testing the internal validateToken() used to implement
 // several Provider's ValidateSessionState() implementations
-func (tp *ValidateSessionStateTestProvider) ValidateSessionState(s *SessionState) bool {
-	return false
+func (tp *ValidateSessionStateTestProvider) ValidateSessionState(s *SessionState) (bool, error) {
+	return false, nil
 }
 
 type ValidateSessionStateTest struct {
@@ -81,7 +87,26 @@ func (vt_test *ValidateSessionStateTest) Close() {
 func TestValidateSessionStateValidToken(t *testing.T) {
 	vt_test := NewValidateSessionStateTest()
 	defer vt_test.Close()
-	assert.Equal(t, true, validateToken(vt_test.provider, "foobar", nil))
+	valid, err := validateToken(vt_test.provider, "foobar", nil)
+	assert.Equal(t, true, valid)
+	assert.Equal(t, nil, err)
+}
+
+func TestValidateSessionStateValidTokenNotLogged(t *testing.T) {
+	vt_test := NewValidateSessionStateTest()
+	defer vt_test.Close()
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	valid, err := validateToken(vt_test.provider, "foobar", nil)
+	assert.Equal(t, true, valid)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", buf.String())
+
+	vt_test.response_code = 401
+	validateToken(vt_test.provider, "foobar", nil)
+	assert.Contains(t, buf.String(), "contents disregarded")
 }
 
 func TestValidateSessionStateValidTokenWithHeaders(t *testing.T) {
@@ -89,35 +114,53 @@ func TestValidateSessionStateValidTokenWithHeaders(t *testing.T) {
 	defer vt_test.Close()
 	vt_test.header = make(http.Header)
 	vt_test.header.Set("Authorization", "Bearer foobar")
-	assert.Equal(t, true,
-		validateToken(vt_test.provider, "foobar", vt_test.header))
+	valid, err := validateToken(vt_test.provider, "foobar", vt_test.header)
+	assert.Equal(t, true, valid)
+	assert.Equal(t, nil, err)
 }
 
 func TestValidateSessionStateEmptyToken(t *testing.T) {
 	vt_test := NewValidateSessionStateTest()
 	defer vt_test.Close()
-	assert.Equal(t, false, validateToken(vt_test.provider, "", nil))
+	valid, err := validateToken(vt_test.provider, "", nil)
+	assert.Equal(t, false, valid)
+	assert.Equal(t, nil, err)
 }
 
 func TestValidateSessionStateEmptyValidateURL(t *testing.T) {
 	vt_test := NewValidateSessionStateTest()
 	defer vt_test.Close()
 	vt_test.provider.Data().ValidateURL = nil
-	assert.Equal(t, false, validateToken(vt_test.provider, "foobar", nil))
+	valid, err := validateToken(vt_test.provider, "foobar", nil)
+	assert.Equal(t, false, valid)
+	assert.Equal(t, nil, err)
 }
 
 func TestValidateSessionStateRequestNetworkFailure(t *testing.T) {
 	vt_test := NewValidateSessionStateTest()
 	// Close immediately to simulate a network failure
 	vt_test.Close()
-	assert.Equal(t, false, validateToken(vt_test.provider, "foobar", nil))
+	valid, err := validateToken(vt_test.provider, "foobar", nil)
+	assert.Equal(t, false, valid)
+	assert.NotEqual(t, nil, err)
 }
 
 func TestValidateSessionStateExpiredToken(t *testing.T) {
 	vt_test := NewValidateSessionStateTest()
 	defer vt_test.Close()
 	vt_test.response_code = 401
-	assert.Equal(t, false, validateToken(vt_test.provider, "foobar", nil))
+	valid, err := validateToken(vt_test.provider, "foobar", nil)
+	assert.Equal(t, false, valid)
+	assert.Equal(t, nil, err)
+}
+
+func TestValidateSessionStateProviderServerError(t *testing.T) {
+	vt_test := NewValidateSessionStateTest()
+	defer vt_test.Close()
+	vt_test.response_code = 503
+	valid, err := validateToken(vt_test.provider, "foobar", nil)
+	assert.Equal(t, false, valid)
+	assert.NotEqual(t, nil, err)
 }
 
 func TestStripTokenNotPresent(t *testing.T) {
@@ -130,3 +173,14 @@ func TestStripToken(t *testing.T) {
 	expected := "http://local.test/api/test?access_token=dead...&b=1&c=2"
 	assert.Equal(t, expected, stripToken(test))
 }
+
+func TestLimitBody(t *testing.T) {
+	body, err := ioutil.ReadAll(limitBody(ioutil.NopCloser(strings.NewReader("0123456789")), 10))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "0123456789", string(body))
+
+	body, err = ioutil.ReadAll(limitBody(ioutil.NopCloser(strings.NewReader("0123456789a")), 10))
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, "response body exceeds 10 bytes", err.Error())
+	assert.Equal(t, "0123456789", string(body))
+}
@@ -0,0 +1,184 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// DefaultJWKSCacheTTL is how long the JWKS of an OIDC issuer is cached,
+// unless changed with SetJWKSCache
+const DefaultJWKSCacheTTL = time.Hour
+
+// DefaultJWKSMinRefetch is how long after fetching the JWKS it may be
+// fetched again for an id_token with an unknown key ID
+const DefaultJWKSMinRefetch = time.Minute
+
+// DefaultJWKSMaxStale is how old the cached JWKS may get while it can't be
+// fetched again, after which id_tokens are rejected
+const DefaultJWKSMaxStale = 24 * time.Hour
+
+// jwksKeySet verifies the signatures of id_tokens, as an oidc.KeySet, with
+// the keys of a JWKS. The JWKS is cached for ttl. It is fetched again early
+// for an unknown key ID, as the issuer may have rotated its keys, but at
+// most every minRefetch, so that tokens with made up key IDs can't cause a
+// request to the issuer each. If it can't be fetched, the cached keys are
+// used until they are maxStale old.
+type jwksKeySet struct {
+	url        string
+	ttl        time.Duration
+	minRefetch time.Duration
+	maxStale   time.Duration
+	client     *http.Client
+	now        func() time.Time
+
+	mu       sync.Mutex
+	keys     []jose.JSONWebKey
+	fetched  time.Time
+	inflight *jwksFetch
+}
+
+// jwksFetch is a fetch of the JWKS shared by all the verifications waiting
+// for it; done is closed once keys and err are set
+type jwksFetch struct {
+	done chan struct{}
+	keys []jose.JSONWebKey
+	err  error
+}
+
+func newJWKSKeySet(url string, ttl, minRefetch time.Duration) *jwksKeySet {
+	return &jwksKeySet{
+		url:        url,
+		ttl:        ttl,
+		minRefetch: minRefetch,
+		maxStale:   DefaultJWKSMaxStale,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		now:        time.Now,
+	}
+}
+
+// VerifySignature returns the payload of jwt if it is signed with one of
+// the keys of the JWKS
+func (k *jwksKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt: %v", err)
+	}
+	if len(jws.Signatures) != 1 {
+		return nil, errors.New("malformed jwt: expected a single signature")
+	}
+	kid := jws.Signatures[0].Header.KeyID
+
+	keys, err := k.keysFor(ctx, kid)
+	if err != nil {
+		return nil, err
+	}
+	known := false
+	for i := range keys {
+		if kid != "" && keys[i].KeyID != kid {
+			continue
+		}
+		known = true
+		if payload, err := jws.Verify(&keys[i]); err == nil {
+			return payload, nil
+		}
+	}
+	if kid != "" && !known {
+		return nil, fmt.Errorf("failed to verify id token signature: unknown key ID %q", kid)
+	}
+	return nil, errors.New("failed to verify id token signature")
+}
+
+// keysFor returns the cached keys, fetching them first if the cache
+// expired or, unless fetched within minRefetch, kid is not among them.
+// Concurrent callers share a single fetch, made without holding the lock.
+func (k *jwksKeySet) keysFor(ctx context.Context, kid string) ([]jose.JSONWebKey, error) {
+	k.mu.Lock()
+	age := k.now().Sub(k.fetched)
+	if k.keys != nil && age < k.ttl && (kid == "" || age < k.minRefetch || hasJWK(k.keys, kid)) {
+		keys := k.keys
+		k.mu.Unlock()
+		return keys, nil
+	}
+	f := k.inflight
+	if f == nil {
+		f = &jwksFetch{done: make(chan struct{})}
+		k.inflight = f
+		go k.refresh(f)
+	}
+	k.mu.Unlock()
+
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return f.keys, f.err
+}
+
+// refresh fetches the JWKS for f and caches it. If the fetch fails, f gets
+// the cached keys instead, unless they are more than maxStale old.
+func (k *jwksKeySet) refresh(f *jwksFetch) {
+	keys, err := k.fetch(context.Background())
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err == nil {
+		k.keys, k.fetched = keys, k.now()
+		f.keys = keys
+	} else if age := k.now().Sub(k.fetched); k.keys != nil && age < k.maxStale {
+		logger.Printf("error refreshing JWKS, using the keys fetched %s ago: %s", age, err)
+		f.keys = k.keys
+	} else {
+		f.err = err
+	}
+	k.inflight = nil
+	close(f.done)
+}
+
+func hasJWK(keys []jose.JSONWebKey, kid string) bool {
+	for _, key := range keys {
+		if key.KeyID == kid {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *jwksKeySet) fetch(ctx context.Context) ([]jose.JSONWebKey, error) {
+	req, err := http.NewRequest("GET", k.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := k.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching JWKS: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error reading JWKS: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("got %d from %q %s", resp.StatusCode, k.url, body)
+	}
+
+	var jwks jose.JSONWebKeySet
+	if err := json.Unmarshal(body, &jwks); err != nil {
+		return nil, fmt.Errorf("error decoding JWKS: %v", err)
+	}
+	keys := make([]jose.JSONWebKey, 0, len(jwks.Keys))
+	for _, key := range jwks.Keys {
+		if key.Use == "" || key.Use == "sig" {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
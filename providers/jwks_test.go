@@ -0,0 +1,170 @@
+package providers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testJWKSServer serves the public keys of keys, by key ID, and counts
+// the requests for them
+type testJWKSServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	fetches int
+}
+
+func newTestJWKSServer(keys map[string]*rsa.PrivateKey) *testJWKSServer {
+	s := &testJWKSServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.fetches++
+		var jwks []string
+		for kid, key := range s.keys {
+			jwks = append(jwks, fmt.Sprintf(`{"kty": "RSA", "use": "sig", "kid": "%s", "n": "%s", "e": "%s"}`, kid,
+				base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+				base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes())))
+		}
+		fmt.Fprintf(w, `{"keys": [%s]}`, strings.Join(jwks, ", "))
+	}))
+	return s
+}
+
+func (s *testJWKSServer) setKeys(keys map[string]*rsa.PrivateKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func (s *testJWKSServer) fetched() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches
+}
+
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, nil, err)
+	return key
+}
+
+var testJWTClaims = map[string]interface{}{"sub": "248289761001"}
+
+func TestJWKSKeySetCached(t *testing.T) {
+	key := testRSAKey(t)
+	s := newTestJWKSServer(map[string]*rsa.PrivateKey{"k1": key})
+	defer s.Close()
+	k := newJWKSKeySet(s.URL, time.Hour, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		payload, err := k.VerifySignature(context.Background(), signTestJWT(key, "k1", testJWTClaims))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, `{"sub":"248289761001"}`, string(payload))
+	}
+	assert.Equal(t, 1, s.fetched())
+
+	// a token without a key ID is checked with each key
+	_, err := k.VerifySignature(context.Background(), signTestJWT(key, "", testJWTClaims))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, s.fetched())
+
+	// a bad signature with a known key ID does not refetch
+	_, err = k.VerifySignature(context.Background(), signTestJWT(testRSAKey(t), "k1", testJWTClaims))
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, 1, s.fetched())
+}
+
+func TestJWKSKeySetTTL(t *testing.T) {
+	key := testRSAKey(t)
+	s := newTestJWKSServer(map[string]*rsa.PrivateKey{"k1": key})
+	defer s.Close()
+	now := time.Now()
+	k := newJWKSKeySet(s.URL, time.Hour, time.Minute)
+	k.now = func() time.Time { return now }
+
+	_, err := k.VerifySignature(context.Background(), signTestJWT(key, "k1", testJWTClaims))
+	assert.Equal(t, nil, err)
+	now = now.Add(61 * time.Minute)
+	_, err = k.VerifySignature(context.Background(), signTestJWT(key, "k1", testJWTClaims))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, s.fetched())
+
+	// the cached keys are used while the JWKS can't be fetched, but only
+	// until they are maxStale old
+	s.Close()
+	now = now.Add(61 * time.Minute)
+	_, err = k.VerifySignature(context.Background(), signTestJWT(key, "k1", testJWTClaims))
+	assert.Equal(t, nil, err)
+	now = now.Add(DefaultJWKSMaxStale)
+	_, err = k.VerifySignature(context.Background(), signTestJWT(key, "k1", testJWTClaims))
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "error fetching JWKS")
+}
+
+func TestJWKSKeySetRotated(t *testing.T) {
+	oldKey, newKey := testRSAKey(t), testRSAKey(t)
+	s := newTestJWKSServer(map[string]*rsa.PrivateKey{"k1": oldKey})
+	defer s.Close()
+	now := time.Now()
+	k := newJWKSKeySet(s.URL, time.Hour, time.Minute)
+	k.now = func() time.Time { return now }
+
+	_, err := k.VerifySignature(context.Background(), signTestJWT(oldKey, "k1", testJWTClaims))
+	assert.Equal(t, nil, err)
+
+	s.setKeys(map[string]*rsa.PrivateKey{"k1": oldKey, "k2": newKey})
+	now = now.Add(2 * time.Minute)
+	_, err = k.VerifySignature(context.Background(), signTestJWT(newKey, "k2", testJWTClaims))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, s.fetched())
+	_, err = k.VerifySignature(context.Background(), signTestJWT(oldKey, "k1", testJWTClaims))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, s.fetched())
+}
+
+func TestJWKSKeySetUnknownKeyID(t *testing.T) {
+	key := testRSAKey(t)
+	s := newTestJWKSServer(map[string]*rsa.PrivateKey{"k1": key})
+	defer s.Close()
+	now := time.Now()
+	k := newJWKSKeySet(s.URL, time.Hour, time.Minute)
+	k.now = func() time.Time { return now }
+
+	_, err := k.VerifySignature(context.Background(), signTestJWT(key, "k1", testJWTClaims))
+	assert.Equal(t, nil, err)
+
+	// refetched, but still unknown
+	now = now.Add(2 * time.Minute)
+	_, err = k.VerifySignature(context.Background(), signTestJWT(key, "k9", testJWTClaims))
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), `unknown key ID "k9"`)
+	assert.Equal(t, 2, s.fetched())
+
+	// not refetched again within the minimum interval
+	for i := 0; i < 3; i++ {
+		_, err = k.VerifySignature(context.Background(), signTestJWT(key, fmt.Sprintf("k%d", 10+i), testJWTClaims))
+		assert.NotEqual(t, nil, err)
+	}
+	assert.Equal(t, 2, s.fetched())
+}
+
+func TestJWKSKeySetMalformed(t *testing.T) {
+	k := newJWKSKeySet("http://127.0.0.1:1/keys", time.Hour, time.Minute)
+	for _, jwt := range []string{"", "a.b", "!.b.c", "e30.!.c"} {
+		_, err := k.VerifySignature(context.Background(), jwt)
+		assert.NotEqual(t, nil, err, jwt)
+	}
+}
@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -47,7 +48,7 @@ func getLinkedInHeader(access_token string) http.Header {
 	return header
 }
 
-func (p *LinkedInProvider) GetEmailAddress(s *SessionState) (string, error) {
+func (p *LinkedInProvider) GetEmailAddress(ctx context.Context, s *SessionState) (string, error) {
 	if s.AccessToken == "" {
 		return "", errors.New("missing access token")
 	}
@@ -55,6 +56,7 @@ func (p *LinkedInProvider) GetEmailAddress(s *SessionState) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	req = req.WithContext(ctx)
 	req.Header = getLinkedInHeader(s.AccessToken)
 
 	json, err := api.Request(req)
@@ -62,13 +64,9 @@ func (p *LinkedInProvider) GetEmailAddress(s *SessionState) (string, error) {
 		return "", err
 	}
 
-	email, err := json.String()
-	if err != nil {
-		return "", err
-	}
-	return email, nil
+	return p.allowedEmail(json.String())
 }
 
-func (p *LinkedInProvider) ValidateSessionState(s *SessionState) bool {
+func (p *LinkedInProvider) ValidateSessionState(s *SessionState) (bool, error) {
 	return validateToken(p, s.AccessToken, getLinkedInHeader(s.AccessToken))
 }
@@ -0,0 +1,29 @@
+package providers
+
+import (
+	"fmt"
+	"log"
+)
+
+// Logger is where providers log, see SetLogger. A *log.Logger is one.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// StdLogger logs to the standard logger of package log
+var StdLogger Logger = stdLogger{}
+
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	// with the file and line of the caller of Printf, as log.Printf has
+	log.Output(2, fmt.Sprintf(format, v...))
+}
+
+var logger = StdLogger
+
+// SetLogger sets where providers log, StdLogger by default, e.g. to discard
+// their logs
+func SetLogger(l Logger) {
+	logger = l
+}
@@ -0,0 +1,83 @@
+package providers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// membershipCacheJitter is the fraction of the TTL by which each entry's
+// expiry is randomly moved earlier or later, so entries cached together
+// don't all expire (and get re-checked against the provider) together
+const membershipCacheJitter = 0.1
+
+type membershipEntry struct {
+	member  bool
+	groups  []string
+	expires time.Time
+}
+
+// membershipCache remembers the result of a membership check for an access
+// token, with the groups found, for up to ttl (±10%). Tokens are stored
+// hashed.
+type membershipCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	rnd     *rand.Rand
+	entries map[string]membershipEntry
+}
+
+func newMembershipCache(ttl time.Duration) *membershipCache {
+	return &membershipCache{
+		ttl:     ttl,
+		now:     time.Now,
+		rnd:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		entries: make(map[string]membershipEntry),
+	}
+}
+
+func membershipCacheKey(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *membershipCache) Get(accessToken string) (member bool, groups []string, ok bool) {
+	key := membershipCacheKey(accessToken)
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return false, nil, false
+	}
+	if !now.Before(e.expires) {
+		delete(c.entries, key)
+		return false, nil, false
+	}
+	return e.member, e.groups, true
+}
+
+func (c *membershipCache) Set(accessToken string, member bool, groups []string) {
+	key := membershipCacheKey(accessToken)
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = membershipEntry{member: member, groups: groups, expires: now.Add(c.jitteredTTL())}
+	// drop expired entries so tokens that are never seen again don't accumulate
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+}
+
+// jitteredTTL returns ttl adjusted by a random amount within ±10%.
+// c.mu must be held.
+func (c *membershipCache) jitteredTTL() time.Duration {
+	spread := float64(c.ttl) * membershipCacheJitter
+	return c.ttl + time.Duration((c.rnd.Float64()*2-1)*spread)
+}
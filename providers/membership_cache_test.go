@@ -0,0 +1,55 @@
+package providers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMembershipCache(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	c := newMembershipCache(time.Minute)
+	c.now = func() time.Time { return now }
+
+	_, _, ok := c.Get("token1")
+	assert.Equal(t, false, ok)
+
+	c.Set("token1", true, []string{"testorg"})
+	c.Set("token2", false, nil)
+	member, groups, ok := c.Get("token1")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, true, member)
+	assert.Equal(t, []string{"testorg"}, groups)
+	member, groups, ok = c.Get("token2")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, false, member)
+	assert.Equal(t, []string(nil), groups)
+
+	now = now.Add(time.Minute * 11 / 10)
+	_, _, ok = c.Get("token1")
+	assert.Equal(t, false, ok)
+	_, _, ok = c.Get("token2")
+	assert.Equal(t, false, ok)
+}
+
+func TestMembershipCacheExpiryJitter(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	c := newMembershipCache(time.Hour)
+	c.now = func() time.Time { return now }
+
+	expiries := make(map[time.Time]bool)
+	for i := 0; i < 100; i++ {
+		c.Set(fmt.Sprintf("token%d", i), true, nil)
+	}
+	for _, e := range c.entries {
+		ttl := e.expires.Sub(now)
+		assert.True(t, ttl >= 54*time.Minute, "ttl %s below -10%%", ttl)
+		assert.True(t, ttl <= 66*time.Minute, "ttl %s above +10%%", ttl)
+		expiries[e.expires] = true
+	}
+	assert.Equal(t, 100, len(c.entries))
+	// entries cached at the same instant must not all expire together
+	assert.True(t, len(expiries) > 50, "only %d distinct expiry times", len(expiries))
+}
@@ -3,6 +3,7 @@ package providers
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"net/url"
 	"time"
 
@@ -15,6 +16,17 @@ type OIDCProvider struct {
 	*ProviderData
 
 	Verifier *oidc.IDTokenVerifier
+
+	// RequiredClaims are id_token claims which must have one of the listed
+	// values; a claim holding a list must contain one of them
+	RequiredClaims map[string][]string
+
+	// JWKSCacheTTL is how long the issuer's JWKS is cached, and
+	// JWKSMinRefetch how long after fetching it, it may be fetched again
+	// for an unknown key ID, see DefaultJWKSCacheTTL and
+	// DefaultJWKSMinRefetch
+	JWKSCacheTTL   time.Duration
+	JWKSMinRefetch time.Duration
 }
 
 func NewOIDCProvider(p *ProviderData) *OIDCProvider {
@@ -22,13 +34,37 @@ func NewOIDCProvider(p *ProviderData) *OIDCProvider {
 	return &OIDCProvider{ProviderData: p}
 }
 
+// SetJWKSCache caches the issuer's JWKS for ttl, and fetches it again for
+// an unknown key ID at most every minRefetch. It must be called before
+// SetIssuerURL.
+func (p *OIDCProvider) SetJWKSCache(ttl, minRefetch time.Duration) {
+	p.JWKSCacheTTL = ttl
+	p.JWKSMinRefetch = minRefetch
+}
+
 func (p *OIDCProvider) SetIssuerURL(issuerURL string) error {
 	provider, err := oidc.NewProvider(context.Background(), issuerURL)
 	if err != nil {
 		return fmt.Errorf("error looking up issuer-url=%q %s", issuerURL, err)
 	}
-	p.Verifier = provider.Verifier(&oidc.Config{
-		ClientID: p.ClientID,
+	var claims struct {
+		JWKSURL       string `json:"jwks_uri"`
+		EndSessionURL string `json:"end_session_endpoint"`
+		UserInfoURL   string `json:"userinfo_endpoint"`
+	}
+	if err := provider.Claims(&claims); err != nil {
+		return fmt.Errorf("error parsing the discovery document of issuer-url=%q %s", issuerURL, err)
+	}
+	ttl, minRefetch := p.JWKSCacheTTL, p.JWKSMinRefetch
+	if ttl == 0 {
+		ttl = DefaultJWKSCacheTTL
+	}
+	if minRefetch == 0 {
+		minRefetch = DefaultJWKSMinRefetch
+	}
+	p.Verifier = oidc.NewVerifier(issuerURL, newJWKSKeySet(claims.JWKSURL, ttl, minRefetch), &oidc.Config{
+		ClientID:             p.ClientID,
+		SupportedSigningAlgs: []string{oidc.RS256, oidc.RS384, oidc.RS512, oidc.ES256, oidc.ES384, oidc.ES512, oidc.PS256, oidc.PS384, oidc.PS512},
 	})
 	p.LoginURL, err = url.Parse(provider.Endpoint().AuthURL)
 	if err != nil {
@@ -38,6 +74,18 @@ func (p *OIDCProvider) SetIssuerURL(issuerURL string) error {
 	if err != nil {
 		return fmt.Errorf("error parsing redeem-url=%q %s", provider.Endpoint().TokenURL, err)
 	}
+	if (p.LogoutURL == nil || p.LogoutURL.String() == "") && claims.EndSessionURL != "" {
+		p.LogoutURL, err = url.Parse(claims.EndSessionURL)
+		if err != nil {
+			return fmt.Errorf("error parsing end_session_endpoint=%q %s", claims.EndSessionURL, err)
+		}
+	}
+	if (p.ValidateURL == nil || p.ValidateURL.String() == "") && claims.UserInfoURL != "" {
+		p.ValidateURL, err = url.Parse(claims.UserInfoURL)
+		if err != nil {
+			return fmt.Errorf("error parsing userinfo_endpoint=%q %s", claims.UserInfoURL, err)
+		}
+	}
 	if p.Scope == "" {
 		p.Scope = "openid email profile"
 	}
@@ -59,12 +107,27 @@ func (p *OIDCProvider) Redeem(redirectURL, code string) (s *SessionState, err er
 		return nil, fmt.Errorf("token exchange: %v", err)
 	}
 	s, err = p.createSessionState(token, ctx)
+	if redeemErr, ok := err.(*RedeemError); ok {
+		return nil, redeemErr
+	}
 	if err != nil {
 		return nil, fmt.Errorf("unable to update session: %v", err)
 	}
 	return
 }
 
+// ValidateSessionState checks the access token with the validate-url, by
+// default the issuer's userinfo_endpoint
+func (p *OIDCProvider) ValidateSessionState(s *SessionState) (bool, error) {
+	return validateToken(p, s.AccessToken, getOIDCHeader(s.AccessToken))
+}
+
+func getOIDCHeader(access_token string) http.Header {
+	header := make(http.Header)
+	header.Set("Authorization", fmt.Sprintf("Bearer %s", access_token))
+	return header
+}
+
 func (p *OIDCProvider) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
 	if s == nil || s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
 		return false, nil
@@ -106,6 +169,10 @@ func (p *OIDCProvider) redeemRefreshToken(s *SessionState) (err error) {
 	s.RefreshToken = newSession.RefreshToken
 	s.ExpiresOn = newSession.ExpiresOn
 	s.Email = newSession.Email
+	if newSession.PreferredUsername != "" {
+		s.PreferredUsername = newSession.PreferredUsername
+	}
+	s.IDToken = newSession.IDToken
 	return
 }
 
@@ -123,8 +190,9 @@ func (p *OIDCProvider) createSessionState(token *oauth2.Token, ctx context.Conte
 
 	// Extract custom claims.
 	var claims struct {
-		Email    string `json:"email"`
-		Verified *bool  `json:"email_verified"`
+		Email             string `json:"email"`
+		Verified          *bool  `json:"email_verified"`
+		PreferredUsername string `json:"preferred_username"`
 	}
 	if err := idToken.Claims(&claims); err != nil {
 		return nil, fmt.Errorf("failed to parse id_token claims: %v", err)
@@ -136,11 +204,69 @@ func (p *OIDCProvider) createSessionState(token *oauth2.Token, ctx context.Conte
 	if claims.Verified != nil && !*claims.Verified {
 		return nil, fmt.Errorf("email in id_token (%s) isn't verified", claims.Email)
 	}
+	if _, err := p.allowedEmail(claims.Email, nil); err != nil {
+		return nil, err
+	}
+
+	if len(p.RequiredClaims) > 0 {
+		var allClaims map[string]interface{}
+		if err := idToken.Claims(&allClaims); err != nil {
+			return nil, fmt.Errorf("failed to parse id_token claims: %v", err)
+		}
+		if err := p.checkRequiredClaims(allClaims); err != nil {
+			return nil, err
+		}
+	}
 
 	return &SessionState{
-		AccessToken:  token.AccessToken,
-		RefreshToken: token.RefreshToken,
-		ExpiresOn:    token.Expiry,
-		Email:        claims.Email,
+		AccessToken:       token.AccessToken,
+		RefreshToken:      token.RefreshToken,
+		ExpiresOn:         token.Expiry,
+		Email:             claims.Email,
+		PreferredUsername: claims.PreferredUsername,
+		IDToken:           rawIDToken,
 	}, nil
 }
+
+// GetPreferredUsername returns the preferred_username claim of the id_token.
+// It is only for display: the user can change it, and it need not be unique,
+// so the session user is not taken from it.
+func (p *OIDCProvider) GetPreferredUsername(ctx context.Context, s *SessionState) (string, error) {
+	return s.PreferredUsername, nil
+}
+
+// checkRequiredClaims returns a RedeemError denying access unless each of
+// RequiredClaims has one of its values in claims
+func (p *OIDCProvider) checkRequiredClaims(claims map[string]interface{}) error {
+	for name, values := range p.RequiredClaims {
+		var present []string
+		switch v := claims[name].(type) {
+		case nil:
+		case []interface{}:
+			for _, item := range v {
+				present = append(present, fmt.Sprint(item))
+			}
+		default:
+			present = append(present, fmt.Sprint(v))
+		}
+		if !containsAny(present, values) {
+			logger.Printf("id_token claim %q is %q, one of %q is required", name, present, values)
+			return &RedeemError{
+				Code:        "access_denied",
+				Description: fmt.Sprintf("id_token claim %q does not have a required value", name),
+			}
+		}
+	}
+	return nil
+}
+
+func containsAny(present, values []string) bool {
+	for _, p := range present {
+		for _, v := range values {
+			if p == v {
+				return true
+			}
+		}
+	}
+	return false
+}
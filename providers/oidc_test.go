@@ -0,0 +1,245 @@
+package providers
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testOIDCIssuer(endSession bool) *httptest.Server {
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/.well-known/openid-configuration" {
+				w.WriteHeader(404)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			endSessionEndpoint := ""
+			if endSession {
+				endSessionEndpoint = fmt.Sprintf(`, "end_session_endpoint": "%s/logout"`, s.URL)
+			}
+			fmt.Fprintf(w, `{"issuer": "%[1]s", "authorization_endpoint": "%[1]s/auth",
+				"token_endpoint": "%[1]s/token", "jwks_uri": "%[1]s/keys"%[2]s}`, s.URL, endSessionEndpoint)
+		}))
+	return s
+}
+
+func TestOIDCProviderSetIssuerURLLogoutURL(t *testing.T) {
+	issuer := testOIDCIssuer(true)
+	defer issuer.Close()
+
+	p := NewOIDCProvider(&ProviderData{})
+	assert.Equal(t, nil, p.SetIssuerURL(issuer.URL))
+	assert.Equal(t, issuer.URL+"/auth", p.LoginURL.String())
+	assert.Equal(t, issuer.URL+"/logout", p.LogoutURL.String())
+}
+
+func TestOIDCProviderSetIssuerURLNoEndSession(t *testing.T) {
+	issuer := testOIDCIssuer(false)
+	defer issuer.Close()
+
+	p := NewOIDCProvider(&ProviderData{})
+	assert.Equal(t, nil, p.SetIssuerURL(issuer.URL))
+	assert.Equal(t, "", p.GetLogoutURL("https://example.com/", ""))
+}
+
+func TestOIDCProviderCheckRequiredClaims(t *testing.T) {
+	p := NewOIDCProvider(&ProviderData{})
+	p.RequiredClaims = map[string][]string{
+		"department": {"engineering", "sre"},
+		"groups":     {"admins"},
+	}
+
+	assert.Equal(t, nil, p.checkRequiredClaims(map[string]interface{}{
+		"department": "sre",
+		"groups":     []interface{}{"users", "admins"},
+	}))
+
+	for _, claims := range []map[string]interface{}{
+		{"department": "sales", "groups": []interface{}{"admins"}},
+		{"department": "engineering", "groups": []interface{}{"users"}},
+		{"department": "engineering", "groups": "users"},
+		{"groups": []interface{}{"admins"}},
+	} {
+		err := p.checkRequiredClaims(claims)
+		assert.NotEqual(t, nil, err, fmt.Sprintf("%v", claims))
+		_, ok := err.(*RedeemError)
+		assert.Equal(t, true, ok)
+	}
+}
+
+func TestOIDCProviderCheckRequiredClaimsNonString(t *testing.T) {
+	p := NewOIDCProvider(&ProviderData{})
+	p.RequiredClaims = map[string][]string{"level": {"3"}, "staff": {"true"}}
+
+	assert.Equal(t, nil, p.checkRequiredClaims(map[string]interface{}{"level": float64(3), "staff": true}))
+	assert.NotEqual(t, nil, p.checkRequiredClaims(map[string]interface{}{"level": float64(2), "staff": true}))
+}
+
+// testOIDCKeyIssuer is an issuer which signs id_tokens with key, for the
+// claims set by the test, and accepts the access token "a1234" at its
+// userinfo_endpoint
+type testOIDCKeyIssuer struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]interface{}
+}
+
+func newTestOIDCKeyIssuer(t *testing.T) *testOIDCKeyIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, nil, err)
+	i := &testOIDCKeyIssuer{key: key}
+	i.Server = httptest.NewServer(http.HandlerFunc(i.serveHTTP))
+	return i
+}
+
+func (i *testOIDCKeyIssuer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		fmt.Fprintf(w, `{"issuer": "%[1]s", "authorization_endpoint": "%[1]s/auth",
+			"token_endpoint": "%[1]s/token", "jwks_uri": "%[1]s/keys",
+			"userinfo_endpoint": "%[1]s/userinfo", "id_token_signing_alg_values_supported": ["RS256"]}`, i.URL)
+	case "/keys":
+		pub := i.key.PublicKey
+		fmt.Fprintf(w, `{"keys": [{"kty": "RSA", "alg": "RS256", "use": "sig", "kid": "test", "n": "%s", "e": "%s"}]}`,
+			base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()))
+	case "/token":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "a1234",
+			"token_type":    "Bearer",
+			"refresh_token": "refresh1234",
+			"expires_in":    3600,
+			"id_token":      signTestJWT(i.key, "test", i.claims),
+		})
+	case "/userinfo":
+		if r.Header.Get("Authorization") != "Bearer a1234" {
+			w.WriteHeader(401)
+			return
+		}
+		w.Write([]byte(`{"sub": "248289761001"}`))
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+// signTestJWT returns claims as a JWT signed with key, with RS256, and
+// with key ID kid in its header
+func signTestJWT(key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (i *testOIDCKeyIssuer) validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":                i.URL,
+		"sub":                "248289761001",
+		"aud":                "bazquux",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"email":              "michael.bland@gsa.gov",
+		"email_verified":     true,
+		"preferred_username": "mbland",
+	}
+}
+
+func testOIDCKeyIssuerProvider(t *testing.T, issuer *testOIDCKeyIssuer) *OIDCProvider {
+	p := NewOIDCProvider(&ProviderData{ClientID: "bazquux", ClientSecret: "xyzzyplugh"})
+	assert.Equal(t, nil, p.SetIssuerURL(issuer.URL))
+	return p
+}
+
+func TestOIDCProviderSetIssuerURL(t *testing.T) {
+	issuer := newTestOIDCKeyIssuer(t)
+	defer issuer.Close()
+
+	p := testOIDCKeyIssuerProvider(t, issuer)
+	assert.Equal(t, issuer.URL+"/auth", p.LoginURL.String())
+	assert.Equal(t, issuer.URL+"/token", p.RedeemURL.String())
+	assert.Equal(t, issuer.URL+"/userinfo", p.ValidateURL.String())
+	assert.Equal(t, "openid email profile", p.Scope)
+
+	// an explicit validate-url is kept
+	p = NewOIDCProvider(&ProviderData{ValidateURL: &url.URL{Scheme: "https", Host: "example.com", Path: "/me"}})
+	assert.Equal(t, nil, p.SetIssuerURL(issuer.URL))
+	assert.Equal(t, "https://example.com/me", p.ValidateURL.String())
+}
+
+func TestOIDCProviderRedeem(t *testing.T) {
+	issuer := newTestOIDCKeyIssuer(t)
+	defer issuer.Close()
+	issuer.claims = issuer.validClaims()
+
+	p := testOIDCKeyIssuerProvider(t, issuer)
+	session, err := p.Redeem("https://example.com/oauth2/callback", "code1234")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", session.Email)
+	assert.Equal(t, "", session.User)
+	assert.Equal(t, "mbland", session.PreferredUsername)
+	preferred, err := p.GetPreferredUsername(context.Background(), session)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "mbland", preferred)
+	assert.Equal(t, "a1234", session.AccessToken)
+	assert.Equal(t, "refresh1234", session.RefreshToken)
+	assert.NotEqual(t, "", session.IDToken)
+	assert.True(t, session.ExpiresOn.After(time.Now()))
+}
+
+func TestOIDCProviderRedeemInvalidIDToken(t *testing.T) {
+	issuer := newTestOIDCKeyIssuer(t)
+	defer issuer.Close()
+	p := testOIDCKeyIssuerProvider(t, issuer)
+
+	for name, change := range map[string]func(map[string]interface{}){
+		"aud": func(c map[string]interface{}) { c["aud"] = "another-client" },
+		"iss": func(c map[string]interface{}) { c["iss"] = "https://issuer.example.com" },
+		"exp": func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Minute).Unix() },
+	} {
+		issuer.claims = issuer.validClaims()
+		change(issuer.claims)
+		_, err := p.Redeem("https://example.com/oauth2/callback", "code1234")
+		assert.NotEqual(t, nil, err, name)
+	}
+
+	// signed with another key
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Equal(t, nil, err)
+	idToken := signTestJWT(other, "test", issuer.validClaims())
+	_, err = p.Verifier.Verify(context.Background(), idToken)
+	assert.NotEqual(t, nil, err)
+	_, err = p.Verifier.Verify(context.Background(), signTestJWT(issuer.key, "test", issuer.validClaims()))
+	assert.Equal(t, nil, err)
+}
+
+func TestOIDCProviderValidateSessionState(t *testing.T) {
+	issuer := newTestOIDCKeyIssuer(t)
+	defer issuer.Close()
+	p := testOIDCKeyIssuerProvider(t, issuer)
+
+	valid, err := p.ValidateSessionState(&SessionState{AccessToken: "a1234"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, valid)
+
+	valid, err = p.ValidateSessionState(&SessionState{AccessToken: "revoked"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, valid)
+}
@@ -1,6 +1,7 @@
 package providers
 
 import (
+	"fmt"
 	"net/url"
 )
 
@@ -13,8 +14,46 @@ type ProviderData struct {
 	ProfileURL        *url.URL
 	ProtectedResource *url.URL
 	ValidateURL       *url.URL
+	LogoutURL         *url.URL
 	Scope             string
 	ApprovalPrompt    string
+
+	// CallBudget limits the number of provider API calls per login, 0 for no limit
+	CallBudget int
+	// MaxBodySize limits the size of provider API responses read, in bytes,
+	// 0 for no limit
+	MaxBodySize int64
+	// Verbose logs the bodies of successful provider API responses, which
+	// contain personal data such as email addresses
+	Verbose bool
+
+	// EmailDomains, if set, are the domains of the email addresses
+	// accepted from the provider, "*" for any
+	EmailDomains []string
 }
 
 func (p *ProviderData) Data() *ProviderData { return p }
+
+// isEmailAllowed returns true if email is in one of EmailDomains, ignoring
+// case, or no domains are set
+func (p *ProviderData) isEmailAllowed(email string) bool {
+	for _, d := range p.EmailDomains {
+		if d == "*" {
+			return true
+		}
+	}
+	return len(p.EmailDomains) == 0 || inDomains(email, p.EmailDomains)
+}
+
+// allowedEmail returns email and err as resolved by a provider, or an
+// access_denied RedeemError if email is not in one of EmailDomains
+func (p *ProviderData) allowedEmail(email string, err error) (string, error) {
+	if err != nil || email == "" || p.isEmailAllowed(email) {
+		return email, err
+	}
+	logger.Printf("email %q is not in an allowed domain %q", email, p.EmailDomains)
+	return "", &RedeemError{
+		Code:        "access_denied",
+		Description: fmt.Sprintf("%s is not in an allowed email domain", email),
+	}
+}
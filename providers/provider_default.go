@@ -2,16 +2,54 @@ package providers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/ploxiln/oauth2_proxy/cookie"
 )
 
+// RedeemError is an OAuth error response from the provider's RedeemURL,
+// e.g. GitHub's "bad_verification_code" for an expired or reused code
+type RedeemError struct {
+	Code        string
+	Description string
+}
+
+func (e *RedeemError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Description)
+}
+
+// parseRedeemError returns the error in a json or x-www-form-urlencoded
+// redeem response body, or nil if there is none
+func parseRedeemError(body []byte) *RedeemError {
+	var e struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &e); err != nil {
+		v, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil
+		}
+		e.Error = v.Get("error")
+		e.ErrorDescription = v.Get("error_description")
+	}
+	if e.Error == "" {
+		return nil
+	}
+	return &RedeemError{Code: e.Error, Description: e.ErrorDescription}
+}
+
 func (p *ProviderData) Redeem(redirectURL, code string) (s *SessionState, err error) {
 	if code == "" {
 		err = errors.New("missing code")
@@ -28,6 +66,19 @@ func (p *ProviderData) Redeem(redirectURL, code string) (s *SessionState, err er
 		params.Add("resource", p.ProtectedResource.String())
 	}
 
+	s, err = p.redeemToken(params)
+	if err == nil && s.RefreshToken == "" {
+		// without a refresh token the access token can't be renewed, so
+		// its expiry must not end the session (see SessionState.IsExpired)
+		// before the cookie does, e.g. a Bitbucket token after 2 hours
+		s.ExpiresOn = time.Time{}
+	}
+	return
+}
+
+// redeemToken requests an access token, with the grant in params, at the
+// RedeemURL
+func (p *ProviderData) redeemToken(params url.Values) (s *SessionState, err error) {
 	var req *http.Request
 	req, err = http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
 	if err != nil {
@@ -47,6 +98,11 @@ func (p *ProviderData) Redeem(redirectURL, code string) (s *SessionState, err er
 		return
 	}
 
+	// GitHub reports errors with a 200 status
+	if redeemErr := parseRedeemError(body); redeemErr != nil {
+		err = redeemErr
+		return
+	}
 	if resp.StatusCode != 200 {
 		err = fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
 		return
@@ -54,12 +110,16 @@ func (p *ProviderData) Redeem(redirectURL, code string) (s *SessionState, err er
 
 	// blindly try json and x-www-form-urlencoded
 	var jsonResponse struct {
-		AccessToken string `json:"access_token"`
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
 	}
 	err = json.Unmarshal(body, &jsonResponse)
 	if err == nil {
 		s = &SessionState{
-			AccessToken: jsonResponse.AccessToken,
+			AccessToken:  jsonResponse.AccessToken,
+			RefreshToken: jsonResponse.RefreshToken,
+			ExpiresOn:    expiresOn(jsonResponse.ExpiresIn),
 		}
 		return
 	}
@@ -70,13 +130,102 @@ func (p *ProviderData) Redeem(redirectURL, code string) (s *SessionState, err er
 		return
 	}
 	if a := v.Get("access_token"); a != "" {
-		s = &SessionState{AccessToken: a}
+		expiresIn, _ := strconv.ParseInt(v.Get("expires_in"), 10, 64)
+		s = &SessionState{AccessToken: a, RefreshToken: v.Get("refresh_token"), ExpiresOn: expiresOn(expiresIn)}
 	} else {
 		err = fmt.Errorf("no access token found %s", body)
 	}
 	return
 }
 
+// ErrTokenExchangeUnsupported is returned by ExchangeToken if the provider
+// does not support token exchange
+var ErrTokenExchangeUnsupported = errors.New("token exchange is not supported by the provider")
+
+// tokenExchangeClient makes the ExchangeToken requests, which are made
+// while serving a request, so they must not hang indefinitely
+var tokenExchangeClient = &http.Client{Timeout: 30 * time.Second}
+
+// ExchangeToken exchanges accessToken for an access token for audience, at
+// the RedeemURL, with OAuth 2.0 Token Exchange (RFC 8693). The returned
+// expiry is zero if the provider did not report one.
+func (p *ProviderData) ExchangeToken(accessToken, audience string) (string, time.Time, error) {
+	const accessTokenType = "urn:ietf:params:oauth:token-type:access_token"
+	params := url.Values{}
+	params.Add("client_id", p.ClientID)
+	params.Add("client_secret", p.ClientSecret)
+	params.Add("grant_type", "urn:ietf:params:oauth:grant-type:token-exchange")
+	params.Add("subject_token", accessToken)
+	params.Add("subject_token_type", accessTokenType)
+	params.Add("requested_token_type", accessTokenType)
+	params.Add("audience", audience)
+
+	req, err := http.NewRequest("POST", p.RedeemURL.String(), bytes.NewBufferString(params.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := tokenExchangeClient.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if redeemErr := parseRedeemError(body); redeemErr != nil {
+		if redeemErr.Code == "unsupported_grant_type" {
+			return "", time.Time{}, ErrTokenExchangeUnsupported
+		}
+		return "", time.Time{}, redeemErr
+	}
+	if resp.StatusCode != 200 {
+		return "", time.Time{}, fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+	}
+
+	var jsonResponse struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &jsonResponse); err != nil {
+		return "", time.Time{}, fmt.Errorf("%s unmarshaling %s", err, body)
+	}
+	if jsonResponse.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("no access token found %s", body)
+	}
+	return jsonResponse.AccessToken, expiresOn(jsonResponse.ExpiresIn), nil
+}
+
+// expiresOn converts an expires_in lifetime in seconds to the absolute
+// expiry of the access token, or the zero time if the lifetime is unknown
+func expiresOn(expiresIn int64) time.Time {
+	if expiresIn <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(expiresIn) * time.Second).Truncate(time.Second)
+}
+
+// GetLogoutURL returns the provider's end-session URL, with parameters for
+// OpenID Connect RP-initiated logout, or "" if the provider has no LogoutURL
+func (p *ProviderData) GetLogoutURL(redirectURI, idTokenHint string) string {
+	if p.LogoutURL == nil || p.LogoutURL.String() == "" {
+		return ""
+	}
+	a := *p.LogoutURL
+	params, _ := url.ParseQuery(a.RawQuery)
+	if idTokenHint != "" {
+		params.Set("id_token_hint", idTokenHint)
+	}
+	params.Set("client_id", p.ClientID)
+	params.Set("post_logout_redirect_uri", redirectURI)
+	a.RawQuery = params.Encode()
+	return a.String()
+}
+
 // GetLoginURL with typical oauth parameters
 func (p *ProviderData) GetLoginURL(redirectURI, state string) string {
 	var a url.URL
@@ -102,26 +251,61 @@ func (p *ProviderData) SessionFromCookie(v string, c *cookie.Cipher) (s *Session
 	return DecodeSessionState(v, c)
 }
 
-func (p *ProviderData) GetEmailAddress(s *SessionState) (string, error) {
+func (p *ProviderData) GetEmailAddress(ctx context.Context, s *SessionState) (string, error) {
 	return "", errors.New("not implemented")
 }
 
 // GetUserName returns the Account username
-func (p *ProviderData) GetUserName(s *SessionState) (string, error) {
+func (p *ProviderData) GetUserName(ctx context.Context, s *SessionState) (string, error) {
 	return "", errors.New("not implemented")
 }
 
+// GetPreferredUsername returns the username the user is known by to the
+// provider, for display, if it has one separate from the email
+func (p *ProviderData) GetPreferredUsername(ctx context.Context, s *SessionState) (string, error) {
+	return "", nil
+}
+
 // ValidateGroup validates that the provided email exists in the configured provider
 // email group(s).
 func (p *ProviderData) ValidateGroup(email string) bool {
 	return true
 }
 
-func (p *ProviderData) ValidateSessionState(s *SessionState) bool {
+// ValidateSessionState checks that the session's access token is still valid.
+// An error indicates the provider could not be reached, so validity is unknown.
+func (p *ProviderData) ValidateSessionState(s *SessionState) (bool, error) {
 	return validateToken(p, s.AccessToken, nil)
 }
 
-// RefreshSessionIfNeeded
+// RefreshSessionIfNeeded renews the access token with the refresh token
+// once it has expired. Sessions without a refresh token have no ExpiresOn,
+// see Redeem.
 func (p *ProviderData) RefreshSessionIfNeeded(s *SessionState) (bool, error) {
-	return false, nil
+	if s == nil || s.RefreshToken == "" || s.ExpiresOn.IsZero() || s.ExpiresOn.After(time.Now()) {
+		return false, nil
+	}
+
+	params := url.Values{}
+	params.Add("client_id", p.ClientID)
+	params.Add("client_secret", p.ClientSecret)
+	params.Add("refresh_token", s.RefreshToken)
+	params.Add("grant_type", "refresh_token")
+	refreshed, err := p.redeemToken(params)
+	if err != nil {
+		return false, err
+	}
+	if refreshed.AccessToken == "" {
+		return false, errors.New("no access token found refreshing the session")
+	}
+
+	origExpiration := s.ExpiresOn
+	s.AccessToken = refreshed.AccessToken
+	s.ExpiresOn = refreshed.ExpiresOn
+	if refreshed.RefreshToken != "" {
+		// the provider rotates refresh tokens
+		s.RefreshToken = refreshed.RefreshToken
+	}
+	logger.Printf("refreshed access token %s (expired on %s)", s, origExpiration)
+	return true, nil
 }
@@ -1,6 +1,10 @@
 package providers
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
@@ -15,3 +19,204 @@ func TestRefresh(t *testing.T) {
 	assert.Equal(t, false, refreshed)
 	assert.Equal(t, nil, err)
 }
+
+func TestGetLogoutURL(t *testing.T) {
+	p := &ProviderData{ClientID: "client1"}
+	assert.Equal(t, "", p.GetLogoutURL("https://example.com/", "id.token.hint"))
+
+	p.LogoutURL, _ = url.Parse("https://provider.example.com/logout?foo=bar")
+	logoutURL, err := url.Parse(p.GetLogoutURL("https://example.com/", "id.token.hint"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "provider.example.com", logoutURL.Host)
+	assert.Equal(t, "/logout", logoutURL.Path)
+	assert.Equal(t, url.Values{
+		"foo":                      {"bar"},
+		"client_id":                {"client1"},
+		"id_token_hint":            {"id.token.hint"},
+		"post_logout_redirect_uri": {"https://example.com/"},
+	}, logoutURL.Query())
+
+	logoutURL, _ = url.Parse(p.GetLogoutURL("https://example.com/", ""))
+	assert.Equal(t, "", logoutURL.Query().Get("id_token_hint"))
+	assert.Equal(t, "client1", logoutURL.Query().Get("client_id"))
+}
+
+func testRedeemProvider(contentType, body string) (*ProviderData, *httptest.Server) {
+	b := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.WriteHeader(200)
+			w.Write([]byte(body))
+		}))
+	redeemURL, _ := url.Parse(b.URL + "/login/oauth/access_token")
+	return &ProviderData{RedeemURL: redeemURL}, b
+}
+
+func TestRedeemExpiresIn(t *testing.T) {
+	p, b := testRedeemProvider("application/json", `{"access_token": "a1234", "refresh_token": "r1234", "expires_in": 3600}`)
+	defer b.Close()
+
+	before := time.Now().Truncate(time.Second)
+	s, err := p.Redeem("https://example.com/oauth2/callback", "code1234")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "a1234", s.AccessToken)
+	assert.Equal(t, "r1234", s.RefreshToken)
+	assert.False(t, s.ExpiresOn.Before(before.Add(time.Hour)))
+	assert.False(t, s.ExpiresOn.After(time.Now().Add(time.Hour)))
+}
+
+func TestRedeemExpiresInForm(t *testing.T) {
+	p, b := testRedeemProvider("application/x-www-form-urlencoded", "access_token=a1234&refresh_token=r1234&expires_in=60&token_type=bearer")
+	defer b.Close()
+
+	before := time.Now().Truncate(time.Second)
+	s, err := p.Redeem("https://example.com/oauth2/callback", "code1234")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "a1234", s.AccessToken)
+	assert.Equal(t, "r1234", s.RefreshToken)
+	assert.False(t, s.ExpiresOn.Before(before.Add(time.Minute)))
+	assert.False(t, s.ExpiresOn.After(time.Now().Add(time.Minute)))
+}
+
+func TestRedeemNoExpiresIn(t *testing.T) {
+	p, b := testRedeemProvider("application/json", `{"access_token": "a1234"}`)
+	defer b.Close()
+
+	s, err := p.Redeem("https://example.com/oauth2/callback", "code1234")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, s.ExpiresOn.IsZero())
+	assert.Equal(t, false, s.IsExpired())
+}
+
+func TestRedeemExpiresInWithoutRefreshToken(t *testing.T) {
+	// e.g. Bitbucket's 2 hour tokens, which can't be renewed without one,
+	// must not end the session before the cookie expires
+	p, b := testRedeemProvider("application/json", `{"access_token": "a1234", "expires_in": 7200}`)
+	defer b.Close()
+
+	s, err := p.Redeem("https://example.com/oauth2/callback", "code1234")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "a1234", s.AccessToken)
+	assert.Equal(t, true, s.ExpiresOn.IsZero())
+}
+
+func TestRefreshExpired(t *testing.T) {
+	var form url.Values
+	b := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			form = r.PostForm
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token": "a5678", "refresh_token": "r5678", "expires_in": 3600}`))
+		}))
+	defer b.Close()
+	redeemURL, _ := url.Parse(b.URL + "/login/oauth/access_token")
+	p := &ProviderData{ClientID: "client1", ClientSecret: "secret1", RedeemURL: redeemURL}
+
+	// not refreshed before the access token expires
+	s := &SessionState{AccessToken: "a1234", RefreshToken: "r1234", ExpiresOn: time.Now().Add(time.Minute)}
+	refreshed, err := p.RefreshSessionIfNeeded(s)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, refreshed)
+	assert.Equal(t, url.Values(nil), form)
+
+	s.ExpiresOn = time.Now().Add(-time.Minute)
+	refreshed, err = p.RefreshSessionIfNeeded(s)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, "refresh_token", form.Get("grant_type"))
+	assert.Equal(t, "r1234", form.Get("refresh_token"))
+	assert.Equal(t, "client1", form.Get("client_id"))
+	assert.Equal(t, "a5678", s.AccessToken)
+	assert.Equal(t, "r5678", s.RefreshToken)
+	assert.True(t, s.ExpiresOn.After(time.Now().Add(59*time.Minute)))
+	assert.Equal(t, false, s.IsExpired())
+}
+
+func TestRefreshExpiredError(t *testing.T) {
+	p, b := testRedeemProvider("application/json", `{"error": "bad_refresh_token"}`)
+	defer b.Close()
+
+	s := &SessionState{AccessToken: "a1234", RefreshToken: "r1234", ExpiresOn: time.Now().Add(-time.Minute)}
+	refreshed, err := p.RefreshSessionIfNeeded(s)
+	assert.Equal(t, &RedeemError{Code: "bad_refresh_token"}, err)
+	assert.Equal(t, false, refreshed)
+	assert.Equal(t, "a1234", s.AccessToken)
+}
+
+func TestExchangeToken(t *testing.T) {
+	var form url.Values
+	b := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			r.ParseForm()
+			form = r.PostForm
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token": "exchanged1234", "issued_token_type": "urn:ietf:params:oauth:token-type:access_token", "token_type": "Bearer", "expires_in": 300}`))
+		}))
+	defer b.Close()
+	redeemURL, _ := url.Parse(b.URL + "/token")
+	p := &ProviderData{ClientID: "client1", ClientSecret: "secret1", RedeemURL: redeemURL}
+
+	token, expires, err := p.ExchangeToken("a1234", "https://api.example.com")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "exchanged1234", token)
+	assert.False(t, expires.After(time.Now().Add(5*time.Minute)))
+	assert.True(t, expires.After(time.Now().Add(4*time.Minute)))
+	assert.Equal(t, "urn:ietf:params:oauth:grant-type:token-exchange", form.Get("grant_type"))
+	assert.Equal(t, "a1234", form.Get("subject_token"))
+	assert.Equal(t, "urn:ietf:params:oauth:token-type:access_token", form.Get("subject_token_type"))
+	assert.Equal(t, "https://api.example.com", form.Get("audience"))
+	assert.Equal(t, "client1", form.Get("client_id"))
+}
+
+func TestExchangeTokenUnsupported(t *testing.T) {
+	p, b := testRedeemProvider("application/json", `{"error": "unsupported_grant_type"}`)
+	defer b.Close()
+
+	token, _, err := p.ExchangeToken("a1234", "https://api.example.com")
+	assert.Equal(t, ErrTokenExchangeUnsupported, err)
+	assert.Equal(t, "", token)
+}
+
+func TestExchangeTokenDenied(t *testing.T) {
+	p, b := testRedeemProvider("application/json", `{"error": "invalid_target", "error_description": "unknown audience"}`)
+	defer b.Close()
+
+	_, _, err := p.ExchangeToken("a1234", "https://api.example.com")
+	assert.Equal(t, &RedeemError{Code: "invalid_target", Description: "unknown audience"}, err)
+}
+
+func TestIsEmailAllowed(t *testing.T) {
+	p := &ProviderData{}
+	assert.Equal(t, true, p.isEmailAllowed("michael.bland@gsa.gov"))
+
+	p.EmailDomains = []string{"example.com", "gsa.gov"}
+	assert.Equal(t, true, p.isEmailAllowed("michael.bland@gsa.gov"))
+	assert.Equal(t, true, p.isEmailAllowed("Michael.Bland@GSA.gov"))
+	assert.Equal(t, false, p.isEmailAllowed("michael.bland@gsa.gov.example.net"))
+	assert.Equal(t, false, p.isEmailAllowed("michael.bland@sub.gsa.gov"))
+	assert.Equal(t, false, p.isEmailAllowed("gsa.gov"))
+
+	p.EmailDomains = []string{"example.com", "*"}
+	assert.Equal(t, true, p.isEmailAllowed("michael.bland@gsa.gov"))
+}
+
+func TestAllowedEmail(t *testing.T) {
+	p := &ProviderData{EmailDomains: []string{"gsa.gov"}}
+	email, err := p.allowedEmail("michael.bland@gsa.gov", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "michael.bland@gsa.gov", email)
+
+	email, err = p.allowedEmail("mbland@example.com", nil)
+	assert.Equal(t, "", email)
+	redeemErr, ok := err.(*RedeemError)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "access_denied", redeemErr.Code)
+}
+
+func TestGetPreferredUsernameDefault(t *testing.T) {
+	p := testGitLabProvider("")
+	user, err := p.GetPreferredUsername(context.Background(), &SessionState{AccessToken: "imaginary_access_token"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", user)
+}
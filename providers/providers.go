@@ -1,22 +1,39 @@
 package providers
 
 import (
+	"context"
+
 	"github.com/ploxiln/oauth2_proxy/cookie"
 )
 
 type Provider interface {
 	Data() *ProviderData
-	GetEmailAddress(*SessionState) (string, error)
-	GetUserName(*SessionState) (string, error)
+	GetEmailAddress(context.Context, *SessionState) (string, error)
+	GetUserName(context.Context, *SessionState) (string, error)
+	GetPreferredUsername(context.Context, *SessionState) (string, error)
 	Redeem(string, string) (*SessionState, error)
 	ValidateGroup(string) bool
-	ValidateSessionState(*SessionState) bool
+	ValidateSessionState(*SessionState) (bool, error)
 	GetLoginURL(redirectURI, finalRedirect string) string
+	GetLogoutURL(redirectURI, idTokenHint string) string
 	RefreshSessionIfNeeded(*SessionState) (bool, error)
 	SessionFromCookie(string, *cookie.Cipher) (*SessionState, error)
 	CookieForSession(*SessionState, *cookie.Cipher) (string, error)
 }
 
+// WarmUpper is implemented by providers which can check their configured
+// credentials with the provider's API, e.g. at startup
+type WarmUpper interface {
+	WarmUp() error
+}
+
+// TokenSessionProvider is implemented by providers which can make a session
+// of a provider token presented as a bearer token, rather than of a login.
+// SessionFromToken returns nil if the provider does not take such tokens.
+type TokenSessionProvider interface {
+	SessionFromToken(ctx context.Context, token string) (*SessionState, error)
+}
+
 func New(provider string, p *ProviderData) Provider {
 	switch provider {
 	case "linkedin":
@@ -33,6 +50,8 @@ func New(provider string, p *ProviderData) Provider {
 		return NewOIDCProvider(p)
 	case "discord":
 		return NewDiscordProvider(p)
+	case "bitbucket":
+		return NewBitbucketProvider(p)
 	default:
 		return NewGoogleProvider(p)
 	}
@@ -0,0 +1,93 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit is the API rate limit status reported by a provider
+type RateLimit struct {
+	Limit      int       `json:"limit"`
+	Remaining  int       `json:"remaining"`
+	Reset      time.Time `json:"reset"`
+	ObservedAt time.Time `json:"observed_at"`
+}
+
+// RateLimitReporter is implemented by providers which track the rate limit
+// status of their API. RateLimit returns nil until a status has been seen.
+type RateLimitReporter interface {
+	RateLimit() *RateLimit
+}
+
+// rateLimitTracker keeps the X-RateLimit-* values of the latest API response
+type rateLimitTracker struct {
+	mu     sync.Mutex
+	latest *RateLimit
+}
+
+func (t *rateLimitTracker) observe(h http.Header) {
+	limit, err1 := strconv.Atoi(h.Get("X-RateLimit-Limit"))
+	remaining, err2 := strconv.Atoi(h.Get("X-RateLimit-Remaining"))
+	reset, err3 := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return
+	}
+	r := &RateLimit{
+		Limit:      limit,
+		Remaining:  remaining,
+		Reset:      time.Unix(reset, 0).UTC(),
+		ObservedAt: time.Now().UTC(),
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.latest = r
+}
+
+func (t *rateLimitTracker) get() *RateLimit {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.latest == nil {
+		return nil
+	}
+	r := *t.latest
+	return &r
+}
+
+// backoffGate holds back all API requests of a provider while it is paused,
+// e.g. after a secondary ("abuse") rate limit response, so that concurrent
+// requests back off together rather than each being throttled in turn
+type backoffGate struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// pause holds back requests for d from now, unless already paused longer
+func (g *backoffGate) pause(d time.Duration) {
+	until := time.Now().Add(d)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if until.After(g.until) {
+		g.until = until
+	}
+}
+
+// wait returns once the gate is not paused, or with the error of ctx if it
+// is done first
+func (g *backoffGate) wait(ctx context.Context) error {
+	for {
+		g.mu.Lock()
+		d := time.Until(g.until)
+		g.mu.Unlock()
+		if d <= 0 {
+			return nil
+		}
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// requestResult is a response, with its body read, shared by the callers of
+// a coalesced request
+type requestResult struct {
+	resp *http.Response
+	body []byte
+	err  error
+}
+
+type requestCall struct {
+	done   chan struct{}
+	dups   int
+	result requestResult
+}
+
+// requestGroup coalesces identical concurrent GET requests, so that only
+// one of them is sent and all callers share its response. Requests are
+// identical if they have the same URL, Accept and Authorization headers;
+// tokens are only kept hashed.
+type requestGroup struct {
+	mu    sync.Mutex
+	calls map[string]*requestCall
+}
+
+func newRequestGroup() *requestGroup {
+	return &requestGroup{calls: make(map[string]*requestCall)}
+}
+
+func requestGroupKey(req *http.Request) string {
+	sum := sha256.Sum256([]byte(req.Header.Get("Authorization")))
+	return req.Method + " " + req.URL.String() + " " + req.Header.Get("Accept") + " " + hex.EncodeToString(sum[:])
+}
+
+// Do sends req with do, unless an identical request is already in flight,
+// in which case it waits for that one's response instead. Each caller gets
+// its own copy of the response. As the request is shared, it is not
+// canceled with the context of req, but each caller stops waiting for it
+// when its own context is done.
+func (g *requestGroup) Do(req *http.Request, do func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if req.Method != "GET" {
+		return do(req)
+	}
+	key := requestGroupKey(req)
+	g.mu.Lock()
+	c, ok := g.calls[key]
+	if ok {
+		c.dups++
+	} else {
+		c = &requestCall{done: make(chan struct{})}
+		g.calls[key] = c
+		go g.run(key, c, req.WithContext(context.Background()), do)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.result.response(req)
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+}
+
+func (g *requestGroup) run(key string, c *requestCall, req *http.Request, do func(*http.Request) (*http.Response, error)) {
+	resp, err := do(req)
+	if err == nil {
+		c.result.body, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	c.result.resp, c.result.err = resp, err
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(c.done)
+}
+
+func (r requestResult) response(req *http.Request) (*http.Response, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	resp := *r.resp
+	resp.Header = make(http.Header, len(r.resp.Header))
+	for k, v := range r.resp.Header {
+		resp.Header[k] = append([]string(nil), v...)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(r.body))
+	resp.ContentLength = int64(len(r.body))
+	resp.Request = req
+	return &resp, nil
+}
@@ -2,6 +2,7 @@ package providers
 
 import (
 	"fmt"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -15,6 +16,27 @@ type SessionState struct {
 	RefreshToken string
 	Email        string
 	User         string
+	IDToken      string
+	AuthTime     time.Time
+	// Fingerprint of the client the session was created for, if enabled
+	Fingerprint string
+	// PreferredUsername is the username the user is known by to the
+	// provider, if it has one separate from the email, see
+	// Provider.GetPreferredUsername
+	PreferredUsername string
+	// UserID is the provider's immutable ID of the user, if it has one
+	// separate from the user name, e.g. GitHub's numeric user id
+	UserID string
+	// AvatarURL is the URL of the user's picture, if the provider has one
+	AvatarURL string
+	// Groups the user was found in by the provider's membership check,
+	// e.g. the matching GitHub "org" or "org/team"
+	Groups []string
+
+	// number of provider API calls made while establishing this session
+	providerCalls int
+	// whether the scopes granted to AccessToken have been checked
+	scopesChecked bool
 }
 
 func (s *SessionState) IsExpired() bool {
@@ -40,7 +62,7 @@ func (s *SessionState) String() string {
 
 func (s *SessionState) EncodeSessionState(c *cookie.Cipher) (string, error) {
 	if c == nil || s.AccessToken == "" {
-		return s.accountInfo(), nil
+		return s.plainInfo(), nil
 	}
 	return s.EncryptedString(c)
 }
@@ -49,6 +71,35 @@ func (s *SessionState) accountInfo() string {
 	return fmt.Sprintf("email:%s user:%s", s.Email, s.User)
 }
 
+// plainInfo is the accountInfo, followed by the fingerprint, the preferred
+// username, the user ID, the avatar URL and the groups if set. Every value is escaped, so that none can
+// add chunks or fields: a space, "|" or "," in a user name must not read back
+// as groups. The email, user and groups are escaped as path segments, which
+// leaves "@" and "+" as they were in sessions from before escaping.
+func (s *SessionState) plainInfo() string {
+	v := fmt.Sprintf("email:%s user:%s", url.PathEscape(s.Email), url.PathEscape(s.User))
+	if s.Fingerprint != "" {
+		v += " fp:" + url.PathEscape(s.Fingerprint)
+	}
+	if s.PreferredUsername != "" {
+		v += " pu:" + url.QueryEscape(s.PreferredUsername)
+	}
+	if s.UserID != "" {
+		v += " uid:" + url.QueryEscape(s.UserID)
+	}
+	if s.AvatarURL != "" {
+		v += " av:" + url.QueryEscape(s.AvatarURL)
+	}
+	if len(s.Groups) > 0 {
+		groups := make([]string, len(s.Groups))
+		for i, g := range s.Groups {
+			groups[i] = url.PathEscape(g)
+		}
+		v += " groups:" + strings.Join(groups, ",")
+	}
+	return v
+}
+
 func (s *SessionState) EncryptedString(c *cookie.Cipher) (string, error) {
 	var err error
 	if c == nil {
@@ -66,22 +117,76 @@ func (s *SessionState) EncryptedString(c *cookie.Cipher) (string, error) {
 			return "", err
 		}
 	}
-	return fmt.Sprintf("%s|%s|%d|%s", s.accountInfo(), a, s.ExpiresOn.Unix(), r), nil
+	v := fmt.Sprintf("%s|%s|%d|%s", s.plainInfo(), a, s.ExpiresOn.Unix(), r)
+	if s.IDToken != "" || !s.AuthTime.IsZero() {
+		i := s.IDToken
+		if i != "" {
+			if i, err = c.Encrypt(i); err != nil {
+				return "", err
+			}
+		}
+		v += "|" + i
+	}
+	if !s.AuthTime.IsZero() {
+		v += fmt.Sprintf("|%d", s.AuthTime.Unix())
+	}
+	return v, nil
 }
 
 func decodeSessionStatePlain(v string) (s *SessionState, err error) {
 	chunks := strings.Split(v, " ")
-	if len(chunks) != 2 {
+	if len(chunks) < 2 {
 		return nil, fmt.Errorf("could not decode session state: expected 2 chunks got %d", len(chunks))
 	}
 
-	email := strings.TrimPrefix(chunks[0], "email:")
-	user := strings.TrimPrefix(chunks[1], "user:")
-	if user == "" {
-		user = strings.Split(email, "@")[0]
+	if !strings.HasPrefix(chunks[0], "email:") || !strings.HasPrefix(chunks[1], "user:") {
+		return nil, fmt.Errorf("could not decode session state: expected email and user chunks")
+	}
+	s = &SessionState{}
+	if s.Email, err = url.PathUnescape(strings.TrimPrefix(chunks[0], "email:")); err != nil {
+		return nil, fmt.Errorf("could not decode session state: %s", err)
+	}
+	if s.User, err = url.PathUnescape(strings.TrimPrefix(chunks[1], "user:")); err != nil {
+		return nil, fmt.Errorf("could not decode session state: %s", err)
+	}
+	if s.User == "" {
+		s.User = strings.Split(s.Email, "@")[0]
 	}
 
-	return &SessionState{User: user, Email: email}, nil
+	// the fingerprint, the preferred username, the user ID, the avatar URL
+	// and the groups are optional, each given at most once
+	seen := make(map[string]bool)
+	for _, chunk := range chunks[2:] {
+		key := strings.SplitN(chunk, ":", 2)[0]
+		if seen[key] {
+			return nil, fmt.Errorf("could not decode session state: repeated chunk %q", key)
+		}
+		seen[key] = true
+		value := strings.TrimPrefix(chunk, key+":")
+		switch {
+		case key == "fp" && chunk != key:
+			s.Fingerprint, err = url.PathUnescape(value)
+		case key == "pu" && chunk != key:
+			s.PreferredUsername, err = url.QueryUnescape(value)
+		case key == "uid" && chunk != key:
+			s.UserID, err = url.QueryUnescape(value)
+		case key == "av" && chunk != key:
+			s.AvatarURL, err = url.QueryUnescape(value)
+		case key == "groups" && chunk != key:
+			for _, g := range strings.Split(value, ",") {
+				if g, err = url.PathUnescape(g); err != nil {
+					break
+				}
+				s.Groups = append(s.Groups, g)
+			}
+		default:
+			return nil, fmt.Errorf("could not decode session state: unexpected chunk %q", chunk)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not decode session state: %s", err)
+		}
+	}
+	return s, nil
 }
 
 func DecodeSessionState(v string, c *cookie.Cipher) (s *SessionState, err error) {
@@ -91,8 +196,9 @@ func DecodeSessionState(v string, c *cookie.Cipher) (s *SessionState, err error)
 		return decodeSessionStatePlain(v)
 	}
 
-	if len(chunks) != 4 {
-		err = fmt.Errorf("invalid number of fields (got %d expected 4)", len(chunks))
+	// the 5th and 6th fields, the OIDC id_token and the auth time, are optional
+	if len(chunks) < 4 || len(chunks) > 6 {
+		err = fmt.Errorf("invalid number of fields (got %d expected 4 to 6)", len(chunks))
 		return
 	}
 
@@ -116,5 +222,17 @@ func DecodeSessionState(v string, c *cookie.Cipher) (s *SessionState, err error)
 		}
 	}
 
+	if len(chunks) >= 5 && chunks[4] != "" {
+		if sessionState.IDToken, err = c.Decrypt(chunks[4]); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(chunks) == 6 {
+		if ts, err := strconv.ParseInt(chunks[5], 10, 64); err == nil {
+			sessionState.AuthTime = time.Unix(ts, 0)
+		}
+	}
+
 	return sessionState, nil
 }
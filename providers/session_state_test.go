@@ -37,15 +37,50 @@ func TestSessionStateSerialization(t *testing.T) {
 	assert.Equal(t, s.ExpiresOn.Unix(), ss.ExpiresOn.Unix())
 	assert.Equal(t, s.RefreshToken, ss.RefreshToken)
 
-	// ensure a different cipher can't decode properly (ie: it gets gibberish)
+	// ensure a different cipher can't decode it
 	ss, err = DecodeSessionState(encoded, c2)
-	t.Logf("%#v", ss)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, (*SessionState)(nil), ss)
+}
+
+func TestSessionStateSerializationWithIDToken(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
 	assert.Equal(t, nil, err)
-	assert.Equal(t, "user", ss.User)
-	assert.Equal(t, s.Email, ss.Email)
-	assert.Equal(t, s.ExpiresOn.Unix(), ss.ExpiresOn.Unix())
-	assert.NotEqual(t, s.AccessToken, ss.AccessToken)
-	assert.NotEqual(t, s.RefreshToken, ss.RefreshToken)
+	s := &SessionState{
+		Email:       "user@domain.com",
+		AccessToken: "token1234",
+		ExpiresOn:   time.Now().Add(time.Duration(1) * time.Hour),
+		IDToken:     "header.payload.signature",
+	}
+	encoded, err := s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4, strings.Count(encoded, "|"))
+
+	ss, err := DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.AccessToken, ss.AccessToken)
+	assert.Equal(t, "", ss.RefreshToken)
+	assert.Equal(t, s.IDToken, ss.IDToken)
+}
+
+func TestSessionStateSerializationWithAuthTime(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	s := &SessionState{
+		Email:       "user@domain.com",
+		AccessToken: "token1234",
+		ExpiresOn:   time.Now().Add(time.Duration(1) * time.Hour),
+		AuthTime:    time.Now().Add(-time.Duration(10) * time.Minute),
+	}
+	encoded, err := s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 5, strings.Count(encoded, "|"))
+
+	ss, err := DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.AccessToken, ss.AccessToken)
+	assert.Equal(t, "", ss.IDToken)
+	assert.Equal(t, s.AuthTime.Unix(), ss.AuthTime.Unix())
 }
 
 func TestSessionStateSerializationWithUser(t *testing.T) {
@@ -73,15 +108,10 @@ func TestSessionStateSerializationWithUser(t *testing.T) {
 	assert.Equal(t, s.ExpiresOn.Unix(), ss.ExpiresOn.Unix())
 	assert.Equal(t, s.RefreshToken, ss.RefreshToken)
 
-	// ensure a different cipher can't decode properly (ie: it gets gibberish)
+	// ensure a different cipher can't decode it
 	ss, err = DecodeSessionState(encoded, c2)
-	t.Logf("%#v", ss)
-	assert.Equal(t, nil, err)
-	assert.Equal(t, s.User, ss.User)
-	assert.Equal(t, s.Email, ss.Email)
-	assert.Equal(t, s.ExpiresOn.Unix(), ss.ExpiresOn.Unix())
-	assert.NotEqual(t, s.AccessToken, ss.AccessToken)
-	assert.NotEqual(t, s.RefreshToken, ss.RefreshToken)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, (*SessionState)(nil), ss)
 }
 
 func TestSessionStateSerializationNoCipher(t *testing.T) {
@@ -127,6 +157,145 @@ func TestSessionStateSerializationNoCipherWithUser(t *testing.T) {
 	assert.Equal(t, "", ss.RefreshToken)
 }
 
+func TestSessionStateSerializationWithFingerprint(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	s := &SessionState{
+		Email:       "user@domain.com",
+		AccessToken: "token1234",
+		ExpiresOn:   time.Now().Add(time.Duration(1) * time.Hour),
+		AuthTime:    time.Now().Add(-time.Duration(10) * time.Minute),
+		Fingerprint: "0123456789abcdef.fedcba9876543210",
+	}
+	encoded, err := s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+	ss, err := DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.Fingerprint, ss.Fingerprint)
+	assert.Equal(t, "user", ss.User)
+	assert.Equal(t, s.AuthTime.Unix(), ss.AuthTime.Unix())
+
+	encoded, err = s.EncodeSessionState(nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "email:user@domain.com user: fp:0123456789abcdef.fedcba9876543210", encoded)
+	ss, err = DecodeSessionState(encoded, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.Fingerprint, ss.Fingerprint)
+	assert.Equal(t, s.Email, ss.Email)
+
+	// sessions from before fingerprints were enabled have none
+	ss, err = DecodeSessionState("email:user@domain.com user:", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", ss.Fingerprint)
+}
+
+func TestSessionStateSerializationWithGroups(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	s := &SessionState{
+		Email:       "user@domain.com",
+		AccessToken: "token1234",
+		ExpiresOn:   time.Now().Add(time.Duration(1) * time.Hour),
+		Groups:      []string{"testorg/ops", "testorg/devs"},
+	}
+	encoded, err := s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+	ss, err := DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.Groups, ss.Groups)
+	assert.Equal(t, s.AccessToken, ss.AccessToken)
+
+	encoded, err = s.EncodeSessionState(nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "email:user@domain.com user: groups:testorg%2Fops,testorg%2Fdevs", encoded)
+
+	s.Fingerprint = "0123456789abcdef.fedcba9876543210"
+	encoded, err = s.EncodeSessionState(nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "email:user@domain.com user: fp:0123456789abcdef.fedcba9876543210 groups:testorg%2Fops,testorg%2Fdevs", encoded)
+	ss, err = DecodeSessionState(encoded, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.Fingerprint, ss.Fingerprint)
+	assert.Equal(t, s.Groups, ss.Groups)
+
+	s.PreferredUsername = "Michael Bland"
+	encoded, err = s.EncodeSessionState(nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "email:user@domain.com user: fp:0123456789abcdef.fedcba9876543210 pu:Michael+Bland groups:testorg%2Fops,testorg%2Fdevs", encoded)
+	ss, err = DecodeSessionState(encoded, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.PreferredUsername, ss.PreferredUsername)
+	assert.Equal(t, s.Groups, ss.Groups)
+
+	s.UserID = "123"
+	encoded, err = s.EncodeSessionState(nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "email:user@domain.com user: fp:0123456789abcdef.fedcba9876543210 pu:Michael+Bland uid:123 groups:testorg%2Fops,testorg%2Fdevs", encoded)
+	ss, err = DecodeSessionState(encoded, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.UserID, ss.UserID)
+
+	s.AvatarURL = "https://avatars.githubusercontent.com/u/123?v=4"
+	encoded, err = s.EncodeSessionState(nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "email:user@domain.com user: fp:0123456789abcdef.fedcba9876543210 pu:Michael+Bland uid:123 av:https%3A%2F%2Favatars.githubusercontent.com%2Fu%2F123%3Fv%3D4 groups:testorg%2Fops,testorg%2Fdevs", encoded)
+	ss, err = DecodeSessionState(encoded, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.AvatarURL, ss.AvatarURL)
+	assert.Equal(t, s.Groups, ss.Groups)
+
+	encoded, err = s.EncodeSessionState(c)
+	assert.Equal(t, nil, err)
+	ss, err = DecodeSessionState(encoded, c)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, s.PreferredUsername, ss.PreferredUsername)
+	assert.Equal(t, s.UserID, ss.UserID)
+	assert.Equal(t, s.AvatarURL, ss.AvatarURL)
+
+	_, err = DecodeSessionState("email:user@domain.com user: other:x", nil)
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSessionStateSerializationEscaped(t *testing.T) {
+	c, err := cookie.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	s := &SessionState{
+		Email:       "first+last@domain.com",
+		User:        "bob groups:org/admins|x",
+		AccessToken: "token1234",
+		ExpiresOn:   time.Now().Add(time.Duration(1) * time.Hour),
+		Groups:      []string{"org/a,b", "org/c d"},
+	}
+	for _, c := range []*cookie.Cipher{nil, c} {
+		encoded, err := s.EncodeSessionState(c)
+		assert.Equal(t, nil, err)
+		ss, err := DecodeSessionState(encoded, c)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, s.Email, ss.Email)
+		assert.Equal(t, s.User, ss.User)
+		assert.Equal(t, s.Groups, ss.Groups)
+	}
+
+	// sessions from before escaping decode as they did
+	ss, err := DecodeSessionState("email:first+last@domain.com user:first+last", nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "first+last@domain.com", ss.Email)
+	assert.Equal(t, "first+last", ss.User)
+}
+
+func TestSessionStateDecodeRepeatedChunk(t *testing.T) {
+	for _, v := range []string{
+		"email:user@domain.com user:bob groups:org/devs groups:org/admins",
+		"email:user@domain.com user:bob fp: fp:0123",
+		"email:user@domain.com user:bob pu:a pu:b",
+		"email:user@domain.com user:bob groups",
+		"user:bob email:user@domain.com",
+	} {
+		_, err := DecodeSessionState(v, nil)
+		assert.NotEqual(t, nil, err, v)
+	}
+}
+
 func TestSessionStateAccountInfo(t *testing.T) {
 	s := &SessionState{
 		Email: "user@domain.com",
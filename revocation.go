@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
+)
+
+// RevocationList records users whose sessions, if issued before the time of
+// revocation, are no longer accepted. Sessions are stored in cookies, so the
+// list is checked on each request. It is held in memory by each oauth2_proxy
+// instance. A revocation is kept for maxAge, the cookie expiry, after which
+// the sessions it revoked have expired anyway.
+type RevocationList struct {
+	mu      sync.RWMutex
+	revoked map[string]time.Time
+	maxAge  time.Duration
+}
+
+func NewRevocationList(maxAge time.Duration) *RevocationList {
+	return &RevocationList{revoked: make(map[string]time.Time), maxAge: maxAge}
+}
+
+// Revoke all sessions for a user name or email issued up to time t, and
+// forget revocations more than maxAge older than t
+func (r *RevocationList) Revoke(id string, t time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t = t.Truncate(time.Second)
+	for revokedID, revoked := range r.revoked {
+		if revoked.Before(t.Add(-r.maxAge)) {
+			delete(r.revoked, revokedID)
+		}
+	}
+	r.revoked[strings.ToLower(id)] = t
+}
+
+// IsRevoked returns true if the session, issued at the given time, belongs to
+// a user whose sessions have since been revoked
+func (r *RevocationList) IsRevoked(s *providers.SessionState, issued time.Time) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, id := range []string{s.User, s.Email} {
+		if id == "" {
+			continue
+		}
+		if t, ok := r.revoked[strings.ToLower(id)]; ok && !issued.After(t) {
+			return true
+		}
+	}
+	return false
+}
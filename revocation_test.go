@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevocationList(t *testing.T) {
+	r := NewRevocationList(24 * time.Hour)
+	now := time.Now().Truncate(time.Second)
+	session := &providers.SessionState{User: "mbland", Email: "michael.bland@gsa.gov"}
+
+	assert.Equal(t, false, r.IsRevoked(session, now))
+
+	r.Revoke("Michael.Bland@gsa.gov", now)
+	assert.Equal(t, true, r.IsRevoked(session, now.Add(-time.Hour)))
+	assert.Equal(t, true, r.IsRevoked(session, now))
+	assert.Equal(t, false, r.IsRevoked(session, now.Add(time.Second)))
+
+	other := &providers.SessionState{User: "other", Email: "other@gsa.gov"}
+	assert.Equal(t, false, r.IsRevoked(other, now.Add(-time.Hour)))
+
+	r.Revoke("other", now)
+	assert.Equal(t, true, r.IsRevoked(other, now.Add(-time.Hour)))
+}
+
+func TestRevocationListExpired(t *testing.T) {
+	r := NewRevocationList(24 * time.Hour)
+	now := time.Now().Truncate(time.Second)
+
+	r.Revoke("mbland", now)
+	r.Revoke("other", now.Add(12*time.Hour))
+	assert.Equal(t, 2, len(r.revoked))
+
+	// revocations older than maxAge are forgotten on the next one
+	r.Revoke("third", now.Add(25*time.Hour))
+	assert.Equal(t, 2, len(r.revoked))
+	_, ok := r.revoked["mbland"]
+	assert.Equal(t, false, ok)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
+)
+
+// clientNetwork is the network of ip which is compared for session
+// fingerprints: its /24 for IPv4, its /64 for IPv6
+func clientNetwork(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// userAgentFamilies are the User-Agent products that identify a browser,
+// most specific first, as e.g. Edge also sends Chrome and Safari
+var userAgentFamilies = []string{"Edg", "Edge", "OPR", "Firefox", "FxiOS", "CriOS", "Chrome", "Version"}
+
+// userAgentFamily is the browser and its major version of the User-Agent
+// ua, e.g. "Firefox/115", or else its first product and major version, so
+// that the fingerprint survives minor browser updates
+func userAgentFamily(ua string) string {
+	var first string
+	products := make(map[string]string)
+	for _, field := range strings.Fields(ua) {
+		i := strings.Index(field, "/")
+		if i <= 0 {
+			continue
+		}
+		name, version := field[:i], field[i+1:]
+		if j := strings.IndexAny(version, ".;)"); j >= 0 {
+			version = version[:j]
+		}
+		if _, ok := products[name]; !ok {
+			products[name] = version
+		}
+		if first == "" {
+			first = name
+		}
+	}
+	for _, name := range userAgentFamilies {
+		if version, ok := products[name]; ok {
+			return name + "/" + version
+		}
+	}
+	if first == "" {
+		return ua
+	}
+	return first + "/" + products[first]
+}
+
+func (p *OAuthProxy) fingerprintHash(kind, value string) string {
+	h := hmac.New(sha256.New, []byte(p.CookieSeed))
+	h.Write([]byte(kind + ":" + value))
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// fingerprint of the client of req: keyed hashes of its User-Agent family
+// and of its network, separated by a dot
+func (p *OAuthProxy) fingerprint(req *http.Request) string {
+	return p.fingerprintHash("user-agent", userAgentFamily(req.UserAgent())) + "." +
+		p.fingerprintHash("network", clientNetwork(p.ClientIP(req)))
+}
+
+// fingerprintMatches returns false if session s was created for another
+// client than that of req. With session-fingerprint=lax only the
+// User-Agent must match, as the network of e.g. mobile clients changes
+// often; a changed network is only logged. Sessions without a fingerprint,
+// created before fingerprints were enabled, match.
+func (p *OAuthProxy) fingerprintMatches(req *http.Request, s *providers.SessionState) bool {
+	if p.fingerprintMode == "" || s.Fingerprint == "" {
+		return true
+	}
+	want := strings.SplitN(s.Fingerprint, ".", 2)
+	got := strings.SplitN(p.fingerprint(req), ".", 2)
+	if len(want) != 2 || want[0] != got[0] {
+		return false
+	}
+	if want[1] != got[1] {
+		if p.fingerprintMode == "strict" {
+			return false
+		}
+		logger.Printf("%s session %s used from another network", getRemoteAddr(req), s)
+	}
+	return true
+}
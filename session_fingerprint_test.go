@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+func fingerprintTestRequest(ua, remoteAddr string) *http.Request {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", ua)
+	req.RemoteAddr = remoteAddr
+	return req
+}
+
+func TestClientNetwork(t *testing.T) {
+	assert.Equal(t, "192.0.2.0", clientNetwork(net.ParseIP("192.0.2.77")))
+	assert.Equal(t, "2001:db8:1:2::", clientNetwork(net.ParseIP("2001:db8:1:2:3:4:5:6")))
+	assert.Equal(t, "", clientNetwork(nil))
+}
+
+func TestUserAgentFamily(t *testing.T) {
+	for _, tc := range []struct{ ua, family string }{
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:115.0) Gecko/20100101 Firefox/115.3.1", "Firefox/115"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.6099.71 Safari/537.36", "Chrome/120"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.2210.61", "Edg/120"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15", "Version/17"},
+		{"curl/7.58.0", "curl/7"},
+		{"Mozilla/5.0", "Mozilla/5"},
+		{"", ""},
+	} {
+		assert.Equal(t, tc.family, userAgentFamily(tc.ua), tc.ua)
+	}
+}
+
+func TestSessionFingerprintMatches(t *testing.T) {
+	for _, mode := range []string{"lax", "strict"} {
+		pcTest := NewProcessCookieTestWithDefaults()
+		pcTest.proxy.fingerprintMode = mode
+		orig := fingerprintTestRequest("Mozilla/5.0", "192.0.2.77:4321")
+		session := &providers.SessionState{Email: "michael.bland@gsa.gov",
+			Fingerprint: pcTest.proxy.fingerprint(orig)}
+
+		assert.True(t, pcTest.proxy.fingerprintMatches(orig, session), mode)
+		sameNet := fingerprintTestRequest("Mozilla/5.0", "192.0.2.12:1234")
+		assert.True(t, pcTest.proxy.fingerprintMatches(sameNet, session), mode)
+		otherUA := fingerprintTestRequest("curl/7.58.0", "192.0.2.77:4321")
+		assert.False(t, pcTest.proxy.fingerprintMatches(otherUA, session), mode)
+		minorUpdate := fingerprintTestRequest("Mozilla/5.1", "192.0.2.77:4321")
+		assert.True(t, pcTest.proxy.fingerprintMatches(minorUpdate, session), mode)
+		otherNet := fingerprintTestRequest("Mozilla/5.0", "198.51.100.77:4321")
+		assert.Equal(t, mode == "lax", pcTest.proxy.fingerprintMatches(otherNet, session), mode)
+
+		unbound := &providers.SessionState{Email: "michael.bland@gsa.gov"}
+		assert.True(t, pcTest.proxy.fingerprintMatches(otherUA, unbound), mode)
+	}
+}
+
+func TestSessionFingerprintDisabled(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	session := &providers.SessionState{Email: "michael.bland@gsa.gov", Fingerprint: "aa.bb"}
+	req := fingerprintTestRequest("curl/7.58.0", "198.51.100.77:4321")
+	assert.True(t, pcTest.proxy.fingerprintMatches(req, session))
+}
+
+func TestSessionFingerprintAuthenticate(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	pcTest.proxy.fingerprintMode = "strict"
+	req := fingerprintTestRequest("Mozilla/5.0", "192.0.2.77:4321")
+	session := &providers.SessionState{Email: "michael.bland@gsa.gov", AccessToken: "my_access_token"}
+	assert.Equal(t, nil, pcTest.proxy.SaveSession(pcTest.rw, req, session))
+	assert.Equal(t, pcTest.proxy.fingerprint(req), session.Fingerprint)
+
+	cookie := pcTest.rw.HeaderMap["Set-Cookie"]
+	for _, tc := range []struct {
+		ua, addr string
+		ok       bool
+	}{
+		{"Mozilla/5.0", "192.0.2.77:4321", true},
+		{"curl/7.58.0", "192.0.2.77:4321", false},
+		{"Mozilla/5.0", "198.51.100.77:4321", false},
+	} {
+		req := fingerprintTestRequest(tc.ua, tc.addr)
+		req.Header["Cookie"] = cookie
+		code, s := pcTest.proxy.authenticate(httptest.NewRecorder(), req)
+		assert.Equal(t, tc.ok, s != nil, tc.ua+" "+tc.addr)
+		if !tc.ok {
+			assert.Equal(t, http.StatusForbidden, code)
+		}
+	}
+}
@@ -116,6 +116,10 @@ func getTemplates() *template.Template {
 	<p>{{.SignInMessage}}</p>
 	{{ end}}
 	<button type="submit" class="btn">Sign in with {{.ProviderName}}</button><br/>
+	{{ if .RememberMe }}
+	<input type="hidden" name="remember_me" value="0">
+	<label><input type="checkbox" name="remember_me" value="1" checked> Remember me</label>
+	{{ end }}
 	</form>
 	</div>
 
@@ -126,6 +130,10 @@ func getTemplates() *template.Template {
 		<label for="username">Username:</label><input type="text" name="username" id="username" size="10"><br/>
 		<label for="password">Password:</label><input type="password" name="password" id="password" size="10"><br/>
 		<button type="submit" class="btn">Sign In</button>
+		{{ if .RememberMe }}
+		<input type="hidden" name="remember_me" value="0">
+		<label><input type="checkbox" name="remember_me" value="1" checked> Remember me</label>
+		{{ end }}
 	</form>
 	</div>
 	{{ end }}
@@ -165,7 +173,11 @@ func getTemplates() *template.Template {
 	<h2>{{.Title}}</h2>
 	<p>{{.Message}}</p>
 	<hr>
+	{{ if .RetryURL }}
+	<p><a href="{{.RetryURL}}">Sign in with a different account</a></p>
+	{{ else }}
 	<p><a href="{{.ProxyPrefix}}/sign_in">Sign In</a></p>
+	{{ end }}
 </body>
 </html>{{end}}`)
 	if err != nil {
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
+)
+
+// exchangedTokenTTL is how long an exchanged token is reused if the provider
+// doesn't report its expiry, and exchangedTokenMargin how long before its
+// expiry it is no longer forwarded
+const (
+	exchangedTokenTTL    = 5 * time.Minute
+	exchangedTokenMargin = 30 * time.Second
+)
+
+type exchangedToken struct {
+	token   string
+	expires time.Time
+}
+
+// tokenExchanger replaces the access token forwarded to an upstream with one
+// for the upstream's audience, exchanged with the provider (RFC 8693).
+// Exchanged tokens are cached by the (hashed) access token until shortly
+// before they expire. If the provider does not support token exchange, the
+// access token is forwarded unchanged.
+type tokenExchanger struct {
+	audience string
+	exchange func(accessToken, audience string) (string, time.Time, error)
+	now      func() time.Time
+
+	mu          sync.Mutex
+	unsupported bool
+	tokens      map[string]exchangedToken
+}
+
+func newTokenExchanger(provider providers.Provider, audience string) *tokenExchanger {
+	return &tokenExchanger{
+		audience: audience,
+		exchange: provider.Data().ExchangeToken,
+		now:      time.Now,
+		tokens:   make(map[string]exchangedToken),
+	}
+}
+
+func exchangedTokenKey(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// Token returns the token to forward to the upstream for accessToken
+func (e *tokenExchanger) Token(accessToken string) (string, error) {
+	key := exchangedTokenKey(accessToken)
+	e.mu.Lock()
+	if e.unsupported {
+		e.mu.Unlock()
+		return accessToken, nil
+	}
+	t, ok := e.tokens[key]
+	e.mu.Unlock()
+	if ok && e.now().Add(exchangedTokenMargin).Before(t.expires) {
+		return t.token, nil
+	}
+
+	token, expires, err := e.exchange(accessToken, e.audience)
+	if err == providers.ErrTokenExchangeUnsupported {
+		logger.Printf("token exchange for audience %q is not supported by the provider, forwarding the access token unchanged", e.audience)
+		e.mu.Lock()
+		e.unsupported = true
+		e.mu.Unlock()
+		return accessToken, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	now := e.now()
+	if expires.IsZero() {
+		expires = now.Add(exchangedTokenTTL)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.tokens[key] = exchangedToken{token: token, expires: expires}
+	// drop expired tokens so access tokens never seen again don't accumulate
+	for k, t := range e.tokens {
+		if !now.Before(t.expires) {
+			delete(e.tokens, k)
+		}
+	}
+	return token, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ploxiln/oauth2_proxy/providers"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeTokenExchange struct {
+	calls   int
+	expires time.Time
+	err     error
+}
+
+func (f *fakeTokenExchange) exchange(accessToken, audience string) (string, time.Time, error) {
+	f.calls++
+	if f.err != nil {
+		return "", time.Time{}, f.err
+	}
+	return accessToken + "@" + audience, f.expires, nil
+}
+
+func newTokenExchangeTestUpstream(f *fakeTokenExchange) (*httptest.Server, *UpstreamProxy) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte(r.Header.Get("X-Forwarded-Access-Token")))
+	}))
+	backendURL, _ := url.Parse(backend.URL)
+	proxyHandler := httputil.NewSingleHostReverseProxy(backendURL)
+	setProxyDirector(proxyHandler)
+	exchange := &tokenExchanger{
+		audience: "https://api.example.com",
+		exchange: f.exchange,
+		now:      time.Now,
+		tokens:   make(map[string]exchangedToken),
+	}
+	return backend, &UpstreamProxy{backendURL.Host, proxyHandler, nil, false, exchange}
+}
+
+func testTokenExchangeRequest(upstream *UpstreamProxy, token string) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	rw.Header().Set("GAP-Auth", "michael.bland@gsa.gov")
+	req, _ := http.NewRequest("GET", "/api", nil)
+	req.RequestURI = "/api"
+	if token != "" {
+		req.Header.Set("X-Forwarded-Access-Token", token)
+	}
+	upstream.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestTokenExchange(t *testing.T) {
+	f := &fakeTokenExchange{expires: time.Now().Add(time.Hour)}
+	backend, upstream := newTokenExchangeTestUpstream(f)
+	defer backend.Close()
+
+	rw := testTokenExchangeRequest(upstream, "a1234")
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "a1234@https://api.example.com", rw.Body.String())
+
+	// cached until it expires
+	rw = testTokenExchangeRequest(upstream, "a1234")
+	assert.Equal(t, "a1234@https://api.example.com", rw.Body.String())
+	assert.Equal(t, 1, f.calls)
+
+	rw = testTokenExchangeRequest(upstream, "b5678")
+	assert.Equal(t, "b5678@https://api.example.com", rw.Body.String())
+	assert.Equal(t, 2, f.calls)
+
+	rw = testTokenExchangeRequest(upstream, "")
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "", rw.Body.String())
+	assert.Equal(t, 2, f.calls)
+}
+
+func TestTokenExchangeNotAuthenticated(t *testing.T) {
+	f := &fakeTokenExchange{expires: time.Now().Add(time.Hour)}
+	backend, upstream := newTokenExchangeTestUpstream(f)
+	defer backend.Close()
+
+	// e.g. a skip-auth-regex path, with a token sent by the client
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api", nil)
+	req.RequestURI = "/api"
+	req.Header.Set("X-Forwarded-Access-Token", "a1234")
+	upstream.ServeHTTP(rw, req)
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "a1234", rw.Body.String())
+	assert.Equal(t, 0, f.calls)
+}
+
+func TestTokenExchangeExpiry(t *testing.T) {
+	f := &fakeTokenExchange{expires: time.Now().Add(exchangedTokenMargin / 2)}
+	backend, upstream := newTokenExchangeTestUpstream(f)
+	defer backend.Close()
+
+	testTokenExchangeRequest(upstream, "a1234")
+	testTokenExchangeRequest(upstream, "a1234")
+	assert.Equal(t, 2, f.calls)
+
+	f.expires = time.Time{}
+	testTokenExchangeRequest(upstream, "a1234")
+	upstream.exchange.now = func() time.Time { return time.Now().Add(exchangedTokenTTL) }
+	testTokenExchangeRequest(upstream, "a1234")
+	assert.Equal(t, 4, f.calls)
+}
+
+func TestTokenExchangeUnsupported(t *testing.T) {
+	f := &fakeTokenExchange{err: providers.ErrTokenExchangeUnsupported}
+	backend, upstream := newTokenExchangeTestUpstream(f)
+	defer backend.Close()
+
+	rw := testTokenExchangeRequest(upstream, "a1234")
+	assert.Equal(t, 200, rw.Code)
+	assert.Equal(t, "a1234", rw.Body.String())
+
+	// not attempted again
+	rw = testTokenExchangeRequest(upstream, "b5678")
+	assert.Equal(t, "b5678", rw.Body.String())
+	assert.Equal(t, 1, f.calls)
+}
+
+func TestTokenExchangeFailed(t *testing.T) {
+	f := &fakeTokenExchange{err: errors.New("invalid_target")}
+	backend, upstream := newTokenExchangeTestUpstream(f)
+	defer backend.Close()
+
+	rw := testTokenExchangeRequest(upstream, "a1234")
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+	assert.NotContains(t, rw.Body.String(), "a1234")
+}